@@ -2,6 +2,8 @@ package event
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"math/rand"
 	"time"
 )
@@ -17,6 +19,46 @@ type AuthEvent struct {
 	IV            uint64
 	EncryptMethod uint8
 	Rand          []byte
+	//client's key exchange public key, empty for legacy clients
+	PubKey []byte
+	//unix time & random nonce used to reject replayed auth, empty for legacy clients
+	Timestamp int64
+	Nonce     []byte
+	//HMAC signed by user's secret key
+	Mac []byte
+	//client's initial receive window per session, 0 if flow control not supported
+	Window uint32
+
+	macKey []byte
+}
+
+//SetMacKey make the event signed by the user's secret key when encoding.
+func (ev *AuthEvent) SetMacKey(key string) {
+	ev.macKey = []byte(key)
+}
+
+func (ev *AuthEvent) computeMac(key []byte) []byte {
+	var buf bytes.Buffer
+	EncodeUInt64Value(&buf, uint64(ev.Id))
+	EncodeStringValue(&buf, ev.User)
+	EncodeInt64Value(&buf, ev.RunId)
+	EncodeInt64Value(&buf, ev.Index)
+	EncodeUInt64Value(&buf, ev.IV)
+	buf.WriteByte(ev.EncryptMethod)
+	EncodeBytesValue(&buf, ev.PubKey)
+	EncodeInt64Value(&buf, ev.Timestamp)
+	EncodeBytesValue(&buf, ev.Nonce)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf.Bytes())
+	return mac.Sum(nil)
+}
+
+//VerifyMac return true if the event is signed by given secret key.
+func (ev *AuthEvent) VerifyMac(key string) bool {
+	if len(ev.Mac) == 0 {
+		return false
+	}
+	return hmac.Equal(ev.Mac, ev.computeMac([]byte(key)))
 }
 
 func (ev *AuthEvent) Encode(buffer *bytes.Buffer) {
@@ -28,6 +70,17 @@ func (ev *AuthEvent) Encode(buffer *bytes.Buffer) {
 	EncodeUInt64Value(buffer, ev.IV)
 	buffer.WriteByte(ev.EncryptMethod)
 	EncodeBytesValue(buffer, ev.Rand)
+	EncodeBytesValue(buffer, ev.PubKey)
+	if len(ev.macKey) > 0 {
+		if 0 == ev.Timestamp {
+			ev.Timestamp = time.Now().Unix()
+		}
+		ev.Mac = ev.computeMac(ev.macKey)
+	}
+	EncodeInt64Value(buffer, ev.Timestamp)
+	EncodeBytesValue(buffer, ev.Nonce)
+	EncodeBytesValue(buffer, ev.Mac)
+	EncodeUInt32Value(buffer, ev.Window)
 }
 func (ev *AuthEvent) Decode(buffer *bytes.Buffer) (err error) {
 	ev.User, err = DecodeStringValue(buffer)
@@ -54,7 +107,34 @@ func (ev *AuthEvent) Decode(buffer *bytes.Buffer) (err error) {
 	if nil != err {
 		return err
 	}
-	//no need to decode Rand, since it's useless
+	//legacy clients do not send anything after Rand
+	if buffer.Len() == 0 {
+		return nil
+	}
+	if _, err = DecodeBytesValue(buffer); nil != err {
+		return err
+	}
+	if buffer.Len() == 0 {
+		return nil
+	}
+	if ev.PubKey, err = DecodeBytesValue(buffer); nil != err {
+		return err
+	}
+	if buffer.Len() == 0 {
+		return nil
+	}
+	if ev.Timestamp, err = DecodeInt64Value(buffer); nil != err {
+		return err
+	}
+	if ev.Nonce, err = DecodeBytesValue(buffer); nil != err {
+		return err
+	}
+	if ev.Mac, err = DecodeBytesValue(buffer); nil != err {
+		return err
+	}
+	if buffer.Len() > 0 {
+		ev.Window, err = DecodeUInt32Value(buffer)
+	}
 	return err
 }
 
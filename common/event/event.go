@@ -4,18 +4,17 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rc4"
+	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
+	"io"
 	"log"
 	"math/rand"
 	"reflect"
 	"runtime"
 	"strings"
 
-	//"github.com/codahale/chacha20"
 	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/salsa20"
 )
 
 const (
@@ -24,13 +23,52 @@ const (
 
 var EBNR = errors.New("Event buffer not ready")
 var ErrToolargeEvent = errors.New("Event too large content")
-
-var secretKey []byte
-var salsa20Key [32]byte
+var ErrInvalidFrame = errors.New("Invalid event frame")
+var ErrAuthFrame = errors.New("Invalid auth event frame")
+var ErrUnsupportedMethod = errors.New("Unsupported encrypt method")
 
 var defaultEncryptMethod int
-var aes256gcm cipher.AEAD
-var chacha20poly1305gcm cipher.AEAD
+var defaultCryptoKey *cryptoKey
+
+//cryptoKey holds the cipher instances derived from one 32 bytes secret key.
+type cryptoKey struct {
+	key                 []byte
+	salsa20Key          [32]byte
+	aes256gcm           cipher.AEAD
+	chacha20poly1305gcm cipher.AEAD
+	authAEAD            cipher.AEAD
+}
+
+func newCryptoKey(key []byte) *cryptoKey {
+	k := new(cryptoKey)
+	k.key = make([]byte, 32)
+	copy(k.key, key)
+	copy(k.salsa20Key[:], k.key)
+	aesblock, _ := aes.NewCipher(k.key)
+	k.aes256gcm, _ = cipher.NewGCM(aesblock)
+	k.chacha20poly1305gcm, _ = chacha20poly1305.New(k.key)
+	k.authAEAD, _ = chacha20poly1305.NewX(k.key)
+	return k
+}
+
+//aead return nil for none encrypt method
+func (k *cryptoKey) aead(method uint8) cipher.AEAD {
+	switch method {
+	case AES256Encrypter:
+		return k.aes256gcm
+	case Chacha20Poly1305Encrypter:
+		return k.chacha20poly1305gcm
+	}
+	return nil
+}
+
+//frameAEAD return the AEAD of frames, frames of none method are authenticated by chacha20poly1305 without encryption
+func (k *cryptoKey) frameAEAD(method uint8) (aead cipher.AEAD, authOnly bool) {
+	if method == NoneEncrypter {
+		return k.chacha20poly1305gcm, true
+	}
+	return k.aead(method), false
+}
 
 type EventFlags uint64
 
@@ -49,26 +87,12 @@ func (f *EventFlags) EnableEncrypt(v int) {
 }
 
 func SetDefaultSecretKey(method string, key string) {
-	secretKey = []byte(key)
-	if len(secretKey) > 32 {
-		secretKey = secretKey[0:32]
-	} else {
-		tmp := make([]byte, 32)
-		copy(tmp[0:len(secretKey)], secretKey)
-	}
-	copy(salsa20Key[:], secretKey[:32])
-	aesblock, _ := aes.NewCipher(secretKey)
-	aes256gcm, _ = cipher.NewGCM(aesblock)
-	chacha20poly1305gcm, _ = chacha20poly1305.New(secretKey)
-	defaultEncryptMethod = Salsa20Encrypter
-	if strings.EqualFold(method, "rc4") {
-		defaultEncryptMethod = RC4Encrypter
-	} else if strings.EqualFold(method, "salsa20") {
-		defaultEncryptMethod = Salsa20Encrypter
+	defaultCryptoKey = newCryptoKey([]byte(key))
+	defaultEncryptMethod = Chacha20Poly1305Encrypter
+	if IsLegacyEncryptMethod(method) {
+		log.Printf("[WARN]Unauthenticated encrypt method:%s is removed, use chacha20poly1305 instead.", method)
 	} else if strings.EqualFold(method, "aes") {
 		defaultEncryptMethod = AES256Encrypter
-	} else if strings.EqualFold(method, "chacha20") {
-		defaultEncryptMethod = Chacha20Encrypter
 	} else if strings.EqualFold(method, "chacha20poly1305") {
 		defaultEncryptMethod = Chacha20Poly1305Encrypter
 	} else if strings.EqualFold(method, "none") {
@@ -464,9 +488,67 @@ type CryptoContext struct {
 	Method    uint8
 	DecryptIV uint64
 	EncryptIV uint64
+	//legacy context use unauthenticated framing & stream ciphers, only for old clients
+	Legacy bool
+	//server side context, frames of two directions use different nonces
+	Server bool
+
+	//shared secret key bound by NewCryptoContext, default key used if nil
+	secretKey *cryptoKey
+	//per connection keys negotiated by key exchange, secret key used if nil
+	encryptKey *cryptoKey
+	decryptKey *cryptoKey
+	//encrypt key which takes effect after the auth result notify sent
+	pendingEncryptKey *cryptoKey
+}
+
+//NewCryptoContext return context with default encrypt method & secret key,
+//it keeps using the key even if the default secret key changed later.
+func NewCryptoContext() CryptoContext {
+	return CryptoContext{Method: GetDefaultCryptoMethod(), secretKey: defaultCryptoKey}
+}
+
+func (ctx *CryptoContext) getSecretKey() *cryptoKey {
+	if nil != ctx.secretKey {
+		return ctx.secretKey
+	}
+	return defaultCryptoKey
+}
+
+func (ctx *CryptoContext) getEncryptKey() *cryptoKey {
+	if nil != ctx.encryptKey {
+		return ctx.encryptKey
+	}
+	return ctx.getSecretKey()
+}
+
+func (ctx *CryptoContext) getDecryptKey() *cryptoKey {
+	if nil != ctx.decryptKey {
+		return ctx.decryptKey
+	}
+	return ctx.getSecretKey()
+}
+
+//IsKeyNegotiated return true if the context use per connection keys.
+func (ctx *CryptoContext) IsKeyNegotiated() bool {
+	return nil != ctx.decryptKey
+}
+
+//frameNonce return nonce of frame with counter iv, the last byte marks the server->client direction
+//since both directions may start from same counter with same key.
+func frameNonce(aead cipher.AEAD, iv uint64, fromServer bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, iv)
+	if fromServer {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
 }
 
 func EncryptEvent(buf *bytes.Buffer, ev Event, ctx *CryptoContext) error {
+	if ctx.Legacy {
+		return legacyEncryptEvent(buf, ev, ctx)
+	}
 	start := buf.Len()
 	buf.Write(make([]byte, 4))
 	var header EventHeader
@@ -474,141 +556,145 @@ func EncryptEvent(buf *bytes.Buffer, ev Event, ctx *CryptoContext) error {
 	header.Id = ev.GetId()
 	header.Flags = 0
 	header.Encode(buf)
-	method := ctx.Method
 	ev.Encode(buf)
+	if header.Type == EventAuth {
+		return sealAuthFrame(buf, start, ctx.getSecretKey())
+	}
 
-	elen := uint32(buf.Len() - start)
+	aead, authOnly := ctx.getEncryptKey().frameAEAD(ctx.Method)
+	if nil == aead {
+		buf.Truncate(start)
+		return ErrUnsupportedMethod
+	}
 	eventContent := buf.Bytes()[start+4:]
-
-	var nonce []byte
-	encryptIV := ctx.EncryptIV
-	if header.Type == EventAuth {
-		method = uint8(Salsa20Encrypter)
-		encryptIV = 0
-		if elen > 256 {
-			log.Fatalf("Too large auth event with length:%d", elen)
-		}
+	elen := uint32(4 + len(eventContent) + aead.Overhead())
+	lenHeader := buf.Bytes()[start : start+4]
+	binary.LittleEndian.PutUint32(lenHeader, elen^uint32(ctx.EncryptIV))
+	nonce := frameNonce(aead, ctx.EncryptIV, ctx.Server)
+	if authOnly {
+		//plain content is authenticated as additional data
+		buf.Write(aead.Seal(nil, nonce, nil, buf.Bytes()[start:]))
+	} else {
+		ad := make([]byte, 4)
+		copy(ad, lenHeader)
+		bb := aead.Seal(eventContent[:0], nonce, eventContent, ad)
+		copy(eventContent, bb[0:len(eventContent)])
+		buf.Write(bb[len(eventContent):])
 	}
-	switch method {
-	case Salsa20Encrypter:
-		fallthrough
-	case Chacha20Encrypter:
-		nonce = make([]byte, 8)
-	case AES256Encrypter:
-		nonce = make([]byte, 12)
-		elen += uint32(aes256gcm.Overhead())
-	case Chacha20Poly1305Encrypter:
-		nonce = make([]byte, 12)
-		elen += uint32(chacha20poly1305gcm.Overhead())
+	ctx.EncryptIV++
+	if header.Type == EventNotify && nil != ctx.pendingEncryptKey {
+		ctx.encryptKey = ctx.pendingEncryptKey
+		ctx.pendingEncryptKey = nil
 	}
-	if len(nonce) > 0 {
-		iv := encryptIV ^ uint64(elen)
-		binary.LittleEndian.PutUint64(nonce, iv)
+	return nil
+}
+
+//sealAuthFrame encrypt auth event with XChaCha20-Poly1305 by secret key & random nonce,
+//the frame header is 16bits length with 16bits random.
+func sealAuthFrame(buf *bytes.Buffer, start int, key *cryptoKey) error {
+	content := make([]byte, buf.Len()-start-4)
+	copy(content, buf.Bytes()[start+4:])
+	elen := 4 + chacha20poly1305.NonceSizeX + len(content) + key.authAEAD.Overhead()
+	if elen > 0xFFFF {
+		buf.Truncate(start)
+		return ErrToolargeEvent
 	}
+	buf.Truncate(start)
+	ad := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ad, uint32(rand.Int31n(0xFFFF))<<16|uint32(elen))
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	io.ReadFull(crand.Reader, nonce)
+	buf.Write(ad)
+	buf.Write(nonce)
+	buf.Write(key.authAEAD.Seal(nil, nonce, content, ad))
+	return nil
+}
 
-	switch method {
-	case Salsa20Encrypter:
-		salsa20.XORKeyStream(eventContent, eventContent, nonce, &salsa20Key)
-	case RC4Encrypter:
-		rc4Cipher, _ := rc4.NewCipher(secretKey)
-		rc4Cipher.XORKeyStream(eventContent, eventContent)
-	case AES256Encrypter:
-		bb := aes256gcm.Seal(eventContent[:0], nonce, eventContent, nil)
-		if len(bb)-len(eventContent) != aes256gcm.Overhead() {
-			log.Printf("Expected aes bytes %d  after encrypt %d bytes", len(bb), len(eventContent))
-		}
-		copy(eventContent, bb[0:len(eventContent)])
-		if len(bb) > len(eventContent) {
-			buf.Write(bb[len(eventContent):])
+//openAuthFrame decrypt the first auth frame of a connection,
+//legacy salsa20 auth frame is accepted only if legacy auth enabled.
+func openAuthFrame(buf *bytes.Buffer, ctx *CryptoContext) (error, []byte) {
+	lenHeader := buf.Bytes()[0:4]
+	elen := int(binary.LittleEndian.Uint16(lenHeader))
+	key := ctx.getSecretKey()
+	minLen := 4 + chacha20poly1305.NonceSizeX + key.authAEAD.Overhead()
+	if elen >= minLen && elen <= buf.Len() {
+		frame := buf.Bytes()[0:elen]
+		nonce := frame[4 : 4+chacha20poly1305.NonceSizeX]
+		body, err := key.authAEAD.Open(nil, nonce, frame[4+chacha20poly1305.NonceSizeX:], lenHeader)
+		if nil == err {
+			buf.Next(elen)
+			return nil, body
 		}
-	case Chacha20Poly1305Encrypter:
-		bb := chacha20poly1305gcm.Seal(eventContent[:0], nonce, eventContent, nil)
-		if len(bb)-len(eventContent) != chacha20poly1305gcm.Overhead() {
-			log.Printf("Expected aes bytes %d  after encrypt %d bytes", len(bb), len(eventContent))
+	}
+	legacyLen := int(lenHeader[0])
+	if legacyAuthEnable {
+		if legacyLen > 4 && legacyLen <= buf.Len() {
+			if body := legacyOpenAuthFrame(buf.Bytes()[0:legacyLen]); nil != body {
+				buf.Next(legacyLen)
+				ctx.Legacy = true
+				return nil, body
+			}
 		}
-		copy(eventContent, bb[0:len(eventContent)])
-		if len(bb) > len(eventContent) {
-			buf.Write(bb[len(eventContent):])
+		if legacyLen > buf.Len() {
+			return EBNR, nil
 		}
-	case Chacha20Encrypter:
-		chacha20XOR(nonce, eventContent, eventContent)
-		//chacha20Cipher, _ := chacha20.New(secretKey, nonce)
-		//chacha20Cipher.XORKeyStream(eventContent, eventContent)
 	}
-
-	//log.Printf("Enc event(%d):%T with iv:%d with len:%d_%d %d", ev.GetId(), ev, encryptIV, elen, len(eventContent), method)
-	if header.Type == EventAuth {
-		base := rand.Int31n(0xFFFFFF)
-		elen = (uint32(base) << 8) + elen
-	} else {
-		elen = elen ^ uint32(encryptIV)
-	}
-	binary.LittleEndian.PutUint32(buf.Bytes()[start:start+4], elen)
-	if header.Type != EventAuth {
-		ctx.EncryptIV++
+	if elen > buf.Len() {
+		return EBNR, nil
 	}
-	return nil
+	return ErrAuthFrame, nil
 }
 
-func DecryptEvent(buf *bytes.Buffer, ctx *CryptoContext) (err error, ev Event) {
-	if buf.Len() < 4 {
-		return EBNR, nil
+func openFrame(buf *bytes.Buffer, ctx *CryptoContext) (error, []byte) {
+	aead, authOnly := ctx.getDecryptKey().frameAEAD(ctx.Method)
+	if nil == aead {
+		return ErrUnsupportedMethod, nil
 	}
-	elen := binary.LittleEndian.Uint32(buf.Bytes()[0:4])
-	method := ctx.Method
-	if method == 0 && ctx.DecryptIV == 0 {
-		method = Salsa20Encrypter
-		elen = elen & uint32(0xFF)
-	} else {
-		elen = elen ^ uint32(ctx.DecryptIV)
+	lenHeader := buf.Bytes()[0:4]
+	elen := binary.LittleEndian.Uint32(lenHeader) ^ uint32(ctx.DecryptIV)
+	minLen := uint32(4 + aead.Overhead())
+	if elen < minLen || elen >= largeEventLimit {
+		return ErrInvalidFrame, nil
 	}
 	if elen > uint32(buf.Len()) {
 		return EBNR, nil
 	}
-	if elen >= largeEventLimit {
-		return ErrToolargeEvent, nil
-	}
-	buf.Next(4)
-	body := buf.Next(int(elen - 4))
-
-	var nonce []byte
-	switch method {
-	case Salsa20Encrypter:
-		fallthrough
-	case Chacha20Encrypter:
-		nonce = make([]byte, 8)
-	case AES256Encrypter:
-		nonce = make([]byte, 12)
-	case Chacha20Poly1305Encrypter:
-		nonce = make([]byte, 12)
-	}
-	if len(nonce) > 0 {
-		iv := ctx.DecryptIV ^ uint64(elen)
-		binary.LittleEndian.PutUint64(nonce, iv)
-	}
-
-	switch method {
-	case Salsa20Encrypter:
-		salsa20.XORKeyStream(body, body, nonce, &salsa20Key)
-	case RC4Encrypter:
-		rc4Cipher, _ := rc4.NewCipher(secretKey)
-		rc4Cipher.XORKeyStream(body, body)
-	case AES256Encrypter:
-		bb, err := aes256gcm.Open(body[:0], nonce, body, nil)
-		if nil != err {
+	frame := buf.Next(int(elen))
+	body := frame[4:]
+	nonce := frameNonce(aead, ctx.DecryptIV, !ctx.Server)
+	if authOnly {
+		tagStart := len(frame) - aead.Overhead()
+		if _, err := aead.Open(nil, nonce, frame[tagStart:], frame[:tagStart]); nil != err {
 			return err, nil
 		}
-		body = bb
-	case Chacha20Poly1305Encrypter:
-		bb, err := chacha20poly1305gcm.Open(body[:0], nonce, body, nil)
+		body = frame[4:tagStart]
+	} else {
+		var err error
+		body, err = aead.Open(body[:0], nonce, body, frame[0:4])
 		if nil != err {
 			return err, nil
 		}
-		body = bb
-	case Chacha20Encrypter:
-		chacha20XOR(nonce, body, body)
-		//cipher, _ := chacha20.New(secretKey, nonce)
-		//cipher.XORKeyStream(body, body)
+	}
+	return nil, body
+}
+
+//DecryptEvent decrypt & decode one event from buffer, the connection should be closed for any error except EBNR.
+func DecryptEvent(buf *bytes.Buffer, ctx *CryptoContext) (err error, ev Event) {
+	if buf.Len() < 4 {
+		return EBNR, nil
+	}
+	var body []byte
+	authFrame := false
+	if ctx.Legacy {
+		err, body = legacyOpenFrame(buf, ctx)
+	} else if ctx.Method == 0 && ctx.DecryptIV == 0 {
+		authFrame = true
+		err, body = openAuthFrame(buf, ctx)
+	} else {
+		err, body = openFrame(buf, ctx)
+	}
+	if nil != err {
+		return
 	}
 	ebuf := bytes.NewBuffer(body)
 	var header EventHeader
@@ -616,17 +702,21 @@ func DecryptEvent(buf *bytes.Buffer, ctx *CryptoContext) (err error, ev Event) {
 		log.Printf("Failed to decode event header")
 		return
 	}
-	//log.Printf("Dec event(%d) with iv:%d with len:%d_%d  %d  %d", header.Id, ctx.DecryptIV, elen, len(body), method, header.Type)
+	if authFrame && header.Type != EventAuth {
+		return ErrAuthFrame, nil
+	}
+	//log.Printf("Dec event(%d) with iv:%d with len:%d  %d  %d", header.Id, ctx.DecryptIV, len(body), ctx.Method, header.Type)
 	var tmp interface{}
 	if err, tmp = NewEventInstance(header.Type); nil != err {
-		log.Printf("Failed to decode event with err:%v with len:%d", err, elen)
+		log.Printf("Failed to decode event with err:%v with len:%d", err, len(body))
 		return
 	}
 	ev = tmp.(Event)
 	ev.SetId(header.Id)
 	err = ev.Decode(ebuf)
 	if nil != err {
-		log.Printf("Failed to decode event:%T with err:%v with len:%d", tmp, err, elen)
+		log.Printf("Failed to decode event:%T with err:%v with len:%d", tmp, err, len(body))
+		return err, nil
 	}
 	if header.Type != EventAuth {
 		ctx.DecryptIV++
@@ -4,7 +4,7 @@ package event
 
 import "github.com/codahale/chacha20"
 
-func chacha20XOR(nonce []byte, dst []byte, src []byte) {
-	chacha20Cipher, _ := chacha20.New(secretKey, nonce)
+func chacha20XOR(key []byte, nonce []byte, dst []byte, src []byte) {
+	chacha20Cipher, _ := chacha20.New(key, nonce)
 	chacha20Cipher.XORKeyStream(dst, src)
 }
@@ -2,6 +2,6 @@
 
 package event
 
-func chacha20XOR(nonce []byte, dst []byte, src []byte) {
+func chacha20XOR(key []byte, nonce []byte, dst []byte, src []byte) {
 	return
 }
@@ -2,10 +2,12 @@ package event
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io"
 	//	"reflect"
 	"net/http"
 	"testing"
-	//"time"
+	"time"
 	"fmt"
 )
 
@@ -26,10 +28,12 @@ func benchamark(n int) {
 	iv := uint64(101)
 	ctx.EncryptIV = iv
 	ctx.DecryptIV = iv
+	server := ctx
+	server.Server = true
 	for i := 0; i < n; i++ {
 		var buf bytes.Buffer
 		EncryptEvent(&buf, &request, &ctx)
-		err, _ := DecryptEvent(&buf, &ctx)
+		err, _ := DecryptEvent(&buf, &server)
 		if nil != err {
 			fmt.Printf("###%v", err)
 			return
@@ -68,6 +72,320 @@ func BenchmarkChacha20Poly1305(b *testing.B) {
 	benchamark(b.N)
 }
 
+func TestKeyExchange(t *testing.T) {
+	SetDefaultSecretKey("chacha20poly1305", "AAAAAAasdadasfafasasdasfasasgagaga")
+	client := CryptoContext{Method: GetDefaultCryptoMethod(), EncryptIV: 101, DecryptIV: 101}
+	server := CryptoContext{Server: true}
+	ckx, _ := NewKeyExchange()
+
+	var buf bytes.Buffer
+	auth := &AuthEvent{User: "test", IV: client.EncryptIV, EncryptMethod: client.Method, PubKey: ckx.PublicKey}
+	EncryptEvent(&buf, auth, &client)
+	err, ev := DecryptEvent(&buf, &server)
+	if nil != err {
+		t.Fatalf("Failed to decrypt auth:%v", err)
+	}
+	recvAuth := ev.(*AuthEvent)
+	if !bytes.Equal(recvAuth.PubKey, ckx.PublicKey) {
+		t.Fatalf("Invalid auth pubkey")
+	}
+	server.Method = recvAuth.EncryptMethod
+	server.EncryptIV = recvAuth.IV
+	server.DecryptIV = recvAuth.IV
+	skx, _ := NewKeyExchange()
+	if err = skx.ServerApply(&server, recvAuth.PubKey, nil); nil != err {
+		t.Fatal(err)
+	}
+	EncryptEvent(&buf, &NotifyEvent{Code: SuccessAuthed, PubKey: skx.PublicKey}, &server)
+	//old client context without negotiated keys
+	legacy := client
+	legacyBuf := bytes.NewBuffer(append([]byte{}, buf.Bytes()...))
+	err, ev = DecryptEvent(&buf, &client)
+	if nil != err {
+		t.Fatalf("Failed to decrypt notify:%v", err)
+	}
+	if err = ckx.ClientApply(&client, ev.(*NotifyEvent).PubKey, nil); nil != err {
+		t.Fatal(err)
+	}
+	if err, _ = DecryptEvent(legacyBuf, &legacy); nil != err {
+		t.Fatalf("Auth result should be encrypted by default key:%v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		EncryptEvent(&buf, &TCPChunkEvent{Content: []byte("hello")}, &client)
+		cp := bytes.NewBuffer(append([]byte{}, buf.Bytes()...))
+		legacy.EncryptIV = client.EncryptIV - 1
+		legacy.DecryptIV = client.EncryptIV - 1
+		if err, _ = DecryptEvent(cp, &legacy); nil == err {
+			t.Fatalf("Default key should not decrypt session traffic")
+		}
+		err, ev = DecryptEvent(&buf, &server)
+		if nil != err || string(ev.(*TCPChunkEvent).Content) != "hello" {
+			t.Fatalf("Failed to decrypt client event:%v", err)
+		}
+		EncryptEvent(&buf, &TCPChunkEvent{Content: []byte("world")}, &server)
+		err, ev = DecryptEvent(&buf, &client)
+		if nil != err || string(ev.(*TCPChunkEvent).Content) != "world" {
+			t.Fatalf("Failed to decrypt server event:%v", err)
+		}
+	}
+}
+
+func TestAuthMac(t *testing.T) {
+	SetDefaultSecretKey("salsa20", "AAAAAAasdadasfafasasdasfasasgagaga")
+	auth := &AuthEvent{User: "alice", IV: 1001, Index: 2, Nonce: []byte("0123456789abcdef")}
+	auth.SetId(123)
+	auth.SetMacKey("alice-secret")
+	var buf bytes.Buffer
+	ctx := CryptoContext{}
+	EncryptEvent(&buf, auth, &ctx)
+	err, ev := DecryptEvent(&buf, &ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	recv := ev.(*AuthEvent)
+	if recv.Timestamp == 0 || !recv.VerifyMac("alice-secret") {
+		t.Fatalf("Failed to verify auth mac")
+	}
+	if recv.VerifyMac("bob-secret") {
+		t.Fatalf("Auth mac verified by invalid key")
+	}
+	if !bytes.Equal(recv.Nonce, auth.Nonce) {
+		t.Fatalf("Invalid auth nonce")
+	}
+	recv.Nonce[0] = 'x'
+	if recv.VerifyMac("alice-secret") {
+		t.Fatalf("Auth mac verified with modified nonce")
+	}
+}
+
+func TestKeyExchangePSK(t *testing.T) {
+	SetDefaultSecretKey("chacha20poly1305", "AAAAAAasdadasfafasasdasfasasgagaga")
+	for _, psk := range []string{"alice", "mallory"} {
+		client := CryptoContext{Method: GetDefaultCryptoMethod(), EncryptIV: 101, DecryptIV: 101}
+		server := CryptoContext{Method: GetDefaultCryptoMethod(), EncryptIV: 101, DecryptIV: 101, Server: true}
+		ckx, _ := NewKeyExchange()
+		skx, _ := NewKeyExchange()
+		ckx.ClientApply(&client, skx.PublicKey, []byte("alice"))
+		skx.ServerApply(&server, ckx.PublicKey, []byte(psk))
+		var buf bytes.Buffer
+		EncryptEvent(&buf, &TCPChunkEvent{Content: []byte("hello")}, &client)
+		err, _ := DecryptEvent(&buf, &server)
+		if psk == "alice" && nil != err {
+			t.Fatalf("Failed to decrypt with same psk:%v", err)
+		} else if psk != "alice" && nil == err {
+			t.Fatalf("Decrypted with different psk")
+		}
+	}
+}
+
+func TestBoundSecretKey(t *testing.T) {
+	SetDefaultSecretKey("chacha20poly1305", "AAAAAAasdadasfafasasdasfasasgagaga")
+	client := NewCryptoContext()
+	server := NewCryptoContext()
+	server.Server = true
+	//server decrypt auth frame before method known
+	server.Method = 0
+	//contexts created before key changed keep using the old key
+	SetDefaultSecretKey("chacha20poly1305", "BBBBBBasdadasfafasasdasfasasgagaga")
+	for _, ev := range []Event{&AuthEvent{User: "test"}, &TCPChunkEvent{Content: []byte("hello")}} {
+		var buf bytes.Buffer
+		EncryptEvent(&buf, ev, &client)
+		if err, _ := DecryptEvent(&buf, &server); nil != err {
+			t.Fatalf("Failed to decrypt %T by bound key:%v", ev, err)
+		}
+		if _, ok := ev.(*AuthEvent); ok {
+			server.Method = client.Method
+			server.EncryptIV, server.DecryptIV = client.EncryptIV, client.EncryptIV
+		}
+	}
+	var buf bytes.Buffer
+	EncryptEvent(&buf, &AuthEvent{User: "test"}, &client)
+	if err, _ := DecryptEvent(&buf, &CryptoContext{Server: true}); nil == err {
+		t.Fatalf("New context should use the new default key")
+	}
+}
+
+func TestTamperedFrame(t *testing.T) {
+	SetDefaultSecretKey("aes", "AAAAAAasdadasfafasasdasfasasgagaga")
+	ctx := CryptoContext{Method: GetDefaultCryptoMethod(), EncryptIV: 101, DecryptIV: 101}
+	var buf bytes.Buffer
+	EncryptEvent(&buf, &TCPChunkEvent{Content: []byte("hello")}, &ctx)
+	for _, pos := range []int{0, 5, buf.Len() - 1} {
+		b := append([]byte{}, buf.Bytes()...)
+		b[pos] ^= 1
+		dctx := CryptoContext{Method: ctx.Method, DecryptIV: 101, Server: true}
+		if err, _ := DecryptEvent(bytes.NewBuffer(b), &dctx); nil == err || err == EBNR && pos != 0 {
+			t.Fatalf("Tampered frame at %d not detected:%v", pos, err)
+		}
+	}
+
+	//none method is authenticated without encryption
+	none := CryptoContext{Method: NoneEncrypter, EncryptIV: 101, DecryptIV: 101}
+	buf.Reset()
+	EncryptEvent(&buf, &TCPChunkEvent{Content: []byte("hello")}, &none)
+	if !bytes.Contains(buf.Bytes(), []byte("hello")) {
+		t.Fatalf("Content should not be encrypted by none method")
+	}
+	for _, pos := range []int{-1, 0, 5, buf.Len() - 1} {
+		b := append([]byte{}, buf.Bytes()...)
+		if pos >= 0 {
+			b[pos] ^= 1
+		}
+		dctx := CryptoContext{Method: NoneEncrypter, DecryptIV: 101, Server: true}
+		err, ev := DecryptEvent(bytes.NewBuffer(b), &dctx)
+		if pos < 0 && (nil != err || string(ev.(*TCPChunkEvent).Content) != "hello") {
+			t.Fatalf("Failed to decrypt frame of none method:%v", err)
+		} else if pos >= 0 && (nil == err || err == EBNR && pos != 0) {
+			t.Fatalf("Tampered frame of none method at %d not detected:%v", pos, err)
+		}
+	}
+
+	var auth bytes.Buffer
+	EncryptEvent(&auth, &AuthEvent{User: "test", IV: 101}, &ctx)
+	auth.Bytes()[10] ^= 1
+	if err, _ := DecryptEvent(&auth, &CryptoContext{}); nil == err {
+		t.Fatalf("Tampered auth frame not detected")
+	}
+}
+
+func TestFrameDirection(t *testing.T) {
+	for _, method := range []string{"aes", "chacha20poly1305"} {
+		SetDefaultSecretKey(method, "AAAAAAasdadasfafasasdasfasasgagaga")
+		client := CryptoContext{Method: GetDefaultCryptoMethod(), EncryptIV: 101, DecryptIV: 101}
+		server := CryptoContext{Method: GetDefaultCryptoMethod(), EncryptIV: 101, DecryptIV: 101, Server: true}
+		var c2s, s2c bytes.Buffer
+		EncryptEvent(&c2s, &TCPChunkEvent{Content: []byte("hello")}, &client)
+		EncryptEvent(&s2c, &TCPChunkEvent{Content: []byte("hello")}, &server)
+		if bytes.Equal(c2s.Bytes(), s2c.Bytes()) {
+			t.Fatalf("Frames of two directions with same counter should differ by %s", method)
+		}
+		//frame reflected back to sender should be rejected
+		if err, _ := DecryptEvent(bytes.NewBuffer(append([]byte{}, c2s.Bytes()...)), &CryptoContext{Method: client.Method, DecryptIV: 101}); nil == err {
+			t.Fatalf("Reflected frame should not be decrypted by %s", method)
+		}
+		if err, ev := DecryptEvent(&c2s, &server); nil != err || string(ev.(*TCPChunkEvent).Content) != "hello" {
+			t.Fatalf("Failed to decrypt client event:%v", err)
+		}
+		if err, ev := DecryptEvent(&s2c, &client); nil != err || string(ev.(*TCPChunkEvent).Content) != "hello" {
+			t.Fatalf("Failed to decrypt server event:%v", err)
+		}
+	}
+}
+
+func TestLegacyAuth(t *testing.T) {
+	SetDefaultSecretKey("salsa20", "AAAAAAasdadasfafasasdasfasasgagaga")
+	client := CryptoContext{Method: Salsa20Encrypter, EncryptIV: 101, DecryptIV: 101, Legacy: true}
+	var buf bytes.Buffer
+	//old client encrypt auth event by salsa20 with 1 byte length
+	start := buf.Len()
+	buf.Write(make([]byte, 4))
+	header := EventHeader{Type: EventAuth}
+	header.Encode(&buf)
+	(&AuthEvent{User: "test", IV: 101, EncryptMethod: Salsa20Encrypter}).Encode(&buf)
+	elen := uint32(buf.Len() - start)
+	legacyXORKeyStream(Salsa20Encrypter, defaultCryptoKey, legacyNonce(Salsa20Encrypter, 0, elen), buf.Bytes()[4:], buf.Bytes()[4:])
+	binary.LittleEndian.PutUint32(buf.Bytes()[0:4], 0x1200+elen)
+	EncryptEvent(&buf, &TCPChunkEvent{Content: []byte("hello")}, &client)
+	frames := buf.Bytes()
+
+	EnableLegacyAuth(false)
+	if err, _ := DecryptEvent(bytes.NewBuffer(frames), &CryptoContext{}); nil == err {
+		t.Fatalf("Legacy auth should be rejected")
+	}
+	EnableLegacyAuth(true)
+	defer EnableLegacyAuth(false)
+	server := CryptoContext{}
+	rbuf := bytes.NewBuffer(frames)
+	err, ev := DecryptEvent(rbuf, &server)
+	if nil != err || !server.Legacy || ev.(*AuthEvent).User != "test" {
+		t.Fatalf("Failed to decrypt legacy auth:%v", err)
+	}
+	server.Method = Salsa20Encrypter
+	server.DecryptIV = 101
+	err, ev = DecryptEvent(rbuf, &server)
+	if nil != err || string(ev.(*TCPChunkEvent).Content) != "hello" {
+		t.Fatalf("Failed to decrypt legacy event:%v", err)
+	}
+}
+
+func TestFlowWindow(t *testing.T) {
+	w := NewFlowWindow(1024)
+	if err := w.Acquire(1000, time.Millisecond); nil != err {
+		t.Fatalf("Failed to acquire window:%v", err)
+	}
+	if err := w.Acquire(100, 10*time.Millisecond); err != ErrWindowTimeout {
+		t.Fatalf("Expected window timeout, but got %v", err)
+	}
+	go w.Release(1000)
+	if err := w.Acquire(100, time.Second); nil != err {
+		t.Fatalf("Failed to acquire window after release:%v", err)
+	}
+	w.Reset()
+	//chunk larger than the whole window is allowed if window is full
+	if err := w.Acquire(4096, time.Millisecond); nil != err || w.Size() != 1024-4096 {
+		t.Fatalf("Failed to acquire large chunk:%v", err)
+	}
+	w.Close()
+	if err := w.Acquire(1, time.Second); err != ErrWindowClosed {
+		t.Fatalf("Expected window closed, but got %v", err)
+	}
+
+	c := NewFlowCounter(1024)
+	if _, ok := c.Consume(500); ok {
+		t.Fatalf("Should not update window before half consumed")
+	}
+	if delta, ok := c.Consume(100); !ok || delta != 600 {
+		t.Fatalf("Invalid window update delta:%d", delta)
+	}
+
+	var buf bytes.Buffer
+	ctx := CryptoContext{Method: NoneEncrypter, EncryptIV: 1, DecryptIV: 1}
+	EncryptEvent(&buf, &WindowUpdateEvent{Delta: 12345}, &ctx)
+	server := CryptoContext{Method: NoneEncrypter, EncryptIV: 1, DecryptIV: 1, Server: true}
+	err, ev := DecryptEvent(&buf, &server)
+	if nil != err || ev.(*WindowUpdateEvent).Delta != 12345 {
+		t.Fatalf("Failed to decode window update event:%v", err)
+	}
+}
+
+func TestEventBuffer(t *testing.T) {
+	b := NewEventBuffer(1024)
+	for i := 0; i < 2; i++ {
+		if err := b.Publish(&TCPChunkEvent{Content: make([]byte, 512)}, 0); nil != err {
+			t.Fatalf("Failed to publish chunk within limit:%v", err)
+		}
+	}
+	if err := b.Publish(&TCPChunkEvent{Content: make([]byte, 1)}, 0); err != ErrWindowOverflow {
+		t.Fatalf("Expected overflow, but got %v", err)
+	}
+	if err := b.Publish(&ConnCloseEvent{}, 0); nil != err || b.Size() != 1024 {
+		t.Fatalf("Events without content should be accepted:%v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Read(time.Second)
+	}()
+	if err := b.Publish(&TCPChunkEvent{Content: make([]byte, 512)}, time.Second); nil != err {
+		t.Fatalf("Failed to publish after read:%v", err)
+	}
+	b.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := b.Read(time.Millisecond); nil != err {
+			t.Fatalf("Buffered events should be read after closed:%v", err)
+		}
+	}
+	if _, err := b.Read(time.Millisecond); err != io.EOF {
+		t.Fatalf("Expected EOF, but got %v", err)
+	}
+
+	//chunk larger than limit is accepted by empty buffer
+	b = NewEventBuffer(1024)
+	if err := b.Publish(&TCPChunkEvent{Content: make([]byte, 4096)}, 0); nil != err {
+		t.Fatalf("Failed to publish large chunk:%v", err)
+	}
+}
+
 // func BenchmarkBlowfish(b *testing.B) {
 // 	SetDefaultSecretKey("blowfish", "AAAAAAasdadasfafasasdasfasasgagaga")
 // 	benchamark(b.N)
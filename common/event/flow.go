@@ -0,0 +1,250 @@
+package event
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+//DefaultSessionWindow is the initial bytes of TCP chunks allowed in flight per session
+const DefaultSessionWindow = 256 * 1024
+
+var ErrWindowTimeout = errors.New("Flow window acquire timeout")
+var ErrWindowClosed = errors.New("Flow window closed")
+var ErrWindowOverflow = errors.New("Flow window overflow")
+
+//WindowUpdateEvent grant peer more bytes to send for the session
+type WindowUpdateEvent struct {
+	EventHeader
+	Delta uint32
+}
+
+func (ev *WindowUpdateEvent) Encode(buffer *bytes.Buffer) {
+	EncodeUInt32Value(buffer, ev.Delta)
+}
+func (ev *WindowUpdateEvent) Decode(buffer *bytes.Buffer) (err error) {
+	ev.Delta, err = DecodeUInt32Value(buffer)
+	return
+}
+
+//FlowWindow is the send window of a session, the writer blocks until peer grant enough window.
+type FlowWindow struct {
+	mutex  sync.Mutex
+	size   int64
+	limit  int64
+	closed bool
+	notify chan struct{}
+}
+
+func NewFlowWindow(size int64) *FlowWindow {
+	w := new(FlowWindow)
+	w.size = size
+	w.limit = size
+	w.notify = make(chan struct{}, 1)
+	return w
+}
+
+func (w *FlowWindow) wakeup() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+//Acquire consume n bytes from window, chunk larger than the whole window is allowed once window is full.
+func (w *FlowWindow) Acquire(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		w.mutex.Lock()
+		if w.closed {
+			w.mutex.Unlock()
+			return ErrWindowClosed
+		}
+		if w.size >= int64(n) || w.size >= w.limit {
+			w.size -= int64(n)
+			w.mutex.Unlock()
+			return nil
+		}
+		w.mutex.Unlock()
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return ErrWindowTimeout
+		}
+		select {
+		case <-w.notify:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (w *FlowWindow) Release(n uint32) {
+	w.mutex.Lock()
+	w.size += int64(n)
+	w.mutex.Unlock()
+	w.wakeup()
+}
+
+//Reset restore the whole window since pending updates may lost with the broken connection
+func (w *FlowWindow) Reset() {
+	w.mutex.Lock()
+	w.size = w.limit
+	w.mutex.Unlock()
+	w.wakeup()
+}
+
+func (w *FlowWindow) Size() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.size
+}
+
+func (w *FlowWindow) Close() {
+	w.mutex.Lock()
+	w.closed = true
+	w.mutex.Unlock()
+	w.wakeup()
+}
+
+//FlowCounter count consumed bytes on receiver side,
+//and return the delta to update once half of the window consumed.
+type FlowCounter struct {
+	mutex    sync.Mutex
+	consumed uint32
+	window   uint32
+}
+
+func NewFlowCounter(window uint32) *FlowCounter {
+	return &FlowCounter{window: window}
+}
+
+func (c *FlowCounter) Consume(n int) (uint32, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.consumed += uint32(n)
+	if c.consumed >= c.window/2 {
+		delta := c.consumed
+		c.consumed = 0
+		return delta, true
+	}
+	return 0, false
+}
+
+//EventBuffer is the receive buffer of sessions, it's bounded by bytes of chunks instead of events count,
+//so that publishing never blocks if peer honors the granted window, no matter how slow the session is consumed.
+type EventBuffer struct {
+	mutex    sync.Mutex
+	events   []Event
+	size     int
+	limit    int
+	closed   bool
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func NewEventBuffer(limit int) *EventBuffer {
+	b := new(EventBuffer)
+	b.limit = limit
+	b.readable = make(chan struct{}, 1)
+	b.writable = make(chan struct{}, 1)
+	return b
+}
+
+func eventContentSize(ev Event) int {
+	switch ev := ev.(type) {
+	case *TCPChunkEvent:
+		return len(ev.Content)
+	case *UDPEvent:
+		return len(ev.Content)
+	}
+	return 0
+}
+
+func notifyChan(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+//Publish append the event, or wait at most timeout until buffer has enough space, 0 timeout never wait.
+//Events without content are always accepted, so is a chunk larger than limit if buffer is empty like FlowWindow.
+func (b *EventBuffer) Publish(ev Event, timeout time.Duration) error {
+	n := eventContentSize(ev)
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			//wakeup other waiting publishers
+			notifyChan(b.writable)
+			return ErrWindowClosed
+		}
+		if n == 0 || b.size == 0 || b.size+n <= b.limit {
+			b.events = append(b.events, ev)
+			b.size += n
+			space := b.size < b.limit
+			b.mutex.Unlock()
+			notifyChan(b.readable)
+			if space {
+				notifyChan(b.writable)
+			}
+			return nil
+		}
+		b.mutex.Unlock()
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return ErrWindowOverflow
+		}
+		select {
+		case <-b.writable:
+		case <-time.After(wait):
+		}
+	}
+}
+
+//Read return buffered events in order, io.EOF after buffer closed & all events read.
+func (b *EventBuffer) Read(timeout time.Duration) (Event, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mutex.Lock()
+		if len(b.events) > 0 {
+			ev := b.events[0]
+			b.events[0] = nil
+			b.events = b.events[1:]
+			b.size -= eventContentSize(ev)
+			b.mutex.Unlock()
+			notifyChan(b.writable)
+			return ev, nil
+		}
+		closed := b.closed
+		b.mutex.Unlock()
+		if closed {
+			return nil, io.EOF
+		}
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return nil, EventReadTimeout
+		}
+		select {
+		case <-b.readable:
+		case <-time.After(wait):
+		}
+	}
+}
+
+//Size return bytes of buffered chunks
+func (b *EventBuffer) Size() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.size
+}
+
+func (b *EventBuffer) Close() {
+	b.mutex.Lock()
+	b.closed = true
+	b.mutex.Unlock()
+	notifyChan(b.readable)
+	notifyChan(b.writable)
+}
@@ -0,0 +1,84 @@
+package event
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrInvalidPubKey = errors.New("Invalid key exchange public key")
+
+const kxInfo = "gsnova session keys"
+
+//KeyExchange is an ephemeral X25519 key pair used to derive per connection keys
+type KeyExchange struct {
+	privateKey [32]byte
+	PublicKey  []byte
+}
+
+func NewKeyExchange() (*KeyExchange, error) {
+	kx := new(KeyExchange)
+	if _, err := io.ReadFull(rand.Reader, kx.privateKey[:]); nil != err {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(kx.privateKey[:], curve25519.Basepoint)
+	if nil != err {
+		return nil, err
+	}
+	kx.PublicKey = pub
+	return kx, nil
+}
+
+//deriveKeys return the client->server & server->client keys, the secret key of ctx is used if psk is nil
+func (kx *KeyExchange) deriveKeys(ctx *CryptoContext, peerPub, clientPub, serverPub []byte, psk []byte) (*cryptoKey, *cryptoKey, error) {
+	if len(peerPub) != curve25519.PointSize {
+		return nil, nil, ErrInvalidPubKey
+	}
+	shared, err := curve25519.X25519(kx.privateKey[:], peerPub)
+	if nil != err {
+		return nil, nil, err
+	}
+	if nil == psk && nil != ctx.getSecretKey() {
+		psk = ctx.getSecretKey().key
+	}
+	info := make([]byte, 0, len(kxInfo)+len(clientPub)+len(serverPub))
+	info = append(info, kxInfo...)
+	info = append(info, clientPub...)
+	info = append(info, serverPub...)
+	keys := make([]byte, 64)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, psk, info), keys); nil != err {
+		return nil, nil, err
+	}
+	return newCryptoKey(keys[:32]), newCryptoKey(keys[32:]), nil
+}
+
+//ClientApply install the negotiated keys into client's crypto context once the server's public key received.
+//The psk should be the user's secret if server flagged it in auth result, so that the exchange could not be
+//intercepted by anyone only knowing the shared secret key, which is used if psk is nil.
+func (kx *KeyExchange) ClientApply(ctx *CryptoContext, serverPub []byte, psk []byte) error {
+	c2s, s2c, err := kx.deriveKeys(ctx, serverPub, kx.PublicKey, serverPub, psk)
+	if nil != err {
+		return err
+	}
+	ctx.encryptKey = c2s
+	ctx.decryptKey = s2c
+	return nil
+}
+
+//ServerApply install the negotiated keys into server's crypto context,
+//the new encrypt key takes effect after the auth result NotifyEvent encrypted.
+//The psk should be the secret verified the auth mac, nil for users not checked by mac,
+//client is told by AuthFlagUserSecretKX in auth result.
+func (kx *KeyExchange) ServerApply(ctx *CryptoContext, clientPub []byte, psk []byte) error {
+	c2s, s2c, err := kx.deriveKeys(ctx, clientPub, clientPub, kx.PublicKey, psk)
+	if nil != err {
+		return err
+	}
+	ctx.decryptKey = c2s
+	ctx.pendingEncryptKey = s2c
+	return nil
+}
@@ -0,0 +1,118 @@
+package event
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"strings"
+
+	"golang.org/x/crypto/salsa20"
+)
+
+var legacyAuthEnable bool
+
+//EnableLegacyAuth let server accept old clients which use unauthenticated framing & stream ciphers.
+func EnableLegacyAuth(v bool) {
+	legacyAuthEnable = v
+}
+
+//IsLegacyEncryptMethod return true for removed unauthenticated stream ciphers, which only legacy clients could use.
+func IsLegacyEncryptMethod(method string) bool {
+	return strings.EqualFold(method, "rc4") || strings.EqualFold(method, "salsa20") || strings.EqualFold(method, "chacha20")
+}
+
+func legacyXORKeyStream(method uint8, key *cryptoKey, nonce []byte, dst, src []byte) {
+	switch method {
+	case Salsa20Encrypter:
+		salsa20.XORKeyStream(dst, src, nonce, &key.salsa20Key)
+	case RC4Encrypter:
+		rc4Cipher, _ := rc4.NewCipher(key.key)
+		rc4Cipher.XORKeyStream(dst, src)
+	case Chacha20Encrypter:
+		chacha20XOR(key.key, nonce, dst, src)
+	}
+}
+
+func legacyNonce(method uint8, iv uint64, elen uint32) []byte {
+	var nonce []byte
+	switch method {
+	case Salsa20Encrypter, Chacha20Encrypter:
+		nonce = make([]byte, 8)
+	case AES256Encrypter, Chacha20Poly1305Encrypter:
+		nonce = make([]byte, 12)
+	}
+	if len(nonce) > 0 {
+		binary.LittleEndian.PutUint64(nonce, iv^uint64(elen))
+	}
+	return nonce
+}
+
+func legacyEncryptEvent(buf *bytes.Buffer, ev Event, ctx *CryptoContext) error {
+	start := buf.Len()
+	buf.Write(make([]byte, 4))
+	var header EventHeader
+	header.Type = GetRegistType(ev)
+	header.Id = ev.GetId()
+	header.Flags = 0
+	header.Encode(buf)
+	method := ctx.Method
+	ev.Encode(buf)
+
+	elen := uint32(buf.Len() - start)
+	eventContent := buf.Bytes()[start+4:]
+	key := ctx.getEncryptKey()
+	aead := key.aead(method)
+	if nil != aead {
+		elen += uint32(aead.Overhead())
+	}
+	nonce := legacyNonce(method, ctx.EncryptIV, elen)
+	if nil != aead {
+		bb := aead.Seal(eventContent[:0], nonce, eventContent, nil)
+		copy(eventContent, bb[0:len(eventContent)])
+		buf.Write(bb[len(eventContent):])
+	} else {
+		legacyXORKeyStream(method, key, nonce, eventContent, eventContent)
+	}
+	elen = elen ^ uint32(ctx.EncryptIV)
+	binary.LittleEndian.PutUint32(buf.Bytes()[start:start+4], elen)
+	ctx.EncryptIV++
+	return nil
+}
+
+//legacyOpenAuthFrame return nil if the frame is not a valid legacy auth frame
+func legacyOpenAuthFrame(frame []byte) []byte {
+	elen := uint32(len(frame))
+	body := make([]byte, len(frame)-4)
+	copy(body, frame[4:])
+	legacyXORKeyStream(Salsa20Encrypter, defaultCryptoKey, legacyNonce(Salsa20Encrypter, 0, elen), body, body)
+	var header EventHeader
+	if err := header.Decode(bytes.NewBuffer(body)); nil != err || header.Type != EventAuth {
+		return nil
+	}
+	return body
+}
+
+func legacyOpenFrame(buf *bytes.Buffer, ctx *CryptoContext) (error, []byte) {
+	elen := binary.LittleEndian.Uint32(buf.Bytes()[0:4]) ^ uint32(ctx.DecryptIV)
+	if elen < 4 || elen >= largeEventLimit {
+		return ErrInvalidFrame, nil
+	}
+	if elen > uint32(buf.Len()) {
+		return EBNR, nil
+	}
+	method := ctx.Method
+	buf.Next(4)
+	body := buf.Next(int(elen - 4))
+	key := ctx.getDecryptKey()
+	nonce := legacyNonce(method, ctx.DecryptIV, elen)
+	if aead := key.aead(method); nil != aead {
+		bb, err := aead.Open(body[:0], nonce, body, nil)
+		if nil != err {
+			return err, nil
+		}
+		body = bb
+	} else {
+		legacyXORKeyStream(method, key, nonce, body, body)
+	}
+	return nil, body
+}
@@ -9,24 +9,69 @@ const (
 	ErrInvalidHttpRequest = 1002
 	ErrRemoteProxyTimeout = 1003
 	ErrAuthFailed         = 1004
+	ErrAuthExpired        = 1005
+	ErrAuthReplayed       = 1006
+	//remote server failed to connect the target, sent before closing the session
+	ErrRemoteConnectFailed = 1007
 
 	SuccessAuthed = 10000
 )
 
+//flags of auth result
+const (
+	//server mixed the user's secret verified by auth mac into key exchange, otherwise the shared secret key
+	AuthFlagUserSecretKX = 1 << iota
+	//server resolve dns queries in UDP events to RemoteDNSAddr, old servers treat it as hostname
+	AuthFlagRemoteDNS
+)
+
 type NotifyEvent struct {
 	EventHeader
 	Code   int64
 	Reason string
+	//server's key exchange public key in auth result
+	PubKey []byte
+	//server's initial receive window per session in auth result
+	Window uint32
+	//AuthFlag* bits in auth result
+	Flags uint32
+}
+
+//KeyExchangePSK return the psk mixed into key exchange by server, secret is the key signed the auth mac,
+//nil means the shared secret key is used.
+func (ev *NotifyEvent) KeyExchangePSK(secret []byte) []byte {
+	if ev.Flags&AuthFlagUserSecretKX != 0 {
+		return secret
+	}
+	return nil
 }
 
 func (ev *NotifyEvent) Encode(buffer *bytes.Buffer) {
 	EncodeInt64Value(buffer, ev.Code)
 	EncodeStringValue(buffer, ev.Reason)
+	if len(ev.PubKey) > 0 || ev.Window > 0 || ev.Flags > 0 {
+		EncodeBytesValue(buffer, ev.PubKey)
+	}
+	if ev.Window > 0 || ev.Flags > 0 {
+		EncodeUInt32Value(buffer, ev.Window)
+	}
+	if ev.Flags > 0 {
+		EncodeUInt32Value(buffer, ev.Flags)
+	}
 }
 func (ev *NotifyEvent) Decode(buffer *bytes.Buffer) (err error) {
 	ev.Code, err = DecodeInt64Value(buffer)
 	if nil == err {
 		ev.Reason, err = DecodeStringValue(buffer)
 	}
+	if nil == err && buffer.Len() > 0 {
+		ev.PubKey, err = DecodeBytesValue(buffer)
+	}
+	if nil == err && buffer.Len() > 0 {
+		ev.Window, err = DecodeUInt32Value(buffer)
+	}
+	if nil == err && buffer.Len() > 0 {
+		ev.Flags, err = DecodeUInt32Value(buffer)
+	}
 	return
 }
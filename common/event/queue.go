@@ -119,7 +119,11 @@ func (q *EventQueue) Read(timeout time.Duration) (Event, error) {
 }
 
 func NewEventQueue() *EventQueue {
+	return NewEventQueueWithSize(10)
+}
+
+func NewEventQueueWithSize(n int) *EventQueue {
 	q := new(EventQueue)
-	q.queue = make(chan Event, 10)
+	q.queue = make(chan Event, n)
 	return q
 }
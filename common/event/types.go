@@ -14,6 +14,7 @@ const (
 	EventChannelCloseACK = 10011
 	EventPortUnicast     = 10012
 	EventConnTest        = 10013
+	EventWindowUpdate    = 10014
 
 	NoneCompressor            = 0
 	SnappyCompressor          = 1
@@ -40,4 +41,5 @@ func init() {
 	RegistObject(EventChannelCloseACK, &ChannelCloseACKEvent{})
 	RegistObject(EventPortUnicast, &PortUnicastEvent{})
 	RegistObject(EventConnTest, &ConnTestEvent{})
+	RegistObject(EventWindowUpdate, &WindowUpdateEvent{})
 }
@@ -4,6 +4,9 @@ import (
 	"bytes"
 )
 
+//RemoteDNSAddr is the address of UDPEvent carrying dns query, which is resolved by the resolver of remote server
+const RemoteDNSAddr = "dns:53"
+
 type UDPEvent struct {
 	EventHeader
 	Addr    string
@@ -2,187 +2,313 @@ package gfwlist
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/yinqiwen/gsnova/common/matcher"
 )
 
-type hostWildcardRule struct {
-	pattern string
+//content type options, which don't restrict matching since the type of proxied request is unknown
+var typeOptions = map[string]bool{
+	"script": true, "image": true, "stylesheet": true, "object": true, "xmlhttprequest": true,
+	"object-subrequest": true, "subdocument": true, "ping": true, "websocket": true, "webrtc": true,
+	"document": true, "elemhide": true, "generichide": true, "genericblock": true, "popup": true,
+	"font": true, "media": true, "other": true, "background": true, "xbl": true, "dtd": true,
 }
 
-func (r *hostWildcardRule) match(req *http.Request) bool {
-	if strings.Contains(req.Host, r.pattern) {
-		return true
-	}
-	return false
-}
+//options like '$script,match-case' at the end of rule
+var optionsRegex = regexp.MustCompile(`\$(~?[\w-]+(=[^,]*)?(,~?[\w-]+(=[^,]*)?)*)$`)
 
-type urlWildcardRule struct {
-	pattern     string
-	prefixMatch bool
+//regex of '||' in javascript, match scheme and any subdomain labels before the pattern
+const domainAnchorRegex = `^[\w\-]+:\/+(?!\/)(?:[^\/?#]*\.)?`
+
+//regex of separator '^', match any character except letters, digits, '_-.%', or the end of url
+const separatorRegex = `(?:[^\w\-.%]|$)`
+
+//gfwListRule is a compiled AdBlock Plus filter, which match the url by regex
+type gfwListRule struct {
+	text      string
+	exception bool
+	matchCase bool
+	//regex source without flags, which match from start of host labels if domain anchored
+	source       string
+	domainAnchor bool
+	regex        *regexp.Regexp
+	//lower case of the longest literal part of the pattern, any url matched contains it
+	keyword string
+	//first label of domain anchored pattern like '||www.example.com', empty if the label is not complete
+	label string
 }
 
-func (r *urlWildcardRule) match(req *http.Request) bool {
-	if len(req.URL.Scheme) == 0 {
-		req.URL.Scheme = "https"
-	}
-	if r.prefixMatch {
-		return strings.HasPrefix(req.URL.String(), r.pattern)
+func isHostLabel(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
 	}
-	return strings.Contains(req.URL.String(), r.pattern)
+	return true
 }
 
-type regexRule struct {
-	pattern string
+//hostStarts return offsets of url where host labels start, e.g. 'www.example.com' & 'example.com' & 'com'
+func hostStarts(url string) []int {
+	i := strings.Index(url, ":")
+	if i < 0 || i+1 >= len(url) || url[i+1] != '/' {
+		return nil
+	}
+	for i++; i < len(url) && url[i] == '/'; i++ {
+	}
+	starts := []int{i}
+	for ; i < len(url) && strings.IndexByte("/?#", url[i]) < 0; i++ {
+		if url[i] == '.' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
 }
 
-func (r *regexRule) match(req *http.Request) bool {
-	if len(req.URL.Scheme) == 0 {
-		req.URL.Scheme = "https"
+func (r *gfwListRule) match(url string, starts []int) bool {
+	if !r.domainAnchor {
+		return r.regex.MatchString(url)
 	}
-	matched, err := regexp.MatchString(r.pattern, req.URL.String())
-	if nil != err {
-		log.Printf("Invalid regex pattern:%s wiuth reason:%v", r.pattern, err)
+	for _, i := range starts {
+		if r.regex.MatchString(url[i:]) {
+			return true
+		}
 	}
-	return matched
+	return false
 }
 
-type whiteListRule struct {
-	r gfwListRule
+//compilePattern convert pattern to regex source, and set keyword & label of the pattern
+func (r *gfwListRule) compilePattern(pattern string) {
+	var buf bytes.Buffer
+	if strings.HasPrefix(pattern, "||") {
+		pattern = pattern[2:]
+		r.domainAnchor = true
+		buf.WriteString("^")
+	} else if strings.HasPrefix(pattern, "|") {
+		pattern = pattern[1:]
+		buf.WriteString("^")
+	}
+	endAnchor := false
+	if strings.HasSuffix(pattern, "|") {
+		pattern = pattern[0 : len(pattern)-1]
+		endAnchor = true
+	}
+	keyword := ""
+	literal := 0
+	for i := 0; i <= len(pattern); i++ {
+		if i < len(pattern) && !strings.ContainsRune("*^|", rune(pattern[i])) {
+			continue
+		}
+		if i-literal > len(keyword) {
+			keyword = pattern[literal:i]
+		}
+		buf.WriteString(regexp.QuoteMeta(pattern[literal:i]))
+		if i < len(pattern) {
+			switch pattern[i] {
+			case '*':
+				buf.WriteString(".*")
+			case '^':
+				buf.WriteString(separatorRegex)
+			default:
+				buf.WriteString(`\|`)
+			}
+		}
+		literal = i + 1
+	}
+	if endAnchor {
+		buf.WriteString("$")
+	}
+	r.source = buf.String()
+	r.keyword = strings.ToLower(keyword)
+	if r.domainAnchor {
+		prefix := pattern
+		if i := strings.IndexAny(prefix, "*^|"); i >= 0 {
+			prefix = prefix[0:i]
+		}
+		if i := strings.IndexByte(prefix, '.'); i > 0 && isHostLabel(prefix[0:i]) {
+			r.label = strings.ToLower(prefix[0:i])
+		}
+	}
 }
 
-func (r *whiteListRule) match(req *http.Request) bool {
-	return r.r.match(req)
+//parseRule compile a line of AdBlock Plus filter list, nil if it's a comment or element hiding rule.
+//Option 'match-case' is supported, options depend on the page sending request like 'domain' & 'third-party'
+//could not be applied by proxy, so the rules are rejected.
+func parseRule(line string) (*gfwListRule, error) {
+	str := strings.TrimSpace(line)
+	if len(str) == 0 || strings.HasPrefix(str, "!") || strings.HasPrefix(str, "[") {
+		return nil, nil
+	}
+	for _, sep := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(str, sep) {
+			return nil, nil
+		}
+	}
+	rule := &gfwListRule{text: str}
+	if strings.HasPrefix(str, "@@") {
+		str = str[2:]
+		rule.exception = true
+	}
+	if loc := optionsRegex.FindStringSubmatchIndex(str); nil != loc {
+		for _, option := range strings.Split(str[loc[2]:loc[3]], ",") {
+			name := strings.ToLower(strings.TrimPrefix(option, "~"))
+			if name == "match-case" {
+				rule.matchCase = true
+			} else if !typeOptions[name] {
+				return nil, fmt.Errorf("Unsupported option:%s", option)
+			}
+		}
+		str = str[0:loc[0]]
+	}
+	if len(str) > 2 && strings.HasPrefix(str, "/") && strings.HasSuffix(str, "/") {
+		rule.source = str[1 : len(str)-1]
+	} else {
+		if len(strings.Trim(str, "|*")) == 0 {
+			return nil, fmt.Errorf("Empty pattern")
+		}
+		rule.compilePattern(str)
+	}
+	source := rule.source
+	if !rule.matchCase {
+		source = "(?i)" + source
+	}
+	regex, err := regexp.Compile(source)
+	if nil != err {
+		return nil, err
+	}
+	rule.regex = regex
+	return rule, nil
 }
 
-type gfwListRule interface {
-	match(req *http.Request) bool
+//CheckRule return error if the rule is not supported
+func CheckRule(line string) error {
+	_, err := parseRule(line)
+	return err
 }
 
 type GFWList struct {
-	ruleMap  map[string]gfwListRule
-	ruleList []gfwListRule
-	mutex    sync.Mutex
+	mutex sync.Mutex
+	rules []*gfwListRule
+	//keywords of rules, matched in one pass to find candidate rules
+	keywords     *matcher.Keywords
+	keywordRules []int
+	//index of rules without keyword like regex rules, which are checked for every url
+	otherRules []int
 }
 
 func (gfw *GFWList) clone(n *GFWList) {
 	gfw.mutex.Lock()
 	defer gfw.mutex.Unlock()
-	gfw.ruleList = n.ruleList
+	gfw.rules = n.rules
+	gfw.keywords = n.keywords
+	gfw.keywordRules = n.keywordRules
+	gfw.otherRules = n.otherRules
 }
 
-func (gfw *GFWList) FastMatchDoamin(req *http.Request) (bool, bool) {
-	domain := req.Host
-	rootDomain := domain
-	if strings.Contains(domain, ":") {
-		domain, _, _ = net.SplitHostPort(domain)
-		rootDomain = domain
+//compile build matchers of rules
+func (gfw *GFWList) compile() {
+	var keywords []string
+	gfw.keywordRules = nil
+	gfw.otherRules = nil
+	for i, rule := range gfw.rules {
+		if len(rule.keyword) > 0 {
+			keywords = append(keywords, rule.keyword)
+			gfw.keywordRules = append(gfw.keywordRules, i)
+		} else {
+			gfw.otherRules = append(gfw.otherRules, i)
+		}
 	}
+	gfw.keywords = matcher.NewKeywords(keywords)
+}
 
-	rule, exist := gfw.ruleMap[domain]
-	if !exist {
-		ss := strings.Split(domain, ".")
-		if len(ss) > 2 {
-			rootDomain = ss[len(ss)-2] + "." + ss[len(ss)-1]
-			if len(ss[len(ss)-2]) < 4 && len(ss) >= 3 {
-				rootDomain = ss[len(ss)-3] + "." + rootDomain
-			}
-		}
-		rule, exist = gfw.ruleMap[rootDomain]
+//requestURL return url of request to match, the scheme is https if not specified like CONNECT request
+func requestURL(req *http.Request) string {
+	u := *req.URL
+	if len(u.Scheme) == 0 {
+		u.Scheme = "https"
 	}
-	if exist {
-		matched := rule.match(req)
-		if _, ok := rule.(*whiteListRule); ok {
-			return !matched, true
-		}
-		return matched, true
+	if len(u.Host) == 0 {
+		u.Host = req.Host
 	}
-	return false, false
+	return u.String()
 }
 
-func (gfw *GFWList) IsBlockedByGFW(req *http.Request) bool {
+//FastMatchDoamin return true if request is blocked, and whether any rule decided the result
+func (gfw *GFWList) FastMatchDoamin(req *http.Request) (bool, bool) {
+	blocked, rule := gfw.Match(req)
+	return blocked, len(rule) > 0
+}
+
+//Match return true if request is blocked, and the original rule decided the result, empty if no rule matched.
+//Exception rules take precedence over blocking rules regardless of order.
+func (gfw *GFWList) Match(req *http.Request) (bool, string) {
+	url := requestURL(req)
 	gfw.mutex.Lock()
 	defer gfw.mutex.Unlock()
 
-	fastMatchResult, exist := gfw.FastMatchDoamin(req)
-	if exist {
-		return fastMatchResult
-	}
-
-	for _, rule := range gfw.ruleList {
-		if rule.match(req) {
-			if _, ok := rule.(*whiteListRule); ok {
-				//log.Printf("#### %s is in whilte list %v", req.Host, rule.(*whiteListRule).r)
-				return false
-			}
-			return true
+	var candidates []int
+	gfw.keywords.Find(strings.ToLower(url), func(id, start, end int) bool {
+		candidates = append(candidates, gfw.keywordRules[id])
+		return true
+	})
+	candidates = append(candidates, gfw.otherRules...)
+	sort.Ints(candidates)
+	starts := hostStarts(url)
+	blocked := -1
+	for j, i := range candidates {
+		if j > 0 && i == candidates[j-1] {
+			continue
+		}
+		rule := gfw.rules[i]
+		if (!rule.exception && blocked >= 0) || !rule.match(url, starts) {
+			continue
+		}
+		if rule.exception {
+			return false, rule.text
 		}
+		blocked = i
 	}
-	return false
+	if blocked < 0 {
+		return false, ""
+	}
+	return true, gfw.rules[blocked].text
+}
+
+func (gfw *GFWList) IsBlockedByGFW(req *http.Request) bool {
+	blocked, _ := gfw.Match(req)
+	return blocked
 }
 
 func Parse(rules string) (*GFWList, error) {
 	reader := bufio.NewReader(strings.NewReader(rules))
 	gfw := new(GFWList)
-	gfw.ruleMap = make(map[string]gfwListRule)
-	//i := 0
 	for {
 		line, _, err := reader.ReadLine()
 		if nil != err {
 			break
 		}
-		str := strings.TrimSpace(string(line))
-		//comment
-		if strings.HasPrefix(str, "!") || len(str) == 0 || strings.HasPrefix(str, "[") {
+		rule, err := parseRule(string(line))
+		if nil != err {
+			log.Printf("[WARN]Invalid gfwlist rule:%s with reason:%v", line, err)
 			continue
 		}
-		var rule gfwListRule
-		isWhileListRule := false
-		fastMatch := false
-		if strings.HasPrefix(str, "@@") {
-			str = str[2:]
-			isWhileListRule = true
-		}
-		if strings.HasPrefix(str, "/") && strings.HasSuffix(str, "/") {
-			str = str[1 : len(str)-1]
-			rule = &regexRule{str}
-		} else {
-			if strings.HasPrefix(str, "||") {
-				str = str[2:]
-				rule = &hostWildcardRule{str}
-				fastMatch = true
-			} else if strings.HasPrefix(str, "|") {
-				rule = &urlWildcardRule{str[1:], true}
-			} else {
-				if !strings.Contains(str, "/") {
-					fastMatch = true
-					rule = &hostWildcardRule{str}
-					if strings.HasPrefix(str, ".") {
-						str = str[1:]
-					}
-				} else {
-					rule = &urlWildcardRule{str, false}
-				}
-			}
-		}
-		if isWhileListRule {
-			rule = &whiteListRule{rule}
-		}
-		if fastMatch {
-			gfw.ruleMap[str] = rule
-		} else {
-			gfw.ruleList = append(gfw.ruleList, rule)
+		if nil != rule {
+			gfw.rules = append(gfw.rules, rule)
 		}
 	}
+	gfw.compile()
 	return gfw, nil
 }
 
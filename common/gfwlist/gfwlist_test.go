@@ -2,14 +2,18 @@ package gfwlist
 
 import (
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestGFWList(t *testing.T) {
 	userRules := []string{"||4ter2n.com", "|https://85.17.73.31/"}
-	gfwlist, err := NewGFWList("https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt", "", userRules, "gfwlist.txt", false)
+	hc := &http.Client{Timeout: 10 * time.Second}
+	gfwlist, err := NewGFWList("https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt", hc, userRules, "", false)
 	if nil != err {
 		log.Printf("#####%v", err)
 		return
@@ -22,3 +26,200 @@ func TestGFWList(t *testing.T) {
 	v := gfwlist.IsBlockedByGFW(req)
 	log.Printf("#####match %v %v", v, time.Now().Sub(s1))
 }
+
+func TestABPSyntax(t *testing.T) {
+	corpus := []struct {
+		rules   []string
+		url     string
+		blocked bool
+	}{
+		{[]string{"||example.com"}, "https://example.com/", true},
+		{[]string{"||example.com"}, "https://www.example.com/x", true},
+		{[]string{"||example.com"}, "https://notexample.com/", false},
+		{[]string{"||example.com"}, "https://notexample.com.evil/", false},
+		{[]string{"||example.com"}, "https://example.com.evil/", true},
+		{[]string{"||example.com"}, "http://evil.com/?u=example.com", false},
+		{[]string{"||example.com"}, "http://evil.com/a.example.com", false},
+		{[]string{"||example.com^"}, "https://example.com:8080/", true},
+		{[]string{"||example.com^"}, "https://example.com", true},
+		{[]string{"||example.com^"}, "https://example.com.evil/", false},
+		{[]string{"||example.com/"}, "https://example.com/", true},
+		{[]string{"||*.example.com"}, "https://a.example.com/", true},
+		{[]string{"||*.example.com"}, "https://example.com/", false},
+		{[]string{"|http://example.com/"}, "http://example.com/a", true},
+		{[]string{"|http://example.com/"}, "https://example.com/", false},
+		{[]string{"|http://example.com/"}, "http://a.com/?http://example.com/", false},
+		{[]string{"|https://85.17.73.31/"}, "https://85.17.73.31/x", true},
+		{[]string{"example.com"}, "http://a.com/?q=example.com", true},
+		{[]string{"example.com"}, "https://EXAMPLE.COM/", true},
+		{[]string{".example.com"}, "https://www.example.com/", true},
+		{[]string{".example.com"}, "https://example.com/", false},
+		{[]string{"/ads/*.gif|"}, "http://a.com/ads/x.gif", true},
+		{[]string{"/ads/*.gif|"}, "http://a.com/ads/x.gif?x", false},
+		{[]string{"/ads/*.gif|"}, "http://a.com/ads.gif", false},
+		{[]string{"swf|"}, "http://a.com/x.swf", true},
+		{[]string{"swf|"}, "http://a.com/x.swf?x", false},
+		{[]string{"^foo^"}, "http://a.com/foo/bar", true},
+		{[]string{"^foo^"}, "http://a.com/foo", true},
+		{[]string{"^foo^"}, "http://a.com/foobar", false},
+		{[]string{"^foo^"}, "http://a.com/a-foo.b", false},
+		{[]string{"||example.com/Path$match-case"}, "https://example.com/Path", true},
+		{[]string{"||example.com/Path$match-case"}, "https://example.com/path", false},
+		{[]string{"||example.com^$script,~image"}, "https://example.com/", true},
+		{[]string{`/^https?:\/\/[^\/]+blogspot\.(.*)/`}, "https://x.blogspot.de/", true},
+		{[]string{`/^https?:\/\/[^\/]+blogspot\.(.*)/`}, "https://x.blogger.de/?blogspot.de", false},
+		{[]string{"/Foo/$match-case"}, "https://a.com/foo", false},
+		{[]string{"||google.com", "@@||maps.google.com"}, "https://www.google.com/", true},
+		{[]string{"||google.com", "@@||maps.google.com"}, "https://maps.google.com/x", false},
+		{[]string{"@@||maps.google.com", "||google.com"}, "https://maps.google.com/x", false},
+		{[]string{"||example.com", "@@|http://example.com"}, "http://example.com/", false},
+		{[]string{"||example.com", "@@|http://example.com"}, "https://example.com/", true},
+		{[]string{"||example.com^$domain=a.com"}, "https://example.com/", false},
+		{[]string{"example.com##.ad"}, "https://example.com/", false},
+		{[]string{"! ||example.com", "[AutoProxy 0.2.9]"}, "https://example.com/", false},
+	}
+	for _, c := range corpus {
+		gfw, _ := Parse(strings.Join(c.rules, "\n"))
+		req, _ := http.NewRequest("GET", c.url, nil)
+		if blocked, rule := gfw.Match(req); blocked != c.blocked {
+			t.Errorf("Expected blocked:%v for %s by %q, but got %v by rule:%s", c.blocked, c.url, c.rules, blocked, rule)
+		}
+	}
+
+	for _, rule := range []string{"||example.com^$domain=a.com", "||example.com^$third-party", "*", "@@||", `/(?<=a)b/`} {
+		if nil == CheckRule(rule) {
+			t.Errorf("Expected invalid rule:%s", rule)
+		}
+	}
+	for _, rule := range []string{"||example.com^$script", "example.com##.ad", "@@|http://example.com|", `/^https?:\/\/a\.com/`} {
+		if err := CheckRule(rule); nil != err {
+			t.Errorf("Expected valid rule:%s, but got %v", rule, err)
+		}
+	}
+
+	//CONNECT request has no scheme & path
+	gfw, _ := Parse("||google.com\n@@|http://www.google.com/\n")
+	req := &http.Request{Method: "CONNECT", URL: &url.URL{Host: "www.google.com:443"}, Host: "www.google.com:443"}
+	if blocked, exist := gfw.FastMatchDoamin(req); !blocked || !exist || req.URL.Scheme != "" {
+		t.Errorf("Expected CONNECT request blocked")
+	}
+	if blocked, rule := gfw.Match(&http.Request{URL: &url.URL{Scheme: "http", Host: "www.google.com", Path: "/"}}); blocked || rule != "@@|http://www.google.com/" {
+		t.Errorf("Expected exception rule, but got %v %s", blocked, rule)
+	}
+}
+
+func isSeparator(c byte) bool {
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("_-.%", c) >= 0)
+}
+
+//matchAt match pattern with wildcards & separators at s[i:] by backtracking
+func matchAt(p string, s string, i int, endAnchor bool) bool {
+	if len(p) == 0 {
+		return !endAnchor || i == len(s)
+	}
+	switch p[0] {
+	case '*':
+		for j := i; j <= len(s); j++ {
+			if matchAt(p[1:], s, j, endAnchor) {
+				return true
+			}
+		}
+		return false
+	case '^':
+		if i == len(s) {
+			return matchAt(p[1:], s, i, endAnchor)
+		}
+		return isSeparator(s[i]) && matchAt(p[1:], s, i+1, endAnchor)
+	}
+	return i < len(s) && s[i] == p[0] && matchAt(p[1:], s, i+1, endAnchor)
+}
+
+//linearMatch is a reference matcher of AdBlock Plus filters without regex
+func linearMatch(rules []string, u string) bool {
+	u = strings.ToLower(u)
+	blocked := false
+	for _, rule := range rules {
+		exception := strings.HasPrefix(rule, "@@")
+		pattern := strings.ToLower(strings.TrimPrefix(rule, "@@"))
+		var starts []int
+		switch {
+		case strings.HasPrefix(pattern, "||"):
+			pattern = pattern[2:]
+			host := strings.Index(u, "://") + 3
+			starts = append(starts, host)
+			for k := host; k < len(u) && strings.IndexByte("/?#", u[k]) < 0; k++ {
+				if u[k] == '.' {
+					starts = append(starts, k+1)
+				}
+			}
+		case strings.HasPrefix(pattern, "|"):
+			pattern = pattern[1:]
+			starts = append(starts, 0)
+		default:
+			for k := 0; k <= len(u); k++ {
+				starts = append(starts, k)
+			}
+		}
+		endAnchor := strings.HasSuffix(pattern, "|")
+		pattern = strings.TrimSuffix(pattern, "|")
+		for _, k := range starts {
+			if matchAt(pattern, u, k, endAnchor) {
+				if exception {
+					return false
+				}
+				blocked = true
+				break
+			}
+		}
+	}
+	return blocked
+}
+
+//compare with reference matcher on random rules & urls
+func TestABPRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(alphabet string, n int) string {
+		b := make([]byte, 1+r.Intn(n))
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+	for round := 0; round < 100; round++ {
+		var rules []string
+		for len(rules) < 20 {
+			rule := random("ab.^*/-", 5)
+			switch r.Intn(4) {
+			case 0:
+				rule = "||" + rule
+			case 1:
+				rule = "|http://" + rule
+			}
+			if r.Intn(3) == 0 {
+				rule = rule + "|"
+			}
+			if r.Intn(5) == 0 {
+				rule = "@@" + rule
+			}
+			//'/pattern/' is regex rule
+			pattern := strings.TrimPrefix(rule, "@@")
+			if isRegex := len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"); !isRegex && nil == CheckRule(rule) {
+				rules = append(rules, rule)
+			}
+		}
+		gfw, _ := Parse(strings.Join(rules, "\n"))
+		for i := 0; i < 200; i++ {
+			u := "http://" + random("ab.", 8) + "/" + random("ab./-B", 8)
+			if r.Intn(3) == 0 {
+				u = u + "?" + random("ab.=", 4)
+			}
+			req, err := http.NewRequest("GET", u, nil)
+			if nil != err {
+				continue
+			}
+			if expected, got := linearMatch(rules, requestURL(req)), gfw.IsBlockedByGFW(req); expected != got {
+				t.Fatalf("Expected blocked:%v for %s by %q, but got %v", expected, u, rules, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package gfwlist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const pacMatchFunctions = `
+function %[1]s(url, host) {
+  var hasOwn = Object.prototype.hasOwnProperty;
+  var lower = url.toLowerCase();
+  var labels = host.toLowerCase().split(".");
+  var candidates = [];
+  for (var i = 0; i < labels.length; i++) {
+    if (hasOwn.call(%[1]sLabelRules, labels[i])) candidates = candidates.concat(%[1]sLabelRules[labels[i]]);
+  }
+  for (var i = 0; i < %[1]sOtherRules.length; i++) {
+    var r = %[1]sRules[%[1]sOtherRules[i]];
+    if (r[0].length == 0 || lower.indexOf(r[0]) >= 0) candidates.push(%[1]sOtherRules[i]);
+  }
+  var blocked = false;
+  for (var i = 0; i < candidates.length; i++) {
+    var r = %[1]sRules[candidates[i]];
+    if (r[2]) {
+      if (r[1].test(url)) return false;
+    } else if (!blocked && r[1].test(url)) {
+      blocked = true;
+    }
+  }
+  return blocked;
+}
+`
+
+//PACFunction generate javascript function 'name(url, host)' which has same result of IsBlockedByGFW,
+//rules anchored by domain are indexed by the first label, others are filtered by keyword before regex test
+func (gfw *GFWList) PACFunction(name string) string {
+	gfw.mutex.Lock()
+	rules := gfw.rules
+	gfw.mutex.Unlock()
+
+	var buf bytes.Buffer
+	labelRules := make(map[string][]int)
+	otherRules := make([]int, 0)
+	fmt.Fprintf(&buf, "var %sRules = [\n", name)
+	for i, rule := range rules {
+		flags := "i"
+		if rule.matchCase {
+			flags = ""
+		}
+		source := rule.source
+		if rule.domainAnchor {
+			source = domainAnchorRegex + source[1:]
+		}
+		data, _ := json.Marshal([]interface{}{rule.keyword, source, rule.exception, flags})
+		if i > 0 {
+			buf.WriteString(",\n")
+		}
+		buf.Write(data)
+		if len(rule.label) > 0 {
+			labelRules[rule.label] = append(labelRules[rule.label], i)
+		} else {
+			otherRules = append(otherRules, i)
+		}
+	}
+	buf.WriteString("\n];\n")
+	labelData, _ := json.Marshal(labelRules)
+	otherData, _ := json.Marshal(otherRules)
+	fmt.Fprintf(&buf, "var %sLabelRules = %s;\n", name, labelData)
+	fmt.Fprintf(&buf, "var %sOtherRules = %s;\n", name, otherData)
+	//compile regex rules once
+	fmt.Fprintf(&buf, "for (var i = 0; i < %[1]sRules.length; i++) {\n  %[1]sRules[i][1] = new RegExp(%[1]sRules[i][1], %[1]sRules[i][3]);\n}\n", name)
+	fmt.Fprintf(&buf, pacMatchFunctions, name)
+	return buf.String()
+}
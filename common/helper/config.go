@@ -0,0 +1,293 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//ConfigError locate an invalid config item by file, line & json path
+type ConfigError struct {
+	File   string
+	Line   int
+	Path   string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Path) == 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Reason)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Path, e.Reason)
+}
+
+//JSONFile is a json config file with comment lines, indexed by json path like 'Proxy[0].PAC[1].Remote'
+type JSONFile struct {
+	Name  string
+	Data  []byte
+	lines map[string]int
+}
+
+//LoadJSONFile blank comment lines instead of removing them, so that line numbers are kept
+func LoadJSONFile(file string, commentPrefix string) (*JSONFile, error) {
+	content, err := ioutil.ReadFile(file)
+	if nil != err {
+		return nil, err
+	}
+	lines := bytes.Split(content, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte(commentPrefix)) {
+			lines[i] = nil
+		}
+	}
+	f := &JSONFile{Name: file, Data: bytes.Join(lines, []byte("\n"))}
+	f.lines = make(map[string]int)
+	x := &jsonIndexer{data: f.Data, line: 1, lines: f.lines}
+	x.value("")
+	return f, nil
+}
+
+//Line return the line of the json path, or its nearest parent if not exist
+func (f *JSONFile) Line(path string) int {
+	for {
+		if line, exist := f.lines[path]; exist {
+			return line
+		}
+		idx := strings.LastIndexAny(path, ".[")
+		if idx < 0 {
+			return 1
+		}
+		path = path[0:idx]
+	}
+}
+
+func (f *JSONFile) lineOfOffset(offset int64) int {
+	if offset > int64(len(f.Data)) {
+		offset = int64(len(f.Data))
+	}
+	return bytes.Count(f.Data[0:offset], []byte("\n")) + 1
+}
+
+//Unmarshal return ConfigError with line number if the content is invalid
+func (f *JSONFile) Unmarshal(v interface{}) error {
+	err := json.Unmarshal(f.Data, v)
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *json.SyntaxError:
+		return &ConfigError{File: f.Name, Line: f.lineOfOffset(e.Offset), Reason: e.Error()}
+	case *json.UnmarshalTypeError:
+		return &ConfigError{File: f.Name, Line: f.lineOfOffset(e.Offset), Path: jsonFieldPath(e.Field), Reason: e.Error()}
+	}
+	return &ConfigError{File: f.Name, Line: 1, Reason: err.Error()}
+}
+
+//jsonFieldPath convert field like 'Proxy.0.Local' reported by json package to 'Proxy[0].Local'
+func jsonFieldPath(field string) string {
+	parts := strings.Split(field, ".")
+	path := ""
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); nil == err {
+			path += "[" + part + "]"
+		} else if len(path) > 0 {
+			path += "." + part
+		} else {
+			path = part
+		}
+	}
+	return path
+}
+
+type jsonIndexer struct {
+	data  []byte
+	pos   int
+	line  int
+	lines map[string]int
+}
+
+func (x *jsonIndexer) skipSpace() {
+	for x.pos < len(x.data) {
+		switch x.data[x.pos] {
+		case '\n':
+			x.line++
+		case ' ', '\t', '\r':
+		default:
+			return
+		}
+		x.pos++
+	}
+}
+
+func (x *jsonIndexer) str() string {
+	start := x.pos
+	x.pos++
+	for x.pos < len(x.data) && x.data[x.pos] != '"' {
+		if x.data[x.pos] == '\\' {
+			x.pos++
+		}
+		x.pos++
+	}
+	x.pos++
+	var s string
+	if x.pos <= len(x.data) {
+		json.Unmarshal(x.data[start:x.pos], &s)
+	}
+	return s
+}
+
+//value index the json value & its children, malformed content is left to json.Unmarshal to report
+func (x *jsonIndexer) value(path string) bool {
+	x.skipSpace()
+	if x.pos >= len(x.data) {
+		return false
+	}
+	if _, exist := x.lines[path]; !exist {
+		x.lines[path] = x.line
+	}
+	switch x.data[x.pos] {
+	case '{':
+		x.pos++
+		for {
+			x.skipSpace()
+			if x.pos >= len(x.data) {
+				return false
+			}
+			if x.data[x.pos] == '}' {
+				x.pos++
+				return true
+			}
+			if x.data[x.pos] == ',' {
+				x.pos++
+				continue
+			}
+			if x.data[x.pos] != '"' {
+				return false
+			}
+			key := x.str()
+			x.skipSpace()
+			if x.pos >= len(x.data) || x.data[x.pos] != ':' {
+				return false
+			}
+			x.pos++
+			child := key
+			if len(path) > 0 {
+				child = path + "." + key
+			}
+			if !x.value(child) {
+				return false
+			}
+		}
+	case '[':
+		x.pos++
+		for i := 0; ; {
+			x.skipSpace()
+			if x.pos >= len(x.data) {
+				return false
+			}
+			if x.data[x.pos] == ']' {
+				x.pos++
+				return true
+			}
+			if x.data[x.pos] == ',' {
+				x.pos++
+				continue
+			}
+			if !x.value(path + "[" + strconv.Itoa(i) + "]") {
+				return false
+			}
+			i++
+		}
+	case '"':
+		x.str()
+	default:
+		for x.pos < len(x.data) && !strings.ContainsRune(",]} \t\r\n", rune(x.data[x.pos])) {
+			x.pos++
+		}
+	}
+	return true
+}
+
+//ConfigChecker collect all errors of a config file
+type ConfigChecker struct {
+	File   *JSONFile
+	Errors []error
+}
+
+func (c *ConfigChecker) Errorf(path string, format string, args ...interface{}) {
+	c.Errors = append(c.Errors, &ConfigError{File: c.File.Name, Line: c.File.Line(path), Path: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+//CheckAddr check address in 'host:port' format with valid port
+func (c *ConfigChecker) CheckAddr(path string, addr string, allowEmpty bool) bool {
+	if len(addr) == 0 {
+		if !allowEmpty {
+			c.Errorf(path, "empty address")
+		}
+		return allowEmpty
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		c.Errorf(path, "invalid address:%s, expected 'host:port'", addr)
+		return false
+	}
+	if p, err := strconv.Atoi(port); nil != err || p <= 0 || p > 65535 {
+		c.Errorf(path, "invalid port:%s", port)
+		return false
+	}
+	return true
+}
+
+//CheckURL check url with one of the schemes, any scheme is allowed if schemes is empty
+func (c *ConfigChecker) CheckURL(path string, str string, schemes ...string) *url.URL {
+	u, err := url.Parse(str)
+	if nil != err {
+		c.Errorf(path, "invalid url:%s for reason:%v", str, err)
+		return nil
+	}
+	if len(u.Host) == 0 {
+		c.Errorf(path, "invalid url:%s without host", str)
+		return nil
+	}
+	if port := u.Port(); len(port) > 0 {
+		if p, err := strconv.Atoi(port); nil != err || p <= 0 || p > 65535 {
+			c.Errorf(path, "invalid port:%s in url:%s", port, str)
+			return nil
+		}
+	}
+	if len(schemes) == 0 {
+		return u
+	}
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return u
+		}
+	}
+	c.Errorf(path, "unsupported scheme:%s in url:%s, expected one of %v", u.Scheme, str, schemes)
+	return nil
+}
+
+//CheckPatterns check wildcard patterns used by filepath.Match
+func (c *ConfigChecker) CheckPatterns(path string, patterns []string) {
+	for i, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); nil != err {
+			c.Errorf(fmt.Sprintf("%s[%d]", path, i), "invalid pattern:%s", pattern)
+		}
+	}
+}
+
+//CheckOneOf check the value is one of the candidates(case insensitive)
+func (c *ConfigChecker) CheckOneOf(path string, v string, candidates ...string) bool {
+	for _, s := range candidates {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	c.Errorf(path, "invalid value:%s, expected one of %v", v, candidates)
+	return false
+}
@@ -0,0 +1,116 @@
+package matcher
+
+import "bytes"
+
+type acNode struct {
+	labels   []byte
+	children []int32
+	fail     int32
+	//nearest node with output in fail chain, -1 if none
+	dict int32
+	//ids of keywords end at this node
+	out []int
+}
+
+//Keywords is an Aho-Corasick automaton which find all occurrences of keywords in one pass
+type Keywords struct {
+	nodes   []acNode
+	lengths []int
+}
+
+func (k *Keywords) child(node int32, c byte) int32 {
+	n := &k.nodes[node]
+	if i := bytes.IndexByte(n.labels, c); i >= 0 {
+		return n.children[i]
+	}
+	return -1
+}
+
+//NewKeywords build automaton of keywords, id of keyword is its index
+func NewKeywords(keywords []string) *Keywords {
+	k := &Keywords{nodes: []acNode{{dict: -1}}, lengths: make([]int, len(keywords))}
+	for id, keyword := range keywords {
+		k.lengths[id] = len(keyword)
+		if len(keyword) == 0 {
+			continue
+		}
+		var node int32
+		for i := 0; i < len(keyword); i++ {
+			next := k.child(node, keyword[i])
+			if next < 0 {
+				next = int32(len(k.nodes))
+				k.nodes = append(k.nodes, acNode{dict: -1})
+				k.nodes[node].labels = append(k.nodes[node].labels, keyword[i])
+				k.nodes[node].children = append(k.nodes[node].children, next)
+			}
+			node = next
+		}
+		k.nodes[node].out = append(k.nodes[node].out, id)
+	}
+	//build fail & dict links in BFS order
+	queue := make([]int32, 0, len(k.nodes))
+	for _, c := range k.nodes[0].children {
+		queue = append(queue, c)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for i, c := range k.nodes[node].labels {
+			next := k.nodes[node].children[i]
+			fail := k.nodes[node].fail
+			for {
+				if f := k.child(fail, c); f >= 0 {
+					k.nodes[next].fail = f
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = k.nodes[fail].fail
+			}
+			f := k.nodes[next].fail
+			if len(k.nodes[f].out) > 0 {
+				k.nodes[next].dict = f
+			} else {
+				k.nodes[next].dict = k.nodes[f].dict
+			}
+			queue = append(queue, next)
+		}
+	}
+	return k
+}
+
+//Find invoke fn for every occurrence of keywords as s[start:end], stop if fn return false
+func (k *Keywords) Find(s string, fn func(id, start, end int) bool) {
+	var node int32
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		for {
+			if next := k.child(node, c); next >= 0 {
+				node = next
+				break
+			}
+			if node == 0 {
+				break
+			}
+			node = k.nodes[node].fail
+		}
+		for n := node; n > 0; n = k.nodes[n].dict {
+			for _, id := range k.nodes[n].out {
+				if !fn(id, i+1-k.lengths[id], i+1) {
+					return
+				}
+			}
+		}
+	}
+}
+
+//Contains return true if any keyword occurs in s
+func (k *Keywords) Contains(s string) bool {
+	found := false
+	k.Find(s, func(id, start, end int) bool {
+		found = true
+		return false
+	})
+	return found
+}
@@ -0,0 +1,74 @@
+package matcher
+
+import "strings"
+
+type domainNode struct {
+	children map[string]*domainNode
+	value    interface{}
+	exist    bool
+}
+
+//DomainSet is a trie of domain labels stored from the top level,
+//which match a domain and all its subdomains.
+type DomainSet struct {
+	root domainNode
+	size int
+}
+
+//Add set value of domain, the old value of same domain is replaced
+func (s *DomainSet) Add(domain string, value interface{}) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	node := &s.root
+	for len(domain) > 0 {
+		var label string
+		if i := strings.LastIndexByte(domain, '.'); i >= 0 {
+			label, domain = domain[i+1:], domain[0:i]
+		} else {
+			label, domain = domain, ""
+		}
+		if nil == node.children {
+			node.children = make(map[string]*domainNode)
+		}
+		next, exist := node.children[label]
+		if !exist {
+			next = new(domainNode)
+			node.children[label] = next
+		}
+		node = next
+	}
+	if !node.exist {
+		s.size++
+	}
+	node.value = value
+	node.exist = true
+}
+
+//Lookup return value of the longest domain which is host or parent of host
+func (s *DomainSet) Lookup(host string) (interface{}, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	node := &s.root
+	var value interface{}
+	found := false
+	for len(host) > 0 && nil != node.children {
+		var label string
+		if i := strings.LastIndexByte(host, '.'); i >= 0 {
+			label, host = host[i+1:], host[0:i]
+		} else {
+			label, host = host, ""
+		}
+		next, exist := node.children[label]
+		if !exist {
+			break
+		}
+		node = next
+		if node.exist {
+			value, found = node.value, true
+		}
+	}
+	return value, found
+}
+
+//Len return count of domains
+func (s *DomainSet) Len() int {
+	return s.size
+}
@@ -0,0 +1,159 @@
+package matcher
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//'*' of filepath.Match never match the separator
+const separator = os.PathSeparator
+
+type byteTrie struct {
+	labels   []byte
+	children []*byteTrie
+	//index of pattern end at this node, -1 if none
+	index int
+}
+
+func (t *byteTrie) add(s string, index int, reverse bool) {
+	node := t
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if reverse {
+			c = s[len(s)-1-i]
+		}
+		j := bytes.IndexByte(node.labels, c)
+		if j < 0 {
+			node.labels = append(node.labels, c)
+			node.children = append(node.children, &byteTrie{index: -1})
+			j = len(node.labels) - 1
+		}
+		node = node.children[j]
+	}
+	if node.index < 0 || index < node.index {
+		node.index = index
+	}
+}
+
+func (t *byteTrie) child(c byte) *byteTrie {
+	if j := bytes.IndexByte(t.labels, c); j >= 0 {
+		return t.children[j]
+	}
+	return nil
+}
+
+type globPattern struct {
+	pattern string
+	index   int
+}
+
+//Patterns is compiled patterns of filepath.Match, patterns like 'literal', '*literal', 'literal*'
+//and '*literal*' are matched by tries & Aho-Corasick automaton, the rest are matched one by one.
+type Patterns struct {
+	exact         map[string]int
+	prefix        *byteTrie
+	suffix        *byteTrie
+	keywords      *Keywords
+	keywordIndex  []int
+	matchAllIndex int
+	globs         []globPattern
+}
+
+//NewPatterns compile patterns, invalid patterns are ignored
+func NewPatterns(patterns []string) *Patterns {
+	p := &Patterns{
+		exact:         make(map[string]int),
+		prefix:        &byteTrie{index: -1},
+		suffix:        &byteTrie{index: -1},
+		matchAllIndex: -1,
+	}
+	var keywords []string
+	for i, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); nil != err {
+			log.Printf("Invalid pattern:%s with reason:%v", pattern, err)
+			continue
+		}
+		literal := strings.Trim(pattern, "*")
+		if strings.ContainsAny(literal, "*?[\\") {
+			p.globs = append(p.globs, globPattern{pattern, i})
+			continue
+		}
+		leading, trailing := strings.HasPrefix(pattern, "*"), strings.HasSuffix(pattern, "*")
+		switch {
+		case !leading && !trailing:
+			if _, exist := p.exact[literal]; !exist {
+				p.exact[literal] = i
+			}
+		case len(literal) == 0:
+			if p.matchAllIndex < 0 {
+				p.matchAllIndex = i
+			}
+		case leading && trailing:
+			keywords = append(keywords, literal)
+			p.keywordIndex = append(p.keywordIndex, i)
+		case leading:
+			p.suffix.add(literal, i, true)
+		default:
+			p.prefix.add(literal, i, false)
+		}
+	}
+	if len(keywords) > 0 {
+		p.keywords = NewKeywords(keywords)
+	}
+	return p
+}
+
+//Match return true if s matched by any pattern
+func (p *Patterns) Match(s string) bool {
+	return p.Find(s) >= 0
+}
+
+//Find return the smallest index of patterns matched s, -1 if none
+func (p *Patterns) Find(s string) int {
+	index := -1
+	better := func(i int) bool {
+		return i >= 0 && (index < 0 || i < index)
+	}
+	if i, exist := p.exact[s]; exist {
+		index = i
+	}
+	firstSep, lastSep := strings.IndexByte(s, separator), strings.LastIndexByte(s, separator)
+	if firstSep < 0 && better(p.matchAllIndex) {
+		index = p.matchAllIndex
+	}
+	//s[i+1:] is matched by the trailing '*'
+	node := p.prefix
+	for i := 0; i < len(s) && nil != node; i++ {
+		if node = node.child(s[i]); nil != node && lastSep <= i && better(node.index) {
+			index = node.index
+		}
+	}
+	//s[0:i] is matched by the leading '*'
+	node = p.suffix
+	for i := len(s) - 1; i >= 0 && nil != node; i-- {
+		if node = node.child(s[i]); nil != node && (firstSep < 0 || firstSep >= i) && better(node.index) {
+			index = node.index
+		}
+	}
+	if nil != p.keywords {
+		p.keywords.Find(s, func(id, start, end int) bool {
+			if (firstSep < 0 || firstSep >= start) && lastSep < end && better(p.keywordIndex[id]) {
+				index = p.keywordIndex[id]
+			}
+			return true
+		})
+	}
+	for _, g := range p.globs {
+		if index >= 0 && g.index > index {
+			break
+		}
+		if matched, _ := filepath.Match(g.pattern, s); matched {
+			index = g.index
+			break
+		}
+	}
+	return index
+}
@@ -0,0 +1,210 @@
+package matcher
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeywords(t *testing.T) {
+	k := NewKeywords([]string{"he", "she", "his", "hers", ""})
+	var found []string
+	k.Find("ushers", func(id, start, end int) bool {
+		found = append(found, fmt.Sprintf("%d:%d-%d", id, start, end))
+		return true
+	})
+	if strings.Join(found, ",") != "1:1-4,0:2-4,3:2-6" {
+		t.Errorf("Invalid occurrences:%v", found)
+	}
+	if !k.Contains("this") || k.Contains("hi") {
+		t.Errorf("Invalid keywords match")
+	}
+}
+
+func TestDomainSet(t *testing.T) {
+	var s DomainSet
+	s.Add("google.com", 1)
+	s.Add("maps.google.com", 2)
+	s.Add(".Example.org", 3)
+	cases := map[string]interface{}{
+		"google.com":          1,
+		"www.google.com":      1,
+		"a.maps.google.com":   2,
+		"maps.google.com.":    2,
+		"fakegoogle.com":      nil,
+		"com":                 nil,
+		"WWW.EXAMPLE.ORG":     3,
+		"example.org.cn":      nil,
+		"":                    nil,
+		"google.com.evil.net": nil,
+	}
+	for host, expected := range cases {
+		v, found := s.Lookup(host)
+		if found != (nil != expected) || v != expected {
+			t.Errorf("Expected %v for %s, but got %v", expected, host, v)
+		}
+	}
+	if s.Len() != 3 {
+		t.Errorf("Invalid size:%d", s.Len())
+	}
+}
+
+func linearFind(patterns []string, s string) int {
+	for i, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, s); matched {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPatterns(t *testing.T) {
+	patterns := []string{"*.google.com", "www.*", "*tube*", "*", "exact.org", "*.google.co.*", "http://*/a*", "a[b-c]?", "[bad"}
+	p := NewPatterns(patterns)
+	cases := map[string]int{
+		"www.google.com":          0,
+		"www.example.com":         1,
+		"m.youtube.com":           2,
+		"exact.org":               3,
+		"x.google.co.jp":          3,
+		"http://www.google.com/":  -1,
+		"http://youtube.com/":     -1,
+		"http://youtube.com/abc":  6,
+		"http://a/b/abc":          -1,
+		"https://x.com/watch?v=1": -1,
+	}
+	for s, expected := range cases {
+		if i := p.Find(s); i != expected {
+			t.Errorf("Expected %d for %s, but got %d", expected, s, i)
+		}
+	}
+}
+
+//compare with filepath.Match on random strings & patterns
+func TestPatternsRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	alphabet := "ab/."
+	random := func(n int) string {
+		b := make([]byte, r.Intn(n))
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+	for round := 0; round < 200; round++ {
+		var patterns []string
+		for i := 0; i < 10; i++ {
+			pattern := random(4)
+			switch r.Intn(5) {
+			case 0:
+				pattern = "*" + pattern
+			case 1:
+				pattern = pattern + "*"
+			case 2:
+				pattern = "*" + pattern + "*"
+			case 3:
+				pattern = pattern + "?" + random(3)
+			}
+			patterns = append(patterns, pattern)
+		}
+		p := NewPatterns(patterns)
+		for i := 0; i < 100; i++ {
+			s := random(8)
+			if expected, got := linearFind(patterns, s), p.Find(s); expected != got {
+				t.Fatalf("Expected %d for %q in %q, but got %d", expected, s, patterns, got)
+			}
+		}
+	}
+}
+
+var benchDomains, benchHosts, benchURLs []string
+
+func init() {
+	r := rand.New(rand.NewSource(1))
+	word := func() string {
+		b := make([]byte, 4+r.Intn(8))
+		for i := range b {
+			b[i] = byte('a' + r.Intn(26))
+		}
+		return string(b)
+	}
+	for i := 0; i < 10000; i++ {
+		benchDomains = append(benchDomains, word()+".com")
+	}
+	for i := 0; i < 100; i++ {
+		domain := word() + ".com"
+		if i%2 == 0 {
+			domain = benchDomains[r.Intn(len(benchDomains))]
+		}
+		host := "www." + domain
+		benchHosts = append(benchHosts, host)
+		benchURLs = append(benchURLs, "https://"+host+"/"+word()+"/"+word()+".html?q="+word())
+	}
+}
+
+func benchPatterns() []string {
+	var patterns []string
+	for _, domain := range benchDomains {
+		patterns = append(patterns, "*."+domain)
+	}
+	return patterns
+}
+
+func BenchmarkPatternsLinear(b *testing.B) {
+	patterns := benchPatterns()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearFind(patterns, benchHosts[i%len(benchHosts)])
+	}
+}
+
+func BenchmarkPatterns(b *testing.B) {
+	p := NewPatterns(benchPatterns())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Find(benchHosts[i%len(benchHosts)])
+	}
+}
+
+func BenchmarkDomainSetLinear(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		host := benchHosts[i%len(benchHosts)]
+		for _, domain := range benchDomains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkDomainSet(b *testing.B) {
+	var s DomainSet
+	for _, domain := range benchDomains {
+		s.Add(domain, true)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Lookup(benchHosts[i%len(benchHosts)])
+	}
+}
+
+func BenchmarkKeywordsLinear(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		url := benchURLs[i%len(benchURLs)]
+		for _, domain := range benchDomains {
+			if strings.Contains(url, domain) {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkKeywords(b *testing.B) {
+	k := NewKeywords(benchDomains)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k.Contains(benchURLs[i%len(benchURLs)])
+	}
+}
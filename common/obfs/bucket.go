@@ -0,0 +1,55 @@
+package obfs
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+var buckets = []int{128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+
+//bucketObfuscator pad every record to one of the fixed bucket sizes,
+//record is [1 byte mask][1 byte masked bucket index][record body]
+type bucketObfuscator struct {
+	jitter
+	maxPadding int
+}
+
+func (b *bucketObfuscator) Encode(dst *bytes.Buffer, p []byte) {
+	maxData := buckets[len(buckets)-1] - 2 - bodyHeaderLen
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxData {
+			n = maxData
+		}
+		need := 2 + bodyHeaderLen + n + randPadding(b.maxPadding)
+		idx := 0
+		for idx < len(buckets)-1 && buckets[idx] < need {
+			idx++
+		}
+		var header [2]byte
+		header[0] = byte(rand.Intn(256))
+		header[1] = byte(idx) ^ header[0]
+		dst.Write(header[:])
+		writeRecordBody(dst, p[:n], buckets[idx]-2-bodyHeaderLen-n)
+		p = p[n:]
+	}
+}
+
+func (b *bucketObfuscator) Decode(src *bytes.Buffer, dst *bytes.Buffer) error {
+	for src.Len() >= 2 {
+		header := src.Bytes()[0:2]
+		idx := int(header[1] ^ header[0])
+		if idx >= len(buckets) {
+			return ErrInvalidRecord
+		}
+		size := buckets[idx]
+		if src.Len() < size {
+			break
+		}
+		src.Next(2)
+		if err := readRecordBody(src.Next(size-2), dst); nil != err {
+			return err
+		}
+	}
+	return nil
+}
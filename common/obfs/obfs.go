@@ -0,0 +1,95 @@
+package obfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRecord = errors.New("Invalid obfuscation record")
+
+type Config struct {
+	//tls/bucket, empty or 'none' to disable
+	Method string
+	//max random padding bytes per record
+	MaxPadding int
+	//max random delay in milliseconds before each write
+	Jitter int
+}
+
+//Enabled return false if method is empty or 'none'
+func (conf *Config) Enabled() bool {
+	return len(conf.Method) > 0 && !strings.EqualFold(conf.Method, "none")
+}
+
+//Obfuscator wrap encrypted event frames into records which hide the frame length structure
+type Obfuscator interface {
+	//Encode write p as one or more records into dst
+	Encode(dst *bytes.Buffer, p []byte)
+	//Decode move data of complete records from src into dst, incomplete record left in src
+	Decode(src *bytes.Buffer, dst *bytes.Buffer) error
+	//Jitter return the delay before next write
+	Jitter() time.Duration
+}
+
+//New return nil if obfuscation is disabled
+func New(conf *Config) (Obfuscator, error) {
+	switch strings.ToLower(conf.Method) {
+	case "", "none":
+		return nil, nil
+	case "tls":
+		return &tlsObfuscator{jitter: jitter(conf.Jitter), maxPadding: conf.MaxPadding}, nil
+	case "bucket":
+		return &bucketObfuscator{jitter: jitter(conf.Jitter), maxPadding: conf.MaxPadding}, nil
+	}
+	return nil, fmt.Errorf("Unsupported obfuscation method:%s", conf.Method)
+}
+
+type jitter int
+
+func (j jitter) Jitter() time.Duration {
+	if j <= 0 {
+		return 0
+	}
+	return time.Duration(mrand.Intn(int(j)+1)) * time.Millisecond
+}
+
+func randPadding(max int) int {
+	if max <= 0 {
+		return 0
+	}
+	return mrand.Intn(max + 1)
+}
+
+//record body is [4 bytes mask][4 bytes masked data length][data][padding]
+const bodyHeaderLen = 8
+
+func writeRecordBody(dst *bytes.Buffer, data []byte, padding int) {
+	var header [bodyHeaderLen]byte
+	rand.Read(header[0:4])
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data))^binary.BigEndian.Uint32(header[0:4]))
+	dst.Write(header[:])
+	dst.Write(data)
+	if padding > 0 {
+		pad := make([]byte, padding)
+		rand.Read(pad)
+		dst.Write(pad)
+	}
+}
+
+func readRecordBody(body []byte, dst *bytes.Buffer) error {
+	if len(body) < bodyHeaderLen {
+		return ErrInvalidRecord
+	}
+	dlen := binary.BigEndian.Uint32(body[4:8]) ^ binary.BigEndian.Uint32(body[0:4])
+	if dlen > uint32(len(body)-bodyHeaderLen) {
+		return ErrInvalidRecord
+	}
+	dst.Write(body[bodyHeaderLen : bodyHeaderLen+dlen])
+	return nil
+}
@@ -0,0 +1,46 @@
+package obfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestObfuscator(t *testing.T) {
+	for _, method := range []string{"tls", "bucket"} {
+		o, err := New(&Config{Method: method, MaxPadding: 64})
+		if nil != err {
+			t.Fatal(err)
+		}
+		var data, records bytes.Buffer
+		for _, size := range []int{1, 100, 1500, 20000, 70000} {
+			p := make([]byte, size)
+			rand.Read(p)
+			data.Write(p)
+			o.Encode(&records, p)
+		}
+		if method == "bucket" && records.Len()%128 != 0 {
+			t.Fatalf("Invalid bucket records length:%d", records.Len())
+		}
+		//feed records in random sized chunks
+		var src, dst bytes.Buffer
+		raw := records.Bytes()
+		for len(raw) > 0 {
+			n := rand.Intn(3000) + 1
+			if n > len(raw) {
+				n = len(raw)
+			}
+			src.Write(raw[:n])
+			raw = raw[n:]
+			if err = o.Decode(&src, &dst); nil != err {
+				t.Fatalf("%s decode failed:%v", method, err)
+			}
+		}
+		if src.Len() != 0 || !bytes.Equal(dst.Bytes(), data.Bytes()) {
+			t.Fatalf("%s decoded data mismatch", method)
+		}
+	}
+	if o, _ := New(&Config{Method: "tls"}); nil == o.Decode(bytes.NewBufferString("\x16\x03\x01\x00\x10"), &bytes.Buffer{}) {
+		t.Fatalf("Invalid record not detected")
+	}
+}
@@ -0,0 +1,63 @@
+package obfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+)
+
+const (
+	tlsRecordHeaderLen = 5
+	tlsMaxRecordLen    = 16384 + 256
+	tlsApplicationData = 0x17
+)
+
+//tlsObfuscator mimic TLS1.2 application data records with random record sizes
+type tlsObfuscator struct {
+	jitter
+	maxPadding int
+}
+
+func (t *tlsObfuscator) Encode(dst *bytes.Buffer, p []byte) {
+	for len(p) > 0 {
+		padding := randPadding(t.maxPadding)
+		if padding > tlsMaxRecordLen/2 {
+			padding = tlsMaxRecordLen / 2
+		}
+		n := len(p)
+		limit := tlsMaxRecordLen - bodyHeaderLen - padding
+		//split large data into random sized records like most TLS stacks do
+		if n > 1024 {
+			if n > limit {
+				n = limit
+			}
+			n = 1024 + rand.Intn(n-1024+1)
+		}
+		header := []byte{tlsApplicationData, 0x03, 0x03, 0, 0}
+		binary.BigEndian.PutUint16(header[3:], uint16(bodyHeaderLen+n+padding))
+		dst.Write(header)
+		writeRecordBody(dst, p[:n], padding)
+		p = p[n:]
+	}
+}
+
+func (t *tlsObfuscator) Decode(src *bytes.Buffer, dst *bytes.Buffer) error {
+	for src.Len() >= tlsRecordHeaderLen {
+		header := src.Bytes()[0:tlsRecordHeaderLen]
+		if header[0] != tlsApplicationData || header[1] != 0x03 || header[2] != 0x03 {
+			return ErrInvalidRecord
+		}
+		rlen := int(binary.BigEndian.Uint16(header[3:]))
+		if rlen > tlsMaxRecordLen {
+			return ErrInvalidRecord
+		}
+		if src.Len() < tlsRecordHeaderLen+rlen {
+			break
+		}
+		src.Next(tlsRecordHeaderLen)
+		if err := readRecordBody(src.Next(rlen), dst); nil != err {
+			return err
+		}
+	}
+	return nil
+}
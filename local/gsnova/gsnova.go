@@ -1,6 +1,8 @@
 package gsnova
 
 import (
+	"net/url"
+
 	"github.com/getlantern/netx"
 	_ "github.com/yinqiwen/gsnova/local/handler/direct"
 	_ "github.com/yinqiwen/gsnova/local/handler/gae"
@@ -28,6 +30,16 @@ func StopLocalProxy() error {
 	return proxy.Stop()
 }
 
+//CheckConfig validate config files under dir, return all errors found
+func CheckConfig(dir string) []error {
+	return proxy.CheckConfig(dir)
+}
+
+//QueryRoute query the routing decision of url or host from running gsnova instance
+func QueryRoute(dir string, admin string, params url.Values) (string, error) {
+	return proxy.QueryRoute(dir, admin, params)
+}
+
 //SyncConfig sync config files from running gsnova instance
 func SyncConfig(addr string, localDir string) error {
 	return proxy.SyncConfig(addr, localDir)
@@ -0,0 +1,6 @@
+package gsnova
+
+import (
+	//TUN device is only supported on linux
+	_ "github.com/yinqiwen/gsnova/local/tun"
+)
@@ -15,6 +15,10 @@ type GAEProxy struct {
 	conf proxy.ProxyChannelConfig
 }
 
+func (p *GAEProxy) ActiveSessionNum() int32 {
+	return p.cs.ActiveSessionNum()
+}
+
 func (p *GAEProxy) Config() *proxy.ProxyChannelConfig {
 	return &p.conf
 }
@@ -25,14 +29,18 @@ func (p *GAEProxy) PrintStat(w io.Writer) {
 func (p *GAEProxy) Init(conf proxy.ProxyChannelConfig) error {
 	p.conf = conf
 	p.cs = proxy.NewRemoteChannelTable()
+	if err := p.cs.SetPolicy(conf.Balance); nil != err {
+		return err
+	}
 	hc := initGAEClient(conf)
-	for _, server := range conf.ServerList {
+	for j, server := range conf.ServerList {
 		channel, err := newHTTPChannel(server, hc, conf)
 		if nil != err {
 			log.Printf("[ERROR]Failed to connect %s for reason:%v", server, err)
 			continue
 		}
 		if nil != channel {
+			channel.Weight = conf.GetServerWeight(j)
 			p.cs.Add(channel)
 		}
 	}
@@ -51,7 +59,7 @@ func (p *GAEProxy) Features() proxy.Feature {
 
 func (p *GAEProxy) Serve(session *proxy.ProxySession, ev event.Event) error {
 	if nil == session.Remote {
-		session.SetRemoteChannel(p.cs.Select())
+		session.SetRemoteChannel(p.cs.Select(proxy.EventHost(ev)))
 		//session.Remote = p.cs.Select()
 		if session.Remote == nil {
 			session.Close()
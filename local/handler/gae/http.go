@@ -141,8 +141,8 @@ func (h *httpChannel) Request(p []byte) ([]byte, error) {
 	req.Close = false
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Content-Type", "image/jpeg")
-	if len(proxy.GConf.UserAgent) > 0 {
-		req.Header.Set("User-Agent", proxy.GConf.UserAgent)
+	if len(proxy.GetConf().UserAgent) > 0 {
+		req.Header.Set("User-Agent", proxy.GetConf().UserAgent)
 	}
 	response, err := h.gaeHttpClient.Do(req)
 	if nil != err {
@@ -179,6 +179,9 @@ func newHTTPChannel(server string, hc *http.Client, conf proxy.ProxyChannelConfi
 		WriteJoinAuth:   true,
 		SecureTransport: true,
 	}
+	if conf.Obfs.Enabled() {
+		log.Printf("[WARN]Obfuscation is not supported by GAE channel:%s, ignore it.", server)
+	}
 	tc := new(httpChannel)
 	tc.server = server
 	tc.conf = conf
@@ -134,6 +134,7 @@ func (hc *httpChannel) pull() error {
 	readAuth := proxy.NewAuthEvent(hc.pullurl.Scheme == "https")
 	readAuth.Index = int64(hc.idx)
 	readAuth.IV = hc.cryptoCtx.EncryptIV
+	readAuth.EncryptMethod = hc.cryptoCtx.Method
 	var buf bytes.Buffer
 	event.EncryptEvent(&buf, readAuth, &hc.cryptoCtx)
 	hc.pulling = true
@@ -175,8 +176,8 @@ func buildHTTPReq(u *url.URL, body io.ReadCloser) *http.Request {
 	req.Close = false
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Content-Type", "image/jpeg")
-	if len(proxy.GConf.UserAgent) > 0 {
-		req.Header.Set("User-Agent", proxy.GConf.UserAgent)
+	if len(proxy.GetConf().UserAgent) > 0 {
+		req.Header.Set("User-Agent", proxy.GetConf().UserAgent)
 	}
 	return req
 }
@@ -218,6 +219,7 @@ func (hc *httpChannel) chunkPush() {
 		wAuth := proxy.NewAuthEvent(u.Scheme == "https")
 		wAuth.Index = int64(hc.idx)
 		wAuth.IV = hc.cryptoCtx.EncryptIV
+		wAuth.EncryptMethod = hc.cryptoCtx.Method
 		var buf bytes.Buffer
 		event.EncryptEvent(&buf, wAuth, &hc.cryptoCtx)
 		hc.chunkChan.prepend(buf.Bytes())
@@ -279,6 +281,9 @@ func newHTTPChannel(addr string, idx int, paasClient *http.Client, conf proxy.Pr
 		WriteJoinAuth:   !conf.HTTPChunkPushEnable,
 		SecureTransport: strings.HasPrefix(addr, "https://"),
 	}
+	if conf.Obfs.Enabled() && idx == 0 {
+		log.Printf("[WARN]Obfuscation is not supported by HTTP channel:%s, ignore it.", addr)
+	}
 
 	tc := new(httpChannel)
 	tc.conf = conf
@@ -23,6 +23,10 @@ func (p *PaasProxy) PrintStat(w io.Writer) {
 	p.cs.PrintStat(w)
 }
 
+func (p *PaasProxy) ActiveSessionNum() int32 {
+	return p.cs.ActiveSessionNum()
+}
+
 func (p *PaasProxy) Config() *proxy.ProxyChannelConfig {
 	return &p.conf
 }
@@ -46,11 +50,14 @@ func (p *PaasProxy) Destory() error {
 func (p *PaasProxy) Init(conf proxy.ProxyChannelConfig) error {
 	p.conf = conf
 	p.cs = proxy.NewRemoteChannelTable()
+	if err := p.cs.SetPolicy(conf.Balance); nil != err {
+		return err
+	}
 	paasHttpClient, err := proxy.NewHTTPClient(&p.conf)
 	if nil != err {
 		return err
 	}
-	for _, server := range conf.ServerList {
+	for j, server := range conf.ServerList {
 		for i := 0; i < conf.ConnsPerServer; i++ {
 			var channel *proxy.RemoteChannel
 			var err error
@@ -69,6 +76,7 @@ func (p *PaasProxy) Init(conf proxy.ProxyChannelConfig) error {
 				continue
 			}
 			if nil != channel {
+				channel.Weight = conf.GetServerWeight(j)
 				p.cs.Add(channel)
 			}
 		}
@@ -84,7 +92,7 @@ func (p *PaasProxy) Features() proxy.Feature {
 
 func (p *PaasProxy) Serve(session *proxy.ProxySession, ev event.Event) error {
 	if nil == session.Remote {
-		session.SetRemoteChannel(p.cs.Select())
+		session.SetRemoteChannel(p.cs.Select(proxy.EventHost(ev)))
 		//session.Remote = p.cs.Select()
 		if session.Remote == nil {
 			session.Close()
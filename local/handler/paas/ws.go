@@ -13,6 +13,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/yinqiwen/gsnova/common/event"
+	"github.com/yinqiwen/gsnova/common/obfs"
 	"github.com/yinqiwen/gsnova/local/proxy"
 )
 
@@ -143,13 +144,18 @@ func newWebsocketChannel(addr string, idx int, conf proxy.ProxyChannelConfig, di
 		HeartBeatPeriod:     conf.HeartBeatPeriod,
 		SecureTransport:     strings.HasPrefix(addr, "wss://"),
 	}
+	var err error
+	rc.Obfs, err = obfs.New(&conf.Obfs)
+	if nil != err {
+		return nil, err
+	}
 	tc := new(websocketChannel)
 	tc.url = addr
 	rc.C = tc
 	tc.conf = conf
 	tc.dial = dial
 
-	err := rc.Init(idx == 0)
+	err = rc.Init(idx == 0)
 	if nil != err {
 		return nil, err
 	}
@@ -13,6 +13,7 @@ import (
 	"github.com/getlantern/netx"
 	"github.com/yinqiwen/gsnova/common/event"
 	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/obfs"
 	"github.com/yinqiwen/gsnova/local/hosts"
 	"github.com/yinqiwen/gsnova/local/proxy"
 )
@@ -147,6 +148,10 @@ func newTCPChannel(addr string, idx int, conf proxy.ProxyChannelConfig) (*proxy.
 		SecureTransport:     strings.HasPrefix(addr, "tls://"),
 	}
 	var err error
+	rc.Obfs, err = obfs.New(&conf.Obfs)
+	if nil != err {
+		return nil, err
+	}
 	tc := new(tcpChannel)
 	tc.originAddr = addr
 	tc.rurl, err = url.Parse(addr)
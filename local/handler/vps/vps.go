@@ -20,6 +20,10 @@ func (p *VPSProxy) PrintStat(w io.Writer) {
 	p.cs.PrintStat(w)
 }
 
+func (p *VPSProxy) ActiveSessionNum() int32 {
+	return p.cs.ActiveSessionNum()
+}
+
 func (p *VPSProxy) Config() *proxy.ProxyChannelConfig {
 	return &p.conf
 }
@@ -33,13 +37,17 @@ func (p *VPSProxy) Destory() error {
 
 func (p *VPSProxy) Init(conf proxy.ProxyChannelConfig) error {
 	p.cs = proxy.NewRemoteChannelTable()
-	for _, server := range conf.ServerList {
+	if err := p.cs.SetPolicy(conf.Balance); nil != err {
+		return err
+	}
+	for j, server := range conf.ServerList {
 		for i := 0; i < conf.ConnsPerServer; i++ {
 			if !strings.Contains(server, "://") {
 				server = "tcp://" + server
 			}
 			channel, err := newTCPChannel(server, i, conf)
 			if nil != channel {
+				channel.Weight = conf.GetServerWeight(j)
 				p.cs.Add(channel)
 			} else {
 				log.Printf("Failed to init proxy channel for %s:%d with reason:%v", server, i, err)
@@ -61,7 +69,7 @@ func (p *VPSProxy) Features() proxy.Feature {
 
 func (p *VPSProxy) Serve(session *proxy.ProxySession, ev event.Event) error {
 	if nil == session.Remote {
-		session.SetRemoteChannel(p.cs.Select())
+		session.SetRemoteChannel(p.cs.Select(proxy.EventHost(ev)))
 		//session.Remote = p.cs.Select()
 		if session.Remote == nil {
 			session.Close()
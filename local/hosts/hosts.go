@@ -3,20 +3,20 @@ package hosts
 import (
 	"encoding/json"
 	"net"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/matcher"
 )
 
 const SNIProxy = "sni_proxy"
 
 type hostMapping struct {
-	host      string
-	hostRegex *regexp.Regexp
-	mapping   []string
-	cursor    int
+	host    string
+	mapping []string
+	cursor  int
 }
 
 func (h *hostMapping) Get() string {
@@ -30,6 +30,10 @@ func (h *hostMapping) Get() string {
 }
 
 var hostMappingTable = make(map[string]*hostMapping)
+
+//mappings of wildcard hosts like '*.google.com', indexed by compiled patterns
+var wildcardMappings []*hostMapping
+var wildcardPatterns = matcher.NewPatterns(nil)
 var mappingMutex sync.Mutex
 
 func getHost(host string) (string, bool) {
@@ -43,19 +47,16 @@ func getHost(host string) (string, bool) {
 		}
 		return s, ok
 	}
-	for _, m := range hostMappingTable {
-		if nil != m.hostRegex {
-			if m.hostRegex.MatchString(host) {
-				s := m.Get()
-				if !strings.Contains(s, ".") { //alials name
-					s, ok = getHost(s)
-				} else {
-					hostMappingTable[host] = m
-					ok = true
-				}
-				return s, ok
-			}
+	if i := wildcardPatterns.Find(strings.ToLower(host)); i >= 0 {
+		m := wildcardMappings[i]
+		s := m.Get()
+		if !strings.Contains(s, ".") { //alials name
+			s, ok = getHost(s)
+		} else {
+			hostMappingTable[host] = m
+			ok = true
 		}
+		return s, ok
 	}
 	return host, false
 }
@@ -100,6 +101,24 @@ func Clear() {
 	mappingMutex.Lock()
 	defer mappingMutex.Unlock()
 	hostMappingTable = make(map[string]*hostMapping)
+	wildcardMappings = nil
+	wildcardPatterns = matcher.NewPatterns(nil)
+}
+
+//moreSpecific compare wildcard hosts by literal suffix after the last '*', then labels & literal chars,
+//e.g. '*.a.b.com' before '*.b.com', and 'a*.b.com' before '*.b.com'
+func moreSpecific(a, b string) bool {
+	sa, sb := a[strings.LastIndex(a, "*")+1:], b[strings.LastIndex(b, "*")+1:]
+	if len(sa) != len(sb) {
+		return len(sa) > len(sb)
+	}
+	if la, lb := strings.Count(a, "."), strings.Count(b, "."); la != lb {
+		return la > lb
+	}
+	if la, lb := len(a)-strings.Count(a, "*"), len(b)-strings.Count(b, "*"); la != lb {
+		return la > lb
+	}
+	return a < b
 }
 
 func Init(confile string) error {
@@ -113,17 +132,34 @@ func Init(confile string) error {
 		//fmt.Printf("Failed to load hosts config:%s for reason:%v", file, err)
 		return err
 	}
+	//build a new table & swap, so that hosts could be reloaded
+	table := make(map[string]*hostMapping)
+	var wildcards []string
 	for k, vs := range hs {
 		if len(vs) > 0 {
 			mapping := new(hostMapping)
 			mapping.host = k
 			mapping.mapping = vs
 			if strings.Contains(k, "*") {
-				rule := strings.Replace(k, "*", ".*", -1)
-				mapping.hostRegex, _ = regexp.Compile(rule)
+				wildcards = append(wildcards, k)
 			}
-			hostMappingTable[k] = mapping
+			table[k] = mapping
 		}
 	}
+	//wildcard hosts are matched in order, more specific one first
+	sort.Slice(wildcards, func(i, j int) bool {
+		return moreSpecific(wildcards[i], wildcards[j])
+	})
+	var mappings []*hostMapping
+	for i, k := range wildcards {
+		wildcards[i] = strings.ToLower(k)
+		mappings = append(mappings, table[k])
+	}
+	patterns := matcher.NewPatterns(wildcards)
+	mappingMutex.Lock()
+	hostMappingTable = table
+	wildcardMappings = mappings
+	wildcardPatterns = patterns
+	mappingMutex.Unlock()
 	return nil
 }
@@ -0,0 +1,32 @@
+package hosts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWildcardHosts(t *testing.T) {
+	home, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(home)
+	hostsFile := filepath.Join(home, "hosts.json")
+	ioutil.WriteFile(hostsFile, []byte(`{"*.b.com":["10.0.0.1"], "*.a.b.com":["10.0.0.2"], "x*.b.com":["10.0.0.3"], "*com":["10.0.0.4"]}`), 0666)
+	if err := Init(hostsFile); nil != err {
+		t.Fatalf("%v", err)
+	}
+	defer Clear()
+	cases := map[string]string{
+		"www.a.b.com": "10.0.0.2",
+		"www.b.com":   "10.0.0.1",
+		"x1.b.com":    "10.0.0.3",
+		"x.a.b.com":   "10.0.0.2",
+		"a.com":       "10.0.0.4",
+		"a.net":       "a.net",
+	}
+	for host, expected := range cases {
+		if addr := GetHost(host); addr != expected {
+			t.Errorf("Expected %s for %s, but got %s", expected, host, addr)
+		}
+	}
+}
@@ -6,8 +6,10 @@ import (
 
 	//"log"
 	//"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	//"time"
 
 	"github.com/yinqiwen/gsnova/local/gsnova"
@@ -21,8 +23,42 @@ func main() {
 	}
 	home, _ := filepath.Split(path)
 	dir := flag.String("dir", home, "Specify running dir for gsnova")
+	check := flag.Bool("check", false, "Validate config files under running dir & exit")
+	route := flag.String("route", "", "Print the routing decision of URL or host by running gsnova instance & exit")
+	proto := flag.String("proto", "", "Protocol of '-route', e.g. http/https/tcp/udp/dns")
+	ip := flag.String("ip", "", "Destination IP of '-route' used by IP rules instead of resolving")
+	local := flag.String("local", "", "Listener of '-route', the first listener by default")
+	admin := flag.String("admin", "", "Admin server address of '-route', 'Admin.Listen' of config by default")
 	flag.Parse()
 
+	if len(*route) > 0 {
+		params := url.Values{"proto": {*proto}, "ip": {*ip}, "local": {*local}}
+		if strings.Contains(*route, "://") {
+			params.Set("url", *route)
+		} else {
+			params.Set("host", *route)
+		}
+		res, err := gsnova.QueryRoute(*dir, *admin, params)
+		if nil != err {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(res)
+		return
+	}
+
+	if *check {
+		errs := gsnova.CheckConfig(*dir)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Config OK")
+		return
+	}
+
 	err = gsnova.StartLocalProxy(*dir, nil)
 	if nil != err {
 		fmt.Printf("Start gsnova error:%v", err)
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/yinqiwen/gsnova/local/socks"
+)
+
+//initACL parse 'AllowCIDR' & 'Users', invalid items are ignored
+func (cfg *ProxyConfig) initACL() {
+	cfg.allowNets = nil
+	for _, cidr := range cfg.AllowCIDR {
+		ipnet, err := parseCIDR(cidr)
+		if nil != err {
+			log.Printf("[ERROR]Invalid CIDR:%s for %s", cidr, cfg.Local)
+			continue
+		}
+		cfg.allowNets = append(cfg.allowNets, ipnet)
+	}
+	cfg.users = nil
+	for _, u := range cfg.Users {
+		idx := strings.Index(u, ":")
+		if idx <= 0 {
+			log.Printf("[ERROR]Invalid user:%s for %s, expected 'name:password'", u, cfg.Local)
+			continue
+		}
+		if nil == cfg.users {
+			cfg.users = make(map[string]string)
+		}
+		cfg.users[u[0:idx]] = u[idx+1:]
+	}
+}
+
+//allowClient check the client address by 'AllowCIDR'
+func (cfg *ProxyConfig) allowClient(addr net.Addr) bool {
+	if len(cfg.AllowCIDR) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return false
+	}
+	for _, ipnet := range cfg.allowNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *ProxyConfig) authRequired() bool {
+	return len(cfg.Users) > 0
+}
+
+func (cfg *ProxyConfig) verifyUser(user, passwd string) bool {
+	expected, exist := cfg.users[user]
+	if !exist {
+		log.Printf("[ERROR]Invalid user:%s for %s", user, cfg.Local)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(passwd)) != 1 {
+		log.Printf("[ERROR]Invalid password for user:%s on %s", user, cfg.Local)
+		return false
+	}
+	return true
+}
+
+//socksAuthenticator return nil if no user configured
+func (cfg *ProxyConfig) socksAuthenticator() socks.Authenticator {
+	if !cfg.authRequired() {
+		return nil
+	}
+	return cfg.verifyUser
+}
+
+//verifyHTTPUser verify 'Proxy-Authorization: Basic' header, return the user name if success
+func (cfg *ProxyConfig) verifyHTTPUser(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[6:]))
+	if nil != err {
+		return "", false
+	}
+	cred := string(data)
+	idx := strings.Index(cred, ":")
+	if idx < 0 {
+		return "", false
+	}
+	user := cred[0:idx]
+	return user, cfg.verifyUser(user, cred[idx+1:])
+}
+
+const proxyAuthRequiredResponse = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"gsnova\"\r\nContent-Length: 0\r\n\r\n"
@@ -37,11 +37,23 @@ func statCallback(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "DNSCacheSize: %d\n", dnsCache.Len())
 	}
 	ots.Handle("stat", w)
+	proxyTableMutex.Lock()
 	for _, p := range proxyTable {
 		p.PrintStat(w)
 	}
+	proxyTableMutex.Unlock()
+	dumpLastGoodChannels(w)
 	dumpProxySessions(w)
 }
+func reloadCallback(w http.ResponseWriter, req *http.Request) {
+	if err := Reload(); nil != err {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Reload failed:%v\n", err)
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "Reload success.\n")
+}
 func stackdumpCallback(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(200)
 	ots.Handle("stackdump", w)
@@ -70,7 +82,11 @@ func startAdminServer() {
 	fs := http.FileServer(http.Dir(GConf.Admin.ConfigDir))
 	mux.Handle("/", fs)
 	mux.HandleFunc("/_conflist", getConfigList)
+	mux.HandleFunc("/proxy.pac", pacCallback)
+	mux.HandleFunc("/route", routeCallback)
 	mux.HandleFunc("/stat", statCallback)
+	mux.HandleFunc("/dns", dnsStatCallback)
+	mux.HandleFunc("/reload", reloadCallback)
 	mux.HandleFunc("/stackdump", stackdumpCallback)
 	mux.HandleFunc("/gc", gcCallback)
 	mux.HandleFunc("/memdump", memdumpCallback)
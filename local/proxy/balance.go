@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+const (
+	LeastSessionsPolicy      = "least-sessions"
+	LowestLatencyPolicy      = "lowest-latency"
+	WeightedRoundRobinPolicy = "weighted-rr"
+	ConsistentHashPolicy     = "consistent-hash"
+)
+
+//SelectPolicy select a channel from healthy channels for the session to host
+type SelectPolicy interface {
+	Select(cs []*RemoteChannel, host string) *RemoteChannel
+}
+
+func NewSelectPolicy(name string) (SelectPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", LeastSessionsPolicy:
+		return &leastSessions{}, nil
+	case LowestLatencyPolicy:
+		return &lowestLatency{}, nil
+	case WeightedRoundRobinPolicy:
+		return &weightedRoundRobin{current: make(map[*RemoteChannel]int)}, nil
+	case ConsistentHashPolicy:
+		return &consistentHash{}, nil
+	}
+	return nil, fmt.Errorf("Invalid channel balance policy:%s", name)
+}
+
+//EventHost return the target host of the event for consistent hash
+func EventHost(ev event.Event) string {
+	host := ""
+	switch ev.(type) {
+	case *event.TCPOpenEvent:
+		host = ev.(*event.TCPOpenEvent).Addr
+	case *event.UDPEvent:
+		host = ev.(*event.UDPEvent).Addr
+	case *event.HTTPRequestEvent:
+		host = ev.(*event.HTTPRequestEvent).Headers.Get("Host")
+	}
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	return host
+}
+
+type leastSessions struct{}
+
+func (p *leastSessions) Select(cs []*RemoteChannel, host string) *RemoteChannel {
+	var selected *RemoteChannel
+	for _, r := range cs {
+		if nil == selected || r.GetActiveSessionNum() < selected.GetActiveSessionNum() {
+			selected = r
+		}
+	}
+	return selected
+}
+
+//lowestLatency select the channel with least sessions among channels close to the lowest RTT,
+//channels not measured yet are used only if no RTT available.
+type lowestLatency struct{}
+
+func (p *lowestLatency) Select(cs []*RemoteChannel, host string) *RemoteChannel {
+	var minRTT time.Duration
+	for _, r := range cs {
+		if rtt := r.RTT(); rtt > 0 && (0 == minRTT || rtt < minRTT) {
+			minRTT = rtt
+		}
+	}
+	if 0 == minRTT {
+		return (&leastSessions{}).Select(cs, host)
+	}
+	tolerance := minRTT / 10
+	if tolerance < 5*time.Millisecond {
+		tolerance = 5 * time.Millisecond
+	}
+	var candidates []*RemoteChannel
+	for _, r := range cs {
+		if rtt := r.RTT(); rtt > 0 && rtt <= minRTT+tolerance {
+			candidates = append(candidates, r)
+		}
+	}
+	return (&leastSessions{}).Select(candidates, host)
+}
+
+//weightedRoundRobin is the smooth weighted round robin used by nginx
+type weightedRoundRobin struct {
+	current map[*RemoteChannel]int
+}
+
+func (p *weightedRoundRobin) Select(cs []*RemoteChannel, host string) *RemoteChannel {
+	var selected *RemoteChannel
+	total := 0
+	for _, r := range cs {
+		weight := r.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		p.current[r] += weight
+		if nil == selected || p.current[r] > p.current[selected] {
+			selected = r
+		}
+	}
+	if nil != selected {
+		p.current[selected] -= total
+	}
+	return selected
+}
+
+const consistentHashReplicas = 64
+
+type hashNode struct {
+	hash    uint32
+	channel *RemoteChannel
+}
+
+//consistentHash keep sessions of same host on same channel,
+//only hosts on ejected channels are moved to others.
+type consistentHash struct {
+	members []*RemoteChannel
+	ring    []hashNode
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (p *consistentHash) rebuild(cs []*RemoteChannel) {
+	p.members = append(p.members[:0], cs...)
+	p.ring = p.ring[:0]
+	for _, r := range cs {
+		for i := 0; i < consistentHashReplicas; i++ {
+			p.ring = append(p.ring, hashNode{hashString(fmt.Sprintf("%s#%d#%d", r.Addr, r.Index, i)), r})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+}
+
+func (p *consistentHash) Select(cs []*RemoteChannel, host string) *RemoteChannel {
+	if len(cs) == 0 {
+		return nil
+	}
+	if len(host) == 0 {
+		return (&leastSessions{}).Select(cs, host)
+	}
+	changed := len(cs) != len(p.members)
+	for i := 0; !changed && i < len(cs); i++ {
+		changed = cs[i] != p.members[i]
+	}
+	if changed {
+		p.rebuild(cs)
+	}
+	h := hashString(host)
+	idx := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	if idx == len(p.ring) {
+		idx = 0
+	}
+	return p.ring[idx].channel
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestSelectPolicy(t *testing.T) {
+	a := &RemoteChannel{Addr: "a", Weight: 3, running: 1}
+	b := &RemoteChannel{Addr: "b", Weight: 1, running: 1}
+	cs := []*RemoteChannel{a, b}
+
+	wrr, _ := NewSelectPolicy(WeightedRoundRobinPolicy)
+	count := make(map[*RemoteChannel]int)
+	for i := 0; i < 8; i++ {
+		count[wrr.Select(cs, "")]++
+	}
+	if count[a] != 6 || count[b] != 2 {
+		t.Fatalf("Invalid weighted round robin result:%d %d", count[a], count[b])
+	}
+
+	ch, _ := NewSelectPolicy(ConsistentHashPolicy)
+	selected := ch.Select(cs, "www.google.com")
+	for i := 0; i < 10; i++ {
+		if ch.Select(cs, "www.google.com") != selected {
+			t.Fatalf("Consistent hash select different channel for same host")
+		}
+	}
+	other := a
+	if selected == a {
+		other = b
+	}
+	if ch.Select([]*RemoteChannel{other}, "www.google.com") != other {
+		t.Fatalf("Consistent hash should select remaining channel")
+	}
+
+	table := NewRemoteChannelTable()
+	table.Add(a)
+	table.Add(b)
+	a.health.eject(a, "test")
+	if table.Select("") != b {
+		t.Fatalf("Ejected channel should not be selected")
+	}
+	a.onProbeEcho(a.newProbe().GetId())
+	if !a.Healthy() || a.RTT() <= 0 {
+		t.Fatalf("Channel should be restored after probe success")
+	}
+	//idle ejected channel is reconnected once per probe period to be probed
+	if a.reprobeDue() {
+		t.Fatalf("Healthy channel should not be reprobed")
+	}
+	b.health.ejected = true
+	if !b.reprobeDue() || b.reprobeDue() {
+		t.Fatalf("Ejected channel should be reprobed once per probe period")
+	}
+	if _, err := NewSelectPolicy("unknown"); nil == err {
+		t.Fatalf("Invalid policy should be rejected")
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/yinqiwen/gsnova/common/event"
 	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/obfs"
 )
 
 const (
@@ -23,6 +24,7 @@ const (
 
 var ErrChannelReadTimeout = errors.New("Remote channel read timeout")
 var ErrChannelAuthFailed = errors.New("Remote channel auth failed")
+var ErrRemoteDNSUnsupported = errors.New("Remote server does not resolve dns queries to " + event.RemoteDNSAddr)
 
 type ProxyChannel interface {
 	Write(event.Event) (event.Event, error)
@@ -49,19 +51,37 @@ type RemoteChannel struct {
 	ReconnectPeriod     int
 	RCPRandomAdjustment int
 	C                   RemoteProxyChannel
+	Obfs                obfs.Obfuscator
+	//weight used by weighted round robin policy
+	Weight int
 
 	connSendedEvents uint32
 	authResult       int
 	cryptoCtx        event.CryptoContext
+	//method & secret key of the channel, kept after the default key reloaded
+	baseCryptoCtx event.CryptoContext
 	//iv               uint64
-	wch     chan event.Event
-	running bool
+	wq *channelWriteQueue
+	//set by Init & Stop, read by io goroutines
+	running int32
+
+	//ephemeral key exchange for current connection
+	kx          *event.KeyExchange
+	kxPSK       []byte
+	handshaking int32
+	authPending bool
+
+	//peer's initial receive window per session, 0 if flow control disabled
+	peerWindow uint32
+	//1 if server resolve dns queries to event.RemoteDNSAddr, -1 if not, 0 before auth result recved
+	remoteDNS int32
 
 	connectTime       time.Time
 	nextReconnectTime time.Time
 	closeState        int
 
 	activeSessionNum int32
+	health           channelHealth
 }
 
 func (rc *RemoteChannel) updateActiveSessionNum(delta int32) {
@@ -71,35 +91,47 @@ func (rc *RemoteChannel) GetActiveSessionNum() int32 {
 	return rc.activeSessionNum
 }
 
+func (rc *RemoteChannel) isRunning() bool {
+	return atomic.LoadInt32(&rc.running) == 1
+}
+
+//isHandshaking return true if waiting server's public key, writes are disabled until the session keys negotiated
+func (rc *RemoteChannel) isHandshaking() bool {
+	return atomic.LoadInt32(&rc.handshaking) == 1
+}
+
 func (rc *RemoteChannel) authed() bool {
 	return rc.authResult != 0
 }
 
-func randCryptoCtx() event.CryptoContext {
+func randCryptoCtx(base event.CryptoContext) event.CryptoContext {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	tmp := uint64(r.Int63())
-	var ctx event.CryptoContext
+	ctx := base
 	ctx.EncryptIV = tmp
 	ctx.DecryptIV = tmp
-	ctx.Method = event.GetDefaultCryptoMethod()
 	return ctx
 }
 func (rc *RemoteChannel) resetCryptoCtx() {
-	rc.cryptoCtx = randCryptoCtx()
-	if rc.SecureTransport && strings.EqualFold(GConf.Encrypt.Method, "auto") {
+	rc.cryptoCtx = randCryptoCtx(rc.baseCryptoCtx)
+	if rc.SecureTransport && strings.EqualFold(GetConf().Encrypt.Method, "auto") {
 		rc.cryptoCtx.Method = 0
 	}
 	//log.Printf("Channel[%d] reset IV:%d.", rc.Index, rc.cryptoCtx.EncryptIV)
 }
 
 func (rc *RemoteChannel) Init(authRequired bool) error {
-	rc.running = true
+	atomic.StoreInt32(&rc.running, 1)
+	rc.baseCryptoCtx = event.NewCryptoContext()
+	if !rc.OpenJoinAuth && rc.Index == 0 && event.GetDefaultCryptoMethod() != event.NoneEncrypter {
+		log.Printf("[WARN]Channel %s does not support key exchange, traffic is encrypted by the shared 'Encrypt.Key'.", rc.Addr)
+	}
 	if !rc.DirectIO {
-		rc.wch = make(chan event.Event, 5)
+		rc.wq = newChannelWriteQueue()
 		go rc.processWrite()
 		go rc.processRead()
 	}
-	if rc.HeartBeatPeriod > 0 {
+	if !rc.DirectIO {
 		go rc.heartbeat()
 	}
 	if !authRequired {
@@ -120,6 +152,12 @@ func (rc *RemoteChannel) Init(authRequired bool) error {
 	if rc.authResult == event.ErrAuthFailed {
 		rc.Stop()
 		return fmt.Errorf("Server:%s auth failed.", rc.Addr)
+	} else if rc.authResult == event.ErrAuthExpired {
+		rc.Stop()
+		return fmt.Errorf("Server:%s auth rejected since clock skew, check local time.", rc.Addr)
+	} else if rc.authResult == event.ErrAuthReplayed {
+		rc.Stop()
+		return fmt.Errorf("Server:%s auth rejected as replayed.", rc.Addr)
 	} else if rc.authResult == event.SuccessAuthed {
 		log.Printf("Server:%s authed success.", rc.Addr)
 	} else {
@@ -135,51 +173,62 @@ func (rc *RemoteChannel) Close() {
 	}
 }
 func (rc *RemoteChannel) Stop() {
-	rc.running = false
+	atomic.StoreInt32(&rc.running, 0)
+	if nil != rc.wq {
+		rc.wq.close()
+	}
 	rc.Close()
 }
 
 func (rc *RemoteChannel) heartbeat() {
-	ticker := time.NewTicker(time.Duration(rc.HeartBeatPeriod) * time.Second)
-	for rc.running {
+	ticker := time.NewTicker(rc.probePeriod())
+	defer ticker.Stop()
+	for rc.isRunning() {
 		select {
 		case <-ticker.C:
-			if !rc.C.Closed() && (GConf.ChannelKeepAlive || getProxySessionSize() > 0) {
-				rc.Write(event.NewHeartBeatEvent())
+			//ejected channel is probed even if idle, so that it could be restored
+			if !rc.C.Closed() && !rc.isHandshaking() && (GetConf().ChannelKeepAlive || getProxySessionSize() > 0 || rc.ejected()) {
+				//heartbeat echoed by server is used to measure RTT
+				rc.Write(rc.newProbe())
 			}
 		}
 	}
 }
 
-func (rc *RemoteChannel) processWrite() {
-	readBufferEv := func(evs []event.Event) []event.Event {
-		sev := <-rc.wch
-		if nil != sev {
-			evs = append(evs, sev)
+func (rc *RemoteChannel) writeConn(conn RemoteProxyChannel, p []byte, obuf *bytes.Buffer) error {
+	if nil != rc.Obfs {
+		obuf.Reset()
+		rc.Obfs.Encode(obuf, p)
+		p = obuf.Bytes()
+		if d := rc.Obfs.Jitter(); d > 0 {
+			time.Sleep(d)
 		}
-		return evs
 	}
+	_, err := conn.Write(p)
+	return err
+}
+
+func (rc *RemoteChannel) processWrite() {
 	var sendEvents []event.Event
-	var wbuf bytes.Buffer
-	for rc.running {
+	var wbuf, obuf bytes.Buffer
+	for rc.isRunning() {
 		conn := rc.C
 		//disable write if waiting for close CK
 		if rc.closeState == stateCloseWaitingACK {
 			time.Sleep(1 * time.Millisecond)
 			continue
 		}
+		//disable write until the session keys negotiated
+		if rc.isHandshaking() && !conn.Closed() {
+			time.Sleep(1 * time.Millisecond)
+			continue
+		}
 
 		if len(sendEvents) == 0 {
-			if len(rc.wch) > 0 {
-				for len(rc.wch) > 0 {
-					sendEvents = readBufferEv(sendEvents)
-				}
-			} else {
-				sendEvents = readBufferEv(sendEvents)
-			}
+			sendEvents = rc.wq.pop(64)
 		}
 
-		if !rc.running && len(sendEvents) == 0 {
+		if !rc.isRunning() && len(sendEvents) == 0 {
 			return
 		}
 		if conn.Closed() {
@@ -192,8 +241,36 @@ func (rc *RemoteChannel) processWrite() {
 			auth := NewAuthEvent(rc.SecureTransport)
 			auth.Index = int64(rc.Index)
 			auth.IV = rc.cryptoCtx.EncryptIV
+			auth.EncryptMethod = rc.cryptoCtx.Method
+			if rc.OpenJoinAuth {
+				auth.Window = event.DefaultSessionWindow
+			}
+			if rc.OpenJoinAuth && auth.EncryptMethod != event.NoneEncrypter {
+				kx, err := event.NewKeyExchange()
+				if nil != err {
+					log.Printf("[ERROR]Failed to create key exchange:%v", err)
+				} else {
+					rc.kx = kx
+					rc.kxPSK = nil
+					if len(GetConf().AuthKey) > 0 {
+						//same secret signed the auth
+						rc.kxPSK = []byte(GetConf().AuthKey)
+					}
+					auth.PubKey = kx.PublicKey
+					atomic.StoreInt32(&rc.handshaking, 1)
+				}
+			}
 			event.EncryptEvent(&wbuf, auth, &rc.cryptoCtx)
 			rc.connSendedEvents++
+			if rc.isHandshaking() {
+				//send auth alone, rest events would be encrypted by negotiated keys
+				if err := rc.writeConn(conn, wbuf.Bytes(), &obuf); nil != err {
+					conn.Close()
+					rc.recordResult(false)
+					log.Printf("Failed to write auth messgage:%v", err)
+				}
+				continue
+			}
 		}
 
 		for _, sev := range sendEvents {
@@ -214,7 +291,8 @@ func (rc *RemoteChannel) processWrite() {
 
 		if wbuf.Len() > 0 {
 			//start := time.Now()
-			_, err := conn.Write(wbuf.Bytes())
+			err := rc.writeConn(conn, wbuf.Bytes(), &obuf)
+			rc.recordResult(nil == err)
 			if nil != err {
 				conn.Close()
 				log.Printf("Failed to write tcp messgage:%v", err)
@@ -232,13 +310,13 @@ func (rc *RemoteChannel) processWrite() {
 }
 
 func (rc *RemoteChannel) processRead() {
-	var buf bytes.Buffer
+	var buf, obuf bytes.Buffer
 	reconnectCount := 0
-	for rc.running {
+	for rc.isRunning() {
 		conn := rc.C
 		if conn.Closed() {
 			rc.closeState = 0
-			if rc.authed() && getProxySessionSize() == 0 && !GConf.ChannelKeepAlive {
+			if rc.authed() && getProxySessionSize() == 0 && !GetConf().ChannelKeepAlive && !rc.reprobeDue() {
 				time.Sleep(10 * time.Millisecond)
 				continue
 			}
@@ -250,11 +328,17 @@ func (rc *RemoteChannel) processRead() {
 			}
 			rc.resetCryptoCtx()
 			buf.Reset()
+			obuf.Reset()
+			rc.kx = nil
+			atomic.StoreInt32(&rc.handshaking, 0)
+			rc.authPending = rc.OpenJoinAuth
+			rc.resetProbe()
 			rc.connSendedEvents = 0
 			conn.SetCryptoCtx(&rc.cryptoCtx)
 			err := conn.Open()
 			reconnectCount++
 			if nil != err {
+				rc.recordResult(false)
 				log.Printf("Channel[%d] connect %s failed:%v.", rc.Index, rc.Addr, err)
 				time.Sleep(1 * time.Second)
 				continue
@@ -275,8 +359,18 @@ func (rc *RemoteChannel) processRead() {
 		reader := &helper.BufferChunkReader{conn, nil}
 		for {
 			//buf.Truncate(buf.Len())
-			buf.Grow(8192)
-			buf.ReadFrom(reader)
+			if nil != rc.Obfs {
+				obuf.Grow(8192)
+				obuf.ReadFrom(reader)
+				if err := rc.Obfs.Decode(&obuf, &buf); nil != err {
+					log.Printf("Channel[%d]Failed to decode obfuscation record:%v", rc.Index, err)
+					conn.Close()
+					break
+				}
+			} else {
+				buf.Grow(8192)
+				buf.ReadFrom(reader)
+			}
 			cerr := reader.Err
 			//n, cerr := conn.Read(data)
 			//buf.Write(data[0:n])
@@ -293,6 +387,7 @@ func (rc *RemoteChannel) processRead() {
 					if err == event.EBNR {
 						err = nil
 					} else {
+						rc.recordResult(false)
 						log.Printf("Channel[%d]Failed to decode event for reason:%v with iv:%d", rc.Index, err, rc.cryptoCtx.DecryptIV)
 						conn.Close()
 					}
@@ -300,8 +395,19 @@ func (rc *RemoteChannel) processRead() {
 				}
 				switch ev.(type) {
 				case *event.NotifyEvent:
+					auth := ev.(*event.NotifyEvent)
+					handshake := rc.isHandshaking()
+					if handshake {
+						rc.completeHandshake(auth)
+					}
+					if auth.Code == event.SuccessAuthed {
+						rc.updateRemoteDNS(auth.Flags)
+					}
+					if auth.Code == event.SuccessAuthed && (rc.authPending || !rc.authed()) {
+						rc.authPending = false
+						rc.updatePeerWindow(auth.Window)
+					}
 					if !rc.authed() {
-						auth := ev.(*event.NotifyEvent)
 						rc.authResult = int(auth.Code)
 						if rc.authResult != event.SuccessAuthed {
 							rc.Stop()
@@ -309,6 +415,17 @@ func (rc *RemoteChannel) processRead() {
 						}
 						continue
 					}
+					if handshake {
+						continue
+					}
+				case *event.HeartBeatEvent:
+					rc.onProbeEcho(ev.GetId())
+					continue
+				case *event.WindowUpdateEvent:
+					if s := getProxySession(ev.GetId()); nil != s {
+						s.releaseSendWindow(ev.(*event.WindowUpdateEvent).Delta)
+					}
+					continue
 				case *event.ChannelCloseACKEvent:
 					conn.Close()
 					log.Printf("Channel[%d] close %s after recved close ACK.", rc.Index, rc.Addr)
@@ -327,6 +444,7 @@ func (rc *RemoteChannel) processRead() {
 			}
 			if nil != cerr {
 				if cerr != io.EOF && cerr != ErrChannelReadTimeout {
+					rc.recordResult(false)
 					log.Printf("Failed to read channel for reason:%v", cerr)
 				}
 				conn.Close()
@@ -336,14 +454,54 @@ func (rc *RemoteChannel) processRead() {
 	}
 }
 
+//completeHandshake install the session keys if server replied its public key,
+//or fallback to legacy mode for old servers.
+func (rc *RemoteChannel) completeHandshake(auth *event.NotifyEvent) {
+	if auth.Code == event.SuccessAuthed && len(auth.PubKey) > 0 {
+		//server mixed the same secret only if it verified the auth mac
+		if err := rc.kx.ClientApply(&rc.cryptoCtx, auth.PubKey, auth.KeyExchangePSK(rc.kxPSK)); nil != err {
+			log.Printf("[ERROR]Channel[%d] failed to negotiate session keys:%v", rc.Index, err)
+			rc.C.Close()
+		}
+	} else if auth.Code == event.SuccessAuthed {
+		log.Printf("Channel[%d] server %s does not support key exchange, use legacy mode.", rc.Index, rc.Addr)
+	} else {
+		log.Printf("[ERROR]Channel[%d] server %s rejected auth with code:%d %s", rc.Index, rc.Addr, auth.Code, auth.Reason)
+	}
+	rc.kx = nil
+	rc.kxPSK = nil
+	atomic.StoreInt32(&rc.handshaking, 0)
+}
+
+//updatePeerWindow enable flow control if peer replied its receive window,
+//and restore send windows of sessions since window updates may lost with previous connection.
+func (rc *RemoteChannel) updatePeerWindow(window uint32) {
+	rc.peerWindow = window
+	resetSessionSendWindows(rc)
+}
+
+func (rc *RemoteChannel) updateRemoteDNS(flags uint32) {
+	if flags&event.AuthFlagRemoteDNS != 0 {
+		atomic.StoreInt32(&rc.remoteDNS, 1)
+	} else {
+		atomic.StoreInt32(&rc.remoteDNS, -1)
+	}
+}
+
+//remoteDNSUnsupported return true if server's auth result has no AuthFlagRemoteDNS
+func (rc *RemoteChannel) remoteDNSUnsupported() bool {
+	return atomic.LoadInt32(&rc.remoteDNS) < 0
+}
+
+func (rc *RemoteChannel) flowControl() bool {
+	return rc.peerWindow > 0
+}
+
 func (rc *RemoteChannel) Request(ev event.Event) (event.Event, error) {
 	var buf bytes.Buffer
 	auth := NewAuthEvent(rc.SecureTransport)
 	auth.Index = int64(rc.Index)
-	if auth.EncryptMethod == event.Chacha20Encrypter {
-		auth.EncryptMethod = event.Salsa20Encrypter
-	}
-	ctx := randCryptoCtx()
+	ctx := randCryptoCtx(rc.baseCryptoCtx)
 	ctx.Method = auth.EncryptMethod
 	auth.IV = ctx.EncryptIV
 	event.EncryptEvent(&buf, auth, &ctx)
@@ -366,8 +524,20 @@ func (rc *RemoteChannel) Write(ev event.Event) error {
 	// if nil != ev {
 	// 	rc.updateActiveSid(ev.GetId(), true)
 	// }
-	rc.wch <- ev
-	return nil
+	if udp, ok := ev.(*event.UDPEvent); ok && udp.Addr == event.RemoteDNSAddr && rc.remoteDNSUnsupported() {
+		return ErrRemoteDNSUnsupported
+	}
+	if chunk, ok := ev.(*event.TCPChunkEvent); ok && rc.flowControl() {
+		if s := getProxySession(ev.GetId()); nil != s {
+			if err := s.acquireSendWindow(rc, len(chunk.Content)); nil != err {
+				return err
+			}
+		}
+	}
+	if nil == rc.wq {
+		return errWriteQueueClosed
+	}
+	return rc.wq.push(ev)
 }
 
 func (rc *RemoteChannel) WriteRaw(p []byte) (int, error) {
@@ -377,15 +547,37 @@ func (rc *RemoteChannel) WriteRaw(p []byte) (int, error) {
 type RemoteChannelTable struct {
 	cs []*RemoteChannel
 	//cursor int
-	mutex sync.Mutex
+	mutex  sync.Mutex
+	policy SelectPolicy
 }
 
 func (p *RemoteChannelTable) PrintStat(w io.Writer) {
 	for _, c := range p.cs {
-		fmt.Fprintf(w, "Channel[%s:%d]:SessionNum=%d\n", c.Addr, c.Index, c.GetActiveSessionNum())
+		fmt.Fprintf(w, "Channel[%s:%d]:SessionNum=%d,RTT=%v,ErrorRate=%.2f,Healthy=%v\n", c.Addr, c.Index, c.GetActiveSessionNum(), c.RTT(), c.ErrorRate(), c.Healthy())
 	}
 }
 
+func (p *RemoteChannelTable) ActiveSessionNum() int32 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var n int32
+	for _, c := range p.cs {
+		n += c.GetActiveSessionNum()
+	}
+	return n
+}
+
+func (p *RemoteChannelTable) SetPolicy(name string) error {
+	policy, err := NewSelectPolicy(name)
+	if nil != err {
+		return err
+	}
+	p.mutex.Lock()
+	p.policy = policy
+	p.mutex.Unlock()
+	return nil
+}
+
 func (p *RemoteChannelTable) Add(c *RemoteChannel) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
@@ -401,38 +593,31 @@ func (p *RemoteChannelTable) StopAll() {
 	p.cs = make([]*RemoteChannel, 0)
 }
 
-func (p *RemoteChannelTable) Select() *RemoteChannel {
+//Select choose a channel by policy from healthy channels, or from all running channels if none healthy.
+func (p *RemoteChannelTable) Select(host string) *RemoteChannel {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	// if len(p.cs) == 0 {
-	// 	return nil
-	// }
-	var selected *RemoteChannel
+	var healthy, running []*RemoteChannel
 	for _, r := range p.cs {
-		if nil == selected || r.activeSessionNum < selected.activeSessionNum {
-			selected = r
+		if r.Healthy() {
+			healthy = append(healthy, r)
+		} else if r.isRunning() {
+			running = append(running, r)
 		}
 	}
-	// startCursor := p.cursor
-	// for {
-	// 	if p.cursor >= len(p.cs) {
-	// 		p.cursor = 0
-	// 	}
-	// 	c := p.cs[p.cursor]
-	// 	p.cursor++
-	// 	if nil != c {
-	// 		return c
-	// 	}
-	// 	if p.cursor == startCursor {
-	// 		break
-	// 	}
-	// }
-	return selected
+	if len(healthy) == 0 {
+		healthy = running
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	return p.policy.Select(healthy, host)
 }
 
 func NewRemoteChannelTable() *RemoteChannelTable {
 	p := new(RemoteChannelTable)
 	p.cs = make([]*RemoteChannel, 0)
+	p.policy = &leastSessions{}
 	return p
 }
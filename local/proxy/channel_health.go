@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+const (
+	defaultProbePeriod   = 10 * time.Second
+	errorRateWindow      = 30 * time.Second
+	minErrorRateSamples  = 10
+	maxErrorRate         = 0.5
+	maxProbeFailures     = 2
+	directIOEjectTimeout = 30 * time.Second
+)
+
+//channelHealth track the RTT measured by heartbeat round trips & recent error rate of a channel
+type channelHealth struct {
+	mutex sync.Mutex
+
+	rtt           time.Duration
+	probeId       uint32
+	probeTime     time.Time
+	probeFailures int
+	//old servers do not echo heartbeat, never treat probe timeout as failure for them
+	echoSupported bool
+
+	windowStart time.Time
+	errs        [2]int
+	total       [2]int
+
+	ejected   bool
+	ejectTime time.Time
+	//last reconnect to probe the idle ejected channel
+	reprobeTime time.Time
+}
+
+func (h *channelHealth) rotate(now time.Time) {
+	if now.Sub(h.windowStart) < errorRateWindow {
+		return
+	}
+	h.errs[1], h.total[1] = h.errs[0], h.total[0]
+	if now.Sub(h.windowStart) >= 2*errorRateWindow {
+		h.errs[1], h.total[1] = 0, 0
+	}
+	h.errs[0], h.total[0] = 0, 0
+	h.windowStart = now
+}
+
+func (h *channelHealth) errorRate() float64 {
+	total := h.total[0] + h.total[1]
+	if total == 0 {
+		return 0
+	}
+	return float64(h.errs[0]+h.errs[1]) / float64(total)
+}
+
+func (h *channelHealth) eject(rc *RemoteChannel, reason string) {
+	if !h.ejected {
+		h.ejected = true
+		h.ejectTime = time.Now()
+		log.Printf("[WARN]Channel[%s:%d] ejected for %s.", rc.Addr, rc.Index, reason)
+	}
+}
+
+func (h *channelHealth) restore(rc *RemoteChannel) {
+	if h.ejected {
+		h.errs = [2]int{}
+		h.total = [2]int{}
+		h.ejected = false
+		log.Printf("Channel[%s:%d] restored.", rc.Addr, rc.Index)
+	}
+}
+
+func (rc *RemoteChannel) recordResult(ok bool) {
+	h := &rc.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.rotate(time.Now())
+	h.total[0]++
+	if !ok {
+		h.errs[0]++
+	}
+	if h.total[0]+h.total[1] >= minErrorRateSamples && h.errorRate() >= maxErrorRate {
+		h.eject(rc, "high error rate")
+	}
+}
+
+func (rc *RemoteChannel) ejected() bool {
+	rc.health.mutex.Lock()
+	defer rc.health.mutex.Unlock()
+	return rc.health.ejected
+}
+
+//reprobeDue return true at most once per probe period for ejected channel,
+//idle channel's closed connection is reopened then to be probed by heartbeat.
+func (rc *RemoteChannel) reprobeDue() bool {
+	h := &rc.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.ejected || time.Now().Sub(h.reprobeTime) < rc.probePeriod() {
+		return false
+	}
+	h.reprobeTime = time.Now()
+	return true
+}
+
+func (rc *RemoteChannel) probePeriod() time.Duration {
+	if rc.HeartBeatPeriod > 0 {
+		return time.Duration(rc.HeartBeatPeriod) * time.Second
+	}
+	return defaultProbePeriod
+}
+
+//newProbe return a heartbeat event to measure RTT, and check if last probe timeout
+func (rc *RemoteChannel) newProbe() *event.HeartBeatEvent {
+	hb := event.NewHeartBeatEvent()
+	h := &rc.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.probeId != 0 && h.echoSupported && time.Now().Sub(h.probeTime) > 2*rc.probePeriod() {
+		h.probeFailures++
+		if h.probeFailures >= maxProbeFailures {
+			h.eject(rc, "heartbeat timeout")
+		}
+	}
+	h.probeId = hb.GetId()
+	h.probeTime = time.Now()
+	return hb
+}
+
+func (rc *RemoteChannel) resetProbe() {
+	h := &rc.health
+	h.mutex.Lock()
+	h.probeId = 0
+	h.mutex.Unlock()
+}
+
+//onProbeEcho update RTT & restore the channel once heartbeat echoed by server
+func (rc *RemoteChannel) onProbeEcho(id uint32) {
+	h := &rc.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if id != h.probeId || 0 == id {
+		return
+	}
+	rtt := time.Now().Sub(h.probeTime)
+	if h.rtt == 0 {
+		h.rtt = rtt
+	} else {
+		h.rtt = (7*h.rtt + rtt) / 8
+	}
+	h.probeId = 0
+	h.probeFailures = 0
+	h.echoSupported = true
+	h.restore(rc)
+}
+
+//RTT return the smoothed round trip time, 0 if not measured yet
+func (rc *RemoteChannel) RTT() time.Duration {
+	rc.health.mutex.Lock()
+	defer rc.health.mutex.Unlock()
+	return rc.health.rtt
+}
+
+func (rc *RemoteChannel) ErrorRate() float64 {
+	rc.health.mutex.Lock()
+	defer rc.health.mutex.Unlock()
+	rc.health.rotate(time.Now())
+	return rc.health.errorRate()
+}
+
+//Healthy return false if the channel stopped, failed to auth or ejected
+func (rc *RemoteChannel) Healthy() bool {
+	if !rc.isRunning() || (rc.authed() && rc.authResult != event.SuccessAuthed) {
+		return false
+	}
+	h := &rc.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	//direct io channels & old servers not echoing heartbeat could not be probed, restore them after a while
+	if h.ejected && (rc.DirectIO || !h.echoSupported) && time.Now().Sub(h.ejectTime) > directIOEjectTimeout {
+		h.restore(rc)
+	}
+	return !h.ejected
+}
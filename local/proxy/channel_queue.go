@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+//max events of one session waiting in channel write queue
+const maxSessionPendingEvents = 16
+
+var errWriteQueueClosed = errors.New("Channel write queue closed")
+
+//channelWriteQueue schedule events of sessions in round robin order,
+//so that one busy session could not starve others in the same channel.
+type channelWriteQueue struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	ctrl     []event.Event
+	sessions map[uint32][]event.Event
+	order    []uint32
+	woken    bool
+	closed   bool
+}
+
+func newChannelWriteQueue() *channelWriteQueue {
+	q := new(channelWriteQueue)
+	q.cond = sync.NewCond(&q.mutex)
+	q.sessions = make(map[uint32][]event.Event)
+	return q
+}
+
+//push a nil event just wakeup the reader, and push blocks if too many chunks of the session pending
+func (q *channelWriteQueue) push(ev event.Event) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return errWriteQueueClosed
+	}
+	switch ev.(type) {
+	case nil:
+		q.woken = true
+	case *event.HeartBeatEvent, *event.WindowUpdateEvent, *event.AuthEvent:
+		q.ctrl = append(q.ctrl, ev)
+	default:
+		sid := ev.GetId()
+		if _, isChunk := ev.(*event.TCPChunkEvent); isChunk {
+			for !q.closed && len(q.sessions[sid]) >= maxSessionPendingEvents {
+				q.cond.Wait()
+			}
+			if q.closed {
+				return errWriteQueueClosed
+			}
+		}
+		pending, exist := q.sessions[sid]
+		if !exist {
+			q.order = append(q.order, sid)
+		}
+		q.sessions[sid] = append(pending, ev)
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+//pop return control events first, then one event per session in turn,
+//it returns empty result if woken up by a nil event or queue closed.
+func (q *channelWriteQueue) pop(max int) []event.Event {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		evs := q.ctrl
+		q.ctrl = nil
+		for len(evs) < max && len(q.order) > 0 {
+			sid := q.order[0]
+			q.order = q.order[1:]
+			pending := q.sessions[sid]
+			evs = append(evs, pending[0])
+			if len(pending) == 1 {
+				delete(q.sessions, sid)
+			} else {
+				q.sessions[sid] = pending[1:]
+				q.order = append(q.order, sid)
+			}
+		}
+		if len(evs) > 0 || q.woken || q.closed {
+			q.woken = false
+			q.cond.Broadcast()
+			return evs
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *channelWriteQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+}
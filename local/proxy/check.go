@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yinqiwen/gsnova/common/event"
+	"github.com/yinqiwen/gsnova/common/gfwlist"
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/obfs"
+)
+
+var encryptMethods = []string{"", "none", "auto", "aes", "chacha20poly1305"}
+
+var pacProtocols = []string{"*", "http", "https", "socks", "tcp", "udp", "dns"}
+
+func checkHostsConfig(file string) []error {
+	hs := make(map[string][]string)
+	f, err := helper.LoadJSONFile(file, "//")
+	if nil != err {
+		return []error{err}
+	}
+	if err = f.Unmarshal(&hs); nil != err {
+		return []error{err}
+	}
+	c := &helper.ConfigChecker{File: f}
+	keys := make([]string, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vs := hs[k]
+		if len(vs) == 0 {
+			c.Errorf(k, "empty mapping")
+		}
+		if strings.Contains(k, "*") {
+			if _, err := filepath.Match(k, ""); nil != err {
+				c.Errorf(k, "invalid host pattern:%v", err)
+			}
+		}
+		for i, v := range vs {
+			//alias name without '.' must be defined in same file
+			if _, exist := hs[v]; !exist && !strings.Contains(v, ".") && !strings.Contains(v, ":") {
+				c.Errorf(fmt.Sprintf("%s[%d]", k, i), "alias:%s is not defined", v)
+			}
+		}
+	}
+	return c.Errors
+}
+
+func checkChannelServer(c *helper.ConfigChecker, path string, conf *ProxyChannelConfig, server string) {
+	switch strings.ToUpper(conf.Type) {
+	case "VPS":
+		if !strings.Contains(server, "://") {
+			server = "tcp://" + server
+		}
+		c.CheckURL(path, server, "tcp", "tls")
+	case "PAAS":
+		c.CheckURL(path, server, "http", "https", "ws", "wss")
+	case "GAE":
+		if len(server) == 0 || strings.ContainsAny(server, "/:. ") {
+			c.Errorf(path, "invalid GAE appid:%s", server)
+		}
+	}
+}
+
+func checkChannelConfig(c *helper.ConfigChecker, i int, conf *ProxyChannelConfig) {
+	path := fmt.Sprintf("Channel[%d]", i)
+	if _, exist := proxyTypeTable[strings.ToUpper(conf.Type)]; !exist {
+		c.Errorf(path+".Type", "unknown channel type:%s", conf.Type)
+	}
+	for j, server := range conf.ServerList {
+		checkChannelServer(c, fmt.Sprintf("%s.ServerList[%d]", path, j), conf, server)
+	}
+	if conf.Enable && len(conf.ServerList) == 0 {
+		switch strings.ToUpper(conf.Type) {
+		case "VPS", "PAAS", "GAE":
+			c.Errorf(path+".ServerList", "empty server list")
+		}
+	}
+	if len(conf.Proxy) > 0 {
+		c.CheckURL(path+".Proxy", conf.Proxy, "http", "https", "socks", "socks4", "socks5")
+	}
+	if _, err := NewSelectPolicy(conf.Balance); nil != err {
+		c.Errorf(path+".Balance", "%v", err)
+	}
+	if len(conf.ServerWeight) > len(conf.ServerList) {
+		c.Errorf(path+".ServerWeight", "%d weights for %d servers", len(conf.ServerWeight), len(conf.ServerList))
+	}
+	for j, w := range conf.ServerWeight {
+		if w < 0 {
+			c.Errorf(fmt.Sprintf("%s.ServerWeight[%d]", path, j), "negative weight:%d", w)
+		}
+	}
+	if _, err := obfs.New(&conf.Obfs); nil != err {
+		c.Errorf(path+".Obfs.Method", "%v", err)
+	}
+	names := []string{"ConnsPerServer", "DialTimeout", "ReadTimeout", "ReconnectPeriod", "HeartBeatPeriod", "RCPRandomAdjustment", "Obfs.MaxPadding", "Obfs.Jitter"}
+	values := []int{conf.ConnsPerServer, conf.DialTimeout, conf.ReadTimeout, conf.ReconnectPeriod, conf.HeartBeatPeriod, conf.RCPRandomAdjustment, conf.Obfs.MaxPadding, conf.Obfs.Jitter}
+	for k, v := range values {
+		if v < 0 {
+			c.Errorf(path+"."+names[k], "negative value:%d", v)
+		}
+	}
+}
+
+//checkFetchChannel check forward proxy url or proxy channel name used to fetch rules
+func checkFetchChannel(c *helper.ConfigChecker, path string, channel string, channels map[string]bool) {
+	if strings.Contains(channel, "://") {
+		c.CheckURL(path, channel, "http", "https", "socks", "socks4", "socks5")
+	} else if len(channel) > 0 && !channels[channel] {
+		c.Errorf(path, "channel:%s is not defined or not enabled", channel)
+	}
+}
+
+func checkRuleSetConfig(c *helper.ConfigChecker, home string, path string, conf *RuleSetConfig, channels map[string]bool) {
+	if !ruleSetNameRegex.MatchString(conf.Name) {
+		c.Errorf(path+".Name", "invalid rule set name:%s", conf.Name)
+	}
+	c.CheckOneOf(path+".Type", strings.ToLower(conf.Type), RuleSetTypeDomain, RuleSetTypeCIDR, RuleSetTypeURL)
+	if strings.Contains(conf.URL, "://") {
+		c.CheckURL(path+".URL", conf.URL, "http", "https")
+	} else if len(conf.URL) == 0 {
+		c.Errorf(path+".URL", "empty rule set url")
+	} else if p, err := newRuleSetProvider(*conf); nil == err {
+		if _, err = p.loadFile(configFilePath(home, conf.URL)); nil != err {
+			c.Errorf(path+".URL", "invalid rule set file:%v", err)
+		}
+	}
+	checkFetchChannel(c, path+".Channel", conf.Channel, channels)
+	if conf.Interval < 0 {
+		c.Errorf(path+".Interval", "negative value:%d", conf.Interval)
+	}
+}
+
+func checkPACConfig(c *helper.ConfigChecker, home string, path string, pac *PACConfig, channels map[string]bool, ruleSets map[string]bool) {
+	for i, rule := range pac.Rule {
+		rpath := fmt.Sprintf("%s.Rule[%d]", path, i)
+		rule = strings.TrimPrefix(rule, "!")
+		if countries, exist := ruleValue(rule, CountryRule); exist {
+			for _, country := range strings.Split(countries, ",") {
+				if len(strings.TrimSpace(country)) != 2 {
+					c.Errorf(rpath, "invalid country:%s, expected ISO 3166 two letters code", country)
+				}
+			}
+			continue
+		}
+		cidrs, exist := ruleValue(rule, IPRule)
+		if !exist {
+			cidrs, exist = ruleValue(rule, SrcIPRule)
+		}
+		if exist {
+			if _, err := parseIPNetList(cidrs, home); nil != err {
+				c.Errorf(rpath, "%v", err)
+			}
+			continue
+		}
+		if name, exist := ruleValue(rule, RuleSetRule); exist {
+			if !ruleSets[name] {
+				c.Errorf(rpath, "rule set:%s is not defined", name)
+			}
+			continue
+		}
+		if !strings.EqualFold(rule, InHostsRule) && !strings.EqualFold(rule, BlockedByGFWRule) && !strings.EqualFold(rule, IsCNIPRule) {
+			c.Errorf(rpath, "invalid rule:%s, expected one of [%s %s %s %sXX %sCIDR %sCIDR %sNAME] with optional '!' prefix", pac.Rule[i], InHostsRule, BlockedByGFWRule, IsCNIPRule, CountryRule, IPRule, SrcIPRule, RuleSetRule)
+		}
+	}
+	for i, protocol := range pac.Protocol {
+		c.CheckOneOf(fmt.Sprintf("%s.Protocol[%d]", path, i), protocol, pacProtocols...)
+	}
+	c.CheckPatterns(path+".Host", pac.Host)
+	c.CheckPatterns(path+".Method", pac.Method)
+	c.CheckPatterns(path+".URL", pac.URL)
+	c.CheckPatterns(path+".User", pac.User)
+	if len(pac.Remote) == 0 {
+		c.Errorf(path, "no remote channel")
+	}
+	for i, remote := range pac.Remote {
+		rpath := fmt.Sprintf("%s.Remote[%d]", path, i)
+		if strings.Contains(remote, "://") {
+			c.CheckURL(rpath, remote, "http", "https", "socks", "socks4", "socks5")
+		} else if !channels[remote] {
+			c.Errorf(rpath, "remote channel:%s is not defined or not enabled", remote)
+		}
+	}
+}
+
+//CheckConfig validate client.json & hosts.json under home, each error locate the invalid item by file, line & json path
+func CheckConfig(home string) []error {
+	errs := checkHostsConfig(home + "/hosts.json")
+	if len(errs) > 0 && os.IsNotExist(errs[0]) {
+		//hosts.json is optional
+		errs = nil
+	}
+	f, err := helper.LoadJSONFile(home+"/client.json", "//")
+	if nil != err {
+		return append(errs, err)
+	}
+	var conf LocalConfig
+	if err = f.Unmarshal(&conf); nil != err {
+		return append(errs, err)
+	}
+	c := &helper.ConfigChecker{File: f}
+	if event.IsLegacyEncryptMethod(conf.Encrypt.Method) {
+		c.Errorf("Encrypt.Method", "unauthenticated encrypt method:%s is removed, use chacha20poly1305 or aes instead", conf.Encrypt.Method)
+	} else {
+		c.CheckOneOf("Encrypt.Method", conf.Encrypt.Method, encryptMethods...)
+	}
+	c.CheckAddr("LocalDNS.Listen", conf.LocalDNS.Listen, true)
+	dnsServers := [][]string{conf.LocalDNS.TrustedDNS, conf.LocalDNS.FastDNS}
+	for k, name := range []string{"TrustedDNS", "FastDNS"} {
+		for i, addr := range dnsServers[k] {
+			path := fmt.Sprintf("LocalDNS.%s[%d]", name, i)
+			lower := strings.ToLower(addr)
+			if strings.HasPrefix(lower, "https://") {
+				c.CheckURL(path, addr, "https")
+				continue
+			}
+			//port is optional for dns server
+			port := "53"
+			if strings.HasPrefix(lower, "tls://") {
+				addr, port = addr[len("tls://"):], "853"
+			} else if strings.Contains(addr, "://") {
+				c.Errorf(path, "invalid dns server:%s, expected 'host[:port]', 'tls://host[:port]' or 'https://host/path'", addr)
+				continue
+			}
+			if _, _, err := net.SplitHostPort(addr); nil != err && len(addr) > 0 {
+				addr = net.JoinHostPort(addr, port)
+			}
+			c.CheckAddr(path, addr, false)
+		}
+	}
+	if conf.LocalDNS.CacheServeStale < 0 {
+		c.Errorf("LocalDNS.CacheServeStale", "negative value:%d", conf.LocalDNS.CacheServeStale)
+	}
+	if len(conf.LocalDNS.BlockMode) > 0 {
+		c.CheckOneOf("LocalDNS.BlockMode", strings.ToLower(conf.LocalDNS.BlockMode), DNSBlockModeNXDomain, DNSBlockModeZero)
+	}
+	if conf.LocalDNS.QueryLogSize < 0 {
+		c.Errorf("LocalDNS.QueryLogSize", "negative value:%d", conf.LocalDNS.QueryLogSize)
+	}
+	if fake := conf.LocalDNS.FakeIP; len(fake.CIDR) > 0 || len(fake.CIDR6) > 0 {
+		if _, err := newFakeIPPool(fake, ""); nil != err {
+			c.Errorf("LocalDNS.FakeIP", "%v", err)
+		}
+		for i, domain := range fake.Exclude {
+			if _, err := filepath.Match(domain, ""); nil != err {
+				c.Errorf(fmt.Sprintf("LocalDNS.FakeIP.Exclude[%d]", i), "invalid domain pattern:%v", err)
+			}
+		}
+	}
+	c.CheckAddr("UDPGWAddr", conf.UDPGWAddr, true)
+	c.CheckAddr("Admin.Listen", conf.Admin.Listen, true)
+	if len(conf.GFWList.URL) > 0 {
+		c.CheckURL("GFWList.URL", conf.GFWList.URL, "http", "https")
+	}
+	for i, rule := range conf.GFWList.UserRule {
+		if err := gfwlist.CheckRule(rule); nil != err {
+			c.Errorf(fmt.Sprintf("GFWList.UserRule[%d]", i), "invalid rule:%s for reason:%v", rule, err)
+		}
+	}
+	for i, db := range conf.GeoIP.Database {
+		if _, err := loadCountryDB(db, home); nil != err {
+			c.Errorf(fmt.Sprintf("GeoIP.Database[%d].File", i), "invalid GeoIP database:%v", err)
+		}
+	}
+
+	channels := make(map[string]bool)
+	for i := range conf.Channel {
+		ch := &conf.Channel[i]
+		path := fmt.Sprintf("Channel[%d]", i)
+		if len(ch.Name) == 0 {
+			c.Errorf(path, "empty channel name")
+		} else if _, exist := channels[ch.Name]; exist {
+			c.Errorf(path+".Name", "duplicate channel name:%s", ch.Name)
+		}
+		channels[ch.Name] = ch.Enable
+		checkChannelConfig(c, i, ch)
+	}
+	checkFetchChannel(c, "GFWList.Proxy", conf.GFWList.Proxy, channels)
+	if ch := conf.LocalDNS.Channel; len(ch) > 0 && !channels[ch] {
+		c.Errorf("LocalDNS.Channel", "channel:%s is not defined or not enabled", ch)
+	}
+	if ch := conf.LocalDNS.TrustedChannel; len(ch) > 0 {
+		if !channels[ch] {
+			c.Errorf("LocalDNS.TrustedChannel", "channel:%s is not defined or not enabled", ch)
+		}
+		for i := range conf.Channel {
+			if conf.Channel[i].Name == ch && strings.EqualFold(conf.Channel[i].Type, "DIRECT") {
+				c.Errorf("LocalDNS.TrustedChannel", "channel:%s is not a remote channel", ch)
+			}
+		}
+		for i, addr := range conf.LocalDNS.TrustedDNS {
+			if strings.Contains(addr, "://") {
+				c.Errorf(fmt.Sprintf("LocalDNS.TrustedDNS[%d]", i), "only 'host[:port]' is supported with 'TrustedChannel'")
+			}
+		}
+	}
+	ruleSets := make(map[string]bool)
+	for i := range conf.RuleSet {
+		path := fmt.Sprintf("RuleSet[%d]", i)
+		if ruleSets[conf.RuleSet[i].Name] {
+			c.Errorf(path+".Name", "duplicate rule set name:%s", conf.RuleSet[i].Name)
+		}
+		ruleSets[conf.RuleSet[i].Name] = true
+		checkRuleSetConfig(c, home, path, &conf.RuleSet[i], channels)
+	}
+	for i, name := range conf.LocalDNS.Blocklist {
+		path := fmt.Sprintf("LocalDNS.Blocklist[%d]", i)
+		if !ruleSets[name] {
+			c.Errorf(path, "rule set:%s is not defined", name)
+			continue
+		}
+		for j := range conf.RuleSet {
+			if conf.RuleSet[j].Name == name && !strings.EqualFold(conf.RuleSet[j].Type, RuleSetTypeDomain) {
+				c.Errorf(path, "rule set:%s is not a 'domain' rule set", name)
+			}
+		}
+	}
+
+	locals := make(map[string]bool)
+	for i := range conf.Proxy {
+		pcfg := &conf.Proxy[i]
+		path := fmt.Sprintf("Proxy[%d]", i)
+		isTUN := strings.EqualFold(pcfg.Mode, ProxyModeTUN)
+		if isTUN {
+			//'Local' is the TUN device name
+			if len(pcfg.Local) == 0 || strings.ContainsAny(pcfg.Local, ":/ ") {
+				c.Errorf(path+".Local", "invalid TUN device name:%s", pcfg.Local)
+			}
+			if pcfg.MTU < 0 || pcfg.MTU > 65535 {
+				c.Errorf(path+".MTU", "invalid MTU:%d", pcfg.MTU)
+			}
+		}
+		if isTUN || c.CheckAddr(path+".Local", pcfg.Local, false) {
+			if locals[pcfg.Local] {
+				c.Errorf(path+".Local", "duplicate listen address:%s", pcfg.Local)
+			}
+			locals[pcfg.Local] = true
+		}
+		for j, cidr := range pcfg.AllowCIDR {
+			if _, _, err := net.ParseCIDR(cidr); nil != err && nil == net.ParseIP(cidr) {
+				c.Errorf(fmt.Sprintf("%s.AllowCIDR[%d]", path, j), "invalid CIDR:%s", cidr)
+			}
+		}
+		for j, u := range pcfg.Users {
+			if strings.Index(u, ":") <= 0 {
+				c.Errorf(fmt.Sprintf("%s.Users[%d]", path, j), "invalid user:%s, expected 'name:password'", u)
+			}
+		}
+		if len(pcfg.Mode) > 0 {
+			if c.CheckOneOf(path+".Mode", pcfg.Mode, ProxyModeRedirect, ProxyModeTProxy, ProxyModeTUN) && len(pcfg.Users) > 0 {
+				c.Errorf(path+".Users", "transparent proxy clients can NOT be authenticated, use 'AllowCIDR' instead")
+			}
+		}
+		for j := range pcfg.PAC {
+			if len(pcfg.PAC[j].User) > 0 && len(pcfg.Users) == 0 {
+				c.Errorf(fmt.Sprintf("%s.PAC[%d].User", path, j), "no 'Users' configured, the rule never match")
+			}
+			checkPACConfig(c, home, fmt.Sprintf("%s.PAC[%d]", path, j), &pcfg.PAC[j], channels, ruleSets)
+		}
+	}
+	return append(errs, c.Errors...)
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(dir)
+	//restore global proxy type table for other tests
+	if rt, exist := proxyTypeTable["DIRECT"]; exist {
+		defer func() { proxyTypeTable["DIRECT"] = rt }()
+	} else {
+		defer delete(proxyTypeTable, "DIRECT")
+	}
+	RegisterProxyType("DIRECT", &testFailoverChannel{})
+	client := `{
+	//comment lines should not shift line numbers
+	"Encrypt":{"Method":"auto"},
+	"Proxy":[
+		{
+			"Local":"127.0.0.1:48100",
+			"PAC":[
+				{"Rule":["!IsCNIP"],"Remote":["Direct", "Unknown"]},
+				{"Rule":["InHost"],"Remote":"Direct"}
+			]
+		}
+	],
+	"Channel":[
+		{"Enable":true, "Type":"direct", "Name":"Direct"},
+		{"Enable":true, "Type":"unknown", "Name":"Direct", "Proxy":"http://127.0.0.1:99999"}
+	]
+}`
+	ioutil.WriteFile(dir+"/client.json", []byte(client), 0644)
+	errs := CheckConfig(dir)
+	expected := []string{
+		"client.json:15: Channel[1].Type: unknown channel type:unknown",
+		"client.json:15: Channel[1].Proxy: invalid port:99999",
+		"client.json:8: Proxy[0].PAC[0].Remote[1]: remote channel:Unknown is not defined",
+		"client.json:9: Proxy[0].PAC[1].Rule[0]: invalid rule:InHost",
+	}
+	if len(errs) != 5 {
+		t.Fatalf("Expected 5 errors, but got %v", errs)
+	}
+	for _, s := range expected {
+		found := false
+		for _, err := range errs {
+			if _, ok := err.(*helper.ConfigError); ok && strings.Contains(err.Error(), s) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Error '%s' not found in %v", s, errs)
+		}
+	}
+
+	ioutil.WriteFile(dir+"/client.json", []byte("{\n//comment\n\"Proxy\":[{\"Local\":48100}]}"), 0644)
+	errs = CheckConfig(dir)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "client.json:3: Proxy[0].Local") {
+		t.Fatalf("Invalid type error:%v", errs)
+	}
+
+	ioutil.WriteFile(dir+"/client.json", []byte("{\n\"Encrypt\":{\"Method\":\"rc4\"}}"), 0644)
+	errs = CheckConfig(dir)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "client.json:2: Encrypt.Method: unauthenticated encrypt method:rc4 is removed") {
+		t.Fatalf("Expected error for removed encrypt method, but got %v", errs)
+	}
+}
@@ -1,29 +1,70 @@
 package proxy
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strings"
-	"time"
+	"sync/atomic"
 
-	"github.com/yinqiwen/gsnova/common/gfwlist"
 	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/matcher"
+	"github.com/yinqiwen/gsnova/common/obfs"
 	"github.com/yinqiwen/gsnova/local/hosts"
 )
 
+//GConf is the config loaded on start, settings which could be reloaded should be read by GetConf()
 var GConf LocalConfig
-var mygfwlist *gfwlist.GFWList
-var cnIPRange *IPRangeHolder
+
+//running config replaced as a whole on reload
+var runningConf atomic.Value
+
+//GetConf return the running config, it should not be modified.
+func GetConf() *LocalConfig {
+	if conf, ok := runningConf.Load().(*LocalConfig); ok {
+		return conf
+	}
+	return &GConf
+}
 
 const (
 	BlockedByGFWRule = "BlockedByGFW"
 	InHostsRule      = "InHosts"
 	IsCNIPRule       = "IsCNIP"
+	//prefix of rules with value, e.g. 'Country:JP', 'IP:10.0.0.0/8,fc00::/7', 'SrcIP:192.168.1.0/24', 'RuleSet:ads'
+	CountryRule = "Country:"
+	IPRule      = "IP:"
+	SrcIPRule   = "SrcIP:"
+	RuleSetRule = "RuleSet:"
 )
 
+//ruleValue return the value of rule with prefix, e.g. 'JP' of 'Country:JP'
+func ruleValue(rule string, prefix string) (string, bool) {
+	if len(rule) > len(prefix) && strings.EqualFold(rule[0:len(prefix)], prefix) {
+		return rule[len(prefix):], true
+	}
+	return "", false
+}
+
+//resolveRuleIP return IP of the domain or IP
+func resolveRuleIP(host string) net.IP {
+	if len(host) == 0 {
+		return nil
+	}
+	if ip := net.ParseIP(host); nil != ip {
+		return ip
+	}
+	ip, err := DnsGetDoaminIP(host)
+	if nil != err {
+		log.Printf("[ERROR]Failed to resolve %s for reason:%v", host, err)
+		return nil
+	}
+	return net.ParseIP(ip)
+}
+
 func matchHostnames(pattern, host string) bool {
 	host = strings.TrimSuffix(host, ".")
 	pattern = strings.TrimSuffix(pattern, ".")
@@ -66,10 +107,21 @@ type ProxyChannelConfig struct {
 	RCPRandomAdjustment int
 	HTTPChunkPushEnable bool
 	ForceTLS            bool
+	Obfs                obfs.Config
+	Balance             string
+	ServerWeight        []int
 
 	proxyURL *url.URL
 }
 
+//GetServerWeight return the weight of i-th server in ServerList, default 1
+func (c *ProxyChannelConfig) GetServerWeight(i int) int {
+	if i < len(c.ServerWeight) && c.ServerWeight[i] > 0 {
+		return c.ServerWeight[i]
+	}
+	return 1
+}
+
 func (c *ProxyChannelConfig) IsDirect() bool {
 	return c.Type == "DIRECT"
 }
@@ -94,7 +146,29 @@ type PACConfig struct {
 	URL      []string
 	Rule     []string
 	Protocol []string
-	Remote   string
+	//patterns of authenticated user name
+	User   []string
+	Remote RemoteNames
+
+	//compiled patterns, matched by MatchPatterns if nil
+	methodPatterns *matcher.Patterns
+	hostPatterns   *matcher.Patterns
+	urlPatterns    *matcher.Patterns
+	userPatterns   *matcher.Patterns
+}
+
+//compile patterns once, so that requests are NOT matched by all patterns one by one
+func (pac *PACConfig) compile() {
+	compile := func(patterns []string) *matcher.Patterns {
+		if len(patterns) == 0 {
+			return nil
+		}
+		return matcher.NewPatterns(patterns)
+	}
+	pac.methodPatterns = compile(pac.Method)
+	pac.hostPatterns = compile(pac.Host)
+	pac.urlPatterns = compile(pac.URL)
+	pac.userPatterns = compile(pac.User)
 }
 
 func (pac *PACConfig) ruleInHosts(req *http.Request) bool {
@@ -113,60 +187,85 @@ func (pac *PACConfig) matchProtocol(protocol string) bool {
 	return false
 }
 
-func (pac *PACConfig) matchRules(ip string, req *http.Request) bool {
+//matchRules match all rules, the result & detail of each rule are recorded in trace if not nil
+func (pac *PACConfig) matchRules(ip string, src string, req *http.Request, trace *routeTrace) bool {
 	if len(pac.Rule) == 0 {
 		return true
 	}
 
 	ok := true
 
-	for _, rule := range pac.Rule {
+	for i, rule := range pac.Rule {
 		not := false
 		if strings.HasPrefix(rule, "!") {
 			not = true
 			rule = rule[1:]
 		}
+		detail := ""
 		if strings.EqualFold(rule, InHostsRule) {
 			if nil == req {
 				ok = false
+				detail = "no request"
 			} else {
 				ok = pac.ruleInHosts(req)
 			}
 		} else if strings.EqualFold(rule, BlockedByGFWRule) {
-			if nil != mygfwlist && nil != req {
-				ok = mygfwlist.IsBlockedByGFW(req)
-				if !ok {
-					log.Printf("#### %s is NOT BlockedByGFW", req.Host)
+			if mygfwlist := getGFWList(); nil != mygfwlist && nil != req {
+				var gfwRule string
+				ok, gfwRule = mygfwlist.Match(req)
+				detail = "gfwlist rule:" + gfwRule
+				if len(gfwRule) == 0 {
+					detail = "no gfwlist rule matched"
 				}
 			} else {
 				ok = true
-				log.Printf("NIL GFWList object or request")
+				detail = "gfwlist not loaded or no request"
 			}
 		} else if strings.EqualFold(rule, IsCNIPRule) {
+			cnIPRange := getCNIPRange()
 			if len(ip) == 0 || nil == cnIPRange {
-				log.Printf("NIL CNIP content  or IP/Domain")
 				ok = false
+				detail = "CN IP range not loaded or no destination"
+			} else if dst := trace.resolveIP(ip); nil == dst {
+				ok = false
+				detail = "failed to resolve " + ip
 			} else {
-				var err error
-				if net.ParseIP(ip) == nil {
-					ip, err = DnsGetDoaminIP(ip)
-				}
-				if nil == err {
-					_, err = cnIPRange.FindCountry(ip)
-				} else {
-					log.Printf("######err:%v", err)
+				_, err := cnIPRange.FindCountry(dst.String())
+				ok = nil == err
+				detail = fmt.Sprintf("%s in CN IP range:%v", dst, ok)
+			}
+		} else if countries, exist := ruleValue(rule, CountryRule); exist {
+			ok = false
+			if dst := trace.resolveIP(ip); nil != dst {
+				country := lookupCountry(dst)
+				for _, c := range strings.Split(countries, ",") {
+					ok = ok || strings.EqualFold(country, strings.TrimSpace(c))
 				}
-				ok = (nil == err)
-				log.Printf("ip:%s is CNIP:%v", ip, ok)
+				detail = fmt.Sprintf("country of %s:%s", dst, country)
+			} else {
+				detail = "failed to resolve " + ip
 			}
-
+		} else if cidrs, exist := ruleValue(rule, IPRule); exist {
+			dst := trace.resolveIP(ip)
+			ok = nil != dst && getIPNetList(cidrs).contains(dst)
+			if nil == dst {
+				detail = "failed to resolve " + ip
+			}
+		} else if cidrs, exist := ruleValue(rule, SrcIPRule); exist {
+			srcIP := net.ParseIP(src)
+			ok = nil != srcIP && getIPNetList(cidrs).contains(srcIP)
+		} else if name, exist := ruleValue(rule, RuleSetRule); exist {
+			ok = matchRuleSet(name, ip, req)
 		} else {
 			log.Printf("###Invalid rule:%s", rule)
+			detail = "invalid rule"
 		}
 		if not {
 			ok = ok != true
 		}
+		trace.rule(pac.Rule[i], ok, detail)
 		if !ok {
+			trace.fail(fmt.Sprintf("Rule[%d]", i))
 			break
 		}
 	}
@@ -191,17 +290,37 @@ func MatchPatterns(str string, rules []string) bool {
 	return false
 }
 
-func (pac *PACConfig) Match(protocol string, ip string, req *http.Request) bool {
-	ret := pac.matchProtocol(protocol)
-	if !ret {
+func matchCompiledPatterns(str string, rules []string, compiled *matcher.Patterns) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	if nil == compiled {
+		return MatchPatterns(str, rules)
+	}
+	return compiled.Match(strings.ToLower(str))
+}
+
+//Match check the request to ip from client 'src' by authenticated user
+func (pac *PACConfig) Match(protocol string, ip string, src string, user string, req *http.Request) bool {
+	return pac.match(protocol, ip, src, user, req, nil)
+}
+
+//match check the request, the failed condition is recorded in trace if not nil
+func (pac *PACConfig) match(protocol string, ip string, src string, user string, req *http.Request, trace *routeTrace) bool {
+	if !pac.matchProtocol(protocol) {
+		trace.fail("Protocol")
 		return false
 	}
-	ret = pac.matchRules(ip, req)
-	if !ret {
+	if len(pac.User) > 0 && (len(user) == 0 || !matchCompiledPatterns(user, pac.User, pac.userPatterns)) {
+		trace.fail("User")
+		return false
+	}
+	if !pac.matchRules(ip, src, req, trace) {
 		return false
 	}
 	if nil == req {
 		if len(pac.Host) > 0 || len(pac.Method) > 0 || len(pac.URL) > 0 {
+			trace.fail("Host/Method/URL of non http request")
 			return false
 		}
 		return true
@@ -210,34 +329,94 @@ func (pac *PACConfig) Match(protocol string, ip string, req *http.Request) bool
 	if len(pac.Host) > 0 && strings.Contains(host, ":") {
 		host, _, _ = net.SplitHostPort(host)
 	}
-	return MatchPatterns(host, pac.Host) && MatchPatterns(req.Method, pac.Method) && MatchPatterns(req.URL.String(), pac.URL)
+	if !matchCompiledPatterns(host, pac.Host, pac.hostPatterns) {
+		trace.fail("Host")
+		return false
+	}
+	if !matchCompiledPatterns(req.Method, pac.Method, pac.methodPatterns) {
+		trace.fail("Method")
+		return false
+	}
+	if !matchCompiledPatterns(req.URL.String(), pac.URL, pac.urlPatterns) {
+		trace.fail("URL")
+		return false
+	}
+	return true
 }
 
+const (
+	ProxyModeRedirect = "redirect"
+	ProxyModeTProxy   = "tproxy"
+	ProxyModeTUN      = "tun"
+)
+
 type ProxyConfig struct {
 	Local    string
 	PAC      []PACConfig
 	SNISniff bool
+	//transparent proxy mode 'redirect'/'tproxy' on linux, socks/http proxy if empty,
+	//or 'tun' to serve TUN device named by 'Local'
+	Mode string
+	//MTU of TUN device, default 1500
+	MTU int
+	//client CIDRs allowed to connect, all allowed if empty
+	AllowCIDR []string
+	//users in 'name:password' format, clients must be authenticated if not empty
+	Users []string
+
+	allowNets []*net.IPNet
+	users     map[string]string
 }
 
-func (cfg *ProxyConfig) findProxyByRequest(proto string, ip string, req *http.Request) Proxy {
-	var p Proxy
+//route return available proxies in order of the first matched PAC rule, the decision is recorded in trace
+func (cfg *ProxyConfig) route(trace *routeTrace, req *http.Request) []Proxy {
+	ip := trace.Host
 	if len(ip) > 0 && helper.IsPrivateIP(ip) {
-		p = getProxyByName("Direct")
+		p := getProxyByName("Direct")
 		if nil != p {
-			return p
+			trace.Reason = "private IP"
+			trace.Remote = []string{"Direct"}
+			return []Proxy{p}
 		}
 	}
-	for _, pac := range cfg.PAC {
-		if pac.Match(proto, ip, req) {
-			p = getProxyByName(pac.Remote)
+	var proxies []Proxy
+	for i := range cfg.PAC {
+		pac := &cfg.PAC[i]
+		trace.begin(i)
+		if pac.match(trace.Protocol, ip, trace.Src, trace.User, req, trace) {
+			trace.matched()
+			for _, name := range pac.Remote {
+				if p := getProxyByName(name); nil != p {
+					proxies = append(proxies, p)
+					trace.Remote = append(trace.Remote, name)
+				} else {
+					trace.Unavailable = append(trace.Unavailable, name)
+				}
+			}
 			break
 		}
-
 	}
-	if nil == p {
-		log.Printf("No proxy found.")
+	if trace.Matched < 0 {
+		trace.Reason = "no PAC rule matched"
+	} else if len(proxies) == 0 {
+		trace.Reason = "no channel available"
 	}
-	return p
+	return proxies
+}
+
+//findProxiesByRequest return available proxies in order of the first matched PAC rule & the decision trace
+func (cfg *ProxyConfig) findProxiesByRequest(proto string, ip string, src string, user string, req *http.Request) ([]Proxy, *routeTrace) {
+	trace := newRouteTrace(cfg.Local, proto, ip, src, user, req)
+	return cfg.route(trace, req), trace
+}
+
+func (cfg *ProxyConfig) findProxyByRequest(proto string, ip string, src string, user string, req *http.Request) Proxy {
+	proxies, trace := cfg.findProxiesByRequest(proto, ip, src, user, req)
+	if len(proxies) == 0 {
+		log.Printf("No proxy found by route:%v", trace)
+		return nil
+	}
+	return proxies[0]
 }
 
 type EncryptConfig struct {
@@ -245,12 +424,43 @@ type EncryptConfig struct {
 	Key    string
 }
 
+//FakeIPConfig answer A/AAAA queries by fake IP in reserved range, so that the domain of connection
+//to fake IP is known without sniffing
+type FakeIPConfig struct {
+	//e.g. '198.18.0.0/15', fake IP is disabled if empty
+	CIDR string
+	//IPv6 range for AAAA queries, AAAA queries are answered with no address if empty
+	CIDR6 string
+	//max count of domains, least recently used domain is evicted if exceeded
+	Size int
+	//domains resolved by dns servers, e.g. '*.lan'
+	Exclude []string
+}
+
 type LocalDNSConfig struct {
 	Listen     string
 	TrustedDNS []string
 	FastDNS    []string
 	TCPConnect bool
 	CacheSize  int
+	//seconds expired answers could be served while refreshed in background, disabled if 0
+	CacheServeStale int
+	//refresh frequently used answers in background before expired
+	CachePrefetch bool
+	//file to save cache on exit & restore on start, relative to config dir, disabled if empty
+	CacheFile string
+	//proxy channel name to connect DoH/DoT/TCP dns servers, direct if empty
+	Channel string
+	//proxy channel name to carry queries for 'TrustedDNS' as udp events, which are resolved by 'TrustedDNS'
+	//from remote server, or by the resolver of remote server if 'TrustedDNS' is empty
+	TrustedChannel string
+	FakeIP         FakeIPConfig
+	//names of 'domain' rule sets, queries of the domains are answered by 'BlockMode'
+	Blocklist []string
+	//'nxdomain' or 'zero' to answer 0.0.0.0/::, default 'nxdomain'
+	BlockMode string
+	//count of recent queries logged per client for admin url '/dns', disabled if 0
+	QueryLogSize int
 }
 
 type AdminConfig struct {
@@ -261,7 +471,32 @@ type AdminConfig struct {
 type GFWListConfig struct {
 	URL      string
 	UserRule []string
-	Proxy    string
+	//forward proxy url or proxy channel name to fetch gfwlist
+	Proxy string
+}
+
+type RuleSetConfig struct {
+	Name string
+	//'domain', 'cidr' or 'url'
+	Type string
+	//local file relative to config dir, or http/https url
+	URL string
+	//forward proxy url or proxy channel name to fetch url, direct if empty
+	Channel string
+	//refresh interval in seconds, default 86400 for url and 60 for local file
+	Interval int
+}
+
+type GeoIPDatabase struct {
+	//MaxMind '.mmdb', RIR delegated stats like APNIC's, or CIDR list with lines 'CIDR [COUNTRY]'
+	File string
+	//country of CIDR list lines without country
+	Country string
+}
+
+type GeoIPConfig struct {
+	//databases searched in order for rule 'Country:'
+	Database []GeoIPDatabase
 }
 
 type LocalConfig struct {
@@ -269,11 +504,15 @@ type LocalConfig struct {
 	Encrypt          EncryptConfig
 	UserAgent        string
 	Auth             string
+	AuthKey          string
 	LocalDNS         LocalDNSConfig
 	UDPGWAddr        string
 	ChannelKeepAlive bool
+	AutoReload       bool
 	Admin            AdminConfig
 	GFWList          GFWListConfig
+	GeoIP            GeoIPConfig
+	RuleSet          []RuleSetConfig
 	Proxy            []ProxyConfig
 	Channel          []ProxyChannelConfig
 }
@@ -282,8 +521,10 @@ func (cfg *LocalConfig) init() error {
 	forwardProxies := make(map[string]bool)
 	for _, pcfg := range cfg.Proxy {
 		for _, pac := range pcfg.PAC {
-			if strings.Contains(pac.Remote, "://") {
-				forwardProxies[pac.Remote] = true
+			for _, remote := range pac.Remote {
+				if strings.Contains(remote, "://") {
+					forwardProxies[remote] = true
+				}
 			}
 		}
 	}
@@ -301,6 +542,7 @@ func (cfg *LocalConfig) init() error {
 	cnIPEnable := false
 	for i, _ := range cfg.Proxy {
 		for j, _ := range cfg.Proxy[i].PAC {
+			cfg.Proxy[i].PAC[j].compile()
 			rules := cfg.Proxy[i].PAC[j].Rule
 			for _, r := range rules {
 				if strings.Contains(r, BlockedByGFWRule) || strings.Contains(r, IsCNIPRule) {
@@ -309,51 +551,29 @@ func (cfg *LocalConfig) init() error {
 				if strings.Contains(r, IsCNIPRule) {
 					cnIPEnable = true
 				}
+				if _, exist := ruleValue(strings.TrimPrefix(r, "!"), CountryRule); exist && len(cfg.GeoIP.Database) == 0 {
+					cnIPEnable = true
+				}
 			}
 		}
 	}
 
+	loadGeoIP(cfg.GeoIP)
+	var providers []*ruleProvider
 	if gfwlistEnable {
-		go func() {
-			hc, _ := NewHTTPClient(&ProxyChannelConfig{Proxy: cfg.GFWList.Proxy})
-			dst := proxyHome + "/gfwlist.txt"
-			tmp, err := gfwlist.NewGFWList(cfg.GFWList.URL, hc, cfg.GFWList.UserRule, dst, true)
-			if nil == err {
-				mygfwlist = tmp
-			} else {
-				log.Printf("[ERROR]Failed to create gfwlist  for reason:%v", err)
-			}
-		}()
+		providers = append(providers, newGFWListProvider(cfg.GFWList))
 	}
 	if cnIPEnable {
-		go func() {
-			iprangeFile := proxyHome + "/" + cnIPFile
-			ipHolder, err := parseApnicIPFile(iprangeFile)
-			nextFetchTime := 1 * time.Second
-			if nil == err {
-				cnIPRange = ipHolder
-				nextFetchTime = 1 * time.Minute
-			}
-			var hc *http.Client
-			for {
-				select {
-				case <-time.After(nextFetchTime):
-					if nil == hc {
-						hc, err = NewHTTPClient(&ProxyChannelConfig{})
-					}
-					if nil != hc {
-						ipHolder, err = getCNIPRangeHolder(hc)
-						if nil != err {
-							log.Printf("[ERROR]Failed to fetch CNIP file:%v", err)
-							nextFetchTime = 1 * time.Second
-						} else {
-							nextFetchTime = 24 * time.Hour
-							cnIPRange = ipHolder
-						}
-					}
-				}
-			}
-		}()
+		providers = append(providers, newCNIPProvider())
+	}
+	for _, conf := range cfg.RuleSet {
+		p, err := newRuleSetProvider(conf)
+		if nil != err {
+			log.Printf("[ERROR]%v", err)
+			continue
+		}
+		providers = append(providers, p)
 	}
+	updateRuleProviders(providers)
 	return nil
 }
@@ -6,97 +6,65 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
-	"strings"
 	"time"
 
-	"github.com/getlantern/netx"
-	"github.com/hashicorp/golang-lru"
 	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/event"
 )
 
 var errNoDNServer = errors.New("No DNS server configured.")
 var errDNSQuryFail = errors.New("DNS query failed.")
-var dnsCache *lru.Cache
-
-type dnsCacheRecord struct {
-	expireAt time.Time
-	ipv4Res  *dns.Msg
-	ipv6Res  *dns.Msg
-}
+var dnsCache *dnsResponseCache
 
+//pickIP return first IPv4 or IPv6 address in answers
 func pickIP(res *dns.Msg) string {
 	for _, answer := range res.Answer {
 		if a, ok := answer.(*dns.A); ok {
 			return a.A.String()
 		}
-	}
-	return ""
-}
-
-func newDNSCacheRecord(record *dnsCacheRecord, res *dns.Msg) *dnsCacheRecord {
-	if nil == record {
-		record = new(dnsCacheRecord)
-	}
-	ipv4 := false
-	now := time.Now()
-	for _, answer := range res.Answer {
-		var hdr dns.RR_Header
-		if a, ok := answer.(*dns.A); ok {
-			hdr = a.Hdr
-			ipv4 = true
-		} else if aaaa, ok := answer.(*dns.AAAA); ok {
-			hdr = aaaa.Hdr
-			ipv4 = false
+		if aaaa, ok := answer.(*dns.AAAA); ok {
+			return aaaa.AAAA.String()
 		}
-		record.expireAt = now.Add(time.Duration(hdr.Ttl+10) * time.Second)
-		break
-	}
-	if ipv4 {
-		record.ipv4Res = res
-	} else {
-		record.ipv6Res = res
 	}
-	return record
+	return ""
 }
 
 func selectDNSServer(servers []string) string {
 	serverLen := len(servers)
-	server := servers[rand.Intn(serverLen)]
-	if !strings.Contains(server, ":") {
-		server = net.JoinHostPort(server, "53")
-	}
-	return server
+	return servers[rand.Intn(serverLen)]
 }
 
 type getConnIntf interface {
 	GetConn() net.Conn
 }
 
+//dnsQuery resolve query by cache or dns servers
 func dnsQuery(r *dns.Msg) (*dns.Msg, error) {
+	if nil == dnsCache {
+		return dnsResolve(r)
+	}
+	if res, refresh := dnsCache.get(r, time.Now()); nil != res {
+		if nil != refresh {
+			go dnsCache.refresh(r, refresh)
+		}
+		return res, nil
+	}
+	res, err := dnsResolve(r)
+	if nil == err {
+		dnsCache.put(res, time.Now())
+	}
+	return res, err
+}
+
+//dnsResolve resolve domain blocked by GFW with 'TrustedDNS', and the rest with 'FastDNS'
+func dnsResolve(r *dns.Msg) (*dns.Msg, error) {
 	dnsServers := GConf.LocalDNS.TrustedDNS
-	var record *dnsCacheRecord
 	var domain string
 	useTrustedDNS := true
 	if len(r.Question) == 1 && dns.IsFqdn(r.Question[0].Name) {
 		domain = r.Question[0].Name
 		domain = domain[0 : len(domain)-1]
-		if nil != dnsCache {
-			item, exist := dnsCache.Get(domain)
-			if exist {
-				record = item.(*dnsCacheRecord)
-				if time.Now().After(record.expireAt) {
-					record = nil
-					dnsCache.Remove(domain)
-				} else {
-					if r.Question[0].Qtype == dns.TypeA && nil != record.ipv4Res {
-						return record.ipv4Res, nil
-					} else if r.Question[0].Qtype == dns.TypeAAAA && nil != record.ipv6Res {
-						return record.ipv6Res, nil
-					}
-				}
-			}
-		}
-		if nil != mygfwlist {
+		if mygfwlist := getGFWList(); nil != mygfwlist {
 			connReq, _ := http.NewRequest("CONNECT", "https://"+domain, nil)
 			isBlocked, _ := mygfwlist.FastMatchDoamin(connReq)
 			if !isBlocked {
@@ -111,82 +79,107 @@ func dnsQuery(r *dns.Msg) (*dns.Msg, error) {
 		dnsServers = GConf.LocalDNS.TrustedDNS
 		useTrustedDNS = true
 	}
-	if len(dnsServers) == 0 {
+	trustedChannel := GConf.LocalDNS.TrustedChannel
+	if len(dnsServers) == 0 && (!useTrustedDNS || len(trustedChannel) == 0) {
 		log.Printf("At least one DNS server need to be configured in 'FastDNS/TrustedDNS'")
 		return nil, errNoDNServer
 	}
-	server := selectDNSServer(dnsServers)
-	network := "udp"
-	if GConf.LocalDNS.TCPConnect && useTrustedDNS {
-		network = "tcp"
+	var server string
+	var upstream dnsUpstream
+	var err error
+	if useTrustedDNS && len(trustedChannel) > 0 {
+		//resolved by remote server's resolver if no trusted dns server
+		server = event.RemoteDNSAddr
+		if len(dnsServers) > 0 {
+			server = selectDNSServer(dnsServers)
+		}
+		upstream, err = newChannelDNSUpstream(server, trustedChannel)
+	} else {
+		server = selectDNSServer(dnsServers)
+		network := "udp"
+		if GConf.LocalDNS.TCPConnect && useTrustedDNS {
+			network = "tcp"
+		}
+		upstream, err = getDNSUpstream(server, network)
+	}
+	if nil != err {
+		return nil, err
 	}
 	log.Printf("DNS query %s to %s", domain, server)
 	for retry := 0; retry < 3; retry++ {
-		c, err := netx.DialTimeout(network, server, 1*time.Second)
+		res, err := upstream.exchange(r)
 		if nil != err {
-			return nil, err
-		}
-		dnsConn := new(dns.Conn)
-		if pc, ok := c.(getConnIntf); ok {
-			c = pc.GetConn()
-		}
-		dnsConn.Conn = c
-		dnsConn.WriteMsg(r)
-		dnsConn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		res, err1 := dnsConn.ReadMsg()
-		if nil == err1 && nil != dnsCache && len(domain) > 0 {
-			record = newDNSCacheRecord(record, res)
-			dnsCache.Add(domain, record)
-		}
-		c.Close()
-		if nil == err1 {
-			return res, nil
+			log.Printf("[WARN]DNS query %s to %s failed:%v", domain, server, err)
+			continue
 		}
+		return res, nil
 	}
 	return nil, errDNSQuryFail
 }
 
+//dnsQueryClient resolve query from dns clients by blocklists, hosts.json and fake IP before dns servers,
+//return the answer and where it's from
+func dnsQueryClient(r *dns.Msg) (*dns.Msg, string, error) {
+	if res, source := dnsAnswerLocal(r); nil != res {
+		return res, source, nil
+	}
+	if nil != fakeIPs {
+		if res := fakeIPs.answer(r); nil != res {
+			return res, dnsSourceFakeIP, nil
+		}
+	}
+	res, err := dnsQuery(r)
+	return res, dnsSourceResolved, err
+}
+
 func dnsQueryRaw(r []byte) ([]byte, error) {
 	req := new(dns.Msg)
 	req.Unpack(r)
-	res, err := dnsQuery(req)
+	res, _, err := dnsQueryClient(req)
 	if nil != err {
 		return nil, err
 	}
-	return res.Pack()
+	return dnsReply(req, res, dnsClientUDPSize(req)).Pack()
 }
 
+//DnsGetDoaminIP return IPv4 address of domain, or IPv6 address if no IPv4 address found
 func DnsGetDoaminIP(domain string) (string, error) {
-	m := new(dns.Msg)
-	m.Id = dns.Id()
-	m.SetQuestion(dns.Fqdn(domain), dns.TypeA)
-	m.RecursionDesired = true
-	res, err := dnsQuery(m)
-	if nil != err {
-		return "", err
-	}
-	return pickIP(res), nil
-}
-
-func proxyDNS(w dns.ResponseWriter, r *dns.Msg) {
-	dnsres, err := dnsQuery(r)
-	if nil != err {
-		log.Printf("DNS query error:%v", err)
-		return
-	}
-	if nil != dnsres {
-		w.WriteMsg(dnsres)
+	var ip string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(domain), qtype)
+		m.RecursionDesired = true
+		res, err := dnsQuery(m)
+		if nil != err {
+			return "", err
+		}
+		if ip = pickIP(res); len(ip) > 0 {
+			break
+		}
 	}
+	return ip, nil
 }
 
 func initDNS() {
 	if GConf.LocalDNS.CacheSize > 0 {
-		dnsCache, _ = lru.New(GConf.LocalDNS.CacheSize)
+		file := ""
+		if len(GConf.LocalDNS.CacheFile) > 0 {
+			file = configFilePath(proxyHome, GConf.LocalDNS.CacheFile)
+		}
+		dnsCache = newDNSResponseCache(GConf.LocalDNS, file)
+		dnsCache.start()
 	}
+	initFakeIP()
 	if len(GConf.LocalDNS.Listen) > 0 {
-		err := dns.ListenAndServe(GConf.LocalDNS.Listen, "udp", dns.HandlerFunc(proxyDNS))
-		if nil != err {
-			log.Printf("Failed to start dns server:%v", err)
-		}
+		startDNSServers(GConf.LocalDNS.Listen)
+	}
+}
+
+func stopDNS() {
+	stopDNSServers()
+	if nil != dnsCache {
+		dnsCache.stop()
+		dnsCache = nil
 	}
+	stopFakeIP()
 }
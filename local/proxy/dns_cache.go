@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+const (
+	//TTL of stale answers, RFC 8767
+	dnsStaleTTL = 30
+	//max TTL of negative answers, RFC 2308
+	dnsMaxNegativeTTL = 3 * 3600
+	//answers hit at least dnsPrefetchHits times are refreshed in the last 10% of TTL
+	dnsPrefetchHits      = 3
+	dnsCacheSaveInterval = 5 * time.Minute
+)
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func newDNSCacheKey(q dns.Question) dnsCacheKey {
+	return dnsCacheKey{strings.ToLower(q.Name), q.Qtype, q.Qclass}
+}
+
+type dnsCacheEntry struct {
+	msg        *dns.Msg
+	storedAt   time.Time
+	expireAt   time.Time
+	hits       int32
+	refreshing int32
+}
+
+//reply return copy of cached answer for query r, TTLs are decreased by seconds elapsed since stored
+func (e *dnsCacheEntry) reply(r *dns.Msg, now time.Time) *dns.Msg {
+	res := e.msg.Copy()
+	res.Id = r.Id
+	res.Question = r.Question
+	stale := !now.Before(e.expireAt)
+	elapsed := uint32(now.Sub(e.storedAt) / time.Second)
+	for _, section := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if stale {
+				hdr.Ttl = dnsStaleTTL
+			} else if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return res
+}
+
+//dnsCacheTTL return seconds the response could be cached, 0 if not cacheable
+func dnsCacheTTL(res *dns.Msg) uint32 {
+	if res.Truncated || len(res.Question) != 1 {
+		return 0
+	}
+	if res.Rcode == dns.RcodeSuccess && len(res.Answer) > 0 {
+		ttl := uint32(0)
+		ttlSet := false
+		for _, section := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					continue
+				}
+				//record with zero ttl should not be cached
+				if !ttlSet || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+					ttlSet = true
+				}
+			}
+		}
+		return ttl
+	}
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	//NODATA & NXDOMAIN are cached by SOA in authority section, RFC 2308
+	for _, rr := range res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			if ttl > dnsMaxNegativeTTL {
+				ttl = dnsMaxNegativeTTL
+			}
+			return ttl
+		}
+	}
+	return 0
+}
+
+//dnsResponseCache cache answers by (name, qtype, class) in LRU
+type dnsResponseCache struct {
+	cache *lru.Cache
+	//expired answers are served in this duration while refreshed in background
+	serveStale time.Duration
+	prefetch   bool
+	file       string
+	dirty      int32
+	stopCh     chan struct{}
+}
+
+func newDNSResponseCache(conf LocalDNSConfig, file string) *dnsResponseCache {
+	c := &dnsResponseCache{
+		serveStale: time.Duration(conf.CacheServeStale) * time.Second,
+		prefetch:   conf.CachePrefetch,
+		file:       file,
+	}
+	c.cache, _ = lru.New(conf.CacheSize)
+	return c
+}
+
+func (c *dnsResponseCache) Len() int {
+	return c.cache.Len()
+}
+
+func (c *dnsResponseCache) add(msg *dns.Msg, storedAt time.Time, expireAt time.Time) {
+	c.cache.Add(newDNSCacheKey(msg.Question[0]), &dnsCacheEntry{msg: msg, storedAt: storedAt, expireAt: expireAt})
+	atomic.StoreInt32(&c.dirty, 1)
+}
+
+//put cache response, return false if it's not cacheable
+func (c *dnsResponseCache) put(res *dns.Msg, now time.Time) bool {
+	ttl := dnsCacheTTL(res)
+	if ttl == 0 {
+		return false
+	}
+	msg := res.Copy()
+	//EDNS option is per query
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+	c.add(msg, now, now.Add(time.Duration(ttl)*time.Second))
+	return true
+}
+
+//get return cached answer of query, and the entry need to be refreshed in background if not nil
+func (c *dnsResponseCache) get(r *dns.Msg, now time.Time) (*dns.Msg, *dnsCacheEntry) {
+	if len(r.Question) != 1 {
+		return nil, nil
+	}
+	key := newDNSCacheKey(r.Question[0])
+	v, exist := c.cache.Get(key)
+	if !exist {
+		return nil, nil
+	}
+	e := v.(*dnsCacheEntry)
+	refresh := false
+	if now.Before(e.expireAt) {
+		hits := atomic.AddInt32(&e.hits, 1)
+		refresh = c.prefetch && hits >= dnsPrefetchHits && e.expireAt.Sub(now) < e.expireAt.Sub(e.storedAt)/10
+	} else if now.Before(e.expireAt.Add(c.serveStale)) {
+		refresh = true
+	} else {
+		c.cache.Remove(key)
+		return nil, nil
+	}
+	if refresh && atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+		return e.reply(r, now), e
+	}
+	return e.reply(r, now), nil
+}
+
+//refresh resolve query of entry in background
+func (c *dnsResponseCache) refresh(r *dns.Msg, e *dnsCacheEntry) {
+	q := r.Copy()
+	q.Id = dns.Id()
+	res, err := dnsResolve(q)
+	if nil == err && c.put(res, time.Now()) {
+		return
+	}
+	if nil != err {
+		log.Printf("[WARN]Failed to refresh dns cache of %s for reason:%v", r.Question[0].Name, err)
+	}
+	atomic.StoreInt32(&e.refreshing, 0)
+}
+
+//save write entries as lines 'storedAt expireAt base64(answer)' from least to most recently used
+func (c *dnsResponseCache) save() error {
+	if !atomic.CompareAndSwapInt32(&c.dirty, 1, 0) {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, key := range c.cache.Keys() {
+		v, exist := c.cache.Peek(key)
+		if !exist {
+			continue
+		}
+		e := v.(*dnsCacheEntry)
+		content, err := e.msg.Pack()
+		if nil != err {
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %d %s\n", e.storedAt.Unix(), e.expireAt.Unix(), base64.StdEncoding.EncodeToString(content))
+	}
+	tmp := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0666); nil != err {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+//load restore entries not expired, or still could be served stale
+func (c *dnsResponseCache) load() error {
+	f, err := os.Open(c.file)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), dns.MaxMsgSize*2)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		storedAt, err1 := strconv.ParseInt(fields[0], 10, 64)
+		expireAt, err2 := strconv.ParseInt(fields[1], 10, 64)
+		content, err3 := base64.StdEncoding.DecodeString(fields[2])
+		if nil != err1 || nil != err2 || nil != err3 || !now.Before(time.Unix(expireAt, 0).Add(c.serveStale)) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if nil != msg.Unpack(content) || len(msg.Question) != 1 {
+			continue
+		}
+		c.add(msg, time.Unix(storedAt, 0), time.Unix(expireAt, 0))
+	}
+	atomic.StoreInt32(&c.dirty, 0)
+	return scanner.Err()
+}
+
+func (c *dnsResponseCache) start() {
+	c.stopCh = make(chan struct{})
+	if len(c.file) == 0 {
+		return
+	}
+	if err := c.load(); nil != err && !os.IsNotExist(err) {
+		log.Printf("[ERROR]Failed to load dns cache for reason:%v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(dnsCacheSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stopCh:
+				return
+			case <-ticker.C:
+				if err := c.save(); nil != err {
+					log.Printf("[ERROR]Failed to save dns cache for reason:%v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (c *dnsResponseCache) stop() {
+	close(c.stopCh)
+	if len(c.file) == 0 {
+		return
+	}
+	if err := c.save(); nil != err {
+		log.Printf("[ERROR]Failed to save dns cache for reason:%v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSResponseCache(t *testing.T) {
+	home, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(home)
+	c := newDNSResponseCache(LocalDNSConfig{CacheSize: 16, CacheServeStale: 60}, filepath.Join(home, "dnscache.txt"))
+	now := time.Now()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		return m
+	}
+	q := query("www.example.com.", dns.TypeA)
+	res := new(dns.Msg)
+	res.SetReply(q)
+	a, _ := dns.NewRR("www.example.com. 100 IN A 1.2.3.4")
+	cname, _ := dns.NewRR("www.example.com. 300 IN CNAME example.com.")
+	res.Answer = []dns.RR{cname, a}
+	res.SetEdns0(4096, false)
+	if !c.put(res, now) {
+		t.Fatalf("Expected cached")
+	}
+
+	//TTL of each record count down
+	q2 := query("WWW.example.com.", dns.TypeA)
+	cached, refresh := c.get(q2, now.Add(40*time.Second))
+	if nil == cached || nil != refresh || cached.Id != q2.Id || cached.Question[0].Name != "WWW.example.com." {
+		t.Fatalf("Invalid cached answer:%v", cached)
+	}
+	if cached.Answer[0].Header().Ttl != 260 || cached.Answer[1].Header().Ttl != 60 || len(cached.Extra) != 0 {
+		t.Fatalf("Invalid cached answer:%v", cached)
+	}
+	//keyed by type
+	if cached, _ = c.get(query("www.example.com.", dns.TypeAAAA), now); nil != cached {
+		t.Fatalf("Expected no AAAA answer cached")
+	}
+
+	//stale answer is served & refreshed once
+	cached, refresh = c.get(q, now.Add(130*time.Second))
+	if nil == cached || nil == refresh || cached.Answer[1].Header().Ttl != dnsStaleTTL {
+		t.Fatalf("Expected stale answer, but got %v", cached)
+	}
+	if _, refresh = c.get(q, now.Add(131*time.Second)); nil != refresh {
+		t.Fatalf("Expected refresh once")
+	}
+	if cached, _ = c.get(q, now.Add(170*time.Second)); nil != cached {
+		t.Fatalf("Expected expired")
+	}
+
+	//any record with zero ttl disable caching
+	zero := new(dns.Msg)
+	zero.SetReply(query("zero.example.com.", dns.TypeA))
+	a0, _ := dns.NewRR("zero.example.com. 0 IN A 1.2.3.4")
+	a300, _ := dns.NewRR("zero.example.com. 300 IN A 1.2.3.5")
+	zero.Answer = []dns.RR{a0, a300}
+	if c.put(zero, now) {
+		t.Fatalf("Expected answer with zero ttl not cached")
+	}
+
+	//negative answers are cached by SOA
+	nx := new(dns.Msg)
+	nx.SetRcode(query("nx.example.com.", dns.TypeA), dns.RcodeNameError)
+	if c.put(nx, now) {
+		t.Fatalf("Expected NXDOMAIN without SOA not cached")
+	}
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 300")
+	nx.Ns = []dns.RR{soa}
+	nodata := new(dns.Msg)
+	nodata.SetReply(query("example.com.", dns.TypeMX))
+	nodata.Ns = []dns.RR{soa}
+	if !c.put(nx, now) || !c.put(nodata, now) {
+		t.Fatalf("Expected negative answers cached")
+	}
+	if cached, _ = c.get(query("nx.example.com.", dns.TypeA), now.Add(100*time.Second)); nil == cached || cached.Rcode != dns.RcodeNameError || cached.Ns[0].Header().Ttl != 3500 {
+		t.Fatalf("Invalid negative answer:%v", cached)
+	}
+	if cached, _ = c.get(query("example.com.", dns.TypeMX), now.Add(330*time.Second)); nil == cached || cached.Ns[0].Header().Ttl != dnsStaleTTL {
+		t.Fatalf("Invalid negative answer:%v", cached)
+	}
+
+	c.put(res, time.Now())
+	if err := c.save(); nil != err {
+		t.Fatalf("%v", err)
+	}
+	c = newDNSResponseCache(LocalDNSConfig{CacheSize: 16}, c.file)
+	if err := c.load(); nil != err {
+		t.Fatalf("%v", err)
+	}
+	if cached, _ = c.get(q, time.Now()); nil == cached || pickIP(cached) != "1.2.3.4" || c.Len() != 3 {
+		t.Fatalf("Invalid restored cache:%v", cached)
+	}
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/matcher"
+	"github.com/yinqiwen/gsnova/local/hosts"
+)
+
+const (
+	DNSBlockModeNXDomain = "nxdomain"
+	DNSBlockModeZero     = "zero"
+
+	//EDNS0 udp payload size advertised to clients, recommended by DNS flag day 2020
+	dnsServerUDPSize = 1232
+	//TTL of answers from blocklists & hosts.json
+	localDNSTTL       = 60
+	dnsMaxStatClients = 256
+
+	//where the answer is from
+	dnsSourceBlocked  = "blocked"
+	dnsSourceHosts    = "hosts"
+	dnsSourceFakeIP   = "fakeip"
+	dnsSourceResolved = "resolved"
+)
+
+var dnsServers []*dns.Server
+var dnsStat *dnsQueryStat
+
+//dnsBlockedBy return name of the blocklist blocking domain, exception rules in any list take precedence
+func dnsBlockedBy(domain string) string {
+	blocked := ""
+	for _, name := range GConf.LocalDNS.Blocklist {
+		p := getRuleProvider(name)
+		if nil == p {
+			continue
+		}
+		set, ok := p.get().(*matcher.DomainSet)
+		if !ok {
+			continue
+		}
+		if v, found := set.Lookup(domain); found {
+			if v != true {
+				return ""
+			}
+			if len(blocked) == 0 {
+				blocked = name
+			}
+		}
+	}
+	return blocked
+}
+
+//newLocalDNSAnswer answer A/AAAA query with ip, no record is answered if the IP version mismatched
+func newLocalDNSAnswer(r *dns.Msg, ip net.IP) *dns.Msg {
+	res := new(dns.Msg)
+	res.SetReply(r)
+	res.RecursionAvailable = true
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: localDNSTTL}
+	if q.Qtype == dns.TypeA && nil != ip.To4() {
+		res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+	} else if q.Qtype == dns.TypeAAAA && nil != ip && nil == ip.To4() {
+		res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	return res
+}
+
+//dnsAnswerLocal answer query by blocklists & hosts.json, nil if it should be resolved by dns servers
+func dnsAnswerLocal(r *dns.Msg) (*dns.Msg, string) {
+	if len(r.Question) != 1 || r.Question[0].Qclass != dns.ClassINET {
+		return nil, ""
+	}
+	q := r.Question[0]
+	domain := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if len(domain) == 0 {
+		return nil, ""
+	}
+	if list := dnsBlockedBy(domain); len(list) > 0 {
+		if strings.EqualFold(GConf.LocalDNS.BlockMode, DNSBlockModeZero) {
+			ip := net.IPv4zero
+			if q.Qtype == dns.TypeAAAA {
+				ip = net.IPv6zero
+			}
+			return newLocalDNSAnswer(r, ip), dnsSourceBlocked
+		}
+		res := new(dns.Msg)
+		res.SetRcode(r, dns.RcodeNameError)
+		res.RecursionAvailable = true
+		return res, dnsSourceBlocked
+	}
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		//only names mapped to IP are answered, others like 'sni_proxy' aliases unresolved are left to dns servers
+		if s := hosts.GetHost(domain); s != domain {
+			if ip := net.ParseIP(s); nil != ip {
+				return newLocalDNSAnswer(r, ip), dnsSourceHosts
+			}
+		}
+	}
+	return nil, ""
+}
+
+//dnsClientUDPSize return max size of udp answer for query, 512 if client doesn't support EDNS0
+func dnsClientUDPSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); nil != opt && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+//dnsReply fit answer res to query r, OPT record is replied only if query has one,
+//and records exceed size are removed with TC bit set so that client could retry by tcp
+func dnsReply(r *dns.Msg, res *dns.Msg, size int) *dns.Msg {
+	res.Id = r.Id
+	res.Response = true
+	extra := res.Extra[:0]
+	for _, rr := range res.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	res.Extra = extra
+	if opt := r.IsEdns0(); nil != opt {
+		res.SetEdns0(dnsServerUDPSize, opt.Do())
+	} else if res.Rcode > 0xF {
+		//extended rcode could not be replied without OPT
+		res.Rcode = dns.RcodeServerFailure
+	}
+	res.Truncate(size)
+	return res
+}
+
+func proxyDNS(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	size := dns.MaxMsgSize
+	if w.LocalAddr().Network() == "udp" {
+		size = dnsClientUDPSize(r)
+	}
+	var res *dns.Msg
+	source := ""
+	if opt := r.IsEdns0(); nil != opt && opt.Version() != 0 {
+		res = new(dns.Msg)
+		res.SetRcode(r, dns.RcodeBadVers)
+	} else if len(r.Question) != 1 {
+		res = new(dns.Msg)
+		res.SetRcode(r, dns.RcodeFormatError)
+	} else {
+		var err error
+		res, source, err = dnsQueryClient(r)
+		if nil != err {
+			log.Printf("DNS query error:%v", err)
+			res = new(dns.Msg)
+			res.SetRcode(r, dns.RcodeServerFailure)
+		}
+	}
+	res = dnsReply(r, res, size)
+	if nil != dnsStat {
+		client := w.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(client); nil == err {
+			client = host
+		}
+		dnsStat.record(client, r, res, source, time.Since(start))
+	}
+	if err := w.WriteMsg(res); nil != err {
+		log.Printf("[WARN]Failed to write dns answer for reason:%v", err)
+	}
+}
+
+type dnsQueryLog struct {
+	Time   time.Time
+	Name   string
+	Type   string
+	Rcode  string
+	Answer string
+	//'blocked', 'hosts', 'fakeip' or 'resolved'
+	Source  string
+	Elapsed string
+}
+
+type dnsClientStat struct {
+	Client  string
+	Queries int64
+	Blocked int64
+	Hosts   int64
+	Failed  int64
+	Last    time.Time
+	//recent queries, the latest first
+	Logs []dnsQueryLog
+
+	logs   []dnsQueryLog
+	cursor int
+}
+
+//dnsQueryStat count queries & log recent queries of most recently active clients
+type dnsQueryStat struct {
+	mutex   sync.Mutex
+	clients *lru.Cache
+	logSize int
+}
+
+func newDNSQueryStat(logSize int) *dnsQueryStat {
+	s := &dnsQueryStat{logSize: logSize}
+	s.clients, _ = lru.New(dnsMaxStatClients)
+	return s
+}
+
+func (s *dnsQueryStat) record(client string, r *dns.Msg, res *dns.Msg, source string, elapsed time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var stat *dnsClientStat
+	if v, exist := s.clients.Get(client); exist {
+		stat = v.(*dnsClientStat)
+	} else {
+		stat = &dnsClientStat{Client: client}
+		s.clients.Add(client, stat)
+	}
+	stat.Queries++
+	stat.Last = time.Now()
+	switch {
+	case source == dnsSourceBlocked:
+		stat.Blocked++
+	case source == dnsSourceHosts:
+		stat.Hosts++
+	case res.Rcode == dns.RcodeServerFailure:
+		stat.Failed++
+	}
+	if s.logSize <= 0 {
+		return
+	}
+	entry := dnsQueryLog{
+		Time:    stat.Last,
+		Rcode:   dns.RcodeToString[res.Rcode],
+		Answer:  pickIP(res),
+		Source:  source,
+		Elapsed: elapsed.String(),
+	}
+	if len(r.Question) > 0 {
+		entry.Name = r.Question[0].Name
+		entry.Type = dns.TypeToString[r.Question[0].Qtype]
+	}
+	if len(stat.logs) < s.logSize {
+		stat.logs = append(stat.logs, entry)
+		return
+	}
+	stat.logs[stat.cursor] = entry
+	stat.cursor = (stat.cursor + 1) % len(stat.logs)
+}
+
+//snapshot return stats of client, or all clients if client is empty, the most recently active first
+func (s *dnsQueryStat) snapshot(client string) []dnsClientStat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var stats []dnsClientStat
+	keys := s.clients.Keys()
+	for i := len(keys) - 1; i >= 0; i-- {
+		v, exist := s.clients.Peek(keys[i])
+		if !exist || (len(client) > 0 && keys[i] != client) {
+			continue
+		}
+		stat := *(v.(*dnsClientStat))
+		stat.Logs = make([]dnsQueryLog, 0, len(stat.logs))
+		for j := len(stat.logs) - 1; j >= 0; j-- {
+			stat.Logs = append(stat.Logs, stat.logs[(stat.cursor+j)%len(stat.logs)])
+		}
+		stat.logs = nil
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func dnsStatCallback(w http.ResponseWriter, req *http.Request) {
+	if nil == dnsStat {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "No dns server enabled by 'LocalDNS.Listen'\n")
+		return
+	}
+	js, _ := json.MarshalIndent(dnsStat.snapshot(req.FormValue("client")), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+}
+
+//startDNSServers serve dns queries on both udp & tcp of addr
+func startDNSServers(addr string) {
+	dnsStat = newDNSQueryStat(GConf.LocalDNS.QueryLogSize)
+	handler := dns.HandlerFunc(proxyDNS)
+	if pc, err := net.ListenPacket("udp", addr); nil != err {
+		log.Printf("[ERROR]Failed to start dns server on udp:%s for reason:%v", addr, err)
+	} else {
+		dnsServers = append(dnsServers, &dns.Server{PacketConn: pc, Handler: handler})
+	}
+	if l, err := net.Listen("tcp", addr); nil != err {
+		log.Printf("[ERROR]Failed to start dns server on tcp:%s for reason:%v", addr, err)
+	} else {
+		dnsServers = append(dnsServers, &dns.Server{Listener: l, Handler: handler})
+	}
+	for _, server := range dnsServers {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); nil != err {
+				log.Printf("[ERROR]DNS server stopped for reason:%v", err)
+			}
+		}(server)
+	}
+}
+
+func stopDNSServers() {
+	for _, server := range dnsServers {
+		if err := server.Shutdown(); nil != err {
+			//not activated yet
+			if nil != server.PacketConn {
+				server.PacketConn.Close()
+			} else {
+				server.Listener.Close()
+			}
+		}
+	}
+	dnsServers = nil
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/matcher"
+	"github.com/yinqiwen/gsnova/local/hosts"
+)
+
+func TestDNSServer(t *testing.T) {
+	home, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(home)
+	hostsFile := filepath.Join(home, "hosts.json")
+	ioutil.WriteFile(hostsFile, []byte(`{"www.example.com":["10.0.0.1"], "*.v6.example.com":["fc00::1"]}`), 0666)
+	if err := hosts.Init(hostsFile); nil != err {
+		t.Fatalf("%v", err)
+	}
+	defer hosts.Clear()
+
+	ads := &ruleProvider{name: "ads", parse: parseDomainSet}
+	ads.load([]byte("0.0.0.0 ads.example.com localhost\n||tracker.com^\n@@||ok.tracker.com^\n||example.net/ads\n"))
+	ruleProvidersMutex.Lock()
+	ruleProviders["ads"] = ads
+	ruleProvidersMutex.Unlock()
+
+	//upstream answer large response by tcp only
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		res := testDNSAnswer(r)
+		if strings.HasPrefix(r.Question[0].Name, "big.") {
+			for i := 0; i < 40; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.1.1.%d", r.Question[0].Name, i))
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+		if w.LocalAddr().Network() == "udp" {
+			res.Truncate(dnsClientUDPSize(r))
+		}
+		w.WriteMsg(res)
+	})
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	addr := pc.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	udpServer := &dns.Server{PacketConn: pc, Handler: upstream}
+	tcpServer := &dns.Server{Listener: l, Handler: upstream}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	l, _ = net.Listen("tcp", "127.0.0.1:0")
+	listen := l.Addr().String()
+	l.Close()
+	oldConf := GConf
+	defer func() {
+		GConf = oldConf
+		ruleProvidersMutex.Lock()
+		delete(ruleProviders, "ads")
+		ruleProvidersMutex.Unlock()
+	}()
+	GConf.LocalDNS = LocalDNSConfig{Listen: listen, TrustedDNS: []string{addr}, Blocklist: []string{"ads"}, QueryLogSize: 2}
+	initDNS()
+
+	query := func(network string, name string, qtype uint16, edns bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		if edns {
+			m.SetEdns0(4096, true)
+		}
+		c := &dns.Client{Net: network, UDPSize: 4096}
+		res, _, err := c.Exchange(m, listen)
+		if nil != err {
+			t.Fatalf("Query %s failed:%v", name, err)
+		}
+		return res
+	}
+	if _, found := ads.get().(*matcher.DomainSet).Lookup("localhost"); found {
+		t.Fatalf("Expected localhost not blocked")
+	}
+	for _, name := range []string{"ads.example.com.", "x.tracker.com."} {
+		if res := query("udp", name, dns.TypeA, false); res.Rcode != dns.RcodeNameError {
+			t.Fatalf("Expected %s blocked, but got %v", name, res)
+		}
+	}
+	if res := query("udp", "ok.tracker.com.", dns.TypeA, false); pickIP(res) != "1.2.3.4" {
+		t.Fatalf("Expected exception not blocked, but got %v", res)
+	}
+	if res := query("tcp", "www.example.com.", dns.TypeA, false); pickIP(res) != "10.0.0.1" {
+		t.Fatalf("Expected answer from hosts, but got %v", res)
+	}
+	if res := query("udp", "a.v6.example.com.", dns.TypeAAAA, false); pickIP(res) != "fc00::1" {
+		t.Fatalf("Expected answer from hosts, but got %v", res)
+	}
+	if res := query("udp", "a.v6.example.com.", dns.TypeA, false); res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 {
+		t.Fatalf("Expected no IPv4 answer, but got %v", res)
+	}
+
+	//answer is truncated to 512 bytes without EDNS0
+	if res := query("udp", "big.example.com.", dns.TypeA, false); !res.Truncated || len(res.Answer) == 0 || len(res.Answer) > 30 || nil != res.IsEdns0() {
+		t.Fatalf("Expected truncated answer, but got %v", res)
+	}
+	if res := query("udp", "big.example.com.", dns.TypeA, true); res.Truncated || len(res.Answer) != 41 || nil == res.IsEdns0() || !res.IsEdns0().Do() {
+		t.Fatalf("Expected full answer with EDNS0, but got %v", res)
+	}
+	if res := query("tcp", "big.example.com.", dns.TypeA, false); res.Truncated || len(res.Answer) != 41 {
+		t.Fatalf("Expected full answer by tcp, but got %v", res)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().SetVersion(1)
+	if res, _, err := new(dns.Client).Exchange(m, listen); nil != err || res.Rcode != dns.RcodeBadVers {
+		t.Fatalf("Expected BADVERS, but got %v %v", res, err)
+	}
+
+	stopDNS()
+
+	stats := dnsStat.snapshot("127.0.0.1")
+	if len(stats) != 1 || stats[0].Queries != 10 || stats[0].Blocked != 2 || stats[0].Hosts != 3 || len(stats[0].Logs) != 2 {
+		t.Fatalf("Invalid stats:%+v", stats)
+	}
+	if stats[0].Logs[0].Rcode != dns.RcodeToString[dns.RcodeBadVers] || stats[0].Logs[1].Name != "big.example.com." {
+		t.Fatalf("Invalid query logs:%+v", stats[0].Logs)
+	}
+
+	GConf.LocalDNS.BlockMode = DNSBlockModeZero
+	m.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	if res, source := dnsAnswerLocal(m); nil == res || pickIP(res) != "::" || source != dnsSourceBlocked {
+		t.Fatalf("Expected zero IP, but got %v", res)
+	}
+}
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/netx"
+	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+const (
+	dnsUpstreamTimeout = 5 * time.Second
+	dnsMaxIdleConns    = 4
+	dohContentType     = "application/dns-message"
+)
+
+//root CAs to verify DoH/DoT servers, system roots are used if nil
+var dnsRootCAs *x509.CertPool
+
+//dnsUpstream exchange dns message with server 'host[:port]', 'tls://host[:853]' or 'https://host[:443]/path'
+type dnsUpstream interface {
+	exchange(r *dns.Msg) (*dns.Msg, error)
+}
+
+//dialDNSServer connect dns server directly or through proxy channel
+func dialDNSServer(channel string, network string, addr string, timeout time.Duration) (net.Conn, error) {
+	if len(channel) > 0 {
+		return dialChannel(channel, addr)
+	}
+	c, err := netx.DialTimeout(network, addr, timeout)
+	if nil != err {
+		return nil, err
+	}
+	if pc, ok := c.(getConnIntf); ok {
+		c = pc.GetConn()
+	}
+	return c, nil
+}
+
+type plainDNSUpstream struct {
+	network string
+	addr    string
+	channel string
+}
+
+func (u *plainDNSUpstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	network := u.network
+	if len(u.channel) > 0 {
+		//only stream is relayed by channels
+		network = "tcp"
+	}
+	res, err := u.exchangeBy(network, r)
+	if nil == err && res.Truncated && network == "udp" {
+		//query truncated answer again by tcp
+		return u.exchangeBy("tcp", r)
+	}
+	return res, err
+}
+
+func (u *plainDNSUpstream) exchangeBy(network string, r *dns.Msg) (*dns.Msg, error) {
+	c, err := dialDNSServer(u.channel, network, u.addr, 1*time.Second)
+	if nil != err {
+		return nil, err
+	}
+	defer c.Close()
+	//udp answer larger than 512 bytes is allowed by EDNS0
+	dnsConn := &dns.Conn{Conn: c, UDPSize: dns.MaxMsgSize}
+	dnsConn.SetDeadline(time.Now().Add(1 * time.Second))
+	if err = dnsConn.WriteMsg(r); nil != err {
+		return nil, err
+	}
+	return dnsConn.ReadMsg()
+}
+
+//tlsDNSUpstream is DNS-over-TLS(RFC7858) client, idle connections are reused by later queries
+type tlsDNSUpstream struct {
+	addr    string
+	channel string
+	config  *tls.Config
+
+	mutex sync.Mutex
+	idle  []*dns.Conn
+}
+
+func (u *tlsDNSUpstream) getConn() (*dns.Conn, bool, error) {
+	u.mutex.Lock()
+	if n := len(u.idle); n > 0 {
+		c := u.idle[n-1]
+		u.idle = u.idle[0 : n-1]
+		u.mutex.Unlock()
+		return c, true, nil
+	}
+	u.mutex.Unlock()
+	c, err := dialDNSServer(u.channel, "tcp", u.addr, dnsUpstreamTimeout)
+	if nil != err {
+		return nil, false, err
+	}
+	tlsConn := tls.Client(c, u.config)
+	tlsConn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+	if err = tlsConn.Handshake(); nil != err {
+		c.Close()
+		return nil, false, err
+	}
+	return &dns.Conn{Conn: tlsConn}, false, nil
+}
+
+func (u *tlsDNSUpstream) putConn(c *dns.Conn) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if len(u.idle) >= dnsMaxIdleConns {
+		c.Close()
+		return
+	}
+	u.idle = append(u.idle, c)
+}
+
+func (u *tlsDNSUpstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	for {
+		c, reused, err := u.getConn()
+		if nil != err {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+		err = c.WriteMsg(r)
+		var res *dns.Msg
+		if nil == err {
+			res, err = c.ReadMsg()
+		}
+		if nil == err && res.Id != r.Id {
+			err = dns.ErrId
+		}
+		if nil != err {
+			c.Close()
+			//idle connection may be closed by server already, retry with new connection
+			if reused {
+				continue
+			}
+			return nil, err
+		}
+		u.putConn(c)
+		return res, nil
+	}
+}
+
+//httpsDNSUpstream is DNS-over-HTTPS(RFC8484) client with HTTP/2 & keep-alive connections
+type httpsDNSUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsDNSUpstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	//id should be 0 for http cache
+	q := r.Copy()
+	q.Id = 0
+	content, err := q.Pack()
+	if nil != err {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u.url, bytes.NewReader(content))
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	res, err := u.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Invalid DoH response:%s", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if nil != err {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err = msg.Unpack(body); nil != err {
+		return nil, err
+	}
+	msg.Id = r.Id
+	return msg, nil
+}
+
+//channelDNSUpstream send query as udp event through proxy channel, the query is resolved by remote server
+type channelDNSUpstream struct {
+	addr    string
+	channel string
+}
+
+func newChannelDNSUpstream(server string, channel string) (dnsUpstream, error) {
+	if strings.Contains(server, "://") {
+		return nil, fmt.Errorf("Invalid dns server:%s for channel:%s, expected 'host[:port]'", server, channel)
+	}
+	if _, _, err := net.SplitHostPort(server); nil != err {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &channelDNSUpstream{addr: server, channel: channel}, nil
+}
+
+func (u *channelDNSUpstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	p := getProxyByName(u.channel)
+	if nil == p {
+		return nil, fmt.Errorf("No proxy channel:%s found", u.channel)
+	}
+	if p.Config().IsDirect() {
+		//direct channel resolve 'dns:53' by local dns again
+		return nil, fmt.Errorf("Channel:%s is not a remote channel", u.channel)
+	}
+	content, err := r.Pack()
+	if nil != err {
+		return nil, err
+	}
+	queue := newSessionBuffer()
+	session := newProxySession(getSessionId(), queue)
+	defer func() {
+		closeEv := &event.ConnCloseEvent{}
+		closeEv.SetId(session.id)
+		p.Serve(session, closeEv)
+		closeProxySession(session.id)
+	}()
+	ev := &event.UDPEvent{Content: content, Addr: u.addr}
+	ev.SetId(session.id)
+	if err = p.Serve(session, ev); nil != err {
+		return nil, err
+	}
+	//channels may ignore write error, old servers would resolve 'dns' as hostname
+	if rc := session.Remote; nil != rc && u.addr == event.RemoteDNSAddr && rc.remoteDNSUnsupported() {
+		return nil, fmt.Errorf("Server %s of channel:%s does not support remote dns, upgrade it or set 'TrustedDNS'", rc.Addr, u.channel)
+	}
+	deadline := time.Now().Add(dnsUpstreamTimeout)
+	for {
+		ev, err := queue.Read(deadline.Sub(time.Now()))
+		if nil != err {
+			return nil, err
+		}
+		switch ev := ev.(type) {
+		case *event.UDPEvent:
+			res := new(dns.Msg)
+			if err = res.Unpack(ev.Content); nil == err && res.Id == r.Id {
+				return res, nil
+			}
+		case *event.ConnCloseEvent:
+			return nil, fmt.Errorf("Closed by channel:%s", u.channel)
+		}
+	}
+}
+
+func newDNSTLSConfig(host string) *tls.Config {
+	return &tls.Config{ServerName: host, RootCAs: dnsRootCAs, ClientSessionCache: tls.NewLRUClientSessionCache(8)}
+}
+
+//newDNSUpstream create upstream of server, the DoH/DoT/TCP servers are connected through channel if not empty
+func newDNSUpstream(server string, network string, channel string) (dnsUpstream, error) {
+	lower := strings.ToLower(server)
+	switch {
+	case strings.HasPrefix(lower, "tls://"):
+		addr := server[len("tls://"):]
+		host, _, err := net.SplitHostPort(addr)
+		if nil != err {
+			host = addr
+			addr = net.JoinHostPort(addr, "853")
+		}
+		return &tlsDNSUpstream{addr: addr, channel: channel, config: newDNSTLSConfig(host)}, nil
+	case strings.HasPrefix(lower, "https://"):
+		u, err := url.Parse(server)
+		if nil != err {
+			return nil, err
+		}
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialDNSServer(channel, network, addr, dnsUpstreamTimeout)
+			},
+			TLSClientConfig:     newDNSTLSConfig(u.Hostname()),
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: dnsMaxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: dnsUpstreamTimeout,
+		}
+		return &httpsDNSUpstream{url: server, client: &http.Client{Transport: tr, Timeout: dnsUpstreamTimeout}}, nil
+	case strings.Contains(lower, "://"):
+		return nil, fmt.Errorf("Invalid dns server:%s", server)
+	}
+	if _, _, err := net.SplitHostPort(server); nil != err {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &plainDNSUpstream{network: network, addr: server, channel: channel}, nil
+}
+
+var dnsUpstreams = make(map[string]dnsUpstream)
+var dnsUpstreamsMutex sync.Mutex
+
+//getDNSUpstream return cached upstream, so that connections of DoH/DoT servers are reused
+func getDNSUpstream(server string, network string) (dnsUpstream, error) {
+	channel := GConf.LocalDNS.Channel
+	key := channel + "|" + network + "|" + server
+	dnsUpstreamsMutex.Lock()
+	defer dnsUpstreamsMutex.Unlock()
+	if u, exist := dnsUpstreams[key]; exist {
+		return u, nil
+	}
+	u, err := newDNSUpstream(server, network, channel)
+	if nil != err {
+		return nil, err
+	}
+	dnsUpstreams[key] = u
+	return u, nil
+}
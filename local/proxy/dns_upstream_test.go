@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+func testDNSAnswer(r *dns.Msg) *dns.Msg {
+	res := new(dns.Msg)
+	res.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 1.2.3.4")
+	res.Answer = append(res.Answer, rr)
+	return res
+}
+
+func testDNSUpstream(t *testing.T, u dnsUpstream) {
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		res, err := u.exchange(m)
+		if nil != err {
+			t.Fatalf("%v", err)
+		}
+		if res.Id != m.Id || pickIP(res) != "1.2.3.4" {
+			t.Fatalf("Invalid answer:%v", res)
+		}
+	}
+}
+
+func TestDNSUpstream(t *testing.T) {
+	var protos []string
+	doh := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos = append(protos, req.Proto)
+		body, _ := ioutil.ReadAll(req.Body)
+		m := new(dns.Msg)
+		if req.Header.Get("Content-Type") != dohContentType || nil != m.Unpack(body) || m.Id != 0 {
+			w.WriteHeader(400)
+			return
+		}
+		content, _ := testDNSAnswer(m).Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(content)
+	}))
+	doh.EnableHTTP2 = true
+	doh.StartTLS()
+	defer doh.Close()
+
+	//certificate is not trusted yet
+	u, _ := newDNSUpstream(doh.URL+"/dns-query", "udp", "")
+	if _, err := u.exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); nil == err {
+		t.Fatalf("Expected certificate error")
+	}
+	dnsRootCAs = x509.NewCertPool()
+	dnsRootCAs.AddCert(doh.Certificate())
+	defer func() { dnsRootCAs = nil }()
+
+	u, _ = newDNSUpstream(doh.URL+"/dns-query", "udp", "")
+	testDNSUpstream(t, u)
+	if len(protos) != 3 || protos[0] != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2 requests, but got %v", protos)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+	var conns int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func(c net.Conn) {
+				defer c.Close()
+				dnsConn := &dns.Conn{Conn: c}
+				for {
+					m, err := dnsConn.ReadMsg()
+					if nil != err {
+						return
+					}
+					dnsConn.WriteMsg(testDNSAnswer(m))
+				}
+			}(c)
+		}
+	}()
+	u, _ = newDNSUpstream("tls://"+l.Addr().String(), "udp", "")
+	testDNSUpstream(t, u)
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected connection reused, but got %d connections", n)
+	}
+
+	if _, err = newDNSUpstream("quic://8.8.8.8", "udp", ""); nil == err {
+		t.Errorf("Expected error for invalid server")
+	}
+}
+
+//testDNSChannel answer dns queries in udp events like remote server
+type testDNSChannel struct {
+	failoverProxy
+	conf  ProxyChannelConfig
+	addrs []string
+	//remote channel the queries relayed by
+	remote *RemoteChannel
+}
+
+func (p *testDNSChannel) Config() *ProxyChannelConfig {
+	return &p.conf
+}
+
+func (p *testDNSChannel) Serve(session *ProxySession, ev event.Event) error {
+	if nil != p.remote {
+		session.SetRemoteChannel(p.remote)
+	}
+	if udp, ok := ev.(*event.UDPEvent); ok {
+		if nil != p.remote && p.remote.Write(udp) == ErrRemoteDNSUnsupported {
+			return nil
+		}
+		p.addrs = append(p.addrs, udp.Addr)
+		m := new(dns.Msg)
+		m.Unpack(udp.Content)
+		content, _ := testDNSAnswer(m).Pack()
+		res := &event.UDPEvent{Content: content}
+		res.SetId(ev.GetId())
+		go HandleEvent(res)
+	}
+	return nil
+}
+
+func TestTrustedChannel(t *testing.T) {
+	ch := &testDNSChannel{conf: ProxyChannelConfig{Name: "remote", Type: "VPS"}}
+	proxyTableMutex.Lock()
+	proxyTable["remote"] = ch
+	proxyTableMutex.Unlock()
+	oldConf := GConf
+	defer func() {
+		GConf = oldConf
+		proxyTableMutex.Lock()
+		delete(proxyTable, "remote")
+		proxyTableMutex.Unlock()
+	}()
+
+	GConf.LocalDNS = LocalDNSConfig{TrustedChannel: "remote"}
+	if ip, err := DnsGetDoaminIP("www.google.com"); nil != err || ip != "1.2.3.4" {
+		t.Fatalf("Invalid answer:%s %v", ip, err)
+	}
+	GConf.LocalDNS.TrustedDNS = []string{"8.8.8.8"}
+	if ip, err := DnsGetDoaminIP("www.google.com"); nil != err || ip != "1.2.3.4" {
+		t.Fatalf("Invalid answer:%s %v", ip, err)
+	}
+	if len(ch.addrs) != 2 || ch.addrs[0] != event.RemoteDNSAddr || ch.addrs[1] != "8.8.8.8:53" {
+		t.Errorf("Invalid query address:%v", ch.addrs)
+	}
+
+	//old servers resolve 'dns' as hostname
+	ch.remote = &RemoteChannel{Addr: "old"}
+	ch.remote.updateRemoteDNS(0)
+	q := new(dns.Msg)
+	q.SetQuestion("www.google.com.", dns.TypeA)
+	u, _ := newChannelDNSUpstream(event.RemoteDNSAddr, "remote")
+	if _, err := u.exchange(q); nil == err || !strings.Contains(err.Error(), "does not support remote dns") {
+		t.Errorf("Expected remote dns unsupported error, but got %v", err)
+	}
+	u, _ = newChannelDNSUpstream("8.8.8.8", "remote")
+	if res, err := u.exchange(q); nil != err || len(res.Answer) == 0 {
+		t.Errorf("Invalid answer from explicit server:%v %v", res, err)
+	}
+}
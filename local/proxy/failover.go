@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+//max request bytes buffered for replay on next channel
+const maxFailoverPendingBytes = 256 * 1024
+
+//RemoteNames is the ordered channel names of a PAC rule, configured as a string or string array
+type RemoteNames []string
+
+func (r *RemoteNames) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); nil == err {
+		*r = RemoteNames{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); nil != err {
+		return err
+	}
+	*r = RemoteNames(names)
+	return nil
+}
+
+var lastGoodChannels, _ = lru.New(4096)
+
+func dumpLastGoodChannels(w io.Writer) {
+	fmt.Fprintf(w, "LastGoodChannels:\n")
+	for _, host := range lastGoodChannels.Keys() {
+		if name, ok := lastGoodChannels.Peek(host); ok {
+			fmt.Fprintf(w, "%s=%s\n", host, name)
+		}
+	}
+}
+
+//failoverProxy serve the session by ordered proxies of PAC rule,
+//and retry next one if current failed to open the session before any bytes relayed back.
+type failoverProxy struct {
+	mutex        sync.Mutex
+	session      *ProxySession
+	host         string
+	proxies      []Proxy
+	cursor       int
+	pending      []event.Event
+	pendingBytes int
+	//set by the reader before first bytes relayed back, atomic since checked for every chunk
+	relayed int32
+	//retry is replaying pending events by next proxy
+	replaying bool
+	//events served by current proxy
+	served int
+	//current proxy failed to serve the first event, or remote failed to connect the target
+	openFailed bool
+}
+
+func (f *failoverProxy) current() Proxy {
+	return f.proxies[f.cursor]
+}
+
+func (f *failoverProxy) Init(conf ProxyChannelConfig) error {
+	return nil
+}
+func (f *failoverProxy) Config() *ProxyChannelConfig {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.current().Config()
+}
+func (f *failoverProxy) Destory() error {
+	return nil
+}
+func (f *failoverProxy) Features() Feature {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.current().Features()
+}
+func (f *failoverProxy) PrintStat(w io.Writer) {
+}
+
+//Serve buffer the event for replay, the lock is not held while serving since it may block on flow window.
+func (f *failoverProxy) Serve(session *ProxySession, ev event.Event) error {
+	f.mutex.Lock()
+	if f.replaying {
+		//served in order by retry
+		f.pending = append(f.pending, ev)
+		f.mutex.Unlock()
+		return nil
+	}
+	if atomic.LoadInt32(&f.relayed) == 0 && nil != f.pending {
+		size := 0
+		switch ev.(type) {
+		case *event.TCPOpenEvent:
+		case *event.UDPEvent:
+			size = len(ev.(*event.UDPEvent).Content)
+		case *event.TCPChunkEvent:
+			size = len(ev.(*event.TCPChunkEvent).Content)
+		case *event.HTTPRequestEvent:
+			size = len(ev.(*event.HTTPRequestEvent).Content)
+		default:
+			size = -1
+		}
+		if size >= 0 {
+			f.pendingBytes += size
+			f.pending = append(f.pending, ev)
+			if f.pendingBytes > maxFailoverPendingBytes {
+				//too large to replay, disable failover
+				f.pending = nil
+			}
+		}
+	}
+	p, cursor, first := f.current(), f.cursor, f.served == 0
+	f.served++
+	f.mutex.Unlock()
+	return f.serve(p, cursor, first, ev)
+}
+
+//serve the event by proxy at cursor, and mark open failed if the first event failed
+func (f *failoverProxy) serve(p Proxy, cursor int, first bool, ev event.Event) error {
+	err := p.Serve(f.session, ev)
+	if nil != err && first {
+		f.mutex.Lock()
+		if f.cursor == cursor {
+			f.openFailed = true
+		}
+		f.mutex.Unlock()
+	}
+	return err
+}
+
+//onOpenFailed is invoked if remote server notified that it failed to connect the target
+func (f *failoverProxy) onOpenFailed() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.openFailed = true
+}
+
+//onRelayed is invoked before the first bytes relayed back, failover is not allowed after that.
+func (f *failoverProxy) onRelayed() {
+	if atomic.LoadInt32(&f.relayed) == 1 || !atomic.CompareAndSwapInt32(&f.relayed, 0, 1) {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.replaying {
+		f.pending = nil
+	}
+	if len(f.proxies) > 1 && len(f.host) > 0 {
+		lastGoodChannels.Add(f.host, f.current().Config().Name)
+	}
+}
+
+//retry serve the buffered events by next proxy if the session closed since current proxy failed to open it,
+//other closes are not retried since the request may be accepted by remote already.
+func (f *failoverProxy) retry() bool {
+	f.mutex.Lock()
+	if !f.openFailed || atomic.LoadInt32(&f.relayed) == 1 || nil == f.pending || f.cursor+1 >= len(f.proxies) || f.current().Config().Type == "REJECT" {
+		f.mutex.Unlock()
+		return false
+	}
+	old := f.current()
+	f.cursor++
+	f.served = 0
+	f.openFailed = false
+	f.replaying = true
+	p, cursor := f.current(), f.cursor
+	f.mutex.Unlock()
+
+	if nil != f.session.Remote {
+		closeEv := &event.ConnCloseEvent{}
+		closeEv.SetId(f.session.id)
+		old.Serve(f.session, closeEv)
+	}
+	f.session.resetRemote()
+	if name, ok := lastGoodChannels.Peek(f.host); ok && name == old.Config().Name {
+		lastGoodChannels.Remove(f.host)
+	}
+	log.Printf("Session:%d failover from channel:%s to %s for %s", f.session.id, old.Config().Name, p.Config().Name, f.host)
+	//events published by Serve while replaying are served here too
+	for i := 0; ; i++ {
+		f.mutex.Lock()
+		if i >= len(f.pending) {
+			f.replaying = false
+			if atomic.LoadInt32(&f.relayed) == 1 {
+				f.pending = nil
+			}
+			f.mutex.Unlock()
+			break
+		}
+		ev := f.pending[i]
+		f.served++
+		f.mutex.Unlock()
+		if nil != f.serve(p, cursor, i == 0, ev) {
+			f.mutex.Lock()
+			f.replaying = false
+			f.mutex.Unlock()
+			break
+		}
+	}
+	return true
+}
+
+//findFailoverProxy return proxy for the session by PAC rule, wrapped with failover if more than one remote configured.
+func (cfg *ProxyConfig) findFailoverProxy(session *ProxySession, proto string, ip string, req *http.Request) Proxy {
+	proxies, trace := cfg.findProxiesByRequest(proto, ip, session.src, session.user, req)
+	session.route = trace
+	if len(proxies) == 0 {
+		log.Printf("No proxy found by route:%v", trace)
+		return nil
+	}
+	if len(proxies) == 1 {
+		return proxies[0]
+	}
+	host := ip
+	if nil != req {
+		host = req.Host
+	}
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if name, ok := lastGoodChannels.Get(host); ok {
+		for i, p := range proxies {
+			if i > 0 && p.Config().Name == name {
+				reordered := []Proxy{p}
+				reordered = append(reordered, proxies[:i]...)
+				proxies = append(reordered, proxies[i+1:]...)
+				break
+			}
+		}
+	}
+	return &failoverProxy{
+		session: session,
+		host:    host,
+		proxies: proxies,
+		pending: make([]event.Event, 0),
+	}
+}
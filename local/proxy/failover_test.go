@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+//testFailoverChannel record served events, and fail to open if openErr set
+type testFailoverChannel struct {
+	failoverProxy
+	conf    ProxyChannelConfig
+	openErr error
+	events  []event.Event
+	//chunks wait on it like a full flow window
+	block chan struct{}
+}
+
+func (p *testFailoverChannel) Config() *ProxyChannelConfig {
+	return &p.conf
+}
+
+func (p *testFailoverChannel) Serve(session *ProxySession, ev event.Event) error {
+	p.events = append(p.events, ev)
+	if _, ok := ev.(*event.TCPOpenEvent); ok {
+		return p.openErr
+	}
+	if _, ok := ev.(*event.TCPChunkEvent); ok && nil != p.block {
+		<-p.block
+	}
+	return nil
+}
+
+func newTestFailover(first, second *testFailoverChannel) *failoverProxy {
+	return &failoverProxy{
+		session: &ProxySession{id: 1},
+		host:    "example.com",
+		proxies: []Proxy{first, second},
+		pending: make([]event.Event, 0),
+	}
+}
+
+func TestFailoverRetry(t *testing.T) {
+	//closed after opened, request may be accepted by remote already
+	first := &testFailoverChannel{conf: ProxyChannelConfig{Name: "first"}}
+	second := &testFailoverChannel{conf: ProxyChannelConfig{Name: "second"}}
+	f := newTestFailover(first, second)
+	f.Serve(f.session, &event.TCPOpenEvent{Addr: "example.com:80"})
+	f.Serve(f.session, &event.TCPChunkEvent{Content: []byte("POST / HTTP/1.1\r\n\r\n")})
+	if f.retry() || len(second.events) != 0 {
+		t.Fatalf("Expected no retry for close after opened")
+	}
+
+	//local open failed
+	first = &testFailoverChannel{conf: ProxyChannelConfig{Name: "first"}, openErr: errors.New("dial failed")}
+	second = &testFailoverChannel{conf: ProxyChannelConfig{Name: "second"}}
+	f = newTestFailover(first, second)
+	f.Serve(f.session, &event.TCPOpenEvent{Addr: "example.com:80"})
+	f.Serve(f.session, &event.TCPChunkEvent{Content: []byte("GET / HTTP/1.1\r\n\r\n")})
+	if !f.retry() || len(second.events) != 2 {
+		t.Fatalf("Expected retry for open failure, but second channel served %d events", len(second.events))
+	}
+	if f.retry() {
+		t.Fatalf("Expected no retry without more channels")
+	}
+
+	//remote notified connect failure
+	first = &testFailoverChannel{conf: ProxyChannelConfig{Name: "first"}}
+	second = &testFailoverChannel{conf: ProxyChannelConfig{Name: "second"}}
+	f = newTestFailover(first, second)
+	f.Serve(f.session, &event.TCPOpenEvent{Addr: "example.com:80"})
+	f.onOpenFailed()
+	if !f.retry() || len(second.events) != 1 {
+		t.Fatalf("Expected retry for remote connect failure")
+	}
+
+	//no retry after relayed
+	first = &testFailoverChannel{conf: ProxyChannelConfig{Name: "first"}}
+	second = &testFailoverChannel{conf: ProxyChannelConfig{Name: "second"}}
+	f = newTestFailover(first, second)
+	f.Serve(f.session, &event.TCPOpenEvent{Addr: "example.com:80"})
+	f.onRelayed()
+	f.onOpenFailed()
+	if f.retry() {
+		t.Fatalf("Expected no retry after relayed")
+	}
+
+	//relayed chunks are not blocked by serving session
+	first = &testFailoverChannel{conf: ProxyChannelConfig{Name: "first"}, block: make(chan struct{})}
+	f = newTestFailover(first, second)
+	f.Serve(f.session, &event.TCPOpenEvent{Addr: "example.com:80"})
+	go f.Serve(f.session, &event.TCPChunkEvent{Content: []byte("GET / HTTP/1.1\r\n\r\n")})
+	done := make(chan struct{})
+	go func() {
+		f.onRelayed()
+		f.Config()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Relayed chunks blocked by serving session")
+	}
+	close(first.block)
+}
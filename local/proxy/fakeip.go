@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/matcher"
+)
+
+const (
+	defaultFakeIPSize = 65536
+	//network & gateway address of the range are not allocated
+	firstFakeIPIndex   = 2
+	fakeIPTTL          = 1
+	fakeIPSaveInterval = 1 * time.Minute
+	fakeIPFile         = "fakeip.txt"
+)
+
+type fakeIPEntry struct {
+	domain string
+	index  uint32
+}
+
+//fakeIPPool allocate fake IP in reserved range for domain, the A & AAAA answers of domain share same index,
+//the least recently used domain is evicted if the pool is full.
+type fakeIPPool struct {
+	mutex   sync.Mutex
+	net4    *net.IPNet
+	net6    *net.IPNet
+	limit   uint32
+	next    uint32
+	lru     *list.List
+	domains map[string]*list.Element
+	indexes map[uint32]*list.Element
+	exclude *matcher.Patterns
+	file    string
+	dirty   bool
+	stopCh  chan struct{}
+}
+
+//rangeSize return count of addresses in network, at most 2^32
+func rangeSize(ipnet *net.IPNet) uint64 {
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones >= 32 {
+		return 1 << 32
+	}
+	return 1 << uint(bits-ones)
+}
+
+func parseFakeIPRange(cidr string, v6 bool) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if nil != err {
+		return nil, err
+	}
+	if v6 != (nil == ipnet.IP.To4()) {
+		return nil, fmt.Errorf("Invalid fake IP range:%s", cidr)
+	}
+	if rangeSize(ipnet) <= firstFakeIPIndex+1 {
+		return nil, fmt.Errorf("Fake IP range:%s is too small", cidr)
+	}
+	return ipnet, nil
+}
+
+func newFakeIPPool(conf FakeIPConfig, file string) (*fakeIPPool, error) {
+	p := &fakeIPPool{
+		lru:     list.New(),
+		domains: make(map[string]*list.Element),
+		indexes: make(map[uint32]*list.Element),
+		file:    file,
+	}
+	var err error
+	if p.net4, err = parseFakeIPRange(conf.CIDR, false); nil != err {
+		return nil, err
+	}
+	size := rangeSize(p.net4)
+	if len(conf.CIDR6) > 0 {
+		if p.net6, err = parseFakeIPRange(conf.CIDR6, true); nil != err {
+			return nil, err
+		}
+		if size6 := rangeSize(p.net6); size6 < size {
+			size = size6
+		}
+	}
+	//broadcast address is not allocated
+	size = size - 1
+	limit := uint64(defaultFakeIPSize)
+	if conf.Size > 0 {
+		limit = uint64(conf.Size)
+	}
+	if limit+firstFakeIPIndex < size {
+		size = limit + firstFakeIPIndex
+	}
+	p.limit = uint32(size)
+	p.next = firstFakeIPIndex
+	var exclude []string
+	for _, domain := range conf.Exclude {
+		exclude = append(exclude, strings.ToLower(domain))
+	}
+	p.exclude = matcher.NewPatterns(exclude)
+	return p, nil
+}
+
+func fakeIPAdd(base net.IP, index uint32) net.IP {
+	ip := make(net.IP, len(base))
+	copy(ip, base)
+	low := ip[len(ip)-4:]
+	binary.BigEndian.PutUint32(low, binary.BigEndian.Uint32(low)+index)
+	return ip
+}
+
+func fakeIPIndex(ipnet *net.IPNet, ip net.IP) (uint32, bool) {
+	if nil == ipnet || !ipnet.Contains(ip) {
+		return 0, false
+	}
+	base := ipnet.IP
+	if len(base) == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	if !bytes.Equal(ip[0:len(ip)-4], base[0:len(base)-4]) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip[len(ip)-4:]) - binary.BigEndian.Uint32(base[len(base)-4:]), true
+}
+
+//add must be called with lock held
+func (p *fakeIPPool) add(domain string, index uint32) {
+	e := p.lru.PushFront(&fakeIPEntry{domain, index})
+	p.domains[domain] = e
+	p.indexes[index] = e
+	p.dirty = true
+}
+
+//alloc return index of domain, the domain is marked as recently used
+func (p *fakeIPPool) alloc(domain string) uint32 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if e, exist := p.domains[domain]; exist {
+		p.lru.MoveToFront(e)
+		return e.Value.(*fakeIPEntry).index
+	}
+	for p.next < p.limit {
+		index := p.next
+		p.next++
+		if _, used := p.indexes[index]; !used {
+			p.add(domain, index)
+			return index
+		}
+	}
+	//reuse index of least recently used domain
+	e := p.lru.Back()
+	entry := e.Value.(*fakeIPEntry)
+	p.lru.Remove(e)
+	delete(p.domains, entry.domain)
+	p.add(domain, entry.index)
+	return entry.index
+}
+
+//lookup return domain of fake IP, the second return value is true if ip in fake IP range
+func (p *fakeIPPool) lookup(ip net.IP) (string, bool) {
+	index, ok := fakeIPIndex(p.net4, ip)
+	if !ok {
+		if index, ok = fakeIPIndex(p.net6, ip); !ok {
+			return "", false
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if e, exist := p.indexes[index]; exist {
+		p.lru.MoveToFront(e)
+		return e.Value.(*fakeIPEntry).domain, true
+	}
+	return "", true
+}
+
+//answer return fake answer of A/AAAA query, nil if the query should be resolved by dns servers
+func (p *fakeIPPool) answer(r *dns.Msg) *dns.Msg {
+	if len(r.Question) != 1 || r.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	q := r.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	domain := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if len(domain) == 0 || !strings.Contains(domain, ".") || nil != net.ParseIP(domain) || p.exclude.Match(domain) {
+		return nil
+	}
+	res := new(dns.Msg)
+	res.SetReply(r)
+	res.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: fakeIPTTL}
+	if q.Qtype == dns.TypeA {
+		res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: fakeIPAdd(p.net4.IP, p.alloc(domain))})
+	} else if nil != p.net6 {
+		res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: fakeIPAdd(p.net6.IP, p.alloc(domain))})
+	}
+	return res
+}
+
+//load restore table saved by 'save', lines are 'index domain' from least to most recently used
+func (p *fakeIPPool) load() error {
+	f, err := os.Open(p.file)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		index, err := strconv.ParseUint(fields[0], 10, 32)
+		if nil != err || index < firstFakeIPIndex || index >= uint64(p.limit) {
+			continue
+		}
+		if e, exist := p.indexes[uint32(index)]; exist {
+			p.lru.Remove(e)
+			delete(p.domains, e.Value.(*fakeIPEntry).domain)
+		}
+		if e, exist := p.domains[fields[1]]; exist {
+			p.lru.Remove(e)
+			delete(p.indexes, e.Value.(*fakeIPEntry).index)
+		}
+		p.add(fields[1], uint32(index))
+	}
+	p.dirty = false
+	return scanner.Err()
+}
+
+func (p *fakeIPPool) save() error {
+	p.mutex.Lock()
+	if !p.dirty {
+		p.mutex.Unlock()
+		return nil
+	}
+	var buf bytes.Buffer
+	for e := p.lru.Back(); nil != e; e = e.Prev() {
+		entry := e.Value.(*fakeIPEntry)
+		fmt.Fprintf(&buf, "%d %s\n", entry.index, entry.domain)
+	}
+	p.dirty = false
+	p.mutex.Unlock()
+	tmp := p.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0666); nil != err {
+		return err
+	}
+	return os.Rename(tmp, p.file)
+}
+
+func (p *fakeIPPool) start() {
+	p.stopCh = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(fakeIPSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopCh:
+				return
+			case <-ticker.C:
+				if err := p.save(); nil != err {
+					log.Printf("[ERROR]Failed to save fake IP table for reason:%v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (p *fakeIPPool) stop() {
+	close(p.stopCh)
+	if err := p.save(); nil != err {
+		log.Printf("[ERROR]Failed to save fake IP table for reason:%v", err)
+	}
+}
+
+var fakeIPs *fakeIPPool
+
+func initFakeIP() {
+	if len(GConf.LocalDNS.FakeIP.CIDR) == 0 {
+		return
+	}
+	p, err := newFakeIPPool(GConf.LocalDNS.FakeIP, filepath.Join(proxyHome, fakeIPFile))
+	if nil != err {
+		log.Printf("[ERROR]Failed to init fake IP for reason:%v", err)
+		return
+	}
+	if err = p.load(); nil != err && !os.IsNotExist(err) {
+		log.Printf("[ERROR]Failed to load fake IP table for reason:%v", err)
+	}
+	p.start()
+	fakeIPs = p
+	log.Printf("Fake IP enabled in %s with %d domains restored", p.net4, p.lru.Len())
+}
+
+func stopFakeIP() {
+	if nil != fakeIPs {
+		fakeIPs.stop()
+		fakeIPs = nil
+	}
+}
+
+//lookupFakeIP return domain of host if host is a fake IP, the second return value is true if host
+//is in fake IP range, the domain is empty if the fake IP is expired.
+func lookupFakeIP(host string) (string, bool) {
+	if nil == fakeIPs {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return "", false
+	}
+	return fakeIPs.lookup(ip)
+}
+
+//mapFakeIPAddr replace fake IP of address 'host:port' by its domain
+func mapFakeIPAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return addr, nil
+	}
+	domain, fake := lookupFakeIP(host)
+	if !fake {
+		return addr, nil
+	}
+	if len(domain) == 0 {
+		return addr, fmt.Errorf("No domain found for fake IP:%s", host)
+	}
+	return net.JoinHostPort(domain, port), nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	home, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(home)
+	file := filepath.Join(home, fakeIPFile)
+	conf := FakeIPConfig{CIDR: "198.18.0.0/15", CIDR6: "fc00::/64", Size: 2, Exclude: []string{"*.lan"}}
+	p, err := newFakeIPPool(conf, file)
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+
+	query := func(domain string, qtype uint16) string {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(domain), qtype)
+		res := p.answer(m)
+		if nil == res {
+			return ""
+		}
+		if len(res.Answer) == 0 {
+			return "none"
+		}
+		switch rr := res.Answer[0].(type) {
+		case *dns.A:
+			return rr.A.String()
+		case *dns.AAAA:
+			return rr.AAAA.String()
+		}
+		return ""
+	}
+	if ip := query("www.google.com", dns.TypeA); ip != "198.18.0.2" {
+		t.Fatalf("Invalid fake IP:%s", ip)
+	}
+	if ip := query("WWW.Google.com", dns.TypeAAAA); ip != "fc00::2" {
+		t.Fatalf("Invalid fake IPv6:%s", ip)
+	}
+	if ip := query("router.lan", dns.TypeA); ip != "" {
+		t.Fatalf("Expected excluded domain, but got %s", ip)
+	}
+	if ip := query("example.com", dns.TypeA); ip != "198.18.0.3" {
+		t.Fatalf("Invalid fake IP:%s", ip)
+	}
+
+	fakeIPs = p
+	defer func() { fakeIPs = nil }()
+	if addr, err := mapFakeIPAddr("[fc00::2]:443"); nil != err || addr != "www.google.com:443" {
+		t.Fatalf("Invalid mapped addr:%s %v", addr, err)
+	}
+	if addr, err := mapFakeIPAddr("8.8.8.8:53"); nil != err || addr != "8.8.8.8:53" {
+		t.Fatalf("Invalid mapped addr:%s %v", addr, err)
+	}
+
+	//example.com is least recently used & evicted
+	if ip := query("github.com", dns.TypeA); ip != "198.18.0.3" {
+		t.Fatalf("Invalid fake IP:%s", ip)
+	}
+	if _, err := mapFakeIPAddr("198.18.0.4:80"); nil == err {
+		t.Fatalf("Expected error for unallocated fake IP")
+	}
+
+	if err = p.save(); nil != err {
+		t.Fatalf("%v", err)
+	}
+	p, _ = newFakeIPPool(conf, file)
+	if err = p.load(); nil != err {
+		t.Fatalf("%v", err)
+	}
+	fakeIPs = p
+	if domain, _ := lookupFakeIP("198.18.0.3"); domain != "github.com" {
+		t.Fatalf("Invalid restored domain:%s", domain)
+	}
+	//github.com is touched, www.google.com is evicted
+	if ip := query("example.com", dns.TypeA); ip != "198.18.0.2" {
+		t.Fatalf("Invalid fake IP:%s", ip)
+	}
+}
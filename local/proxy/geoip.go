@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+//countryDB lookup ISO country code of IP, return empty string if not found
+type countryDB interface {
+	lookupCountry(ip net.IP) string
+}
+
+type mmdbCountryDB struct {
+	reader *maxminddb.Reader
+}
+
+func (db *mmdbCountryDB) lookupCountry(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.reader.Lookup(ip, &record); nil != err {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+type countryRange struct {
+	start, end net.IP
+	country    string
+}
+
+//cidrCountryDB is sorted IPv4/IPv6 ranges loaded from RIR delegated stats or CIDR list
+type cidrCountryDB struct {
+	ranges []countryRange
+}
+
+func (db *cidrCountryDB) addRange(start, end net.IP, country string) {
+	db.ranges = append(db.ranges, countryRange{start.To16(), end.To16(), strings.ToUpper(country)})
+}
+
+func (db *cidrCountryDB) addNet(ipnet *net.IPNet, country string) {
+	start := ipnet.IP.To16()
+	end := make(net.IP, net.IPv6len)
+	mask := ipnet.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[0:12], mask...)
+	}
+	for i := range end {
+		end[i] = start[i] | ^mask[i]
+	}
+	db.addRange(start, end, country)
+}
+
+//nextIP return ip+1, nil if overflow
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+//prevIP return ip-1, ip should not be zero
+func prevIP(ip net.IP) net.IP {
+	prev := append(net.IP{}, ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xFF {
+			break
+		}
+	}
+	return prev
+}
+
+//size return end-start of the range in big endian bytes
+func (r *countryRange) size() []byte {
+	size := make([]byte, len(r.end))
+	borrow := 0
+	for i := len(size) - 1; i >= 0; i-- {
+		v := int(r.end[i]) - int(r.start[i]) - borrow
+		borrow = 0
+		if v < 0 {
+			v += 256
+			borrow = 1
+		}
+		size[i] = byte(v)
+	}
+	return size
+}
+
+type sizedRange struct {
+	*countryRange
+	span  []byte
+	index int
+}
+
+//sizedRangeHeap pop the narrowest range first, and the later added one for same size
+type sizedRangeHeap []sizedRange
+
+func (h sizedRangeHeap) Len() int { return len(h) }
+func (h sizedRangeHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].span, h[j].span); c != 0 {
+		return c < 0
+	}
+	return h[i].index > h[j].index
+}
+func (h sizedRangeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sizedRangeHeap) Push(x interface{}) { *h = append(*h, x.(sizedRange)) }
+func (h *sizedRangeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+//split overlapped ranges into sorted disjoint ones, the narrower range wins in overlapped part like nested CIDRs,
+//and adjacent ranges of same country are merged.
+func (db *cidrCountryDB) split() {
+	var points []net.IP
+	sorted := make([]sizedRange, len(db.ranges))
+	for i := range db.ranges {
+		r := &db.ranges[i]
+		sorted[i] = sizedRange{r, r.size(), i}
+		points = append(points, r.start)
+		if after := nextIP(r.end); nil != after {
+			points = append(points, after)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return bytes.Compare(points[i], points[j]) < 0 })
+	sort.SliceStable(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].start, sorted[j].start) < 0 })
+	var splitted []countryRange
+	var active sizedRangeHeap
+	cursor := 0
+	for k, p := range points {
+		if k > 0 && points[k-1].Equal(p) {
+			continue
+		}
+		for cursor < len(sorted) && bytes.Compare(sorted[cursor].start, p) <= 0 {
+			heap.Push(&active, sorted[cursor])
+			cursor++
+		}
+		for active.Len() > 0 && bytes.Compare(active[0].end, p) < 0 {
+			heap.Pop(&active)
+		}
+		if active.Len() == 0 {
+			continue
+		}
+		//segment ends before next point
+		end := active[0].end
+		for _, next := range points[k+1:] {
+			if !next.Equal(p) {
+				if prev := prevIP(next); bytes.Compare(prev, end) < 0 {
+					end = prev
+				}
+				break
+			}
+		}
+		country := active[0].country
+		if n := len(splitted); n > 0 && splitted[n-1].country == country && nextIP(splitted[n-1].end).Equal(p) {
+			splitted[n-1].end = end
+			continue
+		}
+		splitted = append(splitted, countryRange{p, end, country})
+	}
+	db.ranges = splitted
+}
+
+func (db *cidrCountryDB) lookupCountry(ip net.IP) string {
+	ip = ip.To16()
+	if nil == ip {
+		return ""
+	}
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, ip) > 0
+	})
+	if i > 0 && bytes.Compare(ip, db.ranges[i-1].end) <= 0 {
+		return db.ranges[i-1].country
+	}
+	return ""
+}
+
+//addRIRLine add line of RIR delegated stats like 'apnic|CN|ipv4|1.0.1.0|256|20110414|allocated'
+func (db *cidrCountryDB) addRIRLine(line string) {
+	sp := strings.Split(line, "|")
+	if len(sp) < 5 || len(sp[1]) != 2 {
+		return
+	}
+	start := net.ParseIP(sp[3])
+	value, err := strconv.ParseUint(sp[4], 10, 32)
+	if nil == start || nil != err || value == 0 {
+		return
+	}
+	switch sp[2] {
+	case "ipv4":
+		if nil == start.To4() {
+			return
+		}
+		//value is count of addresses
+		v := binary.BigEndian.Uint32(start.To4())
+		end := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(end, v+uint32(value-1))
+		db.addRange(start, end, sp[1])
+	case "ipv6":
+		//value is prefix length
+		db.addNet(&net.IPNet{IP: start, Mask: net.CIDRMask(int(value), 128)}, sp[1])
+	}
+}
+
+func parseCountryList(r io.Reader, defaultCountry string) (*cidrCountryDB, error) {
+	db := new(cidrCountryDB)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "|") {
+			db.addRIRLine(line)
+			continue
+		}
+		//'CIDR [COUNTRY]' separated by space or comma
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		country := defaultCountry
+		if len(fields) > 1 {
+			country = fields[1]
+		}
+		ipnet, err := parseCIDR(fields[0])
+		if nil != err || len(country) == 0 {
+			continue
+		}
+		db.addNet(ipnet, country)
+	}
+	if err := scanner.Err(); nil != err {
+		return nil, err
+	}
+	db.split()
+	return db, nil
+}
+
+//configFilePath return path of file relative to config dir home
+func configFilePath(home string, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(home, file)
+}
+
+func loadCountryDB(conf GeoIPDatabase, home string) (countryDB, error) {
+	file := configFilePath(home, conf.File)
+	if strings.HasSuffix(strings.ToLower(file), ".mmdb") {
+		data, err := ioutil.ReadFile(file)
+		if nil != err {
+			return nil, err
+		}
+		reader, err := maxminddb.FromBytes(data)
+		if nil != err {
+			return nil, err
+		}
+		return &mmdbCountryDB{reader}, nil
+	}
+	f, err := os.Open(file)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCountryList(f, conf.Country)
+}
+
+var geoIPDatabases atomic.Value
+
+func loadGeoIP(conf GeoIPConfig) {
+	var dbs []countryDB
+	for _, dbConf := range conf.Database {
+		db, err := loadCountryDB(dbConf, proxyHome)
+		if nil != err {
+			log.Printf("[ERROR]Failed to load GeoIP database:%s for reason:%v", dbConf.File, err)
+			continue
+		}
+		dbs = append(dbs, db)
+	}
+	geoIPDatabases.Store(dbs)
+	ipNetListCache.Lock()
+	ipNetListCache.lists = make(map[string]ipNetList)
+	ipNetListCache.Unlock()
+}
+
+//lookupCountry search GeoIP databases in order, the CN IP range of APNIC is used if no database configured
+func lookupCountry(ip net.IP) string {
+	dbs, _ := geoIPDatabases.Load().([]countryDB)
+	for _, db := range dbs {
+		if country := db.lookupCountry(ip); len(country) > 0 {
+			return country
+		}
+	}
+	if cnIPRange := getCNIPRange(); len(dbs) == 0 && nil != cnIPRange && nil != ip.To4() {
+		if _, err := cnIPRange.FindCountry(ip.String()); nil == err {
+			return "CN"
+		}
+	}
+	return ""
+}
+
+//parseCIDR parse CIDR or single IP as /32 & /128 network
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if nil == ip {
+			return nil, fmt.Errorf("Invalid IP:%s", s)
+		}
+		if nil != ip.To4() {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+type ipNetList []*net.IPNet
+
+func (l ipNetList) contains(ip net.IP) bool {
+	for _, ipnet := range l {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//parsed 'IP:'/'SrcIP:' rule values, cleared on config reload
+var ipNetListCache struct {
+	sync.Mutex
+	lists map[string]ipNetList
+}
+
+//parseIPNetList parse comma separated CIDRs or file names of CIDR list
+func parseIPNetList(value string, home string) (ipNetList, error) {
+	var list ipNetList
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if ipnet, err := parseCIDR(item); nil == err {
+			list = append(list, ipnet)
+			continue
+		}
+		data, err := ioutil.ReadFile(configFilePath(home, item))
+		if nil != err {
+			return nil, fmt.Errorf("Invalid CIDR or CIDR list file:%s", item)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			ipnet, err := parseCIDR(fields[0])
+			if nil != err {
+				return nil, fmt.Errorf("Invalid CIDR:%s in %s", fields[0], item)
+			}
+			list = append(list, ipnet)
+		}
+	}
+	return list, nil
+}
+
+func getIPNetList(value string) ipNetList {
+	ipNetListCache.Lock()
+	defer ipNetListCache.Unlock()
+	if list, exist := ipNetListCache.lists[value]; exist {
+		return list
+	}
+	list, err := parseIPNetList(value, proxyHome)
+	if nil != err {
+		log.Printf("[ERROR]%v", err)
+	}
+	if nil == ipNetListCache.lists {
+		ipNetListCache.lists = make(map[string]ipNetList)
+	}
+	ipNetListCache.lists[value] = list
+	return list
+}
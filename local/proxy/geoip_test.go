@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCountryList(t *testing.T) {
+	content := `# RIR delegated stats & CIDR list
+apnic|*|ipv4|*|44172|summary
+apnic|CN|ipv4|1.0.1.0|256|20110414|allocated
+apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated
+apnic|AU|ipv4|1.0.64.0|768|20110412|allocated
+apnic|CN|ipv6|2001:250::|35|20000426|allocated
+8.8.8.0/24 US
+9.9.9.9,CH
+10.0.0.0/8
+`
+	db, err := parseCountryList(strings.NewReader(content), "ZZ")
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	cases := map[string]string{
+		"1.0.1.1":     "CN",
+		"1.0.2.1":     "",
+		"1.0.31.255":  "JP",
+		"1.0.66.255":  "AU",
+		"1.0.67.0":    "",
+		"2001:250::1": "CN",
+		"2001:251::1": "",
+		"8.8.8.8":     "US",
+		"9.9.9.9":     "CH",
+		"10.1.2.3":    "ZZ",
+		"192.168.1.1": "",
+	}
+	for ip, expected := range cases {
+		if country := db.lookupCountry(net.ParseIP(ip)); country != expected {
+			t.Errorf("Expected %s in %s, but got %s", ip, expected, country)
+		}
+	}
+}
+
+func TestNestedCountryList(t *testing.T) {
+	content := `10.1.0.0/16 CN
+10.0.0.0/8 US
+10.1.2.0/24 JP
+10.1.3.0/24 CN
+10.255.255.0/24 HK
+`
+	db, err := parseCountryList(strings.NewReader(content), "")
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	cases := map[string]string{
+		"9.255.255.255":  "",
+		"10.0.0.1":       "US",
+		"10.1.0.1":       "CN",
+		"10.1.2.3":       "JP",
+		"10.1.3.3":       "CN",
+		"10.2.0.1":       "US",
+		"10.255.254.255": "US",
+		"10.255.255.255": "HK",
+		"11.0.0.0":       "",
+	}
+	for ip, expected := range cases {
+		if country := db.lookupCountry(net.ParseIP(ip)); country != expected {
+			t.Errorf("Expected %s in %s, but got %s", ip, expected, country)
+		}
+	}
+}
+
+func TestGeoIPRules(t *testing.T) {
+	db, _ := parseCountryList(strings.NewReader("8.8.8.0/24 US\n1.1.1.0/24 AU\n"), "")
+	geoIPDatabases.Store([]countryDB{db})
+	defer geoIPDatabases.Store([]countryDB{})
+
+	pac := &PACConfig{Rule: []string{"Country:US,JP"}}
+	if !pac.Match("tcp", "8.8.8.8", "", "", nil) || pac.Match("tcp", "1.1.1.1", "", "", nil) {
+		t.Errorf("Invalid country rule match")
+	}
+	pac = &PACConfig{Rule: []string{"!Country:AU"}}
+	if !pac.Match("tcp", "8.8.8.8", "", "", nil) || pac.Match("tcp", "1.1.1.1", "", "", nil) {
+		t.Errorf("Invalid negative country rule match")
+	}
+	pac = &PACConfig{Rule: []string{"IP:10.0.0.0/8,fc00::/7"}}
+	if !pac.Match("tcp", "10.1.1.1", "", "", nil) || !pac.Match("tcp", "fd00::1", "", "", nil) || pac.Match("tcp", "8.8.8.8", "", "", nil) {
+		t.Errorf("Invalid IP rule match")
+	}
+	pac = &PACConfig{Rule: []string{"SrcIP:192.168.1.0/24"}}
+	if !pac.Match("tcp", "8.8.8.8", "192.168.1.2", "", nil) || pac.Match("tcp", "8.8.8.8", "192.168.2.2", "", nil) {
+		t.Errorf("Invalid SrcIP rule match")
+	}
+}
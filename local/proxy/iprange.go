@@ -4,10 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"sort"
 	"strconv"
@@ -19,6 +17,7 @@ import (
 var errIPRangeNotMatch = errors.New("No ip range could match the ip")
 
 const cnIPFile = "apnic_cn.txt"
+const cnIPURL = "http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest"
 
 type IPRange struct {
 	Start, End uint64
@@ -92,7 +91,7 @@ func (h *IPRangeHolder) FindCountry(ip string) (string, error) {
 	return "", errIPRangeNotMatch
 }
 
-func parseApnicIPReader(rc io.ReadCloser, persist bool) (*IPRangeHolder, error) {
+func parseApnicIPReader(rc io.ReadCloser) (*IPRangeHolder, error) {
 	var err error
 	reader := bufio.NewReader(rc)
 	var buffer bytes.Buffer
@@ -102,16 +101,6 @@ func parseApnicIPReader(rc io.ReadCloser, persist bool) (*IPRangeHolder, error)
 	)
 	defer rc.Close()
 	holder := new(IPRangeHolder)
-	var perststFile *os.File
-	if persist {
-		var err error
-		perststFile, err = os.Create(proxyHome + "/" + cnIPFile)
-		if nil == err {
-			defer perststFile.Close()
-		} else {
-			log.Printf("[ERROR]Failed to open CN IP file:%v", err)
-		}
-	}
 	for {
 		if part, prefix, err = reader.ReadLine(); err != nil {
 			if err != io.EOF {
@@ -133,10 +122,6 @@ func parseApnicIPReader(rc io.ReadCloser, persist bool) (*IPRangeHolder, error)
 					ipcount, _ := strconv.ParseUint(sp[4], 10, 32)
 					tmp := &IPRange{uint64(startip), uint64(startip) + uint64(ipcount-1), sp[1]}
 					holder.ranges = append(holder.ranges, tmp)
-					if nil != perststFile {
-						perststFile.Write([]byte(line))
-						perststFile.Write([]byte("\r\n"))
-					}
 				}
 			}
 		}
@@ -151,17 +136,5 @@ func parseApnicIPFile(name string) (*IPRangeHolder, error) {
 	if file, err = os.Open(name); err != nil {
 		return nil, err
 	}
-	return parseApnicIPReader(file, false)
-}
-
-func getCNIPRangeHolder(hc *http.Client) (*IPRangeHolder, error) {
-	url := "http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest"
-	res, err := hc.Get(url)
-	if nil != err {
-		return nil, err
-	}
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("Invalid IP range response:%v", res)
-	}
-	return parseApnicIPReader(res.Body, true)
+	return parseApnicIPReader(file)
 }
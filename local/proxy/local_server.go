@@ -26,54 +26,102 @@ func getSessionId() uint32 {
 	return atomic.AddUint32(&sidSeed, 1)
 }
 
-func serveProxyConn(conn net.Conn, proxy ProxyConfig) {
+//serveProxyConn serve socks/http proxy conn, or transparent proxy conn with non empty origDst
+func serveProxyConn(conn net.Conn, proxy ProxyConfig, origDst string) {
 	var p Proxy
 	protocol := "tcp"
 	sid := getSessionId()
-	queue := event.NewEventQueue()
+	queue := newSessionBuffer()
 	connClosed := false
 	session := newProxySession(sid, queue)
 	defer closeProxySession(sid)
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); nil == err {
+		session.src = host
+	}
+	//non nil if more than one remote configured for the matched PAC rule
+	var failover *failoverProxy
+	selectProxy := func(ip string, req *http.Request) Proxy {
+		selected := proxy.findFailoverProxy(session, protocol, ip, req)
+		failover, _ = selected.(*failoverProxy)
+		if nil != selected {
+			if len(session.user) > 0 {
+				log.Printf("Session:%d select channel:%s for %s by user:%s, route:%v", sid, selected.Config().Name, ip, session.user, session.route)
+			} else {
+				log.Printf("Session:%d select channel:%s for %s, route:%v", sid, selected.Config().Name, ip, session.route)
+			}
+		}
+		return selected
+	}
+	//socks clients are authenticated in handshake
+	authed := !proxy.authRequired()
 
 	remoteHost := ""
 	remotePort := ""
 	//indicate that if remote opened by event
 	tryRemoteResolve := false
-	socksConn, bufconn, err := socks.NewSocksConn(conn)
+	var socksConn *socks.SocksConn
+	var bufconn *bufio.Reader
+	var err error
+	target := origDst
+	if len(origDst) > 0 {
+		//transparent proxy clients are restricted by 'AllowCIDR' only
+		authed = true
+	} else {
+		socksConn, bufconn, err = socks.NewSocksConnWithAuth(conn, proxy.socksAuthenticator())
+		if nil == err && proxy.authRequired() {
+			authed = true
+			session.user = socksConn.Req.Username
+		}
+	}
 
 	socksInitProxy := func() {
 		remoteAddr := net.JoinHostPort(remoteHost, remotePort)
 		creq, _ := http.NewRequest("Connect", "https://"+remoteAddr, nil)
-		p = proxy.findProxyByRequest(protocol, remoteHost, creq)
+		p = selectProxy(remoteHost, creq)
 		if nil == p {
 			conn.Close()
 			return
 		}
-		log.Printf("Session:%d select channel:%s for %s", sid, p.Config().Name, remoteHost)
 		tcpOpen := &event.TCPOpenEvent{}
 		tcpOpen.SetId(sid)
 		tcpOpen.Addr = remoteAddr
 		p.Serve(session, tcpOpen)
 	}
 
-	if nil == err {
+	if nil != socksConn && socksConn.IsUDPAssociate() {
+		handleSocksUDPAssociate(socksConn, proxy, session.user)
+		return
+	}
+	if len(origDst) > 0 {
+		log.Printf("Local proxy recv transparent proxy conn to %s", origDst)
+	} else if nil == err {
 		log.Printf("Local proxy recv %s proxy conn to %s", socksConn.Version(), socksConn.Req.Target)
 		socksConn.Grant(&net.TCPAddr{
 			IP: net.ParseIP("0.0.0.0"), Port: 0})
 
 		if socksConn.Req.Target == GConf.UDPGWAddr {
 			log.Printf("Handle udpgw conn for %v", socksConn.Req.Target)
-			handleUDPGatewayConn(conn, proxy)
+			handleUDPGatewayConn(conn, proxy, session.user)
 			return
 		}
 		conn = socksConn
+		target = socksConn.Req.Target
+	}
+	if len(target) > 0 {
 		session.Hijacked = true
-
-		remoteHost, remotePort, err = net.SplitHostPort(socksConn.Req.Target)
+		remoteHost, remotePort, err = net.SplitHostPort(target)
 		if nil != err {
-			log.Printf("Invalid socks target addresss:%s with reason %v", socksConn.Req.Target, err)
+			log.Printf("Invalid target addresss:%s with reason %v", target, err)
 			return
 		}
+		if domain, fake := lookupFakeIP(remoteHost); fake {
+			if len(domain) == 0 {
+				log.Printf("[WARN]No domain found for fake IP:%s", remoteHost)
+				conn.Close()
+				return
+			}
+			remoteHost = domain
+		}
 		if net.ParseIP(remoteHost) != nil && !helper.IsPrivateIP(remoteHost) && proxy.SNISniff {
 			//this is a ip from local dns query
 			tryRemoteResolve = true
@@ -116,14 +164,26 @@ func serveProxyConn(conn net.Conn, proxy ProxyConfig) {
 			//log.Printf("Session:%d recv event:%T", sid, ev)
 			switch ev.(type) {
 			case *event.NotifyEvent:
-				//donothing now
+				if nil != failover && ev.(*event.NotifyEvent).Code == event.ErrRemoteConnectFailed {
+					failover.onOpenFailed()
+				}
 			case *event.ConnCloseEvent:
+				if nil != failover && failover.retry() {
+					continue
+				}
 				connClosed = true
 				conn.Close()
 				return
 			case *event.TCPChunkEvent:
-				conn.Write(ev.(*event.TCPChunkEvent).Content)
+				if nil != failover {
+					failover.onRelayed()
+				}
+				n, _ := conn.Write(ev.(*event.TCPChunkEvent).Content)
+				session.ackChunk(n)
 			case *event.HTTPResponseEvent:
+				if nil != failover {
+					failover.onRelayed()
+				}
 				ev.(*event.HTTPResponseEvent).Write(conn)
 				code := ev.(*event.HTTPResponseEvent).StatusCode
 				log.Printf("Session:%d response:%d %v", ev.GetId(), code, http.StatusText(int(code)))
@@ -210,6 +270,23 @@ func serveProxyConn(conn net.Conn, proxy ProxyConfig) {
 			connClosed = true
 			break
 		}
+		if !authed {
+			user, ok := proxy.verifyHTTPUser(req)
+			if !ok {
+				conn.Write([]byte(proxyAuthRequiredResponse))
+				if req.ContentLength != 0 {
+					//unread body left in connection
+					connClosed = true
+					break
+				}
+				continue
+			}
+			authed = true
+			session.user = user
+		}
+		if proxy.authRequired() {
+			req.Header.Del("Proxy-Authorization")
+		}
 
 		if nil == p {
 			if strings.Contains(req.Host, ":") {
@@ -228,13 +305,12 @@ func serveProxyConn(conn net.Conn, proxy ProxyConfig) {
 					remotePort = "80"
 				}
 			}
-			p = proxy.findProxyByRequest(protocol, remoteHost, req)
+			p = selectProxy(remoteHost, req)
 			if nil == p {
 				connClosed = true
 				conn.Close()
 				return
 			}
-			log.Printf("Session:%d select channel:%s for %s", sid, p.Config().Name, remoteHost)
 		}
 		reqUrl := req.URL.String()
 		if strings.EqualFold(req.Method, "Connect") {
@@ -344,50 +420,145 @@ func serveProxyConn(conn net.Conn, proxy ProxyConfig) {
 	conn.Close()
 }
 
-func startLocalProxyServer(proxy ProxyConfig) (*net.TCPListener, error) {
+type localProxyServer struct {
+	lp     *net.TCPListener
+	mode   string
+	udp    io.Closer
+	tun    io.Closer
+	closed int32
+}
+
+func (server *localProxyServer) close() {
+	atomic.StoreInt32(&server.closed, 1)
+	if nil != server.lp {
+		server.lp.Close()
+	}
+	if nil != server.udp {
+		server.udp.Close()
+	}
+	if nil != server.tun {
+		server.tun.Close()
+	}
+}
+
+var runningServers = make(map[string]*localProxyServer)
+
+//proxy configs keyed by listen address, swapped on reload
+var proxyConfigs atomic.Value
+
+func getProxyConfig(local string) (ProxyConfig, bool) {
+	confs, _ := proxyConfigs.Load().(map[string]ProxyConfig)
+	conf, exist := confs[local]
+	return conf, exist
+}
+
+func startLocalProxyServer(proxy ProxyConfig) (*localProxyServer, error) {
+	if proxy.Mode == ProxyModeTUN {
+		return startTUNServer(proxy)
+	}
 	tcpaddr, err := net.ResolveTCPAddr("tcp", proxy.Local)
 	if nil != err {
-		log.Fatalf("[ERROR]Local server address:%s error:%v", proxy.Local, err)
-		return nil, err
+		return nil, fmt.Errorf("Local server address:%s error:%v", proxy.Local, err)
 	}
 	var lp *net.TCPListener
-	lp, err = net.ListenTCP("tcp", tcpaddr)
+	if len(proxy.Mode) == 0 {
+		lp, err = net.ListenTCP("tcp", tcpaddr)
+	} else {
+		lp, err = listenTransparentTCP(proxy.Mode, tcpaddr)
+	}
 	if nil != err {
-		log.Fatalf("Can NOT listen on address:%s", proxy.Local)
-		return nil, err
+		return nil, fmt.Errorf("Can NOT listen on address:%s for reason:%v", proxy.Local, err)
+	}
+	server := &localProxyServer{lp: lp, mode: proxy.Mode}
+	if proxy.Mode == ProxyModeTProxy {
+		server.udp, err = startTProxyUDP(proxy, tcpaddr)
+		if nil != err {
+			lp.Close()
+			return nil, fmt.Errorf("Can NOT listen udp on address:%s for reason:%v", proxy.Local, err)
+		}
 	}
 	log.Printf("Listen on address %s", proxy.Local)
 	go func() {
-		for proxyServerRunning {
+		for proxyServerRunning && atomic.LoadInt32(&server.closed) == 0 {
 			conn, err := lp.AcceptTCP()
 			if nil != err {
 				continue
 			}
-			go serveProxyConn(conn, proxy)
+			//use the latest PAC rules since config may be reloaded
+			conf, exist := getProxyConfig(proxy.Local)
+			if !exist {
+				conn.Close()
+				continue
+			}
+			if !conf.allowClient(conn.RemoteAddr()) {
+				log.Printf("[WARN]Reject client:%v not allowed by %s", conn.RemoteAddr(), proxy.Local)
+				conn.Close()
+				continue
+			}
+			if len(server.mode) == 0 {
+				go serveProxyConn(conn, conf, "")
+				continue
+			}
+			dst, err := getOriginalDst(conn, server.mode)
+			if nil != err {
+				log.Printf("[ERROR]Failed to get original destination of %v for reason:%v", conn.RemoteAddr(), err)
+				conn.Close()
+				continue
+			}
+			go serveProxyConn(conn, conf, dst)
 		}
 		lp.Close()
 	}()
-	return lp, nil
+	return server, nil
 }
 
-var runningServers []*net.TCPListener
+//updateLocalServers swap proxy configs, start new listeners & close removed ones,
+//connections accepted by removed listeners are not affected.
+func updateLocalServers(proxies []ProxyConfig) error {
+	confs := make(map[string]ProxyConfig)
+	for _, proxy := range proxies {
+		proxy.Mode = strings.ToLower(proxy.Mode)
+		proxy.initACL()
+		confs[proxy.Local] = proxy
+	}
+	proxyConfigs.Store(confs)
+	for local, server := range runningServers {
+		//listener need restart if mode changed
+		if conf, exist := confs[local]; !exist || conf.Mode != server.mode {
+			server.close()
+			delete(runningServers, local)
+			log.Printf("Close listener on address %s", local)
+		}
+	}
+	var lastErr error
+	for local, proxy := range confs {
+		if _, exist := runningServers[local]; exist {
+			continue
+		}
+		server, err := startLocalProxyServer(proxy)
+		if nil != err {
+			lastErr = err
+			continue
+		}
+		runningServers[local] = server
+	}
+	return lastErr
+}
 
 func startLocalServers() error {
 	proxyServerRunning = true
-	runningServers = make([]*net.TCPListener, 0)
-	for _, proxy := range GConf.Proxy {
-		l, _ := startLocalProxyServer(proxy)
-		if nil != l {
-			runningServers = append(runningServers, l)
-		}
+	runningServers = make(map[string]*localProxyServer)
+	err := updateLocalServers(GConf.Proxy)
+	if nil != err {
+		log.Fatalf("[ERROR]%v", err)
 	}
-	return nil
+	return err
 }
 
 func stopLocalServers() {
 	proxyServerRunning = false
-	for _, l := range runningServers {
-		l.Close()
+	for _, server := range runningServers {
+		server.close()
 	}
 	closeAllProxySession()
 	closeAllUDPSession()
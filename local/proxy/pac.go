@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//blackhole proxy for 'Reject' channels, connections to discard port fail immediately
+const pacRejectProxy = "PROXY 127.0.0.1:9"
+
+//globToRegexp convert pattern of filepath.Match to javascript regexp source
+func globToRegexp(pattern string) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			buf.WriteString("[^/]*")
+		case '?':
+			buf.WriteString("[^/]")
+		case '\\':
+			i++
+			if i >= len(pattern) {
+				return "", fmt.Errorf("Invalid pattern:%s", pattern)
+			}
+			buf.WriteString(regexpQuote(pattern[i]))
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("Invalid pattern:%s", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			buf.WriteString("[")
+			if strings.HasPrefix(class, "^") {
+				buf.WriteString("^")
+				class = class[1:]
+			}
+			for j := 0; j < len(class); j++ {
+				if class[j] == '\\' && j+1 < len(class) {
+					j++
+				}
+				if class[j] == '-' {
+					buf.WriteByte('-')
+				} else {
+					buf.WriteString(regexpQuote(class[j]))
+				}
+			}
+			buf.WriteString("]")
+			i += end + 1
+		default:
+			buf.WriteString(regexpQuote(c))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String(), nil
+}
+
+func regexpQuote(c byte) string {
+	if strings.IndexByte(`\.+*?()|[]{}^$/-`, c) >= 0 {
+		return "\\" + string(c)
+	}
+	return string(c)
+}
+
+//pacPatternsExpr return javascript expression matching v by patterns
+func pacPatternsExpr(v string, patterns []string) string {
+	var regexps []string
+	for _, pattern := range patterns {
+		if re, err := globToRegexp(pattern); nil == err {
+			regexps = append(regexps, re)
+		}
+	}
+	data, _ := json.Marshal(regexps)
+	return fmt.Sprintf("matchPatterns(%s.toLowerCase(), %s)", v, data)
+}
+
+//pacListenerProxy return proxies of the local listener, the unspecified host is replaced by 'host'
+func pacListenerProxy(local string, host string) string {
+	h, port, err := net.SplitHostPort(local)
+	if nil != err {
+		return ""
+	}
+	if ip := net.ParseIP(h); len(h) == 0 || (nil != ip && ip.IsUnspecified()) {
+		h = host
+	}
+	addr := net.JoinHostPort(h, port)
+	return fmt.Sprintf("PROXY %s; SOCKS5 %s", addr, addr)
+}
+
+//pacChannelProxy return the PAC proxy of channel, or the listener if gsnova need to serve it
+func pacChannelProxy(name string, listener string) string {
+	p := getProxyByName(name)
+	if nil == p {
+		return ""
+	}
+	conf := p.Config()
+	switch conf.Type {
+	case "REJECT":
+		return pacRejectProxy
+	case "DIRECT":
+		if len(conf.Proxy) == 0 {
+			return "DIRECT"
+		}
+		u, err := url.Parse(conf.Proxy)
+		if nil != err {
+			return listener
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			return "PROXY " + u.Host
+		case "https":
+			return "HTTPS " + u.Host
+		case "socks", "socks5":
+			return "SOCKS5 " + u.Host
+		case "socks4":
+			return "SOCKS " + u.Host
+		}
+	}
+	return listener
+}
+
+//compilePACRule return the condition & proxies of a PAC rule, conditions can NOT be expressed in
+//javascript make the rule fall back to listener, skip is true if the rule never match browser traffic.
+func compilePACRule(pac *PACConfig, listener string) (cond string, proxies string, skip bool) {
+	var conds []string
+	fallback := false
+	if len(pac.Protocol) > 0 {
+		httpProto, httpsProto := pac.matchProtocol("http"), pac.matchProtocol("https")
+		if !httpProto && !httpsProto {
+			return "", "", true
+		}
+		if !httpProto {
+			conds = append(conds, `url.substring(0, 6) == "https:"`)
+		} else if !httpsProto {
+			conds = append(conds, `url.substring(0, 5) == "http:"`)
+		}
+	}
+	if len(pac.Method) > 0 || len(pac.User) > 0 {
+		fallback = true
+	}
+	for _, rule := range pac.Rule {
+		not := ""
+		if strings.HasPrefix(rule, "!") {
+			not = "!"
+			rule = rule[1:]
+		}
+		if strings.EqualFold(rule, BlockedByGFWRule) && nil != getGFWList() {
+			conds = append(conds, not+"isBlockedByGFW(url, host)")
+		} else {
+			fallback = true
+		}
+	}
+	if len(pac.Host) > 0 {
+		conds = append(conds, pacPatternsExpr("host", pac.Host))
+	}
+	if len(pac.URL) > 0 {
+		conds = append(conds, pacPatternsExpr("url", pac.URL))
+	}
+	if len(conds) == 0 {
+		cond = "true"
+	} else {
+		cond = strings.Join(conds, " && ")
+	}
+	if fallback {
+		return cond, listener, false
+	}
+	var ps []string
+	for _, name := range pac.Remote {
+		if p := pacChannelProxy(name, listener); len(p) > 0 {
+			exist := false
+			for _, v := range ps {
+				exist = exist || v == p
+			}
+			if !exist {
+				ps = append(ps, p)
+			}
+		}
+	}
+	if len(ps) == 0 {
+		//no available channel now, let gsnova decide
+		return cond, listener, false
+	}
+	return cond, strings.Join(ps, "; "), false
+}
+
+//generatePAC compile PAC rules of listener into 'FindProxyForURL'
+func generatePAC(proxy ProxyConfig, host string) string {
+	listener := pacListenerProxy(proxy.Local, host)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "//generated by gsnova from PAC rules of listener %s\n", proxy.Local)
+	buf.WriteString(`function matchPatterns(v, patterns) {
+  for (var i = 0; i < patterns.length; i++) {
+    if (new RegExp(patterns[i]).test(v)) return true;
+  }
+  return false;
+}
+`)
+	if mygfwlist := getGFWList(); nil != mygfwlist {
+		buf.WriteString(mygfwlist.PACFunction("isBlockedByGFW"))
+	}
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	for i := range proxy.PAC {
+		cond, proxies, skip := compilePACRule(&proxy.PAC[i], listener)
+		if skip {
+			continue
+		}
+		if cond == "true" {
+			//rules after it never match
+			fmt.Fprintf(&buf, "  return %q;\n}\n", proxies)
+			return buf.String()
+		}
+		fmt.Fprintf(&buf, "  if (%s) return %q;\n", cond, proxies)
+	}
+	fmt.Fprintf(&buf, "  return %q;\n}\n", listener)
+	return buf.String()
+}
+
+//pacCallback serve '/proxy.pac' of the listener specified by 'local' parameter, or the first socks/http listener
+func pacCallback(w http.ResponseWriter, req *http.Request) {
+	local := req.FormValue("local")
+	var conf ProxyConfig
+	found := false
+	for _, proxy := range GetConf().Proxy {
+		//transparent & TUN listeners can NOT be used as proxy
+		if len(proxy.Mode) == 0 && (len(local) == 0 || proxy.Local == local) {
+			conf = proxy
+			found = true
+			break
+		}
+	}
+	if !found {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "No listener found for PAC\n")
+		return
+	}
+	//clients connect admin server & listener by same host
+	host := req.FormValue("host")
+	if len(host) == 0 {
+		host = req.Host
+		if h, _, err := net.SplitHostPort(req.Host); nil == err {
+			host = h
+		}
+	}
+	host = strings.Trim(host, "[]")
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.WriteHeader(200)
+	w.Write([]byte(generatePAC(conf, host)))
+}
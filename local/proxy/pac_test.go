@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		matched bool
+	}{
+		{"*.google.com", "www.google.com", true},
+		{"*.google.com", "google.com", false},
+		{"a?.qq.com", "a1.qq.com", true},
+		{"a[0-9]?.qq.com", "a12.qq.com", true},
+		{"a[^0-9].qq.com", "a1.qq.com", false},
+		{"https://x.com/*", "https://x.com/a", true},
+		{"https://x.com/*", "https://x.com/a/b", false},
+		{"a\\*b", "a*b", true},
+	}
+	for _, c := range cases {
+		re, err := globToRegexp(c.pattern)
+		if nil != err {
+			t.Fatalf("Failed to convert %s:%v", c.pattern, err)
+		}
+		if regexp.MustCompile(re).MatchString(c.str) != c.matched {
+			t.Errorf("Expected %s match %s:%v by %s", c.pattern, c.str, c.matched, re)
+		}
+	}
+	if _, err := globToRegexp("a[b"); nil == err {
+		t.Errorf("Expected error for invalid pattern")
+	}
+}
+
+func TestGeneratePAC(t *testing.T) {
+	conf := ProxyConfig{Local: "0.0.0.0:48100", PAC: []PACConfig{
+		{Protocol: []string{"dns", "udp"}, Remote: RemoteNames{"Direct"}},
+		{Protocol: []string{"https"}, Host: []string{"*.example.com"}, Remote: RemoteNames{"NotExist"}},
+		{Rule: []string{"IsCNIP"}, Remote: RemoteNames{"Direct"}},
+		{Host: []string{"never.example.com"}, Remote: RemoteNames{"Direct"}},
+	}}
+	pac := generatePAC(conf, "192.168.1.2")
+	listener := `"PROXY 192.168.1.2:48100; SOCKS5 192.168.1.2:48100"`
+	if !strings.Contains(pac, `if (url.substring(0, 6) == "https:" && matchPatterns(host.toLowerCase(), ["^[^/]*\\.example\\.com$"])) return `+listener) {
+		t.Errorf("Invalid https host rule in:%s", pac)
+	}
+	//'IsCNIP' can NOT be expressed in javascript, fall back to listener & stop
+	if !strings.HasSuffix(pac, "  return "+listener+";\n}\n") || strings.Contains(pac, "never.example.com") {
+		t.Errorf("Invalid fallback rule in:%s", pac)
+	}
+	if strings.Contains(pac, "dns") {
+		t.Errorf("Non browser rule in:%s", pac)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/yinqiwen/gsnova/common/event"
 	"github.com/yinqiwen/gsnova/common/helper"
@@ -38,6 +39,10 @@ func init() {
 }
 
 var proxyTable = make(map[string]Proxy)
+
+//normalized configs of running proxies, used to diff with new config on reload
+var proxyConfTable = make(map[string]ProxyChannelConfig)
+var proxyTableMutex sync.Mutex
 var proxyTypeTable map[string]reflect.Type = make(map[string]reflect.Type)
 
 func RegisterProxyType(str string, p Proxy) error {
@@ -51,6 +56,8 @@ func RegisterProxyType(str string, p Proxy) error {
 }
 
 func getProxyByName(name string) Proxy {
+	proxyTableMutex.Lock()
+	defer proxyTableMutex.Unlock()
 	p, exist := proxyTable[name]
 	if exist {
 		return p
@@ -58,19 +65,48 @@ func getProxyByName(name string) Proxy {
 	return nil
 }
 
-func Start(home string, monitor InternalEventMonitor) error {
-	clientConf := home + "/client.json"
-	hostsConf := home + "/hosts.json"
-	confdata, err := helper.ReadWithoutComment(clientConf, "//")
+func normalizeChannelConfig(conf ProxyChannelConfig) ProxyChannelConfig {
+	conf.Type = strings.ToUpper(conf.Type)
+	if 0 == conf.ConnsPerServer {
+		conf.ConnsPerServer = 1
+	}
+	conf.proxyURL = nil
+	return conf
+}
+
+func newProxy(conf ProxyChannelConfig) (Proxy, error) {
+	t, ok := proxyTypeTable[conf.Type]
+	if !ok {
+		return nil, fmt.Errorf("No registe proxy channel type for %s", conf.Type)
+	}
+	p := reflect.New(t).Interface().(Proxy)
+	if err := p.Init(conf); nil != err {
+		return nil, err
+	}
+	return p, nil
+}
+
+func loadConfig(home string) (LocalConfig, error) {
+	var conf LocalConfig
+	confdata, err := helper.ReadWithoutComment(home+"/client.json", "//")
 	if nil != err {
-		//log.Println(err)
-		return err
+		return conf, err
 	}
-	err = json.Unmarshal(confdata, &GConf)
+	err = json.Unmarshal(confdata, &conf)
 	if nil != err {
 		fmt.Printf("Failed to unmarshal json:%s to config for reason:%v", string(confdata), err)
+	}
+	return conf, err
+}
+
+func Start(home string, monitor InternalEventMonitor) error {
+	hostsConf := home + "/hosts.json"
+	conf, err := loadConfig(home)
+	if nil != err {
+		//log.Println(err)
 		return err
 	}
+	GConf = conf
 	err = hosts.Init(hostsConf)
 	if nil != err {
 		log.Printf("Failed to init local hosts with reason:%v.", err)
@@ -78,40 +114,42 @@ func Start(home string, monitor InternalEventMonitor) error {
 	event.SetDefaultSecretKey(GConf.Encrypt.Method, GConf.Encrypt.Key)
 	proxyHome = home
 	GConf.init()
+	running := GConf
+	runningConf.Store(&running)
+	proxyTableMutex.Lock()
+	proxyTable = make(map[string]Proxy)
+	proxyConfTable = make(map[string]ProxyChannelConfig)
 	for _, conf := range GConf.Channel {
-		conf.Type = strings.ToUpper(conf.Type)
-		if t, ok := proxyTypeTable[conf.Type]; !ok {
-			log.Printf("[ERROR]No registe proxy channel type for %s", conf.Type)
+		if !conf.Enable {
 			continue
+		}
+		conf = normalizeChannelConfig(conf)
+		p, err := newProxy(conf)
+		if nil != err {
+			log.Printf("Proxy channel(%s):%s init failed with reason:%v", conf.Type, conf.Name, err)
 		} else {
-			v := reflect.New(t)
-			p := v.Interface().(Proxy)
-			if !conf.Enable {
-				continue
-			}
-			if 0 == conf.ConnsPerServer {
-				conf.ConnsPerServer = 1
-			}
-			err = p.Init(conf)
-			if nil != err {
-				log.Printf("Proxy channel(%s):%s init failed with reason:%v", conf.Type, conf.Name, err)
-			} else {
-				log.Printf("Proxy channel(%s):%s init success", conf.Type, conf.Name)
-				proxyTable[conf.Name] = p
-			}
+			log.Printf("Proxy channel(%s):%s init success", conf.Type, conf.Name)
+			proxyTable[conf.Name] = p
+			proxyConfTable[conf.Name] = conf
 		}
 	}
+	proxyTableMutex.Unlock()
 
 	logger.InitLogger(GConf.Log)
 	log.Printf("Starting GSnova %s.", local.Version)
-	go initDNS()
+	//fake IP table is required before local servers started
+	initDNS()
 	go startAdminServer()
 	startLocalServers()
+	startConfigWatcher()
 	return nil
 }
 
 func Stop() error {
+	stopConfigWatcher()
 	stopLocalServers()
+	proxyTableMutex.Lock()
+	defer proxyTableMutex.Unlock()
 	for name, p := range proxyTable {
 		err := p.Destory()
 		if nil != err {
@@ -121,8 +159,7 @@ func Stop() error {
 		}
 	}
 	hosts.Clear()
-	if nil != cnIPRange {
-		cnIPRange.Clear()
-	}
+	stopRuleProviders()
+	stopDNS()
 	return nil
 }
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+	"github.com/yinqiwen/gsnova/local/hosts"
+)
+
+//max time to wait sessions finished on retired proxy channel
+const maxDrainTime = 30 * time.Minute
+
+//Drainable is optionally implemented by proxies to report sessions still served,
+//a retired proxy is destroyed after all its sessions finished on reload.
+type Drainable interface {
+	ActiveSessionNum() int32
+}
+
+var reloadMutex sync.Mutex
+var configWatcherStop chan struct{}
+
+func drainProxy(name string, p Proxy) {
+	start := time.Now()
+	if d, ok := p.(Drainable); ok {
+		for d.ActiveSessionNum() > 0 && time.Now().Sub(start) < maxDrainTime {
+			time.Sleep(5 * time.Second)
+		}
+	}
+	if err := p.Destory(); nil != err {
+		log.Printf("Failed to destroy retired proxy:%s with error:%v", name, err)
+	} else {
+		log.Printf("Retired proxy:%s destroy success after %v.", name, time.Now().Sub(start))
+	}
+}
+
+//Reload apply changes of client.json & hosts.json, only new or changed channels are inited,
+//and sessions on retired channels are not dropped.
+func Reload() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	conf, err := loadConfig(proxyHome)
+	if nil != err {
+		return err
+	}
+	if err = hosts.Init(proxyHome + "/hosts.json"); nil != err {
+		log.Printf("Failed to reload local hosts with reason:%v.", err)
+	}
+	running := GetConf()
+	unchanged := map[string]bool{
+		"Log":       reflect.DeepEqual(conf.Log, running.Log),
+		"LocalDNS":  reflect.DeepEqual(conf.LocalDNS, running.LocalDNS),
+		"UDPGWAddr": conf.UDPGWAddr == running.UDPGWAddr,
+		"Admin":     reflect.DeepEqual(conf.Admin, running.Admin),
+	}
+	for name, same := range unchanged {
+		if !same {
+			log.Printf("[WARN]Changes of '%s' take effect after restart.", name)
+		}
+	}
+	//all channels need reconnect if auth or encryption changed,
+	//retired channels keep their secret key for sessions not finished
+	authChanged := conf.Encrypt != running.Encrypt || conf.Auth != running.Auth || conf.AuthKey != running.AuthKey || conf.UserAgent != running.UserAgent
+	if authChanged {
+		event.SetDefaultSecretKey(conf.Encrypt.Method, conf.Encrypt.Key)
+	}
+	conf.init()
+
+	proxyTableMutex.Lock()
+	oldTable := proxyTable
+	oldConfTable := proxyConfTable
+	proxyTableMutex.Unlock()
+
+	newTable := make(map[string]Proxy)
+	newConfTable := make(map[string]ProxyChannelConfig)
+	for _, c := range conf.Channel {
+		if !c.Enable {
+			continue
+		}
+		c = normalizeChannelConfig(c)
+		if old, exist := oldConfTable[c.Name]; exist && !authChanged && reflect.DeepEqual(old, c) {
+			newTable[c.Name] = oldTable[c.Name]
+			newConfTable[c.Name] = old
+			continue
+		}
+		p, err := newProxy(c)
+		if nil != err {
+			log.Printf("Proxy channel(%s):%s init failed with reason:%v", c.Type, c.Name, err)
+			//keep the running one if exist
+			if oldp, exist := oldTable[c.Name]; exist {
+				newTable[c.Name] = oldp
+				newConfTable[c.Name] = oldConfTable[c.Name]
+			}
+			continue
+		}
+		log.Printf("Proxy channel(%s):%s init success", c.Type, c.Name)
+		newTable[c.Name] = p
+		newConfTable[c.Name] = c
+	}
+
+	proxyTableMutex.Lock()
+	proxyTable = newTable
+	proxyConfTable = newConfTable
+	proxyTableMutex.Unlock()
+	runningConf.Store(&conf)
+
+	for name, p := range oldTable {
+		if newTable[name] != p {
+			go drainProxy(name, p)
+		}
+	}
+	err = updateLocalServers(conf.Proxy)
+	if nil != err {
+		log.Printf("[ERROR]%v", err)
+	}
+	log.Printf("Reload config from %s success.", proxyHome)
+	return err
+}
+
+//startConfigWatcher reload config on SIGHUP, or on files modified if 'AutoReload' enabled
+func startConfigWatcher() {
+	stopConfigWatcher()
+	configWatcherStop = make(chan struct{})
+	stop := configWatcherStop
+	files := []string{proxyHome + "/client.json", proxyHome + "/hosts.json"}
+	modTimes := make([]time.Time, len(files))
+	checkModified := func() bool {
+		modified := false
+		for i, file := range files {
+			if st, err := os.Stat(file); nil == err && !st.ModTime().Equal(modTimes[i]) {
+				modified = modified || !modTimes[i].IsZero()
+				modTimes[i] = st.ModTime()
+			}
+		}
+		return modified
+	}
+	checkModified()
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		defer signal.Stop(sc)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-sc:
+				checkModified()
+			case <-ticker.C:
+				if !checkModified() || !GetConf().AutoReload {
+					continue
+				}
+			}
+			if err := Reload(); nil != err {
+				log.Printf("[ERROR]Failed to reload config:%v", err)
+			}
+		}
+	}()
+}
+
+func stopConfigWatcher() {
+	if nil != configWatcherStop {
+		close(configWatcherStop)
+		configWatcherStop = nil
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ruleTrace struct {
+	Rule    string
+	Matched bool
+	//e.g. the DNS answer or gfwlist rule used
+	Detail string
+}
+
+type pacTrace struct {
+	Index   int
+	Matched bool
+	//the condition failed, e.g. 'Protocol', 'Rule[1]', 'Host'
+	Failed string
+	Rules  []ruleTrace
+}
+
+//routeTrace record how the channel of a request is selected by PAC rules
+type routeTrace struct {
+	Listener string
+	Protocol string
+	Host     string
+	//destination IP used by IP rules, resolved once or specified by dry run
+	IP   string
+	Src  string
+	User string
+	URL  string
+	PAC  []pacTrace
+	//index of matched PAC rule, -1 if none
+	Matched int
+	Remote  []string
+	//configured channels not available now
+	Unavailable []string
+	Reason      string
+}
+
+func newRouteTrace(listener string, proto string, host string, src string, user string, req *http.Request) *routeTrace {
+	trace := &routeTrace{Listener: listener, Protocol: proto, Host: host, Src: src, User: user, Matched: -1}
+	if nil != req {
+		trace.URL = req.URL.String()
+	}
+	return trace
+}
+
+func (t *routeTrace) begin(index int) {
+	if nil != t {
+		t.PAC = append(t.PAC, pacTrace{Index: index})
+	}
+}
+
+func (t *routeTrace) current() *pacTrace {
+	if nil == t || len(t.PAC) == 0 {
+		return nil
+	}
+	return &t.PAC[len(t.PAC)-1]
+}
+
+func (t *routeTrace) rule(rule string, matched bool, detail string) {
+	if p := t.current(); nil != p {
+		p.Rules = append(p.Rules, ruleTrace{rule, matched, detail})
+	}
+}
+
+func (t *routeTrace) fail(condition string) {
+	if p := t.current(); nil != p {
+		p.Failed = condition
+	}
+}
+
+func (t *routeTrace) matched() {
+	if p := t.current(); nil != p {
+		p.Matched = true
+		t.Matched = p.Index
+	}
+}
+
+//resolveIP return destination IP of host, the DNS answer is recorded and reused by later rules
+func (t *routeTrace) resolveIP(host string) net.IP {
+	if nil != t && len(t.IP) > 0 {
+		return net.ParseIP(t.IP)
+	}
+	ip := resolveRuleIP(host)
+	if nil != t && nil != ip {
+		t.IP = ip.String()
+	}
+	return ip
+}
+
+//String return summary of trace for logs & stat
+func (t *routeTrace) String() string {
+	if nil == t {
+		return "none"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s", t.Protocol, t.Host)
+	if len(t.IP) > 0 {
+		fmt.Fprintf(&buf, "(%s)", t.IP)
+	}
+	for _, p := range t.PAC {
+		if p.Matched {
+			fmt.Fprintf(&buf, " PAC[%d]:matched", p.Index)
+		} else {
+			fmt.Fprintf(&buf, " PAC[%d]:%s", p.Index, p.Failed)
+		}
+		for _, r := range p.Rules {
+			if len(r.Detail) > 0 && (p.Matched || !r.Matched) {
+				fmt.Fprintf(&buf, "(%s:%s)", r.Rule, r.Detail)
+			}
+		}
+	}
+	if len(t.Reason) > 0 {
+		fmt.Fprintf(&buf, " %s", t.Reason)
+	}
+	fmt.Fprintf(&buf, " -> %v", t.Remote)
+	return buf.String()
+}
+
+//dryRunRoute return trace of request by PAC rules of listener 'local' without connecting,
+//the first listener is used if 'local' is empty.
+func dryRunRoute(local string, proto string, rawurl string, host string, ip string, src string, user string) (*routeTrace, error) {
+	var conf ProxyConfig
+	found := false
+	for _, proxy := range GetConf().Proxy {
+		if len(local) == 0 || proxy.Local == local {
+			conf = proxy
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("No listener:%s found", local)
+	}
+	var req *http.Request
+	if len(rawurl) > 0 {
+		var err error
+		if req, err = http.NewRequest("GET", rawurl, nil); nil != err {
+			return nil, err
+		}
+		if len(proto) == 0 {
+			proto = strings.ToLower(req.URL.Scheme)
+		}
+		if len(host) == 0 {
+			host = req.URL.Hostname()
+		}
+	}
+	if len(host) == 0 {
+		host = ip
+	}
+	if len(host) == 0 {
+		return nil, fmt.Errorf("No url, host or ip specified")
+	}
+	if len(proto) == 0 {
+		proto = "tcp"
+	}
+	if nil == req && proto != "udp" && proto != "dns" {
+		//same as socks & transparent proxy connections
+		req, _ = http.NewRequest("Connect", "https://"+net.JoinHostPort(host, "443"), nil)
+	}
+	trace := newRouteTrace(conf.Local, proto, host, src, user, req)
+	trace.IP = ip
+	conf.route(trace, req)
+	return trace, nil
+}
+
+//routeCallback serve '/route?url=&host=&ip=&proto=&local=&src=&user=', return the routing decision in json
+func routeCallback(w http.ResponseWriter, req *http.Request) {
+	trace, err := dryRunRoute(req.FormValue("local"), strings.ToLower(req.FormValue("proto")), req.FormValue("url"),
+		req.FormValue("host"), req.FormValue("ip"), req.FormValue("src"), req.FormValue("user"))
+	if nil != err {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	js, _ := json.MarshalIndent(trace, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+}
+
+//QueryRoute query routing decision from admin server of running gsnova instance,
+//the admin server configured under home is used if addr is empty.
+func QueryRoute(home string, addr string, params url.Values) (string, error) {
+	if len(addr) == 0 {
+		conf, err := loadConfig(home)
+		if nil != err {
+			return "", err
+		}
+		if len(conf.Admin.Listen) == 0 {
+			return "", fmt.Errorf("No admin server configured")
+		}
+		host, port, err := net.SplitHostPort(conf.Admin.Listen)
+		if nil != err {
+			return "", err
+		}
+		if ip := net.ParseIP(host); len(host) == 0 || (nil != ip && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	hc := &http.Client{Timeout: 30 * time.Second}
+	resp, err := hc.Get("http://" + addr + "/route?" + params.Encode())
+	if nil != err {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if nil != err {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDryRunRoute(t *testing.T) {
+	oldConf := GConf
+	defer func() { GConf = oldConf }()
+	GConf = LocalConfig{Proxy: []ProxyConfig{{
+		Local: ":48100",
+		PAC: []PACConfig{
+			{Protocol: []string{"dns"}, Remote: RemoteNames{"Direct"}},
+			{Rule: []string{"IP:10.0.0.0/8"}, Remote: RemoteNames{"Direct"}},
+			{Rule: []string{"!IP:8.8.8.0/24"}, Host: []string{"*.example.com"}, Remote: RemoteNames{"Direct"}},
+			{Remote: RemoteNames{"heroku"}},
+		},
+	}}}
+	trace, err := dryRunRoute("", "", "https://www.example.com/a", "", "8.8.8.8", "", "")
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	if trace.Protocol != "https" || trace.Host != "www.example.com" || trace.Matched != 3 || len(trace.PAC) != 4 {
+		t.Fatalf("Invalid trace:%v", trace)
+	}
+	for i, failed := range []string{"Protocol", "Rule[0]", "Rule[0]"} {
+		if trace.PAC[i].Failed != failed {
+			t.Errorf("Expected PAC[%d] failed at %s, but got %s", i, failed, trace.PAC[i].Failed)
+		}
+	}
+	//channels are not running
+	if len(trace.Remote) != 0 || len(trace.Unavailable) != 1 || trace.Reason != "no channel available" {
+		t.Errorf("Invalid trace:%v", trace)
+	}
+	if s := trace.String(); !strings.Contains(s, "https www.example.com(8.8.8.8) PAC[0]:Protocol PAC[1]:Rule[0] PAC[2]:Rule[0] PAC[3]:matched") {
+		t.Errorf("Invalid trace summary:%s", s)
+	}
+
+	trace, _ = dryRunRoute(":48100", "tcp", "", "www.example.com", "8.8.4.4", "", "")
+	if trace.Matched != 2 || trace.URL != "https://www.example.com:443" {
+		t.Errorf("Invalid trace:%v", trace)
+	}
+	if _, err = dryRunRoute(":8080", "", "", "www.example.com", "", "", ""); nil == err {
+		t.Errorf("Expected error for unknown listener")
+	}
+}
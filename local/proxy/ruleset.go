@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/gfwlist"
+	"github.com/yinqiwen/gsnova/common/matcher"
+)
+
+const (
+	RuleSetTypeDomain = "domain"
+	RuleSetTypeCIDR   = "cidr"
+	RuleSetTypeURL    = "url"
+
+	defaultRuleSetInterval     = 24 * time.Hour
+	defaultRuleSetFileInterval = 1 * time.Minute
+	ruleSetRetryInterval       = 30 * time.Second
+
+	//names of builtin providers, not valid rule set name
+	gfwlistProviderName = "_gfwlist"
+	cnIPProviderName    = "_cnip"
+)
+
+var ruleSetNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+//ruleProvider load rules from local file or http url, the content of url is cached & refreshed
+//by ETag/Last-Modified periodically, the parsed rules are swapped atomically.
+type ruleProvider struct {
+	name string
+	//config the provider created from, the running provider is kept on reload if config not changed
+	conf      interface{}
+	url       string
+	channel   string
+	cacheFile string
+	interval  time.Duration
+	parse     func(content []byte) (interface{}, error)
+
+	value        atomic.Value
+	etag         string
+	lastModified string
+	stopCh       chan struct{}
+}
+
+func (p *ruleProvider) isRemote() bool {
+	u := strings.ToLower(p.url)
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+//get return parsed rules, nil if not loaded yet
+func (p *ruleProvider) get() interface{} {
+	return p.value.Load()
+}
+
+func (p *ruleProvider) load(content []byte) error {
+	v, err := p.parse(content)
+	if nil != err {
+		return err
+	}
+	p.value.Store(v)
+	return nil
+}
+
+//loadFile load rules from file, return modification time of file
+func (p *ruleProvider) loadFile(file string) (time.Time, error) {
+	st, err := os.Stat(file)
+	if nil != err {
+		return time.Time{}, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if nil != err {
+		return time.Time{}, err
+	}
+	return st.ModTime(), p.load(content)
+}
+
+//fetch load rules from url if modified since last fetch, return true if updated
+func (p *ruleProvider) fetch(since time.Time) (bool, error) {
+	hc, err := newChannelHTTPClient(p.channel)
+	if nil != err {
+		return false, err
+	}
+	req, err := http.NewRequest("GET", p.url, nil)
+	if nil != err {
+		return false, err
+	}
+	if len(p.etag) > 0 {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	if len(p.lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", p.lastModified)
+	} else if !since.IsZero() {
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+	res, err := hc.Do(req)
+	if nil != err {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Invalid response:%s", res.Status)
+	}
+	content, err := ioutil.ReadAll(res.Body)
+	if nil != err {
+		return false, err
+	}
+	if err = p.load(content); nil != err {
+		return false, err
+	}
+	p.etag = res.Header.Get("ETag")
+	p.lastModified = res.Header.Get("Last-Modified")
+	if len(p.cacheFile) > 0 {
+		if err = ioutil.WriteFile(p.cacheFile, content, 0666); nil != err {
+			log.Printf("[ERROR]Failed to write cache file:%s for reason:%v", p.cacheFile, err)
+		}
+	}
+	return true, nil
+}
+
+func (p *ruleProvider) run() {
+	file := p.cacheFile
+	if !p.isRemote() {
+		file = configFilePath(proxyHome, p.url)
+	}
+	var modTime time.Time
+	if len(file) > 0 {
+		var err error
+		modTime, err = p.loadFile(file)
+		if nil != err {
+			if !os.IsNotExist(err) || !p.isRemote() {
+				log.Printf("[ERROR]Failed to load rules:%s from %s for reason:%v", p.name, file, err)
+			}
+			modTime = time.Time{}
+		} else {
+			log.Printf("Rules:%s loaded from %s", p.name, file)
+		}
+	}
+	wait := p.interval
+	if p.isRemote() {
+		//fetch now if cache is missing or expired
+		wait = 0
+		if elapsed := time.Since(modTime); !modTime.IsZero() && elapsed < p.interval {
+			wait = p.interval - elapsed
+		}
+	}
+	retry := ruleSetRetryInterval
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-time.After(wait):
+		}
+		wait = p.interval
+		if !p.isRemote() {
+			if st, err := os.Stat(file); nil == err && !st.ModTime().Equal(modTime) {
+				if modTime, err = p.loadFile(file); nil != err {
+					log.Printf("[ERROR]Failed to reload rules:%s from %s for reason:%v", p.name, file, err)
+				} else {
+					log.Printf("Rules:%s reloaded from %s", p.name, file)
+				}
+			}
+			continue
+		}
+		updated, err := p.fetch(modTime)
+		if nil != err {
+			log.Printf("[ERROR]Failed to fetch rules:%s from %s for reason:%v", p.name, p.url, err)
+			wait = retry
+			if retry *= 2; retry > p.interval {
+				retry = p.interval
+			}
+			continue
+		}
+		retry = ruleSetRetryInterval
+		modTime = time.Now()
+		if updated {
+			log.Printf("Rules:%s updated from %s", p.name, p.url)
+		} else if len(p.cacheFile) > 0 {
+			//keep the cache fresh for next start
+			os.Chtimes(p.cacheFile, modTime, modTime)
+		}
+	}
+}
+
+func (p *ruleProvider) start() {
+	p.stopCh = make(chan struct{})
+	go p.run()
+}
+
+func (p *ruleProvider) stop() {
+	close(p.stopCh)
+}
+
+var ruleProviders = make(map[string]*ruleProvider)
+var ruleProvidersMutex sync.Mutex
+
+func getRuleProvider(name string) *ruleProvider {
+	ruleProvidersMutex.Lock()
+	defer ruleProvidersMutex.Unlock()
+	return ruleProviders[name]
+}
+
+//updateRuleProviders start new or changed providers, running providers with same config are kept
+func updateRuleProviders(providers []*ruleProvider) {
+	ruleProvidersMutex.Lock()
+	defer ruleProvidersMutex.Unlock()
+	table := make(map[string]*ruleProvider)
+	for _, p := range providers {
+		if old, exist := ruleProviders[p.name]; exist && reflect.DeepEqual(old.conf, p.conf) {
+			table[p.name] = old
+			delete(ruleProviders, p.name)
+			continue
+		}
+		p.start()
+		table[p.name] = p
+	}
+	for _, p := range ruleProviders {
+		p.stop()
+	}
+	ruleProviders = table
+}
+
+func stopRuleProviders() {
+	updateRuleProviders(nil)
+}
+
+func newGFWListProvider(conf GFWListConfig) *ruleProvider {
+	return &ruleProvider{
+		name:      gfwlistProviderName,
+		conf:      conf,
+		url:       conf.URL,
+		channel:   conf.Proxy,
+		cacheFile: filepath.Join(proxyHome, "gfwlist.txt"),
+		interval:  6 * time.Hour,
+		parse: func(content []byte) (interface{}, error) {
+			//cache of old version is decoded already
+			if plain, err := base64.StdEncoding.DecodeString(string(content)); nil == err {
+				content = plain
+			}
+			rules := string(content)
+			if len(conf.UserRule) > 0 {
+				rules = rules + "\n" + strings.Join(conf.UserRule, "\n") + "\n"
+			}
+			return gfwlist.Parse(rules)
+		},
+	}
+}
+
+func getGFWList() *gfwlist.GFWList {
+	if p := getRuleProvider(gfwlistProviderName); nil != p {
+		gfw, _ := p.get().(*gfwlist.GFWList)
+		return gfw
+	}
+	return nil
+}
+
+func newCNIPProvider() *ruleProvider {
+	return &ruleProvider{
+		name:      cnIPProviderName,
+		url:       cnIPURL,
+		cacheFile: filepath.Join(proxyHome, cnIPFile),
+		interval:  defaultRuleSetInterval,
+		parse: func(content []byte) (interface{}, error) {
+			return parseApnicIPReader(ioutil.NopCloser(bytes.NewReader(content)))
+		},
+	}
+}
+
+func getCNIPRange() *IPRangeHolder {
+	if p := getRuleProvider(cnIPProviderName); nil != p {
+		holder, _ := p.get().(*IPRangeHolder)
+		return holder
+	}
+	return nil
+}
+
+func isRuleSetComment(field string) bool {
+	return strings.HasPrefix(field, "#") || strings.HasPrefix(field, "!") || strings.HasPrefix(field, "//")
+}
+
+//ruleSetLines return fields of lines except empty lines & comments
+func ruleSetLines(content []byte) [][]string {
+	var lines [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || isRuleSetComment(fields[0]) {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+//ruleSetItems return first field of lines except empty lines & comments
+func ruleSetItems(content []byte) []string {
+	var items []string
+	for _, fields := range ruleSetLines(content) {
+		items = append(items, fields[0])
+	}
+	return items
+}
+
+//parseDomainSet parse lines of domain list, hosts file like '0.0.0.0 ads.example.com' or adblock rules like
+//'||ads.example.com^', exception rules like '@@||example.com^' are stored with value false
+func parseDomainSet(content []byte) (interface{}, error) {
+	set := new(matcher.DomainSet)
+	for _, fields := range ruleSetLines(content) {
+		if nil != net.ParseIP(fields[0]) && len(fields) > 1 {
+			for _, host := range fields[1:] {
+				if isRuleSetComment(host) {
+					break
+				}
+				//skip names like 'localhost' & 'broadcasthost'
+				if strings.Contains(host, ".") && nil == net.ParseIP(host) {
+					set.Add(host, true)
+				}
+			}
+			continue
+		}
+		domain := fields[0]
+		value := true
+		if strings.HasPrefix(domain, "@@") {
+			domain, value = domain[2:], false
+		}
+		if strings.HasPrefix(domain, "||") {
+			//adblock rules with path or options are not domain rules
+			domain = strings.TrimSuffix(domain[2:], "^")
+			if strings.ContainsAny(domain, "/^$*|") {
+				continue
+			}
+		} else if !value {
+			continue
+		}
+		//'+.example.com' & '*.example.com' match example.com and its subdomains, same as 'example.com'
+		domain = strings.TrimPrefix(strings.TrimPrefix(domain, "+."), "*.")
+		if domain = strings.Trim(domain, "."); len(domain) > 0 {
+			set.Add(domain, value)
+		}
+	}
+	return set, nil
+}
+
+func parseCIDRSet(content []byte) (interface{}, error) {
+	db := new(cidrCountryDB)
+	for _, item := range ruleSetItems(content) {
+		ipnet, err := parseCIDR(item)
+		if nil != err {
+			return nil, err
+		}
+		db.addNet(ipnet, "*")
+	}
+	db.split()
+	return db, nil
+}
+
+func parseURLSet(content []byte) (interface{}, error) {
+	items := ruleSetItems(content)
+	for i := range items {
+		items[i] = strings.ToLower(items[i])
+	}
+	return matcher.NewPatterns(items), nil
+}
+
+func newRuleSetProvider(conf RuleSetConfig) (*ruleProvider, error) {
+	if !ruleSetNameRegex.MatchString(conf.Name) {
+		return nil, fmt.Errorf("Invalid rule set name:%s", conf.Name)
+	}
+	if len(conf.URL) == 0 {
+		return nil, fmt.Errorf("Empty URL of rule set:%s", conf.Name)
+	}
+	p := &ruleProvider{
+		name:     conf.Name,
+		conf:     conf,
+		url:      conf.URL,
+		channel:  conf.Channel,
+		interval: time.Duration(conf.Interval) * time.Second,
+	}
+	switch strings.ToLower(conf.Type) {
+	case RuleSetTypeDomain:
+		p.parse = parseDomainSet
+	case RuleSetTypeCIDR:
+		p.parse = parseCIDRSet
+	case RuleSetTypeURL:
+		p.parse = parseURLSet
+	default:
+		return nil, fmt.Errorf("Invalid type:%s of rule set:%s", conf.Type, conf.Name)
+	}
+	if p.isRemote() {
+		p.cacheFile = filepath.Join(proxyHome, "ruleset_"+conf.Name+".txt")
+		if p.interval <= 0 {
+			p.interval = defaultRuleSetInterval
+		}
+	} else if p.interval <= 0 {
+		p.interval = defaultRuleSetFileInterval
+	}
+	return p, nil
+}
+
+//matchRuleSet match host or request by rule set, host could be a domain or IP
+func matchRuleSet(name string, host string, req *http.Request) bool {
+	p := getRuleProvider(name)
+	if nil == p {
+		log.Printf("[WARN]No rule set:%s found", name)
+		return false
+	}
+	if len(host) == 0 && nil != req {
+		host = req.Host
+		if h, _, err := net.SplitHostPort(host); nil == err {
+			host = h
+		}
+	}
+	switch set := p.get().(type) {
+	case *matcher.DomainSet:
+		if len(host) == 0 || nil != net.ParseIP(host) {
+			return false
+		}
+		v, found := set.Lookup(host)
+		return found && v == true
+	case *cidrCountryDB:
+		ip := resolveRuleIP(host)
+		return nil != ip && len(set.lookupCountry(ip)) > 0
+	case *matcher.Patterns:
+		return nil != req && set.Match(strings.ToLower(req.URL.String()))
+	}
+	//not loaded yet
+	return false
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleSetProvider(t *testing.T) {
+	home, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(home)
+	oldHome := proxyHome
+	proxyHome = home
+	defer func() { proxyHome = oldHome }()
+
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetched++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("# comment\nexample.com\n+.google.com\n"))
+	}))
+	defer server.Close()
+
+	p, err := newRuleSetProvider(RuleSetConfig{Name: "test", Type: "Domain", URL: server.URL})
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	if updated, err := p.fetch(time.Time{}); !updated || nil != err {
+		t.Fatalf("Expected updated, but got %v %v", updated, err)
+	}
+	if updated, err := p.fetch(time.Now()); updated || nil != err || fetched != 1 {
+		t.Fatalf("Expected not modified, but got %v %v", updated, err)
+	}
+	if _, err := os.Stat(filepath.Join(home, "ruleset_test.txt")); nil != err {
+		t.Fatalf("No cache file:%v", err)
+	}
+
+	//the fresh cache is loaded without fetch
+	updateRuleProviders([]*ruleProvider{p})
+	defer stopRuleProviders()
+	for i := 0; i < 100 && !matchRuleSet("test", "www.google.com", nil); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com:8080/", nil)
+	if !matchRuleSet("test", "www.google.com", nil) || !matchRuleSet("test", "", req) || matchRuleSet("test", "google.com.hk", nil) || fetched != 1 {
+		t.Errorf("Invalid domain rule set match")
+	}
+}
+
+func TestCIDRSet(t *testing.T) {
+	v, err := parseCIDRSet([]byte("10.0.0.0/8\n10.1.1.0/24\n192.168.1.1\n2001:db8::/32\n"))
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	set := v.(*cidrCountryDB)
+	for ip, expected := range map[string]bool{"10.2.0.1": true, "10.1.1.1": true, "192.168.1.1": true, "192.168.1.2": false, "2001:db8::1": true, "2001:db9::1": false} {
+		if (len(set.lookupCountry(net.ParseIP(ip))) > 0) != expected {
+			t.Errorf("Expected %v for %s", expected, ip)
+		}
+	}
+	if _, err := parseCIDRSet([]byte("10.0.0.0/33\n")); nil == err {
+		t.Errorf("Expected error for invalid CIDR")
+	}
+}
@@ -17,11 +17,21 @@ var sessionNotExist error
 
 type ProxySession struct {
 	id          uint32
-	queue       *event.EventQueue
+	queue       *event.EventBuffer
 	Remote      *RemoteChannel
 	Hijacked    bool
 	SSLHijacked bool
 	createTime  time.Time
+	//authenticated user of local proxy listener
+	user string
+	//client IP of local proxy listener
+	src string
+	//decision of PAC rules for the session
+	route *routeTrace
+
+	windowMutex sync.Mutex
+	sendWindow  *event.FlowWindow
+	recvCounter *event.FlowCounter
 }
 
 func (s *ProxySession) SetRemoteChannel(r *RemoteChannel) {
@@ -31,11 +41,39 @@ func (s *ProxySession) SetRemoteChannel(r *RemoteChannel) {
 	s.Remote = r
 }
 
+//resetRemote detach the session from current channel before failover to another one
+func (s *ProxySession) resetRemote() {
+	if nil != s.Remote {
+		s.Remote.updateActiveSessionNum(-1)
+		s.Remote = nil
+	}
+	s.closeWindow()
+	s.windowMutex.Lock()
+	s.sendWindow = nil
+	s.recvCounter = nil
+	s.windowMutex.Unlock()
+}
+
+//handle publish the event into session's buffer without blocking the shared channel reader,
+//since peer never send more chunks than the granted window. Datagrams are dropped if buffer full,
+//chunks from old peers without flow control still wait like before.
 func (s *ProxySession) handle(ev event.Event) error {
-	if nil != s.queue {
-		s.queue.Publish(ev, 5*time.Second)
+	if nil == s.queue {
+		return nil
 	}
-	return nil
+	timeout := 5 * time.Second
+	if _, ok := ev.(*event.UDPEvent); ok {
+		timeout = 0
+	} else if rc := s.Remote; nil != rc && rc.flowControl() {
+		timeout = 0
+	}
+	err := s.queue.Publish(ev, timeout)
+	if _, ok := ev.(*event.TCPChunkEvent); ok && nil != err {
+		//stream is broken once chunk lost
+		log.Printf("[WARN]Session:%d closed since chunk dropped for reason:%v", s.id, err)
+		s.Close()
+	}
+	return err
 }
 
 func (s *ProxySession) Close() error {
@@ -45,6 +83,71 @@ func (s *ProxySession) Close() error {
 	return nil
 }
 
+func (s *ProxySession) getSendWindow(rc *RemoteChannel, createIfMissing bool) *event.FlowWindow {
+	s.windowMutex.Lock()
+	defer s.windowMutex.Unlock()
+	if nil == s.sendWindow && createIfMissing {
+		s.sendWindow = event.NewFlowWindow(int64(rc.peerWindow))
+	}
+	return s.sendWindow
+}
+
+//acquireSendWindow blocks until remote peer grant enough window for the chunk
+func (s *ProxySession) acquireSendWindow(rc *RemoteChannel, n int) error {
+	w := s.getSendWindow(rc, true)
+	for {
+		err := w.Acquire(n, 1*time.Second)
+		if err != event.ErrWindowTimeout {
+			return err
+		}
+		if !rc.isRunning() {
+			return event.ErrWindowClosed
+		}
+	}
+}
+
+func (s *ProxySession) releaseSendWindow(delta uint32) {
+	if w := s.getSendWindow(nil, false); nil != w {
+		w.Release(delta)
+	}
+}
+
+//ackChunk send window update to remote peer once enough received data consumed by local connection
+func (s *ProxySession) ackChunk(n int) {
+	rc := s.Remote
+	if nil == rc || !rc.flowControl() {
+		return
+	}
+	s.windowMutex.Lock()
+	if nil == s.recvCounter {
+		s.recvCounter = event.NewFlowCounter(event.DefaultSessionWindow)
+	}
+	s.windowMutex.Unlock()
+	if delta, ok := s.recvCounter.Consume(n); ok {
+		update := &event.WindowUpdateEvent{Delta: delta}
+		update.SetId(s.id)
+		rc.Write(update)
+	}
+}
+
+func (s *ProxySession) closeWindow() {
+	if w := s.getSendWindow(nil, false); nil != w {
+		w.Close()
+	}
+}
+
+func resetSessionSendWindows(rc *RemoteChannel) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	for _, s := range sessions {
+		if s.Remote == rc {
+			if w := s.getSendWindow(rc, false); nil != w {
+				w.Reset()
+			}
+		}
+	}
+}
+
 func getProxySession(sid uint32) *ProxySession {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
@@ -61,15 +164,20 @@ func dumpProxySessions(w io.Writer) {
 	defer sessionMutex.Unlock()
 	for _, s := range sessions {
 		if nil != s.Remote {
-			fmt.Fprintf(w, "Session[%d]:proxy=%s[%d],age=%v\n", s.id, s.Remote.Addr, s.Remote.Index, time.Now().Sub(s.createTime))
+			fmt.Fprintf(w, "Session[%d]:proxy=%s[%d],user=%s,age=%v,route=%v\n", s.id, s.Remote.Addr, s.Remote.Index, s.user, time.Now().Sub(s.createTime), s.route)
 		} else {
-			fmt.Fprintf(w, "Session[%d]:nil remote,age=%v\n", s.id, time.Now().Sub(s.createTime))
+			fmt.Fprintf(w, "Session[%d]:nil remote,user=%s,age=%v,route=%v\n", s.id, s.user, time.Now().Sub(s.createTime), s.route)
 			//delete(sessions, s.id)
 		}
 	}
 }
 
-func newProxySession(sid uint32, queue *event.EventQueue) *ProxySession {
+//newSessionBuffer return buffer large enough to hold a whole flow window of chunks
+func newSessionBuffer() *event.EventBuffer {
+	return event.NewEventBuffer(event.DefaultSessionWindow)
+}
+
+func newProxySession(sid uint32, queue *event.EventBuffer) *ProxySession {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 	s := new(ProxySession)
@@ -93,6 +201,7 @@ func closeProxySession(sid uint32) {
 		if nil != s && nil != s.Remote {
 			s.Remote.updateActiveSessionNum(-1)
 		}
+		s.closeWindow()
 		delete(sessions, sid)
 	}
 }
@@ -104,6 +213,7 @@ func closeAllProxySession() {
 		if nil != s && nil != s.Remote {
 			s.Remote.updateActiveSessionNum(-1)
 		}
+		s.closeWindow()
 		delete(sessions, id)
 	}
 }
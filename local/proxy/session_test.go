@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+func TestSessionBuffer(t *testing.T) {
+	rc := &RemoteChannel{peerWindow: event.DefaultSessionWindow}
+	slow := newProxySession(getSessionId(), newSessionBuffer())
+	fast := newProxySession(getSessionId(), newSessionBuffer())
+	defer closeProxySession(slow.id)
+	defer closeProxySession(fast.id)
+	slow.SetRemoteChannel(rc)
+	fast.SetRemoteChannel(rc)
+
+	const chunkSize = 8192
+	const chunks = event.DefaultSessionWindow / chunkSize
+	//peer send chunks of fast stream within the window acked by reader
+	window := event.NewFlowWindow(event.DefaultSessionWindow)
+	received := make(chan int)
+	go func() {
+		n := 0
+		for n < 4*chunks*chunkSize {
+			ev, err := fast.queue.Read(time.Second)
+			if nil != err {
+				break
+			}
+			n += len(ev.(*event.TCPChunkEvent).Content)
+			window.Release(uint32(len(ev.(*event.TCPChunkEvent).Content)))
+		}
+		received <- n
+	}()
+
+	//slow session is never read, channel reader should not be blocked by it
+	start := time.Now()
+	for i := 0; i < 4*chunks; i++ {
+		if i < chunks {
+			ev := &event.TCPChunkEvent{Content: make([]byte, chunkSize)}
+			ev.SetId(slow.id)
+			if err := HandleEvent(ev); nil != err {
+				t.Fatalf("Failed to buffer chunk within window:%v", err)
+			}
+		}
+		window.Acquire(chunkSize, time.Second)
+		ev := &event.TCPChunkEvent{Content: make([]byte, chunkSize)}
+		ev.SetId(fast.id)
+		if err := HandleEvent(ev); nil != err {
+			t.Fatalf("Failed to buffer chunk of fast stream:%v", err)
+		}
+	}
+	if n := <-received; n != 4*chunks*chunkSize {
+		t.Fatalf("Fast stream received %d bytes only", n)
+	}
+	if cost := time.Now().Sub(start); cost > time.Second {
+		t.Fatalf("Channel reader blocked %v by slow session", cost)
+	}
+
+	//peer exceed the window, session is closed instead of blocking
+	ev := &event.TCPChunkEvent{Content: make([]byte, chunkSize)}
+	ev.SetId(slow.id)
+	if err := HandleEvent(ev); err != event.ErrWindowOverflow {
+		t.Fatalf("Expected overflow, but got %v", err)
+	}
+	var last event.Event
+	for {
+		ev, err := slow.queue.Read(time.Millisecond)
+		if nil != err {
+			break
+		}
+		last = ev
+	}
+	if _, ok := last.(*event.ConnCloseEvent); !ok {
+		t.Fatalf("Expected session closed, but got %T", last)
+	}
+}
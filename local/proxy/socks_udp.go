@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/yinqiwen/gsnova/local/socks"
+)
+
+//socksUDPAssociation relay datagrams between SOCKS5 client & proxy sessions,
+//it lives until the controlling TCP connection closed.
+type socksUDPAssociation struct {
+	*udpRelay
+	clientMutex sync.Mutex
+	conn        *net.UDPConn
+	clientIP    net.IP
+	clientPort  int
+	client      *net.UDPAddr
+}
+
+//acceptClient only accept datagrams from the client of TCP connection,
+//and the port declared in UDP ASSOCIATE request if not zero.
+func (a *socksUDPAssociation) acceptClient(addr *net.UDPAddr) bool {
+	if !addr.IP.Equal(a.clientIP) {
+		return false
+	}
+	if a.clientPort > 0 && addr.Port != a.clientPort {
+		return false
+	}
+	a.clientMutex.Lock()
+	a.client = addr
+	a.clientMutex.Unlock()
+	return true
+}
+
+func (a *socksUDPAssociation) readDatagrams() {
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buffer)
+		if nil != err {
+			return
+		}
+		if !a.acceptClient(addr) {
+			log.Printf("[WARN]Drop socks udp datagram from unexpected client:%v", addr)
+			continue
+		}
+		target, data, err := socks.ParseUDPDatagram(buffer[0:n])
+		if nil != err {
+			log.Printf("[WARN]Drop socks udp datagram from %v for reason:%v", addr, err)
+			continue
+		}
+		a.relay(target, a.clientIP.String(), target, append([]byte{}, data...), udpReplyFunc(func(content []byte) error {
+			a.clientMutex.Lock()
+			client := a.client
+			a.clientMutex.Unlock()
+			b, err := socks.BuildUDPDatagram(target, content)
+			if nil == err {
+				_, err = a.conn.WriteToUDP(b, client)
+			}
+			return err
+		}))
+	}
+}
+
+//socksUDPClient return the client allowed to send datagrams, which must be the peer of TCP connection (RFC 1928 section 7),
+//DST.ADDR in request is controlled by client, so only its port is used to narrow the datagrams.
+func socksUDPClient(raddr *net.TCPAddr, target string) (net.IP, int) {
+	port := 0
+	if _, p, err := net.SplitHostPort(target); nil == err {
+		port, _ = net.LookupPort("udp", p)
+	}
+	return raddr.IP, port
+}
+
+//handleSocksUDPAssociate serve a SOCKS5 UDP ASSOCIATE request, the relay socket is bound to
+//the same local IP of the TCP connection.
+func handleSocksUDPAssociate(conn *socks.SocksConn, proxy ProxyConfig, user string) {
+	defer conn.Close()
+	laddr := conn.LocalAddr().(*net.TCPAddr)
+	raddr := conn.RemoteAddr().(*net.TCPAddr)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+	if nil != err {
+		log.Printf("[ERROR]Failed to listen udp for socks udp associate:%v", err)
+		conn.Reject()
+		return
+	}
+	a := &socksUDPAssociation{conn: udpConn}
+	a.clientIP, a.clientPort = socksUDPClient(raddr, conn.Req.Target)
+	if err = conn.GrantUDP(udpConn.LocalAddr().(*net.UDPAddr)); nil != err {
+		udpConn.Close()
+		return
+	}
+	log.Printf("Local proxy serve socks udp associate on %v for %v", udpConn.LocalAddr(), raddr)
+	a.udpRelay = newUDPRelay(proxy.Local, user)
+	go a.readDatagrams()
+	//association terminates when the TCP connection closed
+	io.Copy(ioutil.Discard, conn)
+	a.close()
+	udpConn.Close()
+	log.Printf("Socks udp associate on %v closed", udpConn.LocalAddr())
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocksUDPClient(t *testing.T) {
+	raddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 50000}
+	for _, c := range []struct {
+		target string
+		port   int
+	}{
+		{"0.0.0.0:0", 0},
+		{"192.168.1.2:5353", 5353},
+		//other host declared by client is ignored
+		{"10.0.0.1:5353", 5353},
+	} {
+		ip, port := socksUDPClient(raddr, c.target)
+		if !ip.Equal(raddr.IP) || port != c.port {
+			t.Fatalf("Invalid client %v:%d for target:%s", ip, port, c.target)
+		}
+		a := &socksUDPAssociation{clientIP: ip, clientPort: port}
+		if a.acceptClient(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}) {
+			t.Fatalf("Datagram from other host should be dropped for target:%s", c.target)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+#!/bin/sh
+#Setup a client network namespace routed through the host running gsnova with transparent proxy mode,
+#run as root with iptables & iproute2 installed, e.g.
+#  sh transparent_netns.sh redirect 48100
+#  ip netns exec gsnova-client curl -v http://www.example.com/
+#  sh transparent_netns.sh clean
+#gsnova client.json should have a listener like {"Local":"0.0.0.0:48100","Mode":"redirect","PAC":[...]}
+
+NS=gsnova-client
+MODE=${1:-redirect}
+PORT=${2:-48100}
+HOST_IP=10.200.1.1
+CLIENT_IP=10.200.1.2
+
+clean() {
+	iptables -t nat -D PREROUTING -i veth-gsnova -p tcp -j REDIRECT --to-ports $PORT 2>/dev/null
+	iptables -t nat -D POSTROUTING -s $CLIENT_IP/32 ! -o veth-gsnova -j MASQUERADE 2>/dev/null
+	iptables -D FORWARD -i veth-gsnova -j ACCEPT 2>/dev/null
+	iptables -D FORWARD -o veth-gsnova -j ACCEPT 2>/dev/null
+	iptables -t mangle -D PREROUTING -i veth-gsnova -p tcp -j TPROXY --on-port $PORT --tproxy-mark 1 2>/dev/null
+	iptables -t mangle -D PREROUTING -i veth-gsnova -p udp -j TPROXY --on-port $PORT --tproxy-mark 1 2>/dev/null
+	ip rule del fwmark 1 lookup 100 2>/dev/null
+	ip route del local 0.0.0.0/0 dev lo table 100 2>/dev/null
+	ip link del veth-gsnova 2>/dev/null
+	ip netns del $NS 2>/dev/null
+}
+
+if [ "$MODE" = "clean" ]; then
+	clean
+	exit 0
+fi
+
+clean
+set -e
+ip netns add $NS
+ip link add veth-gsnova type veth peer name veth-client
+ip link set veth-client netns $NS
+ip addr add $HOST_IP/24 dev veth-gsnova
+ip link set veth-gsnova up
+ip netns exec $NS ip addr add $CLIENT_IP/24 dev veth-client
+ip netns exec $NS ip link set veth-client up
+ip netns exec $NS ip link set lo up
+ip netns exec $NS ip route add default via $HOST_IP
+#resolve by a public dns server, which is routed through gsnova in 'tproxy' mode,
+#or forwarded & masqueraded by host in 'redirect' mode since only tcp is redirected
+mkdir -p /etc/netns/$NS
+echo "nameserver 8.8.8.8" > /etc/netns/$NS/resolv.conf
+
+case "$MODE" in
+redirect)
+	iptables -t nat -A PREROUTING -i veth-gsnova -p tcp -j REDIRECT --to-ports $PORT
+	#ip_forward is left enabled after clean
+	sysctl -q -w net.ipv4.ip_forward=1
+	iptables -A FORWARD -i veth-gsnova -j ACCEPT
+	iptables -A FORWARD -o veth-gsnova -j ACCEPT
+	iptables -t nat -A POSTROUTING -s $CLIENT_IP/32 ! -o veth-gsnova -j MASQUERADE
+	;;
+tproxy)
+	ip rule add fwmark 1 lookup 100
+	ip route add local 0.0.0.0/0 dev lo table 100
+	iptables -t mangle -A PREROUTING -i veth-gsnova -p tcp -j TPROXY --on-port $PORT --tproxy-mark 1
+	iptables -t mangle -A PREROUTING -i veth-gsnova -p udp -j TPROXY --on-port $PORT --tproxy-mark 1
+	;;
+*)
+	echo "Usage: $0 redirect|tproxy|clean [port]"
+	clean
+	exit 1
+	;;
+esac
+echo "Client namespace $NS ready, run commands by 'ip netns exec $NS ...'"
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+//socket options not defined in syscall package
+const (
+	soOriginalDst         = 80 //SO_ORIGINAL_DST & IP6T_SO_ORIGINAL_DST
+	ipRecvOrigDstAddr     = 20 //IP_RECVORIGDSTADDR
+	ipv6Transparent       = 75 //IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr   = 74 //IPV6_RECVORIGDSTADDR
+	transparentUDPBufSize = 65536
+)
+
+func isIPv6Addr(ip net.IP) bool {
+	return nil != ip && nil == ip.To4()
+}
+
+//setTransparent set IP_TRANSPARENT on socket, and IP_RECVORIGDSTADDR if recvOrigDst
+func setTransparent(fd int, v6 bool, recvOrigDst bool) error {
+	level, opt, recvOpt := syscall.SOL_IP, syscall.IP_TRANSPARENT, ipRecvOrigDstAddr
+	if v6 {
+		level, opt, recvOpt = syscall.SOL_IPV6, ipv6Transparent, ipv6RecvOrigDstAddr
+	}
+	if err := syscall.SetsockoptInt(fd, level, opt, 1); nil != err {
+		return fmt.Errorf("Failed to set transparent option:%v, CAP_NET_ADMIN required", err)
+	}
+	if recvOrigDst {
+		if err := syscall.SetsockoptInt(fd, level, recvOpt, 1); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func transparentListenConfig(v6 bool, recvOrigDst bool, reuseAddr bool) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if reuseAddr {
+					syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				}
+				serr = setTransparent(int(fd), v6, recvOrigDst)
+			})
+			if nil != err {
+				return err
+			}
+			return serr
+		},
+	}
+}
+
+//listenTransparentTCP listen on ipv4 only unless ipv6 address specified,
+//since SO_ORIGINAL_DST is not available on dual stack socket.
+func listenTransparentTCP(mode string, addr *net.TCPAddr) (*net.TCPListener, error) {
+	v6 := isIPv6Addr(addr.IP)
+	network := "tcp4"
+	if v6 {
+		network = "tcp6"
+	}
+	switch mode {
+	case ProxyModeRedirect:
+		return net.ListenTCP(network, addr)
+	case ProxyModeTProxy:
+		l, err := transparentListenConfig(v6, false, false).Listen(context.Background(), network, addr.String())
+		if nil != err {
+			return nil, err
+		}
+		return l.(*net.TCPListener), nil
+	}
+	return nil, fmt.Errorf("Invalid proxy mode:%s", mode)
+}
+
+func getsockoptOriginalDst(fd int, v6 bool) (string, error) {
+	if v6 {
+		var sa syscall.RawSockaddrInet6
+		size := uint32(unsafe.Sizeof(sa))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_IPV6, soOriginalDst, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			return "", errno
+		}
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+	}
+	var sa syscall.RawSockaddrInet4
+	size := uint32(unsafe.Sizeof(sa))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_IP, soOriginalDst, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return "", errno
+	}
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+//getOriginalDst return destination of conn redirected by iptables REDIRECT or TPROXY target
+func getOriginalDst(conn *net.TCPConn, mode string) (string, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if mode == ProxyModeTProxy {
+		//local address of tproxy socket is the original destination
+		return local.String(), nil
+	}
+	raw, err := conn.SyscallConn()
+	if nil != err {
+		return "", err
+	}
+	var dst string
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		dst, serr = getsockoptOriginalDst(int(fd), isIPv6Addr(local.IP))
+	})
+	if nil == err {
+		err = serr
+	}
+	if nil != err {
+		return "", err
+	}
+	if dst == local.String() {
+		return "", fmt.Errorf("Conn is not redirected by iptables")
+	}
+	return dst, nil
+}
+
+//parseOrigDstAddr parse IP_ORIGDSTADDR/IPV6_ORIGDSTADDR control message
+func parseOrigDstAddr(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if nil != err {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.SOL_IP && msg.Header.Type == ipRecvOrigDstAddr && len(msg.Data) >= 8 {
+			ip := net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7])
+			return &net.UDPAddr{IP: ip, Port: int(msg.Data[2])<<8 | int(msg.Data[3])}, nil
+		}
+		if msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(msg.Data) >= 24 {
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, msg.Data[8:24])
+			return &net.UDPAddr{IP: ip, Port: int(msg.Data[2])<<8 | int(msg.Data[3])}, nil
+		}
+	}
+	return nil, fmt.Errorf("No original destination found in control message")
+}
+
+//tproxyUDPReplier write datagrams back to client from the original destination address,
+//which need a transparent socket bound to the non local address.
+type tproxyUDPReplier struct {
+	mutex  sync.Mutex
+	client *net.UDPAddr
+	dst    *net.UDPAddr
+	conn   *net.UDPConn
+}
+
+func (r *tproxyUDPReplier) reply(content []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if nil == r.conn {
+		v6 := isIPv6Addr(r.dst.IP)
+		network := "udp4"
+		if v6 {
+			network = "udp6"
+		}
+		c, err := transparentListenConfig(v6, false, true).ListenPacket(context.Background(), network, r.dst.String())
+		if nil != err {
+			return err
+		}
+		r.conn = c.(*net.UDPConn)
+	}
+	_, err := r.conn.WriteToUDP(content, r.client)
+	return err
+}
+
+func (r *tproxyUDPReplier) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if nil != r.conn {
+		return r.conn.Close()
+	}
+	return nil
+}
+
+type tproxyUDPServer struct {
+	local string
+	conn  *net.UDPConn
+	relay *udpRelay
+}
+
+func (s *tproxyUDPServer) Close() error {
+	err := s.conn.Close()
+	s.relay.close()
+	return err
+}
+
+func (s *tproxyUDPServer) serve() {
+	buffer := make([]byte, transparentUDPBufSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := s.conn.ReadMsgUDP(buffer, oob)
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		//use the latest 'AllowCIDR' since config may be reloaded
+		if conf, exist := getProxyConfig(s.local); !exist || !conf.allowClient(client) {
+			log.Printf("[WARN]Drop tproxy udp datagram from client:%v not allowed by %s", client, s.local)
+			continue
+		}
+		dst, err := parseOrigDstAddr(oob[0:oobn])
+		if nil != err {
+			log.Printf("[WARN]Drop tproxy udp datagram from %v for reason:%v", client, err)
+			continue
+		}
+		key := client.String() + "->" + dst.String()
+		s.relay.relay(key, client.IP.String(), dst.String(), append([]byte{}, buffer[0:n]...), &tproxyUDPReplier{client: client, dst: dst})
+	}
+}
+
+//startTProxyUDP serve udp datagrams redirected by iptables TPROXY target on same address of tcp listener
+func startTProxyUDP(proxy ProxyConfig, addr *net.TCPAddr) (io.Closer, error) {
+	v6 := isIPv6Addr(addr.IP)
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	c, err := transparentListenConfig(v6, true, false).ListenPacket(context.Background(), network, addr.String())
+	if nil != err {
+		return nil, err
+	}
+	s := &tproxyUDPServer{local: proxy.Local, conn: c.(*net.UDPConn), relay: newUDPRelay(proxy.Local, "")}
+	go s.serve()
+	return s, nil
+}
@@ -0,0 +1,21 @@
+// +build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+func listenTransparentTCP(mode string, addr *net.TCPAddr) (*net.TCPListener, error) {
+	return nil, fmt.Errorf("Transparent proxy mode:%s is only supported on linux", mode)
+}
+
+func getOriginalDst(conn *net.TCPConn, mode string) (string, error) {
+	return "", fmt.Errorf("Transparent proxy mode:%s is only supported on linux", mode)
+}
+
+func startTProxyUDP(proxy ProxyConfig, addr *net.TCPAddr) (io.Closer, error) {
+	return nil, fmt.Errorf("Transparent proxy is only supported on linux")
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	defaultTUNMTU = 1500
+	tunDNSTimeout = 10 * time.Second
+)
+
+//TUNHandler serve flows accepted by the userspace TCP/IP stack of TUN device,
+//dst is the original destination of the flow.
+type TUNHandler interface {
+	HandleTCP(conn net.Conn, dst string)
+	//conn read/write datagrams of one UDP flow
+	HandleUDP(conn net.Conn, dst string)
+}
+
+//TUNDeviceOpener open TUN device 'name' & serve its packets by handler
+type TUNDeviceOpener func(name string, mtu int, handler TUNHandler) (io.Closer, error)
+
+var tunDeviceOpener TUNDeviceOpener
+
+//RegisterTUNDeviceOpener is invoked by package 'local/tun' which implements the userspace stack
+func RegisterTUNDeviceOpener(opener TUNDeviceOpener) {
+	tunDeviceOpener = opener
+}
+
+//tunUDPReplier write datagrams back to the UDP flow of TUN device
+type tunUDPReplier struct {
+	net.Conn
+}
+
+func (r tunUDPReplier) reply(content []byte) error {
+	_, err := r.Write(content)
+	return err
+}
+
+type tunHandler struct {
+	local string
+	relay *udpRelay
+}
+
+func (h *tunHandler) HandleTCP(conn net.Conn, dst string) {
+	//use the latest PAC rules since config may be reloaded
+	conf, exist := getProxyConfig(h.local)
+	if !exist {
+		conn.Close()
+		return
+	}
+	serveProxyConn(conn, conf, dst)
+}
+
+func (h *tunHandler) HandleUDP(conn net.Conn, dst string) {
+	_, port, err := net.SplitHostPort(dst)
+	if nil != err {
+		conn.Close()
+		return
+	}
+	if port == "53" {
+		serveTUNDNS(conn)
+		return
+	}
+	//the flow is closed with relay target when it expired
+	key := conn.RemoteAddr().String() + "->" + dst
+	src, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	replier := tunUDPReplier{conn}
+	buffer := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buffer)
+		if nil != err {
+			break
+		}
+		h.relay.relay(key, src, dst, append([]byte{}, buffer[0:n]...), replier)
+	}
+	conn.Close()
+}
+
+//serveTUNDNS intercept DNS queries to any server into local dns resolver
+func serveTUNDNS(conn net.Conn) {
+	defer conn.Close()
+	buffer := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tunDNSTimeout))
+		n, err := conn.Read(buffer)
+		if nil != err {
+			return
+		}
+		res, err := dnsQueryRaw(buffer[0:n])
+		if nil != err {
+			log.Printf("[ERROR]Failed to query dns with reason:%v", err)
+			continue
+		}
+		conn.Write(res)
+	}
+}
+
+type tunServer struct {
+	device io.Closer
+	relay  *udpRelay
+}
+
+func (s *tunServer) Close() error {
+	err := s.device.Close()
+	s.relay.close()
+	return err
+}
+
+func startTUNServer(proxy ProxyConfig) (*localProxyServer, error) {
+	if nil == tunDeviceOpener {
+		return nil, fmt.Errorf("TUN device is not supported")
+	}
+	mtu := proxy.MTU
+	if mtu <= 0 {
+		mtu = defaultTUNMTU
+	}
+	handler := &tunHandler{local: proxy.Local, relay: newUDPRelay(proxy.Local, "")}
+	device, err := tunDeviceOpener(proxy.Local, mtu, handler)
+	if nil != err {
+		handler.relay.close()
+		return nil, fmt.Errorf("Can NOT open TUN device:%s for reason:%v", proxy.Local, err)
+	}
+	log.Printf("Serve TUN device %s with MTU:%d", proxy.Local, mtu)
+	return &localProxyServer{mode: proxy.Mode, tun: &tunServer{device: device, relay: handler.relay}}, nil
+}
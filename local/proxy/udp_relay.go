@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+//max idle time of a relay target
+const udpRelayTargetIdleTime = 60 * time.Second
+
+//udpReplier write datagrams from destination back to client,
+//it's closed with the relay target if it implements io.Closer.
+type udpReplier interface {
+	reply(content []byte) error
+}
+
+type udpReplyFunc func(content []byte) error
+
+func (f udpReplyFunc) reply(content []byte) error {
+	return f(content)
+}
+
+//udpRelayTarget is a proxy session relaying datagrams of one flow to its destination
+type udpRelayTarget struct {
+	key        string
+	addr       string
+	session    *ProxySession
+	proxy      Proxy
+	activeTime time.Time
+	replier    udpReplier
+}
+
+//udpRelay route datagrams by PAC rules into proxy sessions, one session per flow,
+//it's shared by SOCKS5 UDP ASSOCIATE & transparent UDP proxy.
+type udpRelay struct {
+	mutex sync.Mutex
+	//listen address of the proxy config, config is looked up per flow since it may be reloaded
+	local    string
+	user     string
+	queue    *event.EventBuffer
+	targets  map[string]*udpRelayTarget
+	sessions map[uint32]*udpRelayTarget
+	//read by writeBack without lock
+	closed int32
+}
+
+func newUDPRelay(local string, user string) *udpRelay {
+	r := &udpRelay{
+		local:    local,
+		user:     user,
+		queue:    newSessionBuffer(),
+		targets:  make(map[string]*udpRelayTarget),
+		sessions: make(map[uint32]*udpRelayTarget),
+	}
+	go r.writeBack()
+	return r
+}
+
+func (r *udpRelay) getTarget(key string, src string, addr string) (*udpRelayTarget, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, exist := r.targets[key]
+	if !exist {
+		t = &udpRelayTarget{key: key, addr: addr}
+		t.session = newProxySession(getSessionId(), r.queue)
+		t.session.user = r.user
+		t.session.src = src
+		r.targets[key] = t
+		r.sessions[t.session.id] = t
+	}
+	t.activeTime = time.Now()
+	return t, !exist
+}
+
+func (r *udpRelay) getTargetBySession(sid uint32) *udpRelayTarget {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, exist := r.sessions[sid]
+	if exist {
+		t.activeTime = time.Now()
+		return t
+	}
+	return nil
+}
+
+func (r *udpRelay) removeTarget(t *udpRelayTarget, notifyRemote bool) {
+	r.mutex.Lock()
+	if r.targets[t.key] != t {
+		r.mutex.Unlock()
+		return
+	}
+	delete(r.targets, t.key)
+	delete(r.sessions, t.session.id)
+	r.mutex.Unlock()
+	if notifyRemote && nil != t.proxy {
+		closeEv := &event.ConnCloseEvent{}
+		closeEv.SetId(t.session.id)
+		t.proxy.Serve(t.session, closeEv)
+	}
+	if closer, ok := t.replier.(io.Closer); ok {
+		closer.Close()
+	}
+	closeProxySession(t.session.id)
+}
+
+func (r *udpRelay) expireTargets() {
+	var expired []*udpRelayTarget
+	r.mutex.Lock()
+	for _, t := range r.targets {
+		if time.Now().Sub(t.activeTime) > udpRelayTargetIdleTime {
+			expired = append(expired, t)
+		}
+	}
+	r.mutex.Unlock()
+	for _, t := range expired {
+		r.removeTarget(t, true)
+	}
+}
+
+func (r *udpRelay) close() {
+	r.mutex.Lock()
+	atomic.StoreInt32(&r.closed, 1)
+	targets := make([]*udpRelayTarget, 0, len(r.targets))
+	for _, t := range r.targets {
+		targets = append(targets, t)
+	}
+	r.mutex.Unlock()
+	for _, t := range targets {
+		r.removeTarget(t, true)
+	}
+}
+
+//relay route the datagram of flow 'key' from client IP src to addr by PAC 'udp' rules, or 'dns' rules for port 53,
+//replier of the first datagram in flow is used to write datagrams from addr back.
+func (r *udpRelay) relay(key string, src string, addr string, data []byte, replier udpReplier) {
+	addr, err := mapFakeIPAddr(addr)
+	if nil != err {
+		log.Printf("[WARN]Drop udp datagram from %s for reason:%v", src, err)
+		return
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return
+	}
+	t, created := r.getTarget(key, src, addr)
+	if created {
+		t.replier = replier
+		protocol := "udp"
+		if port == "53" {
+			protocol = "dns"
+		}
+		//use the latest PAC rules since config may be reloaded
+		conf, exist := getProxyConfig(r.local)
+		if exist {
+			t.proxy = conf.findProxyByRequest(protocol, host, src, r.user, nil)
+		}
+		if nil == t.proxy {
+			r.removeTarget(t, false)
+			return
+		}
+		log.Printf("Session:%d select channel:%s for udp to %s", t.session.id, t.proxy.Config().Name, addr)
+	}
+	if port == "53" && t.proxy.Config().IsDirect() {
+		sid := t.session.id
+		go func() {
+			res, err := dnsQueryRaw(data)
+			if nil == err {
+				resev := &event.UDPEvent{Content: res}
+				resev.SetId(sid)
+				HandleEvent(resev)
+			} else {
+				log.Printf("[ERROR]Failed to query dns with reason:%v", err)
+			}
+		}()
+		return
+	}
+	ev := &event.UDPEvent{Content: data, Addr: addr}
+	ev.SetId(t.session.id)
+	t.proxy.Serve(t.session, ev)
+}
+
+func (r *udpRelay) writeBack() {
+	lastExpireTime := time.Now()
+	for atomic.LoadInt32(&r.closed) == 0 {
+		if time.Now().Sub(lastExpireTime) > 10*time.Second {
+			r.expireTargets()
+			lastExpireTime = time.Now()
+		}
+		ev, err := r.queue.Read(1 * time.Second)
+		if err != nil {
+			if err != io.EOF {
+				continue
+			}
+			return
+		}
+		t := r.getTargetBySession(ev.GetId())
+		if nil == t {
+			continue
+		}
+		switch ev.(type) {
+		case *event.UDPEvent:
+			if err := t.replier.reply(ev.(*event.UDPEvent).Content); nil != err {
+				log.Printf("Session:%d failed to write udp datagram back for reason:%v", t.session.id, err)
+			}
+		case *event.ConnCloseEvent:
+			r.removeTarget(t, false)
+		case *event.NotifyEvent:
+		default:
+			log.Printf("Invalid event type:%T to process", ev)
+		}
+	}
+}
@@ -178,7 +178,7 @@ func updateUdpSession(u *udpSession) {
 	udpSessionIdSet.ReplaceOrInsert(&u.udpSessionId)
 }
 
-func getUDPSession(id uint16, queue *event.EventQueue, createIfMissing bool) *udpSession {
+func getUDPSession(id uint16, queue *event.EventBuffer, createIfMissing bool) *udpSession {
 	udpSessionMutex.Lock()
 	defer udpSessionMutex.Unlock()
 	session, exist := udpSessionTable[id]
@@ -202,8 +202,9 @@ func getCid(sid uint32) (uint16, bool) {
 	return cid, exist
 }
 
-func handleUDPGatewayConn(conn net.Conn, proxy ProxyConfig) {
-	queue := event.NewEventQueue()
+func handleUDPGatewayConn(conn net.Conn, proxy ProxyConfig, user string) {
+	queue := newSessionBuffer()
+	src, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	connClosed := false
 	go func() {
 		for !connClosed {
@@ -265,16 +266,25 @@ func handleUDPGatewayConn(conn net.Conn, proxy ProxyConfig) {
 			//log.Printf("###Recv udpgw packet to %s:%d", packet.addr.ip.String(), packet.addr.port)
 		}
 
+		addr, err := mapFakeIPAddr(packet.address())
+		if nil != err {
+			log.Printf("[WARN]Drop udpgw packet for reason:%v", err)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(addr)
+
 		usession := getUDPSession(packet.conid, queue, true)
+		usession.session.user = user
+		usession.session.src = src
 		usession.addr = packet.addr
 		updateUdpSession(usession)
 		usession.activeTime = time.Now()
 
-		ev := &event.UDPEvent{Content: packet.content, Addr: packet.address()}
+		ev := &event.UDPEvent{Content: packet.content, Addr: addr}
 		ev.SetId(usession.session.id)
 		var p Proxy
 		if packet.addr.port == 53 {
-			p = proxy.findProxyByRequest("dns", packet.addr.ip.String(), nil)
+			p = proxy.findProxyByRequest("dns", host, src, user, nil)
 			if p.Config().IsDirect() {
 				go func() {
 					res, err := dnsQueryRaw(packet.content)
@@ -293,7 +303,7 @@ func handleUDPGatewayConn(conn net.Conn, proxy ProxyConfig) {
 			}
 		} else {
 			//log.Printf("###Recv non dns udp to %s:%d", packet.addr.ip.String(), packet.addr.port)
-			p = proxy.findProxyByRequest("udp", packet.addr.ip.String(), nil)
+			p = proxy.findProxyByRequest("udp", host, src, user, nil)
 		}
 		if len(usession.targetAddr) > 0 {
 			if usession.targetAddr != ev.Addr {
@@ -1,7 +1,10 @@
 package proxy
 
 import (
+	crand "crypto/rand"
 	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -18,12 +21,19 @@ import (
 
 func NewAuthEvent(secureTransport bool) *event.AuthEvent {
 	auth := &event.AuthEvent{}
-	auth.User = GConf.Auth
+	auth.User = GetConf().Auth
 	//auth.Mac = getDeviceId()
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	auth.SetId(uint32(r.Int31()))
-	auth.Rand = []byte(helper.RandAsciiString(int(r.Int31n(128))))
-	if secureTransport && strings.EqualFold(GConf.Encrypt.Method, "auto") {
+	//random padding hide the size of auth frame, far below the 16 bit frame length
+	auth.Rand = []byte(helper.RandAsciiString(int(r.Int31n(256))))
+	auth.Timestamp = time.Now().Unix()
+	auth.Nonce = make([]byte, 16)
+	io.ReadFull(crand.Reader, auth.Nonce)
+	if len(GetConf().AuthKey) > 0 {
+		auth.SetMacKey(GetConf().AuthKey)
+	}
+	if secureTransport && strings.EqualFold(GetConf().Encrypt.Method, "auto") {
 		auth.EncryptMethod = uint8(event.NoneEncrypter)
 	} else {
 		auth.EncryptMethod = event.GetDefaultCryptoMethod()
@@ -82,6 +92,36 @@ func NewHTTPClient(conf *ProxyChannelConfig) (*http.Client, error) {
 	return hc, nil
 }
 
+//dialChannel connect addr through proxy channel, the pipe is served like a transparent proxy conn to addr
+func dialChannel(channel string, addr string) (net.Conn, error) {
+	if nil == getProxyByName(channel) {
+		return nil, fmt.Errorf("No proxy channel:%s found", channel)
+	}
+	local, remote := net.Pipe()
+	conf := ProxyConfig{PAC: []PACConfig{{Remote: RemoteNames{channel}}}}
+	go serveProxyConn(remote, conf, addr)
+	return local, nil
+}
+
+//newChannelHTTPClient create http client which connect servers through channel, the channel could be
+//a proxy channel name, a forward proxy url, or empty for direct connection.
+func newChannelHTTPClient(channel string) (*http.Client, error) {
+	if len(channel) == 0 || strings.Contains(channel, "://") {
+		return NewHTTPClient(&ProxyChannelConfig{Proxy: channel})
+	}
+	if nil == getProxyByName(channel) {
+		return nil, fmt.Errorf("No proxy channel:%s found", channel)
+	}
+	hc, err := NewHTTPClient(&ProxyChannelConfig{})
+	if nil != err {
+		return nil, err
+	}
+	hc.Transport.(*http.Transport).Dial = func(network, addr string) (net.Conn, error) {
+		return dialChannel(channel, addr)
+	}
+	return hc, nil
+}
+
 // func FillNOnce(auth *event.AuthEvent, nonceLen int) {
 // 	auth.NOnce = make([]byte, nonceLen)
 // 	io.ReadFull(rand.Reader, auth.NOnce)
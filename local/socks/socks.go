@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -57,7 +58,11 @@ const socksRequestTimeout = 5 * time.Second
 
 // SocksRequest describes a SOCKS request.
 type SocksRequest struct {
+	// The SOCKS command, CONNECT or UDP ASSOCIATE.
+	Command byte
 	// The endpoint requested by the client as a "host:port" string.
+	// For UDP ASSOCIATE, it's the address the client expects to send
+	// datagrams from, which may be all zeros.
 	Target string
 	// The userid string sent by the client.
 	Username string
@@ -67,6 +72,10 @@ type SocksRequest struct {
 	Args Args
 }
 
+// Authenticator verifies the credentials of a SOCKS client, for SOCKS4 the
+// userid is split at the first ':' into username & password.
+type Authenticator func(username, password string) bool
+
 // SocksConn encapsulates a net.Conn and information associated with a SOCKS request.
 type SocksConn struct {
 	net.Conn
@@ -96,6 +105,18 @@ func (conn *SocksConn) Grant(addr *net.TCPAddr) error {
 	return sendSocks5ResponseGranted(conn)
 }
 
+// IsUDPAssociate return true if the client requests a SOCKS5 UDP ASSOCIATE.
+func (conn *SocksConn) IsUDPAssociate() bool {
+	return conn.socksVersion == socks5Version && conn.Req.Command == socksCmdUDP
+}
+
+// Send a message to the proxy client that the UDP association is granted,
+// addr is the address of the UDP relay which the client should send
+// datagrams to.
+func (conn *SocksConn) GrantUDP(addr *net.UDPAddr) error {
+	return sendSocks5ResponseAddr(conn, socksRepSucceeded, addr.IP, addr.Port)
+}
+
 // Send a message to the proxy client that access was rejected or failed.  This
 // sends back a "General Failure" error code.  RejectReason should be used if
 // more specific error reporting is desired.
@@ -198,6 +219,12 @@ func (ln *SocksListener) Accept() (net.Conn, error) {
 // 	}
 
 func NewSocksConn(c net.Conn) (*SocksConn, *bufio.Reader, error) {
+	return NewSocksConnWithAuth(c, nil)
+}
+
+// NewSocksConnWithAuth is the same as NewSocksConn, except that the client
+// must be verified by auth if it's not nil.
+func NewSocksConnWithAuth(c net.Conn, auth Authenticator) (*SocksConn, *bufio.Reader, error) {
 	conn := new(SocksConn)
 	conn.Conn = c
 	bio := bufio.NewReader(c)
@@ -208,7 +235,19 @@ func NewSocksConn(c net.Conn) (*SocksConn, *bufio.Reader, error) {
 		return nil, bio, err
 	} else if version == socks4Version {
 		conn.socksVersion = socks4Version
-		conn.Req, err = readSocks4aConnect(bio)
+		conn.Req, err = readSocks4aConnect(bio, auth == nil)
+		if err == nil && auth != nil {
+			user, passwd := conn.Req.Username, ""
+			if idx := strings.IndexByte(user, ':'); idx >= 0 {
+				user, passwd = user[0:idx], user[idx+1:]
+			}
+			if !auth(user, passwd) {
+				sendSocks4aResponseRejected(conn)
+				err = newTemporaryNetError("readSocks4aConnect: Failed to verify userid:%s", user)
+			} else {
+				conn.Req.Username, conn.Req.Password = user, passwd
+			}
+		}
 		if err != nil {
 			conn.Close()
 			return nil, nil, err
@@ -216,7 +255,7 @@ func NewSocksConn(c net.Conn) (*SocksConn, *bufio.Reader, error) {
 	} else if version == socks5Version {
 		conn.socksVersion = socks5Version
 		rw := bufio.NewReadWriter(bio, bufio.NewWriter(conn))
-		conn.Req, err = socks5Handshake(rw)
+		conn.Req, err = socks5Handshake(rw, auth)
 		if err != nil {
 			conn.Close()
 			return nil, nil, err
@@ -254,14 +293,14 @@ func (ln *SocksListener) AcceptSocks() (*SocksConn, error) {
 		return nil, err
 	} else if version == socks4Version {
 		conn.socksVersion = socks4Version
-		conn.Req, err = readSocks4aConnect(rw.Reader)
+		conn.Req, err = readSocks4aConnect(rw.Reader, true)
 		if err != nil {
 			conn.Close()
 			return nil, err
 		}
 	} else if version == socks5Version {
 		conn.socksVersion = socks5Version
-		conn.Req, err = socks5Handshake(rw)
+		conn.Req, err = socks5Handshake(rw, nil)
 		if err != nil {
 			conn.Close()
 			return nil, err
@@ -289,16 +328,17 @@ func (ln *SocksListener) Version() string {
 
 // socks5handshake conducts the SOCKS5 handshake up to the point where the
 // client command is read and the proxy must open the outgoing connection.
-// Returns a SocksRequest.
-func socks5Handshake(rw *bufio.ReadWriter) (req SocksRequest, err error) {
+// Returns a SocksRequest. Username/password authentication is required if
+// auth is not nil.
+func socks5Handshake(rw *bufio.ReadWriter, auth Authenticator) (req SocksRequest, err error) {
 	// Negotiate the authentication method.
 	var method byte
-	if method, err = socks5NegotiateAuth(rw); err != nil {
+	if method, err = socks5NegotiateAuth(rw, auth != nil); err != nil {
 		return
 	}
 
 	// Authenticate the client.
-	if err = socks5Authenticate(rw, method, &req); err != nil {
+	if err = socks5Authenticate(rw, method, &req, auth); err != nil {
 		return
 	}
 
@@ -309,7 +349,8 @@ func socks5Handshake(rw *bufio.ReadWriter) (req SocksRequest, err error) {
 
 // socks5NegotiateAuth negotiates the authentication method and returns the
 // selected method as a byte.  On negotiation failures an error is returned.
-func socks5NegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
+// Only username/password method is acceptable if authRequired.
+func socks5NegotiateAuth(rw *bufio.ReadWriter, authRequired bool) (method byte, err error) {
 	// Validate the version.
 	if err = socksReadByteVerify(rw.Reader, "version", socks5Version); err != nil {
 		err = newTemporaryNetError("socks5NegotiateAuth: %s", err.Error())
@@ -337,7 +378,7 @@ func socks5NegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
 		case socksAuthNoneRequired:
 			// Pick Username/Password over None if the client happens to
 			// send both.
-			if method == socksAuthNoAcceptableMethods {
+			if method == socksAuthNoAcceptableMethods && !authRequired {
 				method = m
 			}
 
@@ -364,13 +405,13 @@ func socks5NegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
 
 // socks5Authenticate authenticates the client via the chosen authentication
 // mechanism.
-func socks5Authenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest) (err error) {
+func socks5Authenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest, auth Authenticator) (err error) {
 	switch method {
 	case socksAuthNoneRequired:
 		// Straight into reading the connect.
 
 	case socksAuthUsernamePassword:
-		if err = socks5AuthRFC1929(rw, req); err != nil {
+		if err = socks5AuthRFC1929(rw, req, auth); err != nil {
 			return
 		}
 
@@ -391,10 +432,10 @@ func socks5Authenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest) (e
 }
 
 // socks5AuthRFC1929 authenticates the client via RFC 1929 username/password
-// auth.  As a design decision any valid username/password is accepted as this
+// auth.  Any valid username/password is accepted if auth is nil, as this
 // field is primarily used as an out-of-band argument passing mechanism for
 // pluggable transports.
-func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
+func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest, auth Authenticator) (err error) {
 	sendErrResp := func() {
 		// Swallow the write/flush error here, we are going to close the
 		// connection and the original failure is more useful.
@@ -449,9 +490,17 @@ func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		req.Password = string(passwd)
 	}
 
-	// Mash the username/password together and parse it as a pluggable
-	// transport argument string.
-	if req.Args, err = parseClientParameters(req.Username + req.Password); err != nil {
+	if auth != nil {
+		if !auth(req.Username, req.Password) {
+			sendErrResp()
+			err = newTemporaryNetError("socks5AuthRFC1929: failed to verify username:%s", req.Username)
+			return
+		}
+		// Credentials are not pluggable transport arguments.
+		req.Args = make(Args)
+	} else if req.Args, err = parseClientParameters(req.Username + req.Password); err != nil {
+		// Mash the username/password together and parse it as a pluggable
+		// transport argument string.
 		sendErrResp()
 		err = newTemporaryNetError("socks5AuthRFC1929: failed to parse client parameters: %s", err)
 		return
@@ -467,7 +516,7 @@ func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 }
 
 // socks5ReadCommand reads a SOCKS5 client command and parses out the relevant
-// fields into a SocksRequest.  Only CMD_CONNECT is supported.
+// fields into a SocksRequest.  CMD_CONNECT & CMD_UDP_ASSOCIATE are supported.
 func socks5ReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 	sendErrResp := func(reason byte) {
 		// Swallow errors that occur when writing/flushing the response,
@@ -482,9 +531,13 @@ func socks5ReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		err = newTemporaryNetError("socks5ReadCommand: %s", err)
 		return
 	}
-	if err = socksReadByteVerify(rw.Reader, "command", socksCmdConnect); err != nil {
+	if req.Command, err = socksReadByte(rw.Reader); err != nil {
+		err = newTemporaryNetError("socks5ReadCommand: Failed to read command: %s", err)
+		return
+	}
+	if req.Command != socksCmdConnect && req.Command != socksCmdUDP {
 		sendErrResp(SocksRepCommandNotSupported)
-		err = newTemporaryNetError("socks5ReadCommand: %s", err)
+		err = newTemporaryNetError("socks5ReadCommand: SOCKS command 0x%02x is not supported", req.Command)
 		return
 	}
 	if err = socksReadByteVerify(rw.Reader, "reserved", socksReserved); err != nil {
@@ -559,6 +612,27 @@ func socks5ReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 	return
 }
 
+// Send a SOCKS5 response with the given code and BND.ADDR/BND.PORT.
+func sendSocks5ResponseAddr(w io.Writer, code byte, ip net.IP, port int) error {
+	resp := make([]byte, 0, 4+net.IPv6len+2)
+	resp = append(resp, socks5Version, code, socksReserved)
+	if ip4 := ip.To4(); ip4 != nil {
+		resp = append(resp, socksAtypeV4)
+		resp = append(resp, ip4...)
+	} else if ip6 := ip.To16(); ip6 != nil {
+		resp = append(resp, socksAtypeV6)
+		resp = append(resp, ip6...)
+	} else {
+		resp = append(resp, socksAtypeV4, 0, 0, 0, 0)
+	}
+	resp = append(resp, byte(port>>8), byte(port))
+	if _, err := w.Write(resp); err != nil {
+		err = newTemporaryNetError("sendSocks5ResponseAddr: Failed write response: %s", err)
+		return err
+	}
+	return nil
+}
+
 // Send a SOCKS5 response with the given code. BND.ADDR/BND.PORT is always the
 // IPv4 address/port "0.0.0.0:0".
 func sendSocks5Response(w io.Writer, code byte) error {
@@ -679,8 +753,9 @@ func (tne temporaryNetError) Temporary() bool {
  * SOCKS4a-specific code
  */
 
-// Read a SOCKS4a connect request. Returns a SocksRequest.
-func readSocks4aConnect(r *bufio.Reader) (req SocksRequest, err error) {
+// Read a SOCKS4a connect request. Returns a SocksRequest. The userid is parsed
+// as pluggable transport arguments if parseArgs.
+func readSocks4aConnect(r *bufio.Reader, parseArgs bool) (req SocksRequest, err error) {
 	// Validate the version.
 	if err = socksReadByteVerify(r, "version", socks4Version); err != nil {
 		err = newTemporaryNetError("readSocks4aConnect: %s", err.Error())
@@ -720,10 +795,15 @@ func readSocks4aConnect(r *bufio.Reader) (req SocksRequest, err error) {
 	}
 	req.Username = string(usernameBytes[:len(usernameBytes)-1])
 
-	req.Args, err = parseClientParameters(req.Username)
-	if err != nil {
-		err = newTemporaryNetError("readSocks4aConnect: Failed to parse client parameters: %s", err.Error())
-		return
+	if parseArgs {
+		req.Args, err = parseClientParameters(req.Username)
+		if err != nil {
+			err = newTemporaryNetError("readSocks4aConnect: Failed to parse client parameters: %s", err.Error())
+			return
+		}
+	} else {
+		// userid carries credentials instead of pluggable transport arguments.
+		req.Args = make(Args)
 	}
 
 	var host string
@@ -0,0 +1,95 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+var (
+	// ErrUDPFragment is returned for fragmented datagrams, which are not supported.
+	ErrUDPFragment = errors.New("SOCKS5 UDP fragmentation is not supported")
+	// ErrUDPHeader is returned for datagrams with truncated or invalid header.
+	ErrUDPHeader = errors.New("Invalid SOCKS5 UDP request header")
+)
+
+// ParseUDPDatagram parses the RFC 1928 UDP request header, returns the
+// destination as a "host:port" string and the user data.
+//
+// 	+----+------+------+----------+----------+----------+
+// 	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// 	+----+------+------+----------+----------+----------+
+// 	| 2  |  1   |  1   | Variable |    2     | Variable |
+// 	+----+------+------+----------+----------+----------+
+func ParseUDPDatagram(b []byte) (target string, data []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, ErrUDPHeader
+	}
+	if b[2] != 0 {
+		return "", nil, ErrUDPFragment
+	}
+	var host string
+	pos := 4
+	switch b[3] {
+	case socksAtypeV4:
+		if len(b) < pos+net.IPv4len+2 {
+			return "", nil, ErrUDPHeader
+		}
+		host = net.IP(b[pos : pos+net.IPv4len]).String()
+		pos += net.IPv4len
+	case socksAtypeV6:
+		if len(b) < pos+net.IPv6len+2 {
+			return "", nil, ErrUDPHeader
+		}
+		host = net.IP(b[pos : pos+net.IPv6len]).String()
+		pos += net.IPv6len
+	case socksAtypeDomainName:
+		if len(b) < pos+1 {
+			return "", nil, ErrUDPHeader
+		}
+		alen := int(b[pos])
+		pos++
+		if alen == 0 || len(b) < pos+alen+2 {
+			return "", nil, ErrUDPHeader
+		}
+		host = string(b[pos : pos+alen])
+		pos += alen
+	default:
+		return "", nil, fmt.Errorf("SOCKS5 UDP request had unsupported address type 0x%02x", b[3])
+	}
+	port := int(b[pos])<<8 | int(b[pos+1])
+	pos += 2
+	return net.JoinHostPort(host, strconv.Itoa(port)), b[pos:], nil
+}
+
+// BuildUDPDatagram prepends the RFC 1928 UDP request header of the source
+// address addr to data, addr is a "host:port" string.
+func BuildUDPDatagram(addr string, data []byte) ([]byte, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port in address:%s", addr)
+	}
+	b := make([]byte, 0, 4+1+len(host)+2+len(data))
+	b = append(b, 0, 0, 0)
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Too long domain name:%s", host)
+		}
+		b = append(b, socksAtypeDomainName, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypeV4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypeV6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	b = append(b, data...)
+	return b, nil
+}
@@ -0,0 +1,25 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUDPDatagram(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:53", "[2001:db8::1]:443", "www.google.com:80"} {
+		b, err := BuildUDPDatagram(addr, []byte("hello"))
+		if nil != err {
+			t.Fatalf("Failed to build datagram for %s:%v", addr, err)
+		}
+		target, data, err := ParseUDPDatagram(b)
+		if nil != err || target != addr || !bytes.Equal(data, []byte("hello")) {
+			t.Fatalf("Invalid datagram parsed:%s %s %v", target, data, err)
+		}
+	}
+	if _, _, err := ParseUDPDatagram([]byte{0, 0, 1, 1, 1, 2, 3, 4, 0, 53}); err != ErrUDPFragment {
+		t.Fatalf("Fragmented datagram should be rejected")
+	}
+	if _, _, err := ParseUDPDatagram([]byte{0, 0, 0, 1, 1, 2}); err != ErrUDPHeader {
+		t.Fatalf("Truncated datagram should be rejected")
+	}
+}
@@ -0,0 +1,45 @@
+package tun
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/yinqiwen/gsnova/local/proxy"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	gtun "gvisor.dev/gvisor/pkg/tcpip/link/tun"
+)
+
+type device struct {
+	fd    int
+	stack *Stack
+}
+
+func (d *device) Close() error {
+	d.stack.Close()
+	return syscall.Close(d.fd)
+}
+
+//Open create TUN device 'name' & serve it by userspace stack, the device need to be
+//configured with address & routes by 'ip' command after opened.
+func Open(name string, mtu int, handler proxy.TUNHandler) (io.Closer, error) {
+	fd, err := gtun.Open(name)
+	if nil != err {
+		return nil, fmt.Errorf("Failed to open TUN device:%s for reason:%v, CAP_NET_ADMIN required", name, err)
+	}
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(mtu)})
+	if nil != err {
+		syscall.Close(fd)
+		return nil, err
+	}
+	st, err := NewStack(ep, handler)
+	if nil != err {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &device{fd: fd, stack: st}, nil
+}
+
+func init() {
+	proxy.RegisterTUNDeviceOpener(Open)
+}
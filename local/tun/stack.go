@@ -0,0 +1,104 @@
+// +build linux
+
+package tun
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/yinqiwen/gsnova/local/proxy"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	nicID = 1
+	//0 means default receive window
+	tcpReceiveWindow = 0
+	tcpMaxInFlight   = 1024
+)
+
+//Stack is a userspace TCP/IP stack on a link endpoint, it accept TCP & UDP flows
+//to any destination and serve them by handler.
+type Stack struct {
+	stack   *stack.Stack
+	handler proxy.TUNHandler
+}
+
+func endpointAddr(addr tcpip.Address, port uint16) string {
+	return net.JoinHostPort(net.IP(addr.AsSlice()).String(), strconv.Itoa(int(port)))
+}
+
+//NewStack create stack on link endpoint, which is a TUN device or in memory channel endpoint
+func NewStack(ep stack.LinkEndpoint, handler proxy.TUNHandler) (*Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+	if err := s.CreateNIC(nicID, ep); nil != err {
+		s.Close()
+		return nil, fmt.Errorf("Failed to create NIC:%v", err)
+	}
+	//accept packets to any address & reply with the original destination as source
+	if err := s.SetPromiscuousMode(nicID, true); nil != err {
+		s.Close()
+		return nil, fmt.Errorf("Failed to set promiscuous mode:%v", err)
+	}
+	if err := s.SetSpoofing(nicID, true); nil != err {
+		s.Close()
+		return nil, fmt.Errorf("Failed to set spoofing:%v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+	st := &Stack{stack: s, handler: handler}
+	tcpForwarder := tcp.NewForwarder(s, tcpReceiveWindow, tcpMaxInFlight, st.forwardTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, st.forwardUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	return st, nil
+}
+
+func (st *Stack) forwardTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	dst := endpointAddr(id.LocalAddress, id.LocalPort)
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if nil != err {
+		log.Printf("[ERROR]Failed to accept tcp flow from %s to %s:%v", endpointAddr(id.RemoteAddress, id.RemotePort), dst, err)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	go st.handler.HandleTCP(gonet.NewTCPConn(&wq, ep), dst)
+}
+
+func (st *Stack) forwardUDP(r *udp.ForwarderRequest) bool {
+	id := r.ID()
+	dst := endpointAddr(id.LocalAddress, id.LocalPort)
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if nil != err {
+		log.Printf("[ERROR]Failed to accept udp flow from %s to %s:%v", endpointAddr(id.RemoteAddress, id.RemotePort), dst, err)
+		return false
+	}
+	go st.handler.HandleUDP(gonet.NewUDPConn(&wq, ep), dst)
+	return true
+}
+
+//Close close all flows & the link endpoint
+func (st *Stack) Close() {
+	st.stack.Close()
+	st.stack.Wait()
+}
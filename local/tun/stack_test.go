@@ -0,0 +1,136 @@
+// +build linux
+
+package tun
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+type echoHandler struct {
+	dsts chan string
+}
+
+func (h *echoHandler) HandleTCP(conn net.Conn, dst string) {
+	h.dsts <- dst
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+func (h *echoHandler) HandleUDP(conn net.Conn, dst string) {
+	h.dsts <- dst
+	b := make([]byte, 1500)
+	n, err := conn.Read(b)
+	if nil == err {
+		conn.Write(b[0:n])
+	}
+	conn.Close()
+}
+
+//pump forward packets written to 'from' into 'to'
+func pump(ctx context.Context, from, to *channel.Endpoint) {
+	for {
+		pkt := from.ReadContext(ctx)
+		if nil == pkt {
+			return
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+		data := view.AsSlice()
+		proto := header.IPv4ProtocolNumber
+		if data[0]>>4 == 6 {
+			proto = header.IPv6ProtocolNumber
+		}
+		to.InjectInbound(proto, stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(data)}))
+	}
+}
+
+//newClientStack create a normal stack with address 10.0.0.2 whose default route is 'ep'
+func newClientStack(t *testing.T, ep *channel.Endpoint) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := s.CreateNIC(nicID, ep); nil != err {
+		t.Fatalf("%v", err)
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFromSlice(net.ParseIP("10.0.0.2").To4()).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); nil != err {
+		t.Fatalf("%v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+	return s
+}
+
+func TestStackInMemory(t *testing.T) {
+	clientEP := channel.New(256, 1500, "")
+	tunEP := channel.New(256, 1500, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pump(ctx, clientEP, tunEP)
+	go pump(ctx, tunEP, clientEP)
+
+	handler := &echoHandler{dsts: make(chan string, 2)}
+	st, err := NewStack(tunEP, handler)
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	defer st.Close()
+	client := newClientStack(t, clientEP)
+	defer client.Close()
+
+	dst := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(net.ParseIP("1.2.3.4").To4()), Port: 80}
+	tcpConn, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber)
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = tcpConn.Write([]byte("hello")); nil != err {
+		t.Fatalf("%v", err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(tcpConn, b); nil != err || string(b) != "hello" {
+		t.Fatalf("Expected echo 'hello', got '%s' %v", b, err)
+	}
+	if d := <-handler.dsts; d != "1.2.3.4:80" {
+		t.Fatalf("Expected tcp dst 1.2.3.4:80, got %s", d)
+	}
+
+	dst.Addr = tcpip.AddrFromSlice(net.ParseIP("8.8.8.8").To4())
+	dst.Port = 53
+	udpConn, err := gonet.DialUDP(client, nil, &dst, ipv4.ProtocolNumber)
+	if nil != err {
+		t.Fatalf("%v", err)
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = udpConn.Write([]byte("query")); nil != err {
+		t.Fatalf("%v", err)
+	}
+	b = make([]byte, 1500)
+	n, err := udpConn.Read(b)
+	if nil != err || string(b[0:n]) != "query" {
+		t.Fatalf("Expected echo 'query', got '%s' %v", b[0:n], err)
+	}
+	if d := <-handler.dsts; d != "8.8.8.8:53" {
+		t.Fatalf("Expected udp dst 8.8.8.8:53, got %s", d)
+	}
+}
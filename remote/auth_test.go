@@ -0,0 +1,87 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+//testAuthKeyExchange run the auth & key exchange like a client with given auth key, then exchange chunks both ways
+func testAuthKeyExchange(t *testing.T, user string, authKey string) {
+	client := event.NewCryptoContext()
+	client.EncryptIV, client.DecryptIV = 101, 101
+	ctx := NewConnContext()
+	ctx.CryptoContext = event.NewCryptoContext()
+	ctx.Server = true
+	ctx.Method = 0
+	kx, _ := event.NewKeyExchange()
+	auth := &event.AuthEvent{User: user, IV: client.EncryptIV, EncryptMethod: client.Method, PubKey: kx.PublicKey}
+	auth.Timestamp = time.Now().Unix()
+	auth.Nonce = make([]byte, 16)
+	io.ReadFull(rand.Reader, auth.Nonce)
+	if len(authKey) > 0 {
+		auth.SetMacKey(authKey)
+	}
+
+	var buf bytes.Buffer
+	event.EncryptEvent(&buf, auth, &client)
+	err, ev := event.DecryptEvent(&buf, &ctx.CryptoContext)
+	if nil != err {
+		t.Fatalf("Failed to decrypt auth:%v", err)
+	}
+	res, _ := handleEvent(ev, ctx)
+	event.EncryptEvent(&buf, res, &ctx.CryptoContext)
+	err, ev = event.DecryptEvent(&buf, &client)
+	if nil != err {
+		t.Fatalf("Failed to decrypt auth result:%v", err)
+	}
+	notify := ev.(*event.NotifyEvent)
+	if notify.Code != event.SuccessAuthed || len(notify.PubKey) == 0 {
+		t.Fatalf("User:%s auth failed:%d %s", user, notify.Code, notify.Reason)
+	}
+	if err = kx.ClientApply(&client, notify.PubKey, notify.KeyExchangePSK([]byte(authKey))); nil != err {
+		t.Fatal(err)
+	}
+	event.EncryptEvent(&buf, &event.TCPChunkEvent{Content: []byte("hello")}, &client)
+	if err, ev = event.DecryptEvent(&buf, &ctx.CryptoContext); nil != err || string(ev.(*event.TCPChunkEvent).Content) != "hello" {
+		t.Fatalf("User:%s failed to decrypt client event:%v", user, err)
+	}
+	event.EncryptEvent(&buf, &event.TCPChunkEvent{Content: []byte("world")}, &ctx.CryptoContext)
+	if err, ev = event.DecryptEvent(&buf, &client); nil != err || string(ev.(*event.TCPChunkEvent).Content) != "world" {
+		t.Fatalf("User:%s failed to decrypt server event:%v", user, err)
+	}
+}
+
+func TestAuthKeyExchange(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(dir)
+	oldConf := ServerConf
+	defer func() {
+		ServerConf = oldConf
+		currentUserDB.Store((*userDB)(nil))
+	}()
+	event.SetDefaultSecretKey("chacha20poly1305", "AAAAAAasdadasfafasasdasfasasgagaga")
+	ServerConf.Auth = []string{"*"}
+	ServerConf.LegacyUsers = []string{"old"}
+
+	//mac is not verified without user db
+	testAuthKeyExchange(t, "alice", "a")
+	testAuthKeyExchange(t, "alice", "")
+
+	file := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(file, []byte(`{"alice":{"Secret":"a"}}`), 0666)
+	if err := loadUserDB(file); nil != err {
+		t.Fatal(err)
+	}
+	testAuthKeyExchange(t, "alice", "a")
+	//legacy user is not in user db
+	testAuthKeyExchange(t, "old", "x")
+	testAuthKeyExchange(t, "old", "")
+}
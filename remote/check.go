@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/yinqiwen/gsnova/common/event"
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/obfs"
+)
+
+var encryptMethods = []string{"", "none", "auto", "aes", "chacha20poly1305"}
+
+//CheckConfig validate server config file & the user db it refers, each error locate the invalid item by file, line & json path
+func CheckConfig(file string) []error {
+	f, err := helper.LoadJSONFile(file, "//")
+	if nil != err {
+		return []error{err}
+	}
+	var conf ServerConfig
+	if err = f.Unmarshal(&conf); nil != err {
+		return []error{err}
+	}
+	c := &helper.ConfigChecker{File: f}
+	c.CheckAddr("Listen", conf.Listen, false)
+	c.CheckAddr("AdminListen", conf.AdminListen, true)
+	if event.IsLegacyEncryptMethod(conf.Encrypt.Method) {
+		c.Errorf("Encrypt.Method", "unauthenticated encrypt method:%s is removed, list users of old clients in LegacyUsers instead", conf.Encrypt.Method)
+	} else {
+		c.CheckOneOf("Encrypt.Method", conf.Encrypt.Method, encryptMethods...)
+	}
+	if _, err := obfs.New(&conf.Obfs); nil != err {
+		c.Errorf("Obfs.Method", "%v", err)
+	}
+	for i, port := range conf.CandidateDynamicPort {
+		if port <= 0 || port > 65535 {
+			c.Errorf(fmt.Sprintf("CandidateDynamicPort[%d]", i), "invalid port:%d", port)
+		}
+	}
+	names := []string{"MaxDynamicPort", "DynamicPortLifeCycle", "AuthClockSkew", "AuthNonceCacheSize", "Obfs.MaxPadding", "Obfs.Jitter"}
+	values := []int{conf.MaxDynamicPort, conf.DynamicPortLifeCycle, conf.AuthClockSkew, conf.AuthNonceCacheSize, conf.Obfs.MaxPadding, conf.Obfs.Jitter}
+	for k, v := range values {
+		if v < 0 {
+			c.Errorf(names[k], "negative value:%d", v)
+		}
+	}
+	for i, server := range conf.DNS {
+		//port is optional for dns server
+		if _, _, err := net.SplitHostPort(server); nil != err && len(server) > 0 {
+			server = net.JoinHostPort(server, "53")
+		}
+		c.CheckAddr(fmt.Sprintf("DNS[%d]", i), server, false)
+	}
+	if len(conf.TLS.Cert) > 0 || len(conf.TLS.Key) > 0 {
+		if _, err := tls.LoadX509KeyPair(conf.TLS.Cert, conf.TLS.Key); nil != err {
+			c.Errorf("TLS", "invalid cert/key:%v", err)
+		}
+	}
+	if len(conf.UserDB) == 0 {
+		return c.Errors
+	}
+	db, err := helper.LoadJSONFile(conf.UserDB, "//")
+	if nil != err {
+		c.Errorf("UserDB", "%v", err)
+		return c.Errors
+	}
+	users := make(map[string]*UserConfig)
+	if err = db.Unmarshal(&users); nil != err {
+		return append(c.Errors, err)
+	}
+	uc := &helper.ConfigChecker{File: db}
+	for user, u := range users {
+		if nil == u || len(u.Secret) == 0 {
+			uc.Errorf(user, "empty secret")
+		}
+	}
+	return append(c.Errors, uc.Errors...)
+}
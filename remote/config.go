@@ -3,6 +3,7 @@ package remote
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -11,6 +12,7 @@ import (
 	"github.com/yinqiwen/gsnova/common/event"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/obfs"
 )
 
 type EncryptConfig struct {
@@ -30,9 +32,16 @@ type ServerConfig struct {
 	DynamicPortLifeCycle int
 	CandidateDynamicPort []int
 	Auth                 []string
+	UserDB               string
+	AuthClockSkew        int
+	AuthNonceCacheSize   int
+	LegacyUsers          []string
+	Obfs                 obfs.Config
 	Encrypt              EncryptConfig
 	Log                  []string
 	TLS                  TLServerConfig
+	//dns servers to resolve queries from clients' 'LocalDNS.TrustedChannel', nameservers in /etc/resolv.conf if empty
+	DNS []string
 }
 
 func (conf *ServerConfig) VerifyUser(user string) bool {
@@ -51,7 +60,17 @@ func (conf *ServerConfig) VerifyUser(user string) bool {
 
 var ServerConf ServerConfig
 
+//NewObfuscator return nil if obfuscation disabled
+func NewObfuscator() obfs.Obfuscator {
+	o, _ := obfs.New(&ServerConf.Obfs)
+	return o
+}
+
 func init() {
+	//test binary has its own flags & no server config
+	if strings.HasSuffix(os.Args[0], ".test") {
+		return
+	}
 	key := flag.String("key", "", "Crypto key setting")
 	listen := flag.String("listen", "", "Server listen address")
 	logging := flag.String("log", "stdout", "Server log setting, , split by ','")
@@ -59,8 +78,21 @@ func init() {
 	dps := flag.String("dps", "", "Candidate dynamic ports")
 	ndp := flag.Uint("ndp", 0, "Max dynamic ports")
 	conf := flag.String("conf", "server.json", "Server config file")
+	check := flag.Bool("check", false, "Validate server config file & exit")
 	flag.Parse()
 
+	if *check {
+		errs := CheckConfig(*conf)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Config OK")
+		os.Exit(0)
+	}
+
 	if _, err := os.Stat(*conf); os.IsNotExist(err) {
 		if len(*key) == 0 || len(*listen) == 0 {
 			flag.PrintDefaults()
@@ -94,4 +126,16 @@ func init() {
 	log.Printf("Load server conf success.")
 	log.Printf("ServerConf:%v", &ServerConf)
 	event.SetDefaultSecretKey(ServerConf.Encrypt.Method, ServerConf.Encrypt.Key)
+	event.EnableLegacyAuth(len(ServerConf.LegacyUsers) > 0)
+	if _, err := obfs.New(&ServerConf.Obfs); nil != err {
+		log.Fatalf("Invalid obfuscation config:%v", err)
+		return
+	}
+	if len(ServerConf.UserDB) > 0 {
+		if err := loadUserDB(ServerConf.UserDB); nil != err {
+			log.Fatalf("Failed to load user db:%s for reason:%v", ServerConf.UserDB, err)
+			return
+		}
+		go watchUserDB(ServerConf.UserDB)
+	}
 }
@@ -0,0 +1,53 @@
+package remote
+
+import (
+	"bufio"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+//used if no dns server configured or found in /etc/resolv.conf
+const defaultDNSServer = "8.8.8.8:53"
+
+var systemDNSServers []string
+var systemDNSOnce sync.Once
+
+//loadSystemDNSServers return nameservers in resolv.conf
+func loadSystemDNSServers(file string) []string {
+	f, err := os.Open(file)
+	if nil != err {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && nil != net.ParseIP(fields[1]) {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+//remoteDNSServer return address of dns server for UDP events to event.RemoteDNSAddr
+func remoteDNSServer() string {
+	servers := ServerConf.DNS
+	if len(servers) == 0 {
+		systemDNSOnce.Do(func() {
+			systemDNSServers = loadSystemDNSServers("/etc/resolv.conf")
+		})
+		servers = systemDNSServers
+	}
+	if len(servers) == 0 {
+		return defaultDNSServer
+	}
+	server := servers[rand.Intn(len(servers))]
+	if _, _, err := net.SplitHostPort(server); nil != err {
+		server = net.JoinHostPort(server, "53")
+	}
+	return server
+}
@@ -74,7 +74,7 @@ func httpInvoke(w http.ResponseWriter, r *http.Request) {
 	buf := bytes.NewBuffer(b)
 	ctx := appengine.NewContext(r)
 
-	var cryptoContext event.CryptoContext
+	cryptoContext := event.CryptoContext{Server: true}
 	err, ev := event.DecryptEvent(buf, &cryptoContext)
 	if nil != err {
 		ctx.Errorf("Decode auth event failed:%v", err)
@@ -82,7 +82,8 @@ func httpInvoke(w http.ResponseWriter, r *http.Request) {
 	}
 	//var iv uint64
 	if auth, ok := ev.(*event.AuthEvent); ok {
-		if !remote.ServerConf.VerifyUser(auth.User) {
+		if err := remote.CheckAuth(auth, &cryptoContext); nil != err {
+			ctx.Errorf("%v", err)
 			return
 		}
 		cryptoContext.DecryptIV = auth.IV
@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yinqiwen/gsnova/common/event"
@@ -15,6 +16,16 @@ type ConnEventQueue struct {
 	id         ConnId
 	activeTime time.Time
 	acuired    bool
+	//client's initial receive window per session, 0 if flow control disabled
+	peerWindow uint32
+}
+
+func (q *ConnEventQueue) setPeerWindow(window uint32) {
+	atomic.StoreUint32(&q.peerWindow, window)
+}
+
+func (q *ConnEventQueue) getPeerWindow() uint32 {
+	return atomic.LoadUint32(&q.peerWindow)
 }
 
 //just for debug
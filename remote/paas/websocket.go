@@ -33,6 +33,7 @@ func websocketInvoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx := remote.NewConnContext()
+	obfuscator := remote.NewObfuscator()
 	writeEvents := func(evs []event.Event, wbuf *bytes.Buffer) error {
 		if len(evs) > 0 {
 			//var buf bytes.Buffer
@@ -43,7 +44,16 @@ func websocketInvoke(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			if wbuf.Len() > 0 {
-				return ws.WriteMessage(websocket.BinaryMessage, wbuf.Bytes())
+				b := wbuf.Bytes()
+				if nil != obfuscator {
+					var obuf bytes.Buffer
+					obfuscator.Encode(&obuf, b)
+					b = obuf.Bytes()
+					if d := obfuscator.Jitter(); d > 0 {
+						time.Sleep(d)
+					}
+				}
+				return ws.WriteMessage(websocket.BinaryMessage, b)
 			}
 			return nil
 		}
@@ -51,7 +61,7 @@ func websocketInvoke(w http.ResponseWriter, r *http.Request) {
 	}
 	//log.Printf("###Recv websocket connection")
 	buf := bytes.NewBuffer(nil)
-	var wbuf bytes.Buffer
+	var obuf, wbuf bytes.Buffer
 	wsClosed := false
 	var queue *remote.ConnEventQueue
 	for {
@@ -65,7 +75,15 @@ func websocketInvoke(w http.ResponseWriter, r *http.Request) {
 		}
 		switch mt {
 		case websocket.BinaryMessage:
-			if buf.Len() == 0 {
+			if nil != obfuscator {
+				obuf.Write(data)
+				if err = obfuscator.Decode(&obuf, buf); nil != err {
+					log.Printf("[ERROR]connection %s:%d obfuscation error:%v", ctx.User, ctx.ConnIndex, err)
+					ws.Close()
+					wsClosed = true
+					break
+				}
+			} else if buf.Len() == 0 {
 				buf = bytes.NewBuffer(data)
 			} else {
 				buf.Write(data)
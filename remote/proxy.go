@@ -31,10 +31,13 @@ type ConnContext struct {
 	//IV            uint64
 	EncryptMethod int
 	Closing       bool
+
+	userDBVersion int32
 }
 
 func NewConnContext() *ConnContext {
 	ctx := new(ConnContext)
+	ctx.Server = true
 	return ctx
 }
 
@@ -49,10 +52,14 @@ type ProxySession struct {
 	conn          net.Conn
 	addr          string
 	network       string
-	ch            chan event.Event
+	events        *event.EventBuffer
 	closeByClient bool
 
 	closed bool
+
+	windowMutex sync.Mutex
+	sendWindow  *event.FlowWindow
+	recvCounter *event.FlowCounter
 }
 
 func GetSessionTableSize() int {
@@ -92,7 +99,8 @@ func getProxySessionByEvent(ctx *ConnContext, ev event.Event) *ProxySession {
 	p := new(ProxySession)
 	p.Id = sid
 	p.CreateTime = time.Now()
-	p.ch = make(chan event.Event, 100)
+	//large enough to hold a whole flow window of chunks
+	p.events = event.NewEventBuffer(event.DefaultSessionWindow)
 	go p.processEvents()
 	proxySessionMap[sid] = p
 	atomic.AddInt32(&sessionSize, 1)
@@ -101,8 +109,12 @@ func getProxySessionByEvent(ctx *ConnContext, ev event.Event) *ProxySession {
 
 func destroyProxySession(s *ProxySession) {
 	delete(proxySessionMap, s.Id)
-	s.ch <- nil
-	close(s.ch)
+	s.windowMutex.Lock()
+	if nil != s.sendWindow {
+		s.sendWindow.Close()
+	}
+	s.windowMutex.Unlock()
+	s.events.Close()
 	s.closed = true
 	atomic.AddInt32(&sessionSize, -1)
 }
@@ -127,6 +139,22 @@ func removeUserSessions(user string, runid int64) {
 	}
 }
 
+//resetSessionWindows restore send windows of sessions after client reconnected,
+//since window updates may lost with previous connection.
+func resetSessionWindows(cid ConnId) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	for k, s := range proxySessionMap {
+		if k.ConnId == cid {
+			s.windowMutex.Lock()
+			if nil != s.sendWindow {
+				s.sendWindow.Reset()
+			}
+			s.windowMutex.Unlock()
+		}
+	}
+}
+
 //just for debug
 func (p *ProxySession) dump(wr io.Writer) {
 	fmt.Fprintf(wr, "[%d]network=%s,addr=%s,closed=%v\n", p.Id.Id, p.network, p.addr, p.conn == nil)
@@ -153,6 +181,52 @@ func (p *ProxySession) publish(ev event.Event) {
 	}
 }
 
+//acquireWindow blocks until client grant enough window for the chunk
+func (p *ProxySession) acquireWindow(n int) error {
+	queue := getEventQueue(p.Id.ConnId, false)
+	if nil == queue || queue.getPeerWindow() == 0 {
+		return nil
+	}
+	p.windowMutex.Lock()
+	if nil == p.sendWindow {
+		p.sendWindow = event.NewFlowWindow(int64(queue.getPeerWindow()))
+	}
+	w := p.sendWindow
+	p.windowMutex.Unlock()
+	for {
+		err := w.Acquire(n, 1*time.Second)
+		if err != event.ErrWindowTimeout {
+			return err
+		}
+		if p.closeByClient || nil == getEventQueue(p.Id.ConnId, false) {
+			return event.ErrWindowClosed
+		}
+	}
+}
+
+func (p *ProxySession) releaseWindow(delta uint32) {
+	p.windowMutex.Lock()
+	w := p.sendWindow
+	p.windowMutex.Unlock()
+	if nil != w {
+		w.Release(delta)
+	}
+}
+
+//ackChunk grant client more window once enough chunks written to target
+func (p *ProxySession) ackChunk(n int) {
+	queue := getEventQueue(p.Id.ConnId, false)
+	if nil == queue || queue.getPeerWindow() == 0 {
+		return
+	}
+	if nil == p.recvCounter {
+		p.recvCounter = event.NewFlowCounter(event.DefaultSessionWindow)
+	}
+	if delta, ok := p.recvCounter.Consume(n); ok {
+		p.publish(&event.WindowUpdateEvent{Delta: delta})
+	}
+}
+
 func (p *ProxySession) close() error {
 	c := p.conn
 	if nil != c {
@@ -179,17 +253,11 @@ func (p *ProxySession) initialClose() {
 
 func (p *ProxySession) processEvents() {
 	for {
-		select {
-		case ev := <-p.ch:
-			if nil != ev {
-				p.handle(ev)
-			} else {
-				return
-			}
-		case <-time.After(time.Second * 30):
-			if nil == p.conn {
-				return
-			}
+		ev, err := p.events.Read(30 * time.Second)
+		if nil == err {
+			p.handle(ev)
+		} else if err == io.EOF || nil == p.conn {
+			return
 		}
 	}
 }
@@ -203,6 +271,10 @@ func (p *ProxySession) open(network, to string) error {
 	//log.Printf("Session[%s:%d] open connection to %s.", p.Id.User, p.Id.Id, to)
 	c, err := net.DialTimeout(network, to, 5*time.Second)
 	if nil != err {
+		if network == "tcp" {
+			//client could retry other channels since nothing relayed
+			p.publish(&event.NotifyEvent{Code: event.ErrRemoteConnectFailed, Reason: err.Error()})
+		}
 		p.initialClose()
 		log.Printf("Failed to connect %s:%s for reason:%v", network, to, err)
 		return err
@@ -246,6 +318,9 @@ func (p *ProxySession) readNetwork() error {
 			copy(content, b[0:n])
 			var ev event.Event
 			if p.network == "tcp" {
+				if err = p.acquireWindow(n); nil != err {
+					break
+				}
 				ev = &event.TCPChunkEvent{Content: content}
 			} else {
 				ev = &event.UDPEvent{Content: content}
@@ -260,14 +335,32 @@ func (p *ProxySession) readNetwork() error {
 	p.initialClose()
 	return nil
 }
+
+//offer never block the connection reader since client honors the granted window,
+//datagrams are dropped if buffer full, chunks from old clients without flow control still wait.
 func (p *ProxySession) offer(ev event.Event) {
-	p.ch <- ev
+	timeout := 1 * time.Minute
+	if _, ok := ev.(*event.UDPEvent); ok {
+		timeout = 0
+	} else if queue := getEventQueue(p.Id.ConnId, false); nil != queue && queue.getPeerWindow() > 0 {
+		timeout = 0
+	}
+	err := p.events.Publish(ev, timeout)
+	if _, ok := ev.(*event.TCPChunkEvent); ok && nil != err {
+		//stream is broken once chunk lost
+		log.Printf("[WARN]Session[%s:%d] closed since chunk dropped for reason:%v", p.Id.User, p.Id.Id, err)
+		go p.initialClose()
+	}
 }
 
 func (p *ProxySession) handle(ev event.Event) error {
 	switch ev.(type) {
 	case *event.UDPEvent:
-		err := p.open("udp", ev.(*event.UDPEvent).Addr)
+		addr := ev.(*event.UDPEvent).Addr
+		if addr == event.RemoteDNSAddr {
+			addr = remoteDNSServer()
+		}
+		err := p.open("udp", addr)
 		if nil != err {
 			return err
 		}
@@ -279,7 +372,8 @@ func (p *ProxySession) handle(ev event.Event) error {
 		p.close()
 		removeProxySession(p)
 	case *event.TCPChunkEvent:
-		p.write(ev.(*event.TCPChunkEvent).Content)
+		n, _ := p.write(ev.(*event.TCPChunkEvent).Content)
+		p.ackChunk(n)
 	case *event.HTTPRequestEvent:
 		req := ev.(*event.HTTPRequestEvent)
 		addr := req.Headers.Get("Host")
@@ -304,26 +398,51 @@ func (p *ProxySession) handle(ev event.Event) error {
 	return nil
 }
 
-func authConnection(auth *event.AuthEvent, ctx *ConnContext) error {
+//authConnection return server's key exchange public key & auth result flags if client requested key exchange
+func authConnection(auth *event.AuthEvent, ctx *ConnContext) ([]byte, uint32, error) {
 	//log.Printf("###Recv auth IV = %d, ctx IV = %d", auth.IV, ctx.IV)
 	if len(ctx.User) == 0 {
-		if !ServerConf.VerifyUser(auth.User) {
-			return fmt.Errorf("Auth failed with user:%s", auth.User)
+		secret, err := checkAuth(auth, &ctx.CryptoContext)
+		if nil != err {
+			return nil, 0, err
+		}
+		var pubKey []byte
+		var flags uint32
+		if len(auth.PubKey) > 0 && auth.EncryptMethod != event.NoneEncrypter {
+			kx, err := event.NewKeyExchange()
+			if nil != err {
+				return nil, 0, err
+			}
+			//only the secret verified the auth mac is known by client, tell client which psk mixed in
+			if err = kx.ServerApply(&ctx.CryptoContext, auth.PubKey, secret); nil != err {
+				return nil, 0, err
+			}
+			pubKey = kx.PublicKey
+			if nil != secret {
+				flags |= event.AuthFlagUserSecretKX
+			}
 		}
 		authedUser := auth.User
 		//authedUser = authedUser + "@" + auth.Mac
 		ctx.User = authedUser
 		ctx.ConnIndex = int(auth.Index)
+		ctx.userDBVersion = atomic.LoadInt32(&userDBVersion)
 		//ctx.IV = auth.IV
 		ctx.RunId = auth.RunId
 		ctx.CryptoContext.DecryptIV = auth.IV
 		ctx.CryptoContext.EncryptIV = auth.IV
 		ctx.CryptoContext.Method = auth.EncryptMethod
-		GetEventQueue(ctx.ConnId, true)
+		queue := GetEventQueue(ctx.ConnId, true)
+		if auth.Window > 0 {
+			queue.setPeerWindow(auth.Window)
+			resetSessionWindows(ctx.ConnId)
+		} else {
+			queue.setPeerWindow(0)
+		}
 		//log.Printf("###Recv IV = %d", ctx.IV)
-		return nil
+		return pubKey, flags, nil
 	} else {
-		return fmt.Errorf("Duplicate auth/login event in same connection")
+		return nil, 0, fmt.Errorf("Duplicate auth/login event in same connection")
 	}
 }
 
@@ -331,17 +450,36 @@ func handleEvent(ev event.Event, ctx *ConnContext) (event.Event, error) {
 	switch ev.(type) {
 	case *event.AuthEvent:
 		auth := ev.(*event.AuthEvent)
-		err := authConnection(auth, ctx)
+		pubKey, flags, err := authConnection(auth, ctx)
 		var authres event.NotifyEvent
 		authres.SetId(ev.GetId())
 		if nil == err {
 			authres.Code = event.SuccessAuthed
+			authres.PubKey = pubKey
+			authres.Flags = flags | event.AuthFlagRemoteDNS
+			if auth.Window > 0 {
+				authres.Window = event.DefaultSessionWindow
+			}
 		} else {
 			authres.Code = event.ErrAuthFailed
+			if aerr, ok := err.(*authError); ok {
+				authres.Code = aerr.code
+				authres.Reason = aerr.reason
+			}
+			log.Printf("[ERROR]%v", err)
 		}
 		return &authres, nil
 	case *event.HeartBeatEvent:
-		//do nothing
+		//echo heartbeat for client to measure RTT
+		queue := getEventQueue(ctx.ConnId, false)
+		if nil != queue {
+			queue.Publish(ev, 10*time.Millisecond)
+		}
+	case *event.WindowUpdateEvent:
+		session := getProxySessionByEvent(ctx, ev)
+		if nil != session {
+			session.releaseWindow(ev.(*event.WindowUpdateEvent).Delta)
+		}
 	case *event.ChannelCloseReqEvent:
 		ctx.Closing = true
 		queue := getEventQueue(ctx.ConnId, false)
@@ -379,6 +517,9 @@ func handleEvent(ev event.Event, ctx *ConnContext) (event.Event, error) {
 
 func HandleRequestBuffer(reqbuf *bytes.Buffer, ctx *ConnContext) ([]event.Event, error) {
 	var ress []event.Event
+	if len(ctx.User) > 0 && isUserRevoked(ctx) {
+		return nil, fmt.Errorf("User:%s is revoked", ctx.User)
+	}
 	for reqbuf.Len() > 0 {
 		var ev event.Event
 		var err error
@@ -0,0 +1,87 @@
+package remote
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+const (
+	defaultAuthClockSkew      = 300
+	defaultAuthNonceCacheSize = 100000
+)
+
+//authError carry the NotifyEvent code replied to client
+type authError struct {
+	code   int64
+	reason string
+}
+
+func (e *authError) Error() string {
+	return e.reason
+}
+
+var authNonceCache *lru.Cache
+var authNonceCacheOnce sync.Once
+
+func getAuthNonceCache() *lru.Cache {
+	authNonceCacheOnce.Do(func() {
+		size := ServerConf.AuthNonceCacheSize
+		if size <= 0 {
+			size = defaultAuthNonceCacheSize
+		}
+		authNonceCache, _ = lru.New(size)
+	})
+	return authNonceCache
+}
+
+//CheckAuth verify user, encryption method & replay of the auth event decrypted by ctx
+func CheckAuth(auth *event.AuthEvent, ctx *event.CryptoContext) error {
+	_, err := checkAuth(auth, ctx)
+	return err
+}
+
+//checkAuth return the user's secret which verified the auth mac like verifyAuth
+func checkAuth(auth *event.AuthEvent, ctx *event.CryptoContext) ([]byte, error) {
+	secret, err := ServerConf.verifyAuth(auth)
+	if nil != err {
+		return nil, err
+	}
+	if err = ServerConf.verifyLegacyAuth(auth, ctx); nil != err {
+		return nil, err
+	}
+	if err = checkAuthReplay(auth); nil != err {
+		return nil, err
+	}
+	return secret, nil
+}
+
+//checkAuthReplay reject auth out of the clock skew window or with seen nonce,
+//the nonce cache should be large enough to hold all auth nonces within the window.
+func checkAuthReplay(auth *event.AuthEvent) error {
+	if 0 == auth.Timestamp && len(auth.Nonce) == 0 {
+		//legacy client could not carry timestamp & nonce
+		if ServerConf.isLegacyUser(auth.User) {
+			return nil
+		}
+		return &authError{event.ErrAuthReplayed, fmt.Sprintf("Auth without timestamp & nonce for user:%s", auth.User)}
+	}
+	skew := int64(ServerConf.AuthClockSkew)
+	if skew <= 0 {
+		skew = defaultAuthClockSkew
+	}
+	now := time.Now().Unix()
+	if auth.Timestamp < now-skew || auth.Timestamp > now+skew {
+		return &authError{event.ErrAuthExpired, fmt.Sprintf("Auth timestamp:%d out of clock skew window:%ds", auth.Timestamp, skew)}
+	}
+	if len(auth.Nonce) == 0 {
+		return &authError{event.ErrAuthReplayed, "Auth without nonce"}
+	}
+	if exist, _ := getAuthNonceCache().ContainsOrAdd(auth.User+"@"+string(auth.Nonce), auth.Timestamp); exist {
+		return &authError{event.ErrAuthReplayed, fmt.Sprintf("Replayed auth for user:%s", auth.User)}
+	}
+	return nil
+}
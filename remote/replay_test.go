@@ -0,0 +1,44 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+func TestCheckAuthReplay(t *testing.T) {
+	oldConf := ServerConf
+	defer func() { ServerConf = oldConf }()
+	ServerConf.LegacyUsers = []string{"old"}
+
+	if err := checkAuthReplay(&event.AuthEvent{User: "old"}); nil != err {
+		t.Fatalf("Legacy user should be accepted without timestamp & nonce:%v", err)
+	}
+	err := checkAuthReplay(&event.AuthEvent{User: "alice"})
+	if aerr, ok := err.(*authError); !ok || aerr.code != event.ErrAuthReplayed {
+		t.Fatalf("Expected replay error without timestamp & nonce, but got %v", err)
+	}
+	auth := &event.AuthEvent{User: "alice", Timestamp: time.Now().Unix(), Nonce: []byte("replay-test-nonce")}
+	if err = checkAuthReplay(auth); nil != err {
+		t.Fatalf("Failed to check auth:%v", err)
+	}
+	err = checkAuthReplay(auth)
+	if aerr, ok := err.(*authError); !ok || aerr.code != event.ErrAuthReplayed {
+		t.Fatalf("Expected replay error, but got %v", err)
+	}
+	err = checkAuthReplay(&event.AuthEvent{User: "alice", Timestamp: time.Now().Unix() - 3600, Nonce: []byte("x")})
+	if aerr, ok := err.(*authError); !ok || aerr.code != event.ErrAuthExpired {
+		t.Fatalf("Expected expired error, but got %v", err)
+	}
+
+	//all users are allowed to use legacy clients
+	ServerConf.LegacyUsers = []string{"*"}
+	legacy := &event.AuthEvent{User: "alice"}
+	if err = checkAuthReplay(legacy); nil != err {
+		t.Fatalf("Legacy user matched by '*' should be accepted without timestamp & nonce:%v", err)
+	}
+	if err = ServerConf.verifyLegacyAuth(legacy, &event.CryptoContext{Legacy: true}); nil != err {
+		t.Fatalf("Legacy user matched by '*' should be accepted:%v", err)
+	}
+}
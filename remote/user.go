@@ -0,0 +1,144 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/event"
+	"github.com/yinqiwen/gsnova/common/helper"
+)
+
+type UserConfig struct {
+	Secret   string
+	Disabled bool
+}
+
+type userDB struct {
+	users   map[string]*UserConfig
+	modTime time.Time
+}
+
+var currentUserDB atomic.Value
+var userDBVersion int32
+
+func getUserDB() *userDB {
+	db, _ := currentUserDB.Load().(*userDB)
+	return db
+}
+
+func loadUserDB(file string) error {
+	st, err := os.Stat(file)
+	if nil != err {
+		return err
+	}
+	data, err := helper.ReadWithoutComment(file, "//")
+	if nil != err {
+		return err
+	}
+	db := &userDB{modTime: st.ModTime()}
+	if err = json.Unmarshal(data, &db.users); nil != err {
+		return err
+	}
+	currentUserDB.Store(db)
+	atomic.AddInt32(&userDBVersion, 1)
+	log.Printf("Load %d users from %s.", len(db.users), file)
+	return nil
+}
+
+//watchUserDB reload user db on SIGHUP or file modified
+func watchUserDB(file string) {
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGHUP)
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		select {
+		case <-sc:
+		case <-ticker.C:
+			st, err := os.Stat(file)
+			if nil != err || st.ModTime().Equal(getUserDB().modTime) {
+				continue
+			}
+		}
+		if err := loadUserDB(file); nil != err {
+			log.Printf("[ERROR]Failed to reload user db:%s for reason:%v", file, err)
+		}
+	}
+}
+
+//VerifyAuth check the auth event by user db, or by 'Auth' user list if no user db configured.
+func (conf *ServerConfig) VerifyAuth(auth *event.AuthEvent) error {
+	_, err := conf.verifyAuth(auth)
+	return err
+}
+
+//verifyAuth return the user's secret which verified the auth mac, nil if the user is not checked by mac.
+func (conf *ServerConfig) verifyAuth(auth *event.AuthEvent) ([]byte, error) {
+	db := getUserDB()
+	if nil == db {
+		if !conf.VerifyUser(auth.User) {
+			return nil, fmt.Errorf("Auth failed with user:%s", auth.User)
+		}
+		return nil, nil
+	}
+	user, exist := db.users[auth.User]
+	if !exist {
+		//only legacy clients which could not sign auth are still checked by 'Auth'
+		if !conf.isLegacyUser(auth.User) || !conf.VerifyUser(auth.User) {
+			return nil, fmt.Errorf("Auth failed with unknown user:%s", auth.User)
+		}
+		return nil, nil
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("Auth failed with revoked user:%s", auth.User)
+	}
+	if !auth.VerifyMac(user.Secret) {
+		return nil, fmt.Errorf("Auth failed with invalid mac for user:%s", auth.User)
+	}
+	return []byte(user.Secret), nil
+}
+
+//isLegacyUser return true if user is listed in 'LegacyUsers' by name or '*'
+func (conf *ServerConfig) isLegacyUser(user string) bool {
+	for _, u := range conf.LegacyUsers {
+		if u == user || u == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//verifyLegacyAuth check if user could use unauthenticated framing & stream ciphers
+func (conf *ServerConfig) verifyLegacyAuth(auth *event.AuthEvent, ctx *event.CryptoContext) error {
+	if !ctx.Legacy {
+		switch auth.EncryptMethod {
+		case event.RC4Encrypter, event.Salsa20Encrypter, event.Chacha20Encrypter:
+			return fmt.Errorf("Auth failed with unauthenticated encrypt method:%d for user:%s", auth.EncryptMethod, auth.User)
+		}
+		return nil
+	}
+	if conf.isLegacyUser(auth.User) {
+		log.Printf("[WARN]User:%s connected with legacy unauthenticated encryption, please upgrade the client.", auth.User)
+		return nil
+	}
+	return fmt.Errorf("Auth failed since legacy client not allowed for user:%s", auth.User)
+}
+
+//isUserRevoked check if an authed user is disabled or removed after user db reloaded.
+func isUserRevoked(ctx *ConnContext) bool {
+	version := atomic.LoadInt32(&userDBVersion)
+	if ctx.userDBVersion == version {
+		return false
+	}
+	ctx.userDBVersion = version
+	db := getUserDB()
+	if user, exist := db.users[ctx.User]; exist {
+		return user.Disabled
+	}
+	return !ServerConf.isLegacyUser(ctx.User) || !ServerConf.VerifyUser(ctx.User)
+}
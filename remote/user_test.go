@@ -0,0 +1,73 @@
+package remote
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/event"
+)
+
+func signedAuth(user string, secret string) *event.AuthEvent {
+	auth := &event.AuthEvent{User: user, Nonce: []byte("0123456789abcdef")}
+	if len(secret) > 0 {
+		auth.SetMacKey(secret)
+	}
+	var buf bytes.Buffer
+	auth.Encode(&buf)
+	return auth
+}
+
+func TestVerifyAuth(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gsnova")
+	defer os.RemoveAll(dir)
+	oldConf := ServerConf
+	defer func() {
+		ServerConf = oldConf
+		currentUserDB.Store((*userDB)(nil))
+	}()
+	ServerConf.Auth = []string{"*", "gsnova"}
+	ServerConf.LegacyUsers = []string{"old"}
+	file := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(file, []byte(`{"alice":{"Secret":"a"}, "bob":{"Secret":"b", "Disabled":true}}`), 0666)
+	if err := loadUserDB(file); nil != err {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user   string
+		secret string
+		ok     bool
+	}{
+		{"alice", "a", true},
+		{"alice", "b", false},
+		{"alice", "", false},
+		{"bob", "b", false},
+		{"carol", "", false},
+		{"carol", "c", false},
+		{"old", "", true},
+	} {
+		if err := ServerConf.VerifyAuth(signedAuth(c.user, c.secret)); (nil == err) != c.ok {
+			t.Fatalf("Expected auth:%v for user:%s with secret:%q, but got %v", c.ok, c.user, c.secret, err)
+		}
+	}
+
+	//removed user is rejected & authed connections revoked
+	ctx := NewConnContext()
+	ctx.User = "alice"
+	ctx.userDBVersion = userDBVersion
+	ioutil.WriteFile(file, []byte(`{"bob":{"Secret":"b"}}`), 0666)
+	if err := loadUserDB(file); nil != err {
+		t.Fatal(err)
+	}
+	if nil == ServerConf.VerifyAuth(signedAuth("alice", "a")) {
+		t.Fatalf("Removed user should be rejected")
+	}
+	if !isUserRevoked(ctx) {
+		t.Fatalf("Connection of removed user should be revoked")
+	}
+	if nil != ServerConf.VerifyAuth(signedAuth("bob", "b")) {
+		t.Fatalf("Enabled user should be accepted")
+	}
+}
@@ -120,6 +120,7 @@ func serveProxyConn(conn net.Conn, vs *vpsServer) {
 	defer deferFunc()
 
 	ctx := remote.NewConnContext()
+	obfuscator := remote.NewObfuscator()
 	writeEvents := func(evs []event.Event, buf *bytes.Buffer) error {
 		if len(evs) > 0 {
 			buf.Reset()
@@ -129,8 +130,16 @@ func serveProxyConn(conn net.Conn, vs *vpsServer) {
 				}
 			}
 			if buf.Len() > 0 {
-				conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
 				b := buf.Bytes()
+				if nil != obfuscator {
+					var obuf bytes.Buffer
+					obfuscator.Encode(&obuf, b)
+					b = obuf.Bytes()
+					if d := obfuscator.Jitter(); d > 0 {
+						time.Sleep(d)
+					}
+				}
+				conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
 				_, err := conn.Write(b)
 
 				return err
@@ -139,7 +148,7 @@ func serveProxyConn(conn net.Conn, vs *vpsServer) {
 		return nil
 	}
 
-	var rbuf bytes.Buffer
+	var rbuf, obuf bytes.Buffer
 	var wbuf bytes.Buffer
 
 	writeTaskRunning := false
@@ -147,8 +156,17 @@ func serveProxyConn(conn net.Conn, vs *vpsServer) {
 	reader := &helper.BufferChunkReader{bufconn, nil}
 	for !connClosed {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		rbuf.Grow(8192)
-		rbuf.ReadFrom(reader)
+		if nil != obfuscator {
+			obuf.Grow(8192)
+			obuf.ReadFrom(reader)
+			if err := obfuscator.Decode(&obuf, &rbuf); nil != err {
+				log.Printf("[ERROR]connection %s:%d obfuscation error:%v", ctx.User, ctx.ConnIndex, err)
+				return
+			}
+		} else {
+			rbuf.Grow(8192)
+			rbuf.ReadFrom(reader)
+		}
 		if nil != reader.Err {
 			conn.Close()
 			connClosed = true